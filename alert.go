@@ -41,6 +41,7 @@ const (
 	alertMissingExtension       alert = 109
 	alertUnsupportedExtension   alert = 110
 	alertNoApplicationProtocol  alert = 120
+	alertECHRequired            alert = 121
 )
 
 var alertText = map[alert]string{
@@ -70,6 +71,7 @@ var alertText = map[alert]string{
 	alertMissingExtension:       "missing extension",
 	alertUnsupportedExtension:   "unsupported extension",
 	alertNoApplicationProtocol:  "no application protocol",
+	alertECHRequired:            "encrypted client hello required",
 }
 
 func (e alert) String() string {
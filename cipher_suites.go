@@ -461,10 +461,18 @@ const (
 	TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305    uint16 = 0xcca8
 	TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305  uint16 = 0xcca9
 
+	// AES-CCM cipher suites, RFC 7251. They are not enabled by default.
+	TLS_ECDHE_ECDSA_WITH_AES_128_CCM   uint16 = 0xc0ac
+	TLS_ECDHE_ECDSA_WITH_AES_256_CCM   uint16 = 0xc0ad
+	TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 uint16 = 0xc0ae
+	TLS_ECDHE_ECDSA_WITH_AES_256_CCM_8 uint16 = 0xc0af
+
 	// TLS 1.3 cipher suites.
 	TLS_AES_128_GCM_SHA256       uint16 = 0x1301
 	TLS_AES_256_GCM_SHA384       uint16 = 0x1302
 	TLS_CHACHA20_POLY1305_SHA256 uint16 = 0x1303
+	TLS_AES_128_CCM_SHA256       uint16 = 0x1304
+	TLS_AES_128_CCM_8_SHA256     uint16 = 0x1305
 
 	// TLS_FALLBACK_SCSV isn't a standard cipher suite but an indicator
 	// that the client is doing version fallback. See RFC 7507.
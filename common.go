@@ -209,6 +209,17 @@ type ConnectionState struct {
 	VerifiedChains              [][]*x509.Certificate // verified chains built from PeerCertificates
 	SignedCertificateTimestamps [][]byte              // SCTs from the peer, if any
 	OCSPResponse                []byte                // stapled OCSP response from peer, if any
+	OCSPResponses               [][]byte              // stapled OCSP responses for each of PeerCertificates, nil where missing (client side only)
+	OCSPStatus                  OCSPStatus            // status in OCSPResponse, if checked by Config.OCSPPolicy or VerifyStapledOCSP (client side only)
+	ECHAccepted                 bool                  // Encrypted Client Hello was offered and accepted
+	EarlyDataAccepted           bool                  // early data set with UConn.EnableEarlyData was accepted (client side only)
+	ServerHelloRandom           [32]byte              // random value of the ServerHello
+	DelegatedCredential         *DelegatedCredential  // delegated credential the server authenticated with, if any (client side only)
+	CertCompressionAlgorithm    CertCompressionAlgo   // algorithm the server's Certificate message was compressed with, zero if it was not compressed
+	KeyShareGroup               CurveID               // group of the TLS 1.3 key exchange, zero if there was none (client side only)
+	DidHelloRetryRequest        bool                  // server sent a HelloRetryRequest (client side only)
+	HelloRetryRequestCookie     []byte                // cookie of the HelloRetryRequest, if any (client side only)
+	UserData                    interface{}           // value set with UConn.SetUserData, if any
 
 	// ekm is a closure exposed via ExportKeyingMaterial.
 	ekm func(label string, context []byte, length int) ([]byte, error)
@@ -224,9 +235,12 @@ type ConnectionState struct {
 
 // ExportKeyingMaterial returns length bytes of exported key material in a new
 // slice as defined in RFC 5705. If context is nil, it is not used as part of
-// the seed. If the connection was set to allow renegotiation via
-// Config.Renegotiation, this function will return an error.
+// the seed. If a TLS 1.2 or earlier connection was set to allow renegotiation
+// via Config.Renegotiation, this function will return an error.
 func (cs *ConnectionState) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if cs.ekm == nil { // [uTLS] the state was taken before the handshake completed
+		return nil, errors.New("tls: handshake has not yet been performed")
+	}
 	return cs.ekm(label, context, length)
 }
 
@@ -268,6 +282,10 @@ type ClientSessionState struct {
 	nonce  []byte    // Ticket nonce sent by the server, to derive PSK
 	useBy  time.Time // Expiration of the ticket lifetime as set by the server
 	ageAdd uint32    // Random obfuscation factor for sending the ticket age
+
+	// [uTLS] TLS 1.3 early data fields, see UConn.EnableEarlyData.
+	maxEarlyData uint32 // max_early_data_size of the ticket, zero if it does not allow early data
+	alpnProtocol string // ALPN protocol of the session, which early data is sent for
 }
 
 // ClientSessionCache is a cache of ClientSessionState objects that can be used
@@ -354,6 +372,12 @@ type ClientHelloInfo struct {
 	// might be rejected if used.
 	SupportedVersions []uint16
 
+	// [uTLS] CertificateAuthorities lists the DER-encoded distinguished names
+	// of the certificate authorities the client accepts. It is set only if
+	// the client sent the certificate_authorities extension (see RFC 8446,
+	// Section 4.2.4), and may be used by GetCertificate to pick a chain.
+	CertificateAuthorities [][]byte
+
 	// Conn is the underlying net.Conn for the connection. Do not read
 	// from, or write to, this connection; that will cause the TLS
 	// connection to fail.
@@ -373,6 +397,14 @@ type CertificateRequestInfo struct {
 	// SignatureSchemes lists the signature schemes that the server is
 	// willing to verify.
 	SignatureSchemes []SignatureScheme
+
+	// [uTLS] UserData is the value set with UConn.SetUserData, if any.
+	UserData interface{}
+
+	// [uTLS] advertisedCAs are the certificate authorities the client listed
+	// in its certificate_authorities extension, used to pick a certificate
+	// when AcceptableCAs is empty.
+	advertisedCAs [][]byte
 }
 
 // RenegotiationSupport enumerates the different levels of support for TLS
@@ -491,15 +523,77 @@ type Config struct {
 	// be considered but the verifiedChains argument will always be nil.
 	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 
+	// OnRawCertificates, if not nil, is called by clients with the raw ASN.1
+	// certificates of the server's Certificate message, in the order they
+	// were received, before they are parsed or verified. It is called even
+	// if verification fails afterwards, so that the chain a server sends can
+	// be recorded. The certificates must not be modified.
+	OnRawCertificates func(rawCerts [][]byte)
+
+	// UnsafeServerHelloCallback, if not nil, is called by clients with each
+	// ServerHello message the server sends, HelloRetryRequests included,
+	// as received: the handshake message with its 4-byte TLS header, also
+	// for DTLS, before it is parsed. It is called even if the message turns out to be
+	// malformed, so that what a server or a middlebox sent can be recorded.
+	//
+	// It is unsafe in that the message is not authenticated yet: nothing
+	// in it can be trusted until the handshake completes. raw is a copy,
+	// modifying it has no effect on the handshake.
+	UnsafeServerHelloCallback func(raw []byte)
+
+	// VerifyConnection, if not nil, is called after normal certificate
+	// verification and after VerifyPeerCertificate by either a TLS client
+	// or server. If it returns a non-nil error, the handshake is aborted
+	// and that error results.
+	//
+	// If normal verification fails then the handshake will abort before
+	// considering this callback. This callback will run for all connections
+	// regardless of InsecureSkipVerify or ClientAuth settings, including
+	// resumed ones. The ConnectionState it receives carries the UserData
+	// set with UConn.SetUserData.
+	VerifyConnection func(ConnectionState) error
+
 	// RootCAs defines the set of root certificate authorities
 	// that clients use when verifying server certificates.
 	// If RootCAs is nil, TLS uses the host's root CA set.
 	RootCAs *x509.CertPool
 
+	// CertificatePolicy, if not nil, restricts the signature algorithms
+	// and keys a client accepts in the server's certificate chain, on top
+	// of normal certificate verification. It is enforced before
+	// VerifyPeerCertificate is called.
+	CertificatePolicy *CertificatePolicy
+
+	// OCSPPolicy, if not nil, makes a client check the OCSP response the
+	// server staples for its certificate, and reject a revoked certificate.
+	// It is enforced after normal certificate verification, unless
+	// VerifyConnection is set, which then has to check
+	// ConnectionState.OCSPResponse itself.
+	OCSPPolicy *OCSPPolicy
+
+	// VerifyStapledOCSP makes a client check the OCSP response the server
+	// staples for its certificate as OCSPPolicy does, and also abort the
+	// handshake if that response is expired, or if the certificate requires
+	// a stapled response (OCSP Must-Staple, RFC 7633) and none was stapled.
+	// Unlike OCSPPolicy, it is enforced even if VerifyConnection is set.
+	VerifyStapledOCSP bool
+
+	// [uTLS] GetRootCAs, if not nil, is called by clients when verifying the
+	// server certificate, with the name the certificate is verified
+	// against. If it returns a non-nil pool, that pool is used instead of
+	// RootCAs.
+	GetRootCAs func(serverName string) *x509.CertPool
+
 	// NextProtos is a list of supported application level protocols, in
 	// order of preference.
 	NextProtos []string
 
+	// EnforceNextProtoSelection makes a client abort the handshake with an
+	// *AlpnError if it offered application protocols with ALPN but the
+	// server selected none, rather than complete it with an empty
+	// ConnectionState.NegotiatedProtocol.
+	EnforceNextProtoSelection bool
+
 	// ServerName is used to verify the hostname on the returned
 	// certificates unless InsecureSkipVerify is given. It is also included
 	// in the client's handshake to support virtual hosting unless it is
@@ -576,6 +670,18 @@ type Config struct {
 	// improve latency.
 	DynamicRecordSizingDisabled bool
 
+	// RecordPadding, if not nil, is called for every TLS 1.3 application
+	// data record with the length of its plaintext, and returns the number
+	// of zero bytes to pad the record with (RFC 8446, Section 5.4). The
+	// padding is capped so the record stays within the maximum plaintext
+	// size.
+	RecordPadding func(plaintextLen int) int
+
+	// HandshakeTimeout, if not zero, bounds the duration of the handshake.
+	// The deadlines set on the Conn are restored once the handshake is
+	// over, so they keep applying to the established connection.
+	HandshakeTimeout time.Duration
+
 	// Renegotiation controls what types of renegotiation are supported.
 	// The default, none, is correct for the vast majority of applications.
 	Renegotiation RenegotiationSupport
@@ -588,6 +694,42 @@ type Config struct {
 	// used for debugging.
 	KeyLogWriter io.Writer
 
+	// KeySecretsCallback, if not nil, is called with each secret as the key
+	// schedule derives it, for external keylogging tools. The label is the
+	// one of the NSS key log format: CLIENT_HANDSHAKE_TRAFFIC_SECRET,
+	// SERVER_HANDSHAKE_TRAFFIC_SECRET, CLIENT_TRAFFIC_SECRET_0,
+	// SERVER_TRAFFIC_SECRET_0 and EXPORTER_SECRET in TLS 1.3, and
+	// CLIENT_RANDOM for the master secret in TLS 1.2. Unlike KeyLogWriter,
+	// it also receives the TLS 1.3 exporter secret.
+	//
+	// KeySecretsCallback is called synchronously from the handshake, so it
+	// must not block. It must not modify or retain clientRandom and secret.
+	// Like KeyLogWriter, it compromises security and should only be used for
+	// debugging.
+	KeySecretsCallback func(label string, clientRandom, secret []byte)
+
+	// EncryptedClientHelloKeys are the keys a server uses to decrypt the
+	// ClientHelloInner of clients offering Encrypted Client Hello. If none
+	// match, the handshake continues with the ClientHelloOuter and the
+	// keys marked SendAsRetry are offered as retry configs. Clients ignore
+	// this field, see UConn.SetECHConfigs.
+	EncryptedClientHelloKeys []EncryptedClientHelloKey
+
+	// ApplicationSettings maps ALPN protocols to the application settings
+	// (ALPS) a server sends to clients that offer ALPS for the negotiated
+	// protocol. Clients ignore this field, see ApplicationSettingsExtension.
+	ApplicationSettings map[string][]byte
+
+	// CertificateCompressors maps certificate compression algorithms to
+	// functions compressing a TLS 1.3 Certificate message body (RFC 8879).
+	// The first algorithm offered by the client that has a compressor is
+	// used. Clients ignore this field, see CompressCertificateExtension.
+	CertificateCompressors map[CertCompressionAlgo]func([]byte) ([]byte, error)
+
+	// Bugs enables deliberately insecure behaviors, to build vulnerable
+	// peers for testing tools. It must never be set in production.
+	Bugs ProtocolBugs
+
 	serverInitOnce sync.Once // guards calling (*Config).serverInit
 
 	// mutex protects sessionTicketKeys.
@@ -648,8 +790,16 @@ func (c *Config) Clone() *Config {
 		GetClientCertificate:        c.GetClientCertificate,
 		GetConfigForClient:          c.GetConfigForClient,
 		VerifyPeerCertificate:       c.VerifyPeerCertificate,
+		OnRawCertificates:           c.OnRawCertificates,
+		UnsafeServerHelloCallback:   c.UnsafeServerHelloCallback,
+		VerifyConnection:            c.VerifyConnection,
 		RootCAs:                     c.RootCAs,
+		CertificatePolicy:           c.CertificatePolicy,
+		OCSPPolicy:                  c.OCSPPolicy,
+		VerifyStapledOCSP:           c.VerifyStapledOCSP,
+		GetRootCAs:                  c.GetRootCAs,
 		NextProtos:                  c.NextProtos,
+		EnforceNextProtoSelection:   c.EnforceNextProtoSelection,
 		ServerName:                  c.ServerName,
 		ClientAuth:                  c.ClientAuth,
 		ClientCAs:                   c.ClientCAs,
@@ -663,8 +813,15 @@ func (c *Config) Clone() *Config {
 		MaxVersion:                  c.MaxVersion,
 		CurvePreferences:            c.CurvePreferences,
 		DynamicRecordSizingDisabled: c.DynamicRecordSizingDisabled,
+		RecordPadding:               c.RecordPadding,
+		HandshakeTimeout:            c.HandshakeTimeout,
 		Renegotiation:               c.Renegotiation,
 		KeyLogWriter:                c.KeyLogWriter,
+		KeySecretsCallback:          c.KeySecretsCallback,
+		EncryptedClientHelloKeys:    c.EncryptedClientHelloKeys,
+		ApplicationSettings:         c.ApplicationSettings,
+		CertificateCompressors:      c.CertificateCompressors,
+		Bugs:                        c.Bugs,
 		sessionTicketKeys:           sessionTicketKeys,
 	}
 }
@@ -943,9 +1100,14 @@ const (
 	keyLogLabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
 	keyLogLabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
 	keyLogLabelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+	keyLogLabelExporter        = "EXPORTER_SECRET" // [uTLS] only passed to KeySecretsCallback
+
+	keyLogLabelClientEarlyTraffic = "CLIENT_EARLY_TRAFFIC_SECRET" // [uTLS]
 )
 
 func (c *Config) writeKeyLog(label string, clientRandom, secret []byte) error {
+	c.keySecret(label, clientRandom, secret) // [uTLS]
+
 	if c.KeyLogWriter == nil {
 		return nil
 	}
@@ -959,6 +1121,13 @@ func (c *Config) writeKeyLog(label string, clientRandom, secret []byte) error {
 	return err
 }
 
+// keySecret passes a derived secret to KeySecretsCallback, if set.
+func (c *Config) keySecret(label string, clientRandom, secret []byte) {
+	if c.KeySecretsCallback != nil {
+		c.KeySecretsCallback(label, clientRandom, secret)
+	}
+}
+
 // writerMutex protects all KeyLogWriters globally. It is rarely enabled,
 // and is only for debugging, so a global mutex saves space.
 var writerMutex sync.Mutex
@@ -977,6 +1146,12 @@ type Certificate struct {
 	// SignedCertificateTimestamps contains an optional list of Signed
 	// Certificate Timestamps which will be served to clients that request it.
 	SignedCertificateTimestamps [][]byte
+	// [uTLS] DelegatedCredential contains an optional marshaled delegated
+	// credential (RFC 9345), which will be served to TLS 1.3 clients that
+	// accept its signature scheme. The handshake is then signed with
+	// DelegatedCredentialPrivateKey instead of PrivateKey.
+	DelegatedCredential           []byte
+	DelegatedCredentialPrivateKey crypto.PrivateKey
 	// Leaf is the parsed form of the leaf certificate, which may be
 	// initialized using x509.ParseCertificate to reduce per-handshake
 	// processing for TLS clients doing client authentication. If nil, the
@@ -43,7 +43,12 @@ type Conn struct {
 	handshakes       int
 	didResume        bool // whether this connection was a session resumption
 	cipherSuite      uint16
-	ocspResponse     []byte   // stapled OCSP response
+	ocspResponse     []byte     // stapled OCSP response
+	ocspResponses    [][]byte   // [uTLS] stapled OCSP responses of the chain
+	ocspStatus       OCSPStatus // [uTLS] status of ocspResponse, set by OCSPPolicy
+	// [uTLS] cachedCertificates is whether the server sends the hash of its
+	// certificate chain, see CachedInfoExtension.
+	cachedCertificates bool
 	scts             [][]byte // signed certificate timestamps from server
 	peerCertificates []*x509.Certificate
 	// verifiedChains contains the certificate chains that we built, as
@@ -52,8 +57,9 @@ type Conn struct {
 	// serverName contains the server name indicated by the client, if any.
 	serverName string
 	// secureRenegotiation is true if the server echoed the secure
-	// renegotiation extension. (This is meaningless as a server because
-	// renegotiation is not supported in that case.)
+	// renegotiation extension. [uTLS] As a server, it is true if the client
+	// signaled it and the extension was echoed, although renegotiation is
+	// still not supported in that case.
 	secureRenegotiation bool
 	// ekm is a closure for exporting keying material.
 	ekm func(label string, context []byte, length int) ([]byte, error)
@@ -83,6 +89,48 @@ type Conn struct {
 	clientProtocol         string
 	clientProtocolFallback bool
 
+	// [uTLS] echAccepted is true if Encrypted Client Hello was accepted.
+	echAccepted bool
+	// [uTLS] earlyDataAccepted is true if the server accepted the early
+	// data of the client.
+	earlyDataAccepted bool
+	// [uTLS] echPublicName is the ECHConfig public name the server
+	// certificate is verified against after the server rejected ECH.
+	echPublicName string
+	// [uTLS] peerRecordSizeLimit is the largest record plaintext, including
+	// TLS 1.3 padding and content type, the peer accepts. Zero means the
+	// record_size_limit extension was not negotiated.
+	peerRecordSizeLimit int
+	// [uTLS] serverHelloRandom is the random value of the ServerHello.
+	serverHelloRandom [32]byte
+	// [uTLS] delegatedCredential is the verified delegated credential the
+	// server signed the handshake with, if any.
+	delegatedCredential *DelegatedCredential
+	// [uTLS] certCompressionAlgorithm is the algorithm the server's
+	// Certificate message was compressed with, zero if it was not.
+	certCompressionAlgorithm CertCompressionAlgo
+	// [uTLS] peerApplicationSettings are the application settings (ALPS)
+	// received from the peer, nil if ALPS was not negotiated.
+	peerApplicationSettings []byte
+	// [uTLS] certSignatureSchemes are the schemes the client offered in
+	// signature_algorithms_cert, which the server's certificates must be
+	// signed with. Nil if the extension was not sent.
+	certSignatureSchemes []SignatureScheme
+	// [uTLS] keyShareGroup is the group of the TLS 1.3 key exchange, zero
+	// if there was none.
+	keyShareGroup CurveID
+	// [uTLS] didHelloRetryRequest is set if the server sent a
+	// HelloRetryRequest, along with the cookie it sent, if any.
+	didHelloRetryRequest    bool
+	helloRetryRequestCookie []byte
+	// [uTLS] userData is the value set with UConn.SetUserData.
+	userData interface{}
+	// [uTLS] readDeadline and writeDeadline are the deadlines last set
+	// through the Conn, restored after a handshake bounded by
+	// Config.HandshakeTimeout. Protected by deadlineMutex.
+	deadlineMutex               sync.Mutex
+	readDeadline, writeDeadline time.Time
+
 	// input/output
 	in, out   halfConn
 	rawInput  bytes.Buffer // raw input, starting with a record header
@@ -128,12 +176,18 @@ func (c *Conn) RemoteAddr() net.Addr {
 // A zero value for t means Read and Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMutex.Lock() // [uTLS]
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
 	return c.conn.SetDeadline(t)
 }
 
 // SetReadDeadline sets the read deadline on the underlying connection.
 // A zero value for t means Read will not time out.
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock() // [uTLS]
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline = t
 	return c.conn.SetReadDeadline(t)
 }
 
@@ -141,6 +195,9 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // A zero value for t means Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock() // [uTLS]
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
 	return c.conn.SetWriteDeadline(t)
 }
 
@@ -160,6 +217,10 @@ type halfConn struct {
 	nextMac    macFunction // next MAC algorithm
 
 	trafficSecret []byte // current TLS 1.3 traffic secret
+
+	// [uTLS] recordSizeLimit is the record_size_limit advertised to the
+	// peer, enforced on protected records once negotiated. Zero means none.
+	recordSizeLimit int
 }
 
 func (hc *halfConn) setErrorLocked(err error) error {
@@ -398,6 +459,10 @@ func (hc *halfConn) decrypt(record []byte) ([]byte, recordType, error) {
 			if len(plaintext) > maxPlaintext+1 {
 				return nil, 0, alertRecordOverflow
 			}
+			// [uTLS] The limit includes the padding and the content type.
+			if hc.recordSizeLimit != 0 && len(plaintext) > hc.recordSizeLimit {
+				return nil, 0, alertRecordOverflow
+			}
 			// Remove padding and find the ContentType scanning from the end.
 			for i := len(plaintext) - 1; i >= 0; i-- {
 				if plaintext[i] != 0 {
@@ -442,6 +507,12 @@ func (hc *halfConn) decrypt(record []byte) ([]byte, recordType, error) {
 		plaintext = payload[:n]
 	}
 
+	// [uTLS] See RFC 8449, Section 4.
+	if hc.cipher != nil && hc.version != VersionTLS13 &&
+		hc.recordSizeLimit != 0 && len(plaintext) > hc.recordSizeLimit {
+		return nil, 0, alertRecordOverflow
+	}
+
 	hc.incSeq()
 	return plaintext, typ, nil
 }
@@ -461,8 +532,9 @@ func sliceForAppend(in []byte, n int) (head, tail []byte) {
 }
 
 // encrypt encrypts payload, adding the appropriate nonce and/or MAC, and
-// appends it to record, which contains the record header.
-func (hc *halfConn) encrypt(record, payload []byte, rand io.Reader) ([]byte, error) {
+// appends it to record, which contains the record header. In TLS 1.3,
+// padding zero bytes are added after the content type.
+func (hc *halfConn) encrypt(record, payload []byte, padding int, rand io.Reader) ([]byte, error) {
 	if hc.cipher == nil {
 		return append(record, payload...), nil
 	}
@@ -511,8 +583,11 @@ func (hc *halfConn) encrypt(record, payload []byte, rand io.Reader) ([]byte, err
 			// Encrypt the actual ContentType and replace the plaintext one.
 			record = append(record, record[0])
 			record[0] = byte(recordTypeApplicationData)
+			for i := 0; i < padding; i++ {
+				record = append(record, 0)
+			}
 
-			n := len(payload) + 1 + c.Overhead()
+			n := len(payload) + 1 + padding + c.Overhead()
 			record[3] = byte(n >> 8)
 			record[4] = byte(n)
 
@@ -695,14 +770,14 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 			return c.in.setErrorLocked(io.EOF)
 		}
 		if c.vers == VersionTLS13 {
-			return c.in.setErrorLocked(&net.OpError{Op: "remote error", Err: alert(data[1])})
+			return c.in.setErrorLocked(c.remoteAlertError(alert(data[1]), vers)) // [uTLS]
 		}
 		switch data[0] {
 		case alertLevelWarning:
 			// Drop the record on the floor and retry.
 			return c.retryReadRecord(expectChangeCipherSpec)
 		case alertLevelError:
-			return c.in.setErrorLocked(&net.OpError{Op: "remote error", Err: alert(data[1])})
+			return c.in.setErrorLocked(c.remoteAlertError(alert(data[1]), vers)) // [uTLS]
 		default:
 			return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 		}
@@ -860,12 +935,13 @@ const (
 // In the interests of simplicity and determinism, this code does not attempt
 // to reset the record size once the connection is idle, however.
 func (c *Conn) maxPayloadSizeForWrite(typ recordType) int {
+	limit := c.maxPlaintextForWrite()
 	if c.config.DynamicRecordSizingDisabled || typ != recordTypeApplicationData {
-		return maxPlaintext
+		return limit
 	}
 
 	if c.bytesSent >= recordSizeBoostThreshold {
-		return maxPlaintext
+		return limit
 	}
 
 	// Subtract TLS overheads to get the maximum payload size.
@@ -896,16 +972,43 @@ func (c *Conn) maxPayloadSizeForWrite(typ recordType) int {
 	pkt := c.packetsSent
 	c.packetsSent++
 	if pkt > 1000 {
-		return maxPlaintext // avoid overflow in multiply below
+		return limit // avoid overflow in multiply below
 	}
 
 	n := payloadBytes * int(pkt+1)
-	if n > maxPlaintext {
-		n = maxPlaintext
+	if n > limit {
+		n = limit
 	}
 	return n
 }
 
+// maxPlaintextForWrite returns the largest record plaintext, including any
+// TLS 1.3 padding, that may be sent to the peer.
+func (c *Conn) maxPlaintextForWrite() int {
+	if c.peerRecordSizeLimit == 0 {
+		return maxPlaintext
+	}
+	limit := c.peerRecordSizeLimit
+	if c.vers == VersionTLS13 {
+		limit-- // the limit includes the encrypted ContentType
+	}
+	if limit > maxPlaintext {
+		limit = maxPlaintext
+	}
+	return limit
+}
+
+// setPeerRecordSizeLimit validates and records the record_size_limit sent by
+// the peer, see RFC 8449, Section 4.
+func (c *Conn) setPeerRecordSizeLimit(limit uint16) error {
+	if limit < 64 {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: peer sent an invalid record_size_limit")
+	}
+	c.peerRecordSizeLimit = int(limit)
+	return nil
+}
+
 func (c *Conn) write(data []byte) (int, error) {
 	if c.buffering {
 		c.sendBuf = append(c.sendBuf, data...)
@@ -956,8 +1059,20 @@ func (c *Conn) writeRecordLocked(typ recordType, data []byte) (int, error) {
 		c.outBuf[3] = byte(m >> 8)
 		c.outBuf[4] = byte(m)
 
+		var padding int
+		if c.config.RecordPadding != nil && typ == recordTypeApplicationData &&
+			c.vers == VersionTLS13 && c.out.cipher != nil {
+			padding = c.config.RecordPadding(m)
+			if padding < 0 {
+				padding = 0
+			}
+			if max := c.maxPlaintextForWrite() - m; padding > max {
+				padding = max
+			}
+		}
+
 		var err error
-		c.outBuf, err = c.out.encrypt(c.outBuf, data[:m], c.config.rand())
+		c.outBuf, err = c.out.encrypt(c.outBuf, data[:m], padding, c.config.rand())
 		if err != nil {
 			return n, err
 		}
@@ -1014,6 +1129,9 @@ func (c *Conn) readHandshake() (interface{}, error) {
 	case typeClientHello:
 		m = new(clientHelloMsg)
 	case typeServerHello:
+		if c.isClient && c.config.UnsafeServerHelloCallback != nil { // [uTLS]
+			c.config.UnsafeServerHelloCallback(append([]byte(nil), data...))
+		}
 		m = new(serverHelloMsg)
 	case typeNewSessionTicket:
 		if c.vers == VersionTLS13 {
@@ -1024,6 +1142,8 @@ func (c *Conn) readHandshake() (interface{}, error) {
 	case typeCertificate:
 		if c.vers == VersionTLS13 {
 			m = new(certificateMsgTLS13)
+		} else if c.cachedCertificates { // [uTLS]
+			m = new(cachedCertificateMsg)
 		} else {
 			m = new(certificateMsg)
 		}
@@ -1059,6 +1179,8 @@ func (c *Conn) readHandshake() (interface{}, error) {
 		m = new(keyUpdateMsg)
 	case typeCompressedCertificate:
 		m = new(compressedCertificateMsg)
+	case typeClientEncryptedExtensions: // [uTLS]
+		m = new(clientEncryptedExtensionsMsg)
 	default:
 		return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 	}
@@ -1360,6 +1482,10 @@ func (c *Conn) Handshake() error {
 	c.in.Lock()
 	defer c.in.Unlock()
 
+	if c.config.HandshakeTimeout != 0 { // [uTLS]
+		defer c.applyHandshakeTimeout(c.config.HandshakeTimeout)()
+	}
+
 	if c.isClient {
 		c.handshakeErr = c.clientHandshake()
 	} else {
@@ -1384,21 +1510,37 @@ func (c *Conn) Handshake() error {
 func (c *Conn) ConnectionState() ConnectionState {
 	c.handshakeMutex.Lock()
 	defer c.handshakeMutex.Unlock()
+	return c.connectionStateLocked()
+}
 
+// connectionStateLocked returns the ConnectionState, which is only partially
+// populated while the handshake is in progress, as seen by VerifyConnection.
+func (c *Conn) connectionStateLocked() ConnectionState {
 	var state ConnectionState
 	state.HandshakeComplete = c.handshakeComplete()
 	state.ServerName = c.serverName
-
+	state.UserData = c.userData // [uTLS]
+
+	state.Version = c.vers
+	state.NegotiatedProtocol = c.clientProtocol
+	state.DidResume = c.didResume
+	state.NegotiatedProtocolIsMutual = !c.clientProtocolFallback
+	state.CipherSuite = c.cipherSuite
+	state.PeerCertificates = c.peerCertificates
+	state.VerifiedChains = c.verifiedChains
+	state.SignedCertificateTimestamps = c.scts
+	state.OCSPResponse = c.ocspResponse
+	state.OCSPResponses = c.ocspResponses
+	state.OCSPStatus = c.ocspStatus
+	state.ECHAccepted = c.echAccepted
+	state.EarlyDataAccepted = c.earlyDataAccepted
+	state.ServerHelloRandom = c.serverHelloRandom
+	state.DelegatedCredential = c.delegatedCredential
+	state.CertCompressionAlgorithm = c.certCompressionAlgorithm
+	state.KeyShareGroup = c.keyShareGroup
+	state.DidHelloRetryRequest = c.didHelloRetryRequest
+	state.HelloRetryRequestCookie = c.helloRetryRequestCookie
 	if state.HandshakeComplete {
-		state.Version = c.vers
-		state.NegotiatedProtocol = c.clientProtocol
-		state.DidResume = c.didResume
-		state.NegotiatedProtocolIsMutual = !c.clientProtocolFallback
-		state.CipherSuite = c.cipherSuite
-		state.PeerCertificates = c.peerCertificates
-		state.VerifiedChains = c.verifiedChains
-		state.SignedCertificateTimestamps = c.scts
-		state.OCSPResponse = c.ocspResponse
 		if !c.didResume && c.vers != VersionTLS13 {
 			if c.clientFinishedIsFirst {
 				state.TLSUnique = c.clientFinished[:]
@@ -1406,7 +1548,8 @@ func (c *Conn) ConnectionState() ConnectionState {
 				state.TLSUnique = c.serverFinished[:]
 			}
 		}
-		if c.config.Renegotiation != RenegotiateNever {
+		// [uTLS] TLS 1.3 has no renegotiation, and parrots enable it.
+		if c.config.Renegotiation != RenegotiateNever && c.vers != VersionTLS13 {
 			state.ekm = noExportedKeyingMaterial
 		} else {
 			state.ekm = c.ekm
@@ -1443,6 +1586,23 @@ func (c *Conn) VerifyHostname(host string) error {
 	return c.peerCertificates[0].VerifyHostname(host)
 }
 
+// ExportKeyingMaterial returns length bytes of keying material exported as
+// defined in RFC 5705 for TLS 1.2 and earlier, and in RFC 8446, Section 7.5,
+// for TLS 1.3. If context is nil, it is not used as part of the seed. It
+// returns an error if the handshake has not completed or if a TLS 1.2 or
+// earlier connection was set to allow renegotiation via Config.Renegotiation.
+func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if !c.handshakeComplete() {
+		return nil, errors.New("tls: handshake has not yet been performed")
+	}
+	if c.config.Renegotiation != RenegotiateNever && c.vers != VersionTLS13 {
+		return noExportedKeyingMaterial(label, context, length)
+	}
+	return c.ekm(label, context, length)
+}
+
 func (c *Conn) handshakeComplete() bool {
 	return atomic.LoadUint32(&c.handshakeStatus) == 1
 }
@@ -293,3 +293,68 @@ func TestHairpinInClose(t *testing.T) {
 	// This call should not deadlock.
 	tlsConn.Close()
 }
+
+// writeSizeConn records the size of every Write.
+type writeSizeConn struct {
+	net.Conn
+	sizes []int
+}
+
+func (c *writeSizeConn) Write(b []byte) (int, error) {
+	c.sizes = append(c.sizes, len(b))
+	return c.Conn.Write(b)
+}
+
+func TestRecordPadding(t *testing.T) {
+	message := []byte("padded application data")
+	for _, padding := range []int{0, 100, maxPlaintext} {
+		clientConn, serverConn := localPipe(t)
+		recorder := &writeSizeConn{Conn: serverConn}
+
+		serverConfig := testConfig.Clone()
+		serverConfig.MaxVersion = VersionTLS13
+		serverConfig.RecordPadding = func(plaintextLen int) int {
+			if plaintextLen != len(message) {
+				t.Errorf("RecordPadding called with %d, expected %d", plaintextLen, len(message))
+			}
+			return padding
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			server := Server(recorder, serverConfig)
+			if err := server.Handshake(); err != nil {
+				done <- err
+				return
+			}
+			recorder.sizes = nil
+			_, err := server.Write(message)
+			done <- err
+		}()
+
+		client := Client(clientConn, testConfig.Clone())
+		buf := make([]byte, len(message)+1)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("padding %d: read failed: %v", padding, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("padding %d: server failed: %v", padding, err)
+		}
+		if !bytes.Equal(buf[:n], message) {
+			t.Errorf("padding %d: read %q, expected %q", padding, buf[:n], message)
+		}
+
+		wantPadding := padding
+		if wantPadding > maxPlaintext-len(message) {
+			wantPadding = maxPlaintext - len(message)
+		}
+		want := recordHeaderLen + len(message) + 1 + wantPadding + 16
+		if len(recorder.sizes) != 1 || recorder.sizes[0] != want {
+			t.Errorf("padding %d: record sizes %v, expected a single %d byte record", padding, recorder.sizes, want)
+		}
+
+		client.Close()
+		serverConn.Close()
+	}
+}
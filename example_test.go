@@ -7,11 +7,15 @@ package tls_test
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"time"
+
+	utls "github.com/voromade/utls"
 )
 
 // zeroSource is an io.Reader that returns an unlimited number of zero bytes.
@@ -183,3 +187,24 @@ EKTcWGekdmdDPsHloRNtsiCa697B2O9IFA==
 	}
 	log.Fatal(srv.ListenAndServeTLS("", ""))
 }
+
+func ExampleUTransport() {
+	// Fetching a page over HTTP/2 with the ClientHello of Chrome.
+	transport := &utls.UTransport{
+		HelloIDForAddr: func(addr string) utls.ClientHelloID {
+			return utls.HelloChrome_Auto
+		},
+	}
+	defer transport.Close()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	resp, err := client.Get("https://www.google.com/")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(resp.Proto)
+}
@@ -1,9 +1,11 @@
 module github.com/voromade/utls
 
-go 1.18
+go 1.22.0
 
 require (
+	github.com/cloudflare/circl v1.6.1
 	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.16.7
 	gitlab.com/yawning/bsaes.git v0.0.0-20190805113838-0a714cd429ec
 	gitlab.com/yawning/utls.git v0.0.12-1
 	golang.org/x/crypto v0.12.0
@@ -138,7 +138,7 @@ func paramsForCurves(rng io.Reader, curves []CurveID) ([]keyShare, map[CurveID]e
 		keyShares []keyShare
 	)
 	for _, curveID := range curves {
-		if _, ok := curveForCurveID(curveID); curveID != X25519 && !ok {
+		if _, ok := curveForCurveID(curveID); curveID != X25519 && !isKEMGroup(curveID) && !ok {
 			return nil, nil, errors.New("tls: CurvePreferences includes unsupported curve")
 		}
 		if !utlsSupportedGroups[curveID] {
@@ -247,7 +247,7 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 
 	hello.ticketSupported = true
 
-	if hello.supportedVersions[0] == VersionTLS13 {
+	if hello.supportedVersions[0] == VersionTLS13 && hello.raw == nil { // [uTLS] mimicked hellos have their own modes
 		// Require DHE on resumption as it guarantees forward secrecy against
 		// compromise of the session ticket key. See RFC 8446, Section 4.2.9.
 		hello.pskModes = []uint8{pskModeDHE}
@@ -333,6 +333,12 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 		return cacheKey, nil, nil, nil
 	}
 
+	// [uTLS] A mimicked ClientHello is already marshaled: its pre_shared_key
+	// extension, if any, is a PreSharedKeyExtension.
+	if hello.raw != nil {
+		return
+	}
+
 	// Set the pre_shared_key extension. See RFC 8446, Section 4.2.11.1.
 	ticketAge := uint32(c.config.time().Sub(session.receivedAt) / time.Millisecond)
 	identity := pskIdentity{
@@ -462,6 +468,14 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 	if err != nil {
 		return err
 	}
+	if cached, ok := msg.(*cachedCertificateMsg); ok { // [uTLS]
+		certificates := hs.uconn.cachedInfo.certificates(cached.hash)
+		if certificates == nil {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server sent the hash of a certificate chain that is not cached")
+		}
+		msg = &certificateMsg{raw: cached.marshal(), certificates: certificates}
+	}
 	certMsg, ok := msg.(*certificateMsg)
 	if !ok || len(certMsg.certificates) == 0 {
 		c.sendAlert(alertUnexpectedMessage)
@@ -498,7 +512,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		// RFC4366 on Certificate Status Request:
 		// The server MAY return a "certificate_status" message.
 
-		if !hs.serverHello.ocspStapling {
+		if !hs.serverHello.ocspStapling && !hs.serverHello.statusRequestV2 { // [uTLS] or status_request_v2
 			// If a server returns a "CertificateStatus" message, then the
 			// server MUST have included an extension of type "status_request"
 			// with empty "extension_data" in the extended server hello.
@@ -506,9 +520,19 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			c.sendAlert(alertUnexpectedMessage)
 			return errors.New("tls: received unexpected CertificateStatus message")
 		}
+		if cs.responses != nil && !hs.serverHello.statusRequestV2 { // [uTLS]
+			// An ocsp_multi CertificateStatus answers status_request_v2
+			// only, see RFC 6961, Section 2.2.
+			c.sendAlert(alertUnexpectedMessage)
+			return errors.New("tls: received unexpected ocsp_multi CertificateStatus message")
+		}
 		hs.finishedHash.Write(cs.marshal())
 
 		c.ocspResponse = cs.response
+		c.ocspResponses = cs.responses // [uTLS]
+		if c.ocspResponses == nil {
+			c.ocspResponses = [][]byte{cs.response}
+		}
 
 		msg, err = c.readHandshake()
 		if err != nil {
@@ -516,6 +540,19 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		}
 	}
 
+	if policy := c.config.ocspPolicy(); c.handshakes == 0 && policy != nil { // [uTLS]
+		if err := policy.check(c); err != nil {
+			return err
+		}
+	}
+
+	if c.handshakes == 0 && c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
 	keyAgreement := hs.suite.ka(c.vers)
 
 	skx, ok := msg.(*serverKeyExchangeMsg)
@@ -541,6 +578,9 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		hs.finishedHash.Write(certReq.marshal())
 
 		cri := certificateRequestInfoFromMsg(certReq)
+		if hs.uconn != nil { // [uTLS]
+			cri.advertisedCAs = hs.uconn.certificateAuthorities
+		}
 		if chainToSend, err = c.getClientCertificate(cri); err != nil {
 			c.sendAlert(alertInternalError)
 			return err
@@ -583,6 +623,19 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		}
 	}
 
+	// [uTLS] The session hash of the extended master secret covers the
+	// handshake up to the ClientKeyExchange, before any CertificateVerify.
+	// See RFC 7627, Section 3.
+	if hs.hello.ems && hs.serverHello.ems {
+		hs.masterSecret = extendedMasterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.finishedHash)
+	} else {
+		hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.hello.random, hs.serverHello.random)
+	}
+	if err := c.config.writeKeyLog(keyLogLabelTLS12, hs.hello.random, hs.masterSecret); err != nil {
+		c.sendAlert(alertInternalError)
+		return errors.New("tls: failed to write to key log: " + err.Error())
+	}
+
 	if chainToSend != nil && len(chainToSend.Certificate) > 0 {
 		certVerify := &certificateVerifyMsg{
 			hasSignatureAlgorithm: c.vers >= VersionTLS12,
@@ -624,16 +677,6 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		}
 	}
 
-	if hs.hello.ems && hs.serverHello.ems {
-		hs.masterSecret = extendedMasterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.finishedHash)
-	} else {
-		hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.hello.random, hs.serverHello.random)
-	}
-	if err := c.config.writeKeyLog(keyLogLabelTLS12, hs.hello.random, hs.masterSecret); err != nil {
-		c.sendAlert(alertInternalError)
-		return errors.New("tls: failed to write to key log: " + err.Error())
-	}
-
 	hs.finishedHash.discardHandshakeBuffer()
 
 	return nil
@@ -722,7 +765,40 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 		c.clientProtocol = hs.serverHello.alpnProtocol
 		c.clientProtocolFallback = false
 	}
+	if !serverHasNPN {
+		if err := c.checkALPNSelected(hs.hello.alpnProtocols); err != nil { // [uTLS]
+			return false, err
+		}
+	}
 	c.scts = hs.serverHello.scts
+	copy(c.serverHelloRandom[:], hs.serverHello.random) // [uTLS]
+
+	if hs.serverHello.recordSizeLimit != 0 { // [uTLS]
+		if hs.uconn == nil || hs.uconn.recordSizeLimit == 0 {
+			c.sendAlert(alertUnsupportedExtension)
+			return false, errors.New("tls: server sent unrequested record_size_limit extension")
+		}
+		if err := c.setPeerRecordSizeLimit(hs.serverHello.recordSizeLimit); err != nil {
+			return false, err
+		}
+		c.in.recordSizeLimit = int(hs.uconn.recordSizeLimit)
+	}
+
+	if hs.serverHello.statusRequestV2 && (hs.uconn == nil || !hs.uconn.statusRequestV2) { // [uTLS]
+		c.sendAlert(alertUnsupportedExtension)
+		return false, errors.New("tls: server sent unrequested status_request_v2 extension")
+	}
+
+	c.cachedCertificates = false // [uTLS]
+	if len(hs.serverHello.cachedInfo) > 0 {
+		if hs.uconn == nil || hs.uconn.cachedInfo == nil {
+			c.sendAlert(alertUnsupportedExtension)
+			return false, errors.New("tls: server sent unrequested cached_info extension")
+		}
+		for _, t := range hs.serverHello.cachedInfo {
+			c.cachedCertificates = c.cachedCertificates || t == CachedInformationCert
+		}
+	}
 
 	if !hs.serverResumedSession() {
 		return false, nil
@@ -742,6 +818,13 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 	hs.masterSecret = hs.session.masterSecret
 	c.peerCertificates = hs.session.serverCertificates
 	c.verifiedChains = hs.session.verifiedChains
+
+	if c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return false, err
+		}
+	}
 	return true, nil
 }
 
@@ -835,6 +918,10 @@ func (hs *clientHandshakeState) sendFinished(out []byte) error {
 // verifyServerCertificate parses and verifies the provided chain, setting
 // c.verifiedChains and c.peerCertificates or sending the appropriate alert.
 func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
+	if c.config.OnRawCertificates != nil { // [uTLS]
+		c.config.OnRawCertificates(certificates)
+	}
+
 	certs := make([]*x509.Certificate, len(certificates))
 	for i, asn1Data := range certificates {
 		cert, err := x509.ParseCertificate(asn1Data)
@@ -852,6 +939,14 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 			DNSName:       c.config.ServerName,
 			Intermediates: x509.NewCertPool(),
 		}
+		if c.echPublicName != "" { // [uTLS]
+			opts.DNSName = c.echPublicName
+		}
+		if c.config.GetRootCAs != nil { // [uTLS]
+			if roots := c.config.GetRootCAs(opts.DNSName); roots != nil {
+				opts.Roots = roots
+			}
+		}
 		for _, cert := range certs[1:] {
 			opts.Intermediates.AddCert(cert)
 		}
@@ -863,6 +958,24 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 		}
 	}
 
+	if c.config.CertificatePolicy != nil { // [uTLS]
+		var err error
+		c.verifiedChains, err = c.config.CertificatePolicy.verifyChains(certs, c.verifiedChains)
+		if err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
+	if c.certSignatureSchemes != nil { // [uTLS]
+		var err error
+		c.verifiedChains, err = certSignatureSchemesPolicy(c.certSignatureSchemes).verifyChains(certs, c.verifiedChains)
+		if err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
 	if c.config.VerifyPeerCertificate != nil {
 		if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
 			c.sendAlert(alertBadCertificate)
@@ -946,6 +1059,7 @@ func certificateRequestInfoFromMsg(certReq *certificateRequestMsg) *CertificateR
 }
 
 func (c *Conn) getClientCertificate(cri *CertificateRequestInfo) (*Certificate, error) {
+	cri.UserData = c.userData // [uTLS]
 	if c.config.GetClientCertificate != nil {
 		return c.config.GetClientCertificate(cri)
 	}
@@ -953,6 +1067,10 @@ func (c *Conn) getClientCertificate(cri *CertificateRequestInfo) (*Certificate,
 	// We need to search our list of client certs for one
 	// where SignatureAlgorithm is acceptable to the server and the
 	// Issuer is in AcceptableCAs.
+	acceptableCAs := cri.AcceptableCAs
+	if len(acceptableCAs) == 0 { // [uTLS]
+		acceptableCAs = cri.advertisedCAs
+	}
 	for i, chain := range c.config.Certificates {
 		sigOK := false
 		for _, alg := range signatureSchemesForCertificate(c.vers, &chain) {
@@ -965,7 +1083,7 @@ func (c *Conn) getClientCertificate(cri *CertificateRequestInfo) (*Certificate,
 			continue
 		}
 
-		if len(cri.AcceptableCAs) == 0 {
+		if len(acceptableCAs) == 0 {
 			return &chain, nil
 		}
 
@@ -981,7 +1099,7 @@ func (c *Conn) getClientCertificate(cri *CertificateRequestInfo) (*Certificate,
 				}
 			}
 
-			for _, ca := range cri.AcceptableCAs {
+			for _, ca := range acceptableCAs {
 				if bytes.Equal(x509Cert.RawIssuer, ca) {
 					return &chain, nil
 				}
@@ -7,8 +7,11 @@ package tls
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/pem"
@@ -1570,6 +1573,79 @@ func testVerifyPeerCertificate(t *testing.T, version uint16) {
 	}
 }
 
+func TestGetRootCAs(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "GetRootCAs"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"trusted.example", "untrusted.example"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := x509.ParseCertificate(testRSACertificateIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(cert)
+	untrusted := x509.NewCertPool()
+	untrusted.AddCert(issuer)
+	pools := map[string]*x509.CertPool{
+		"trusted.example":   trusted,
+		"untrusted.example": untrusted,
+	}
+
+	for _, serverName := range []string{"trusted.example", "untrusted.example"} {
+		c, s := localPipe(t)
+		go func() {
+			config := testConfig.Clone()
+			config.Certificates = []Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+			Server(s, config).Handshake()
+			s.Close()
+		}()
+
+		var calledWith string
+		config := testConfig.Clone()
+		config.ServerName = serverName
+		config.InsecureSkipVerify = false
+		config.Time = nil
+		// RootCAs is ignored when GetRootCAs returns a pool.
+		config.RootCAs = trusted
+		config.GetRootCAs = func(serverName string) *x509.CertPool {
+			calledWith = serverName
+			return pools[serverName]
+		}
+		err := Client(c, config).Handshake()
+		c.Close()
+
+		if calledWith != serverName {
+			t.Errorf("%s: GetRootCAs called with %q", serverName, calledWith)
+		}
+		if serverName == "trusted.example" && err != nil {
+			t.Errorf("%s: unexpected handshake error: %v", serverName, err)
+		}
+		if _, ok := err.(x509.UnknownAuthorityError); serverName == "untrusted.example" && !ok {
+			t.Errorf("%s: expected x509.UnknownAuthorityError, got %v", serverName, err)
+		}
+	}
+}
+
 // brokenConn wraps a net.Conn and causes all Writes after a certain number to
 // fail with brokenConnErr.
 type brokenConn struct {
@@ -10,7 +10,6 @@ import (
 	"crypto/hmac"
 	"crypto/rsa"
 	"errors"
-	"fmt"
 	"hash"
 	"sync/atomic"
 	"time"
@@ -36,6 +35,10 @@ type clientHandshakeStateTLS13 struct {
 
 	certCompAlgs []CertCompressionAlgo
 
+	// [uTLS] clientHandshakeSecret is the client_handshake_traffic_secret,
+	// which becomes the write key once early data is ended.
+	clientHandshakeSecret []byte
+
 	uconn *UConn // [UTLS]
 }
 
@@ -63,6 +66,10 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 
 	hs.transcript = hs.suite.hash.New()
 	hs.transcript.Write(hs.hello.marshal())
+	if ech := hs.echContext(); ech != nil { // [uTLS]
+		ech.innerTranscript = hs.suite.hash.New()
+		ech.innerTranscript.Write(ech.innerRaw)
+	}
 
 	if bytes.Equal(hs.serverHello.random, helloRetryRequestRandom) {
 		if err := hs.sendDummyChangeCipherSpec(); err != nil {
@@ -73,12 +80,17 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		}
 	}
 
+	if err := hs.processECHServerHello(); err != nil { // [uTLS]
+		return err
+	}
+
 	hs.transcript.Write(hs.serverHello.marshal())
 
 	c.buffering = true
 	if err := hs.processServerHello(); err != nil {
 		return err
 	}
+	copy(c.serverHelloRandom[:], hs.serverHello.random) // [uTLS]
 	if err := hs.sendDummyChangeCipherSpec(); err != nil {
 		return err
 	}
@@ -94,6 +106,12 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	if err := hs.readServerFinished(); err != nil {
 		return err
 	}
+	if err := hs.sendEndOfEarlyData(); err != nil { // [uTLS]
+		return err
+	}
+	if err := hs.sendClientEncryptedExtensions(); err != nil { // [uTLS]
+		return err
+	}
 	if err := hs.sendClientCertificate(); err != nil {
 		return err
 	}
@@ -104,6 +122,10 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		return err
 	}
 
+	if ech := hs.echContext(); ech != nil && ech.rejected { // [uTLS]
+		return c.echRejectionError(ech)
+	}
+
 	atomic.StoreUint32(&c.handshakeStatus, 1)
 
 	return nil
@@ -191,6 +213,10 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 	hs.transcript.Write(chHash)
 	hs.transcript.Write(hs.serverHello.marshal())
 
+	if err := hs.processECHHelloRetryRequest(); err != nil { // [uTLS]
+		return err
+	}
+
 	if hs.serverHello.serverShare.group != 0 {
 		c.sendAlert(alertDecodeError)
 		return errors.New("tls: received malformed key_share extension")
@@ -225,9 +251,19 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 	hs.ecdheParams[curveID] = params
 	hs.hello.keyShares = []keyShare{{group: curveID, data: params.PublicKey()}}
 	hs.hello.cookie = hs.serverHello.cookie
+	c.didHelloRetryRequest = true                     // [uTLS]
+	c.helloRetryRequestCookie = hs.serverHello.cookie // [uTLS]
+
+	// [uTLS] A HelloRetryRequest rejects early data, which must not be
+	// indicated in the second ClientHello. See RFC 8446, Section 4.2.10.
+	hs.hello.earlyData = false
+	if hs.uconn != nil {
+		hs.uconn.abandonEarlyData()
+	}
 
 	hs.hello.raw = nil
-	if len(hs.hello.pskIdentities) > 0 {
+	// [uTLS] the binders of mimicked ClientHellos are updated below.
+	if len(hs.hello.pskIdentities) > 0 && (hs.uconn == nil || hs.uconn.ClientHelloID == HelloGolang) {
 		pskSuite := cipherSuiteTLS13ByID(hs.session.cipherSuite)
 		if pskSuite == nil {
 			return c.sendAlert(alertInternalError)
@@ -259,9 +295,10 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 	// and utlsExtensionPadding are supposed to change
 	if hs.uconn != nil {
 		if hs.uconn.ClientHelloID != HelloGolang {
-			if len(hs.hello.pskIdentities) > 0 {
-				// TODO: wait for someone who cares about PSK to implement
-				return errors.New("uTLS does not support reprocessing of PSK key triggered by HelloRetryRequest")
+			if hs.session != nil && len(hs.hello.pskIdentities) > len(hs.uconn.externalPSKs) {
+				// Update the obfuscated_ticket_age of the session to resume.
+				ticketAge := uint32(c.config.time().Sub(hs.session.receivedAt) / time.Millisecond)
+				hs.uconn.HandshakeState.Hello.PskIdentities[0].obfuscatedTicketAge = ticketAge + hs.session.ageAdd
 			}
 
 			keyShareExtFound := false
@@ -279,41 +316,25 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 
 			if len(hs.serverHello.cookie) > 0 {
 				// serverHello specified a cookie, let's echo it
-				cookieFound := false
-				for _, ext := range hs.uconn.Extensions {
-					if ks, ok := ext.(*CookieExtension); ok {
-						ks.Cookie = hs.serverHello.cookie
-						cookieFound = true
-					}
-				}
-
-				if !cookieFound {
-					// pick a random index where to add cookieExtension
-					// -2 instead of -1 is a lazy way to ensure that PSK is still a last extension
-					p, err := newPRNG()
-					if err != nil {
-						return err
-					}
-					cookieIndex := p.Intn(len(hs.uconn.Extensions) - 2)
-					if cookieIndex >= len(hs.uconn.Extensions) {
-						// this check is for empty hs.uconn.Extensions
-						return fmt.Errorf("cookieIndex >= len(hs.uconn.Extensions): %v >= %v",
-							cookieIndex, len(hs.uconn.Extensions))
-					}
-					hs.uconn.Extensions = append(hs.uconn.Extensions[:cookieIndex],
-						append([]TLSExtension{&CookieExtension{Cookie: hs.serverHello.cookie}},
-							hs.uconn.Extensions[cookieIndex:]...)...)
-				}
+				hs.uconn.Extensions = setCookieExtension(hs.uconn.Extensions, hs.serverHello.cookie)
 			}
-			if err = hs.uconn.MarshalClientHello(); err != nil {
+			// The binders cover the first ClientHello and the
+			// HelloRetryRequest, see RFC 8446, Section 4.2.11.2.
+			transcript := append([]byte{typeMessageHash, 0, 0, uint8(len(chHash))}, chHash...)
+			transcript = append(transcript, hs.serverHello.marshal()...)
+			if err = hs.uconn.marshalHelloWithTranscript(transcript); err != nil {
 				return err
 			}
 			hs.hello.raw = hs.uconn.HandshakeState.Hello.Raw
+			hs.hello.pskBinders = hs.uconn.HandshakeState.Hello.PskBinders
 		}
 	}
 	// [UTLS SECTION ENDS]
 
 	hs.transcript.Write(hs.hello.marshal())
+	if ech := hs.echContext(); ech != nil { // [uTLS]
+		ech.innerTranscript.Write(ech.innerRaw)
+	}
 	if _, err = c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
 		return err
 	}
@@ -356,10 +377,13 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 	}
 
 	if hs.serverHello.serverShare.group == 0 {
-		c.sendAlert(alertIllegalParameter)
-		return errors.New("tls: server did not send a key share")
-	}
-	if _, ok := hs.ecdheParams[hs.serverHello.serverShare.group]; !ok {
+		// [uTLS] In a psk_ke resumption the server sends no key share, and
+		// the keys are derived from the PSK alone. See RFC 8446, Section 4.2.9.
+		if !hs.serverHello.selectedIdentityPresent || !hs.offeredPSKMode(pskModePlain) {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server did not send a key share")
+		}
+	} else if _, ok := hs.ecdheParams[hs.serverHello.serverShare.group]; !ok {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: server selected unsupported group")
 	}
@@ -373,7 +397,18 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 		return errors.New("tls: server selected an invalid PSK")
 	}
 
-	if len(hs.hello.pskIdentities) != 1 || hs.session == nil {
+	if psk := hs.selectedExternalPSK(); psk != nil { // [uTLS]
+		if psk.hash != hs.suite.hash {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server selected an invalid PSK and cipher suite pair")
+		}
+		hs.earlySecret = hs.suite.extract(psk.key, nil)
+		hs.usingPSK = true
+		return nil
+	}
+
+	// [uTLS] the session may be followed by external PSKs.
+	if hs.session == nil {
 		return c.sendAlert(alertInternalError)
 	}
 	pskSuite := cipherSuiteTLS13ByID(hs.session.cipherSuite)
@@ -392,14 +427,29 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 	return nil
 }
 
+// offeredPSKMode reports whether the ClientHello offered the PSK key exchange
+// mode.
+func (hs *clientHandshakeStateTLS13) offeredPSKMode(mode uint8) bool {
+	for _, m := range hs.hello.pskModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 func (hs *clientHandshakeStateTLS13) establishHandshakeKeys() error {
 	c := hs.c
 
-	ecdheParams := hs.ecdheParams[hs.serverHello.serverShare.group]
-	sharedKey := ecdheParams.SharedKey(hs.serverHello.serverShare.data)
-	if sharedKey == nil {
-		c.sendAlert(alertIllegalParameter)
-		return errors.New("tls: invalid server key share")
+	var sharedKey []byte // [uTLS] none in a psk_ke resumption
+	if hs.serverHello.serverShare.group != 0 {
+		ecdheParams := hs.ecdheParams[hs.serverHello.serverShare.group]
+		sharedKey = ecdheParams.SharedKey(hs.serverHello.serverShare.data)
+		if sharedKey == nil {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: invalid server key share")
+		}
+		c.keyShareGroup = hs.serverHello.serverShare.group // [uTLS]
 	}
 
 	earlySecret := hs.earlySecret
@@ -411,7 +461,11 @@ func (hs *clientHandshakeStateTLS13) establishHandshakeKeys() error {
 
 	clientSecret := hs.suite.deriveSecret(handshakeSecret,
 		clientHandshakeTrafficLabel, hs.transcript)
-	c.out.setTrafficSecret(hs.suite, clientSecret)
+	if hs.earlyDataInFlight() { // [uTLS] early data is ended first
+		hs.clientHandshakeSecret = clientSecret
+	} else {
+		c.out.setTrafficSecret(hs.suite, clientSecret)
+	}
 	serverSecret := hs.suite.deriveSecret(handshakeSecret,
 		serverHandshakeTrafficLabel, hs.transcript)
 	c.in.setTrafficSecret(hs.suite, serverSecret)
@@ -453,6 +507,32 @@ func (hs *clientHandshakeStateTLS13) readServerParameters() error {
 		return errors.New("tls: server advertised unrequested ALPN extension")
 	}
 	c.clientProtocol = encryptedExtensions.alpnProtocol
+	if err := c.checkALPNSelected(hs.hello.alpnProtocols); err != nil { // [uTLS]
+		return err
+	}
+
+	if err := hs.processApplicationSettings(encryptedExtensions); err != nil { // [uTLS]
+		return err
+	}
+
+	if err := hs.processEarlyDataResponse(encryptedExtensions); err != nil { // [uTLS]
+		return err
+	}
+
+	if encryptedExtensions.recordSizeLimit != 0 { // [uTLS]
+		if hs.uconn == nil || hs.uconn.recordSizeLimit == 0 {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server sent unrequested record_size_limit extension")
+		}
+		if err := c.setPeerRecordSizeLimit(encryptedExtensions.recordSizeLimit); err != nil {
+			return err
+		}
+		c.in.recordSizeLimit = int(hs.uconn.recordSizeLimit)
+	}
+
+	if ech := hs.echContext(); ech != nil { // [uTLS]
+		ech.retryConfigs = encryptedExtensions.echRetryConfigs
+	}
 
 	return nil
 }
@@ -463,6 +543,12 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 	// Either a PSK or a certificate is always used, but not both.
 	// See RFC 8446, Section 4.1.1.
 	if hs.usingPSK {
+		if c.config.VerifyConnection != nil {
+			if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+				c.sendAlert(alertBadCertificate)
+				return err
+			}
+		}
 		return nil
 	}
 
@@ -508,6 +594,7 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 			return err
 		}
 		rawCertMsg = v.marshal()
+		c.certCompressionAlgorithm = v.algorithm
 	default:
 		c.sendAlert(alertUnexpectedMessage)
 		return unexpectedMessageError(certMsg, msg)
@@ -521,11 +608,31 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 
 	c.scts = certMsg.certificate.SignedCertificateTimestamps
 	c.ocspResponse = certMsg.certificate.OCSPStaple
+	c.ocspResponses = certMsg.ocspResponses() // [uTLS]
 
 	if err := c.verifyServerCertificate(certMsg.certificate.Certificate); err != nil {
 		return err
 	}
 
+	pubKey := c.peerCertificates[0].PublicKey
+	if raw := certMsg.certificate.DelegatedCredential; raw != nil { // [uTLS]
+		if hs.uconn == nil || len(hs.uconn.delegatedCredentialSchemes) == 0 {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server sent an unsolicited delegated credential")
+		}
+		dc, err := parseDelegatedCredential(raw)
+		if err != nil {
+			c.sendAlert(alertDecodeError)
+			return err
+		}
+		if err := dc.verify(c.peerCertificates[0], hs.uconn.delegatedCredentialSchemes, c.config.time()); err != nil {
+			c.sendAlert(alertIllegalParameter)
+			return err
+		}
+		c.delegatedCredential = dc
+		pubKey = dc.PublicKey
+	}
+
 	msg, err = c.readHandshake()
 	if err != nil {
 		return err
@@ -552,9 +659,13 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: invalid certificate signature algorithm")
 	}
+	if c.delegatedCredential != nil && certVerify.signatureAlgorithm != c.delegatedCredential.CertVerifyAlgorithm { // [uTLS]
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: certificate signature algorithm does not match the delegated credential")
+	}
 	h := sigHash.New()
 	writeSignedMessage(h, serverSignatureContext, hs.transcript)
-	if err := verifyHandshakeSignature(sigType, c.peerCertificates[0].PublicKey,
+	if err := verifyHandshakeSignature(sigType, pubKey,
 		sigHash, h.Sum(nil), certVerify.signature); err != nil {
 		c.sendAlert(alertDecryptError)
 		return errors.New("tls: invalid certificate signature")
@@ -562,6 +673,19 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 
 	hs.transcript.Write(certVerify.marshal())
 
+	if policy := c.config.ocspPolicy(); policy != nil { // [uTLS]
+		if err := policy.check(c); err != nil {
+			return err
+		}
+	}
+
+	if c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -606,7 +730,9 @@ func (hs *clientHandshakeStateTLS13) readServerFinished() error {
 		return err
 	}
 
-	c.ekm = hs.suite.exportKeyingMaterial(hs.masterSecret, hs.transcript)
+	expMasterSecret := hs.suite.deriveSecret(hs.masterSecret, exporterLabel, hs.transcript)
+	c.config.keySecret(keyLogLabelExporter, hs.hello.random, expMasterSecret) // [uTLS]
+	c.ekm = hs.suite.exportKeyingMaterial(expMasterSecret)
 
 	return nil
 }
@@ -618,12 +744,20 @@ func (hs *clientHandshakeStateTLS13) sendClientCertificate() error {
 		return nil
 	}
 
-	cert, err := c.getClientCertificate(&CertificateRequestInfo{
-		AcceptableCAs:    hs.certReq.certificateAuthorities,
-		SignatureSchemes: hs.certReq.supportedSignatureAlgorithms,
-	})
-	if err != nil {
-		return err
+	cert := new(Certificate)
+	if ech := hs.echContext(); ech == nil || !ech.rejected { // [uTLS] no client certificate after ECH rejection
+		var err error
+		cri := &CertificateRequestInfo{
+			AcceptableCAs:    hs.certReq.certificateAuthorities,
+			SignatureSchemes: hs.certReq.supportedSignatureAlgorithms,
+		}
+		if hs.uconn != nil {
+			cri.advertisedCAs = hs.uconn.certificateAuthorities
+		}
+		cert, err = c.getClientCertificate(cri)
+		if err != nil {
+			return err
+		}
 	}
 
 	certMsg := new(certificateMsgTLS13)
@@ -754,6 +888,8 @@ func (c *Conn) handleNewSessionTicket(msg *newSessionTicketMsgTLS13) error {
 		nonce:              msg.nonce,
 		useBy:              c.config.time().Add(lifetime),
 		ageAdd:             msg.ageAdd,
+		maxEarlyData:       msg.maxEarlyData, // [uTLS]
+		alpnProtocol:       c.clientProtocol, // [uTLS]
 	}
 
 	cacheKey := clientSessionCacheKey(c.conn.RemoteAddr(), c.config)
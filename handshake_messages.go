@@ -93,6 +93,15 @@ type clientHelloMsg struct {
 	pskModes                         []uint8
 	pskIdentities                    []pskIdentity
 	pskBinders                       [][]byte
+	encryptedClientHello             []byte                // [uTLS] raw encrypted_client_hello extension body
+	recordSizeLimit                  uint16                // [uTLS]
+	delegatedCredentialSchemes       []SignatureScheme     // [uTLS]
+	alpsCodepoint                    uint16                // [uTLS] application_settings codepoint, if offered
+	alpsProtocols                    []string              // [uTLS]
+	certCompressionAlgorithms        []CertCompressionAlgo // [uTLS]
+	certificateAuthorities           [][]byte              // [uTLS]
+	statusRequestV2                  bool                  // [uTLS] status_request_v2 with an ocsp_multi request
+	cachedInfo                       []CachedObject        // [uTLS]
 }
 
 func (m *clientHelloMsg) marshal() []byte {
@@ -148,6 +157,19 @@ func (m *clientHelloMsg) marshal() []byte {
 					b.AddUint16(0) // empty request_extensions
 				})
 			}
+			if m.statusRequestV2 { // [uTLS]
+				// RFC 6961, Section 2.2
+				b.AddUint16(utlsExtensionStatusRequestV2)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint8(statusTypeOCSPMulti)
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddUint16(0) // empty responder_id_list
+							b.AddUint16(0) // empty request_extensions
+						})
+					})
+				})
+			}
 			if len(m.supportedCurves) > 0 {
 				// RFC 4492, sections 5.1.1 and RFC 8446, Section 4.2.7
 				b.AddUint16(extensionSupportedCurves)
@@ -272,6 +294,81 @@ func (m *clientHelloMsg) marshal() []byte {
 					})
 				})
 			}
+			if m.recordSizeLimit != 0 {
+				// RFC 8449, Section 4
+				b.AddUint16(utlsExtensionRecordSizeLimit)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(m.recordSizeLimit)
+				})
+			}
+			if m.alpsCodepoint != 0 {
+				// draft-vvv-tls-alps-01, Section 3
+				b.AddUint16(m.alpsCodepoint)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, proto := range m.alpsProtocols {
+							b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+								b.AddBytes([]byte(proto))
+							})
+						}
+					})
+				})
+			}
+			if len(m.certCompressionAlgorithms) > 0 {
+				// RFC 8879, Section 3
+				b.AddUint16(extensionCompressCertificate)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, alg := range m.certCompressionAlgorithms {
+							b.AddUint16(uint16(alg))
+						}
+					})
+				})
+			}
+			if len(m.delegatedCredentialSchemes) > 0 {
+				// RFC 9345, Section 4.1.1
+				b.AddUint16(utlsExtensionDelegatedCredentials)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, sigAlgo := range m.delegatedCredentialSchemes {
+							b.AddUint16(uint16(sigAlgo))
+						}
+					})
+				})
+			}
+			if len(m.certificateAuthorities) > 0 {
+				// RFC 8446, Section 4.2.4
+				b.AddUint16(extensionCertificateAuthorities)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, ca := range m.certificateAuthorities {
+							b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+								b.AddBytes(ca)
+							})
+						}
+					})
+				})
+			}
+			if len(m.cachedInfo) > 0 {
+				// RFC 7924, Section 3
+				b.AddUint16(utlsExtensionCachedInfo)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, obj := range m.cachedInfo {
+							b.AddUint8(uint8(obj.Type))
+							b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+								b.AddBytes(obj.Hash)
+							})
+						}
+					})
+				})
+			}
+			if len(m.encryptedClientHello) > 0 {
+				b.AddUint16(utlsExtensionEncryptedClientHello)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.encryptedClientHello)
+				})
+			}
 			if len(m.pskIdentities) > 0 { // pre_shared_key must be the last extension
 				// RFC 8446, Section 4.2.11
 				b.AddUint16(extensionPreSharedKey)
@@ -440,6 +537,20 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.ocspStapling = statusType == statusTypeOCSP
+		case utlsExtensionStatusRequestV2: // [uTLS]
+			// RFC 6961, Section 2.2
+			var items cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&items) || items.Empty() {
+				return false
+			}
+			for !items.Empty() {
+				var statusType uint8
+				var ignored cryptobyte.String
+				if !items.ReadUint8(&statusType) || !items.ReadUint16LengthPrefixed(&ignored) {
+					return false
+				}
+				m.statusRequestV2 = m.statusRequestV2 || statusType == statusTypeOCSPMulti
+			}
 		case extensionSupportedCurves:
 			// RFC 4492, sections 5.1.1 and RFC 8446, Section 4.2.7
 			var curves cryptobyte.String
@@ -550,6 +661,86 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 		case extensionEarlyData:
 			// RFC 8446, Section 4.2.10
 			m.earlyData = true
+		case utlsExtensionEncryptedClientHello:
+			if extData.Empty() {
+				return false
+			}
+			m.encryptedClientHello = extData
+			extData = nil
+		case utlsExtensionRecordSizeLimit:
+			// RFC 8449, Section 4
+			if !extData.ReadUint16(&m.recordSizeLimit) {
+				return false
+			}
+		case utlsExtensionApplicationSettings, utlsExtensionApplicationSettingsNew:
+			// draft-vvv-tls-alps-01, Section 3
+			var protoList cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&protoList) {
+				return false
+			}
+			m.alpsCodepoint = extension
+			for !protoList.Empty() {
+				var proto cryptobyte.String
+				if !protoList.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+					return false
+				}
+				m.alpsProtocols = append(m.alpsProtocols, string(proto))
+			}
+		case extensionCompressCertificate:
+			// RFC 8879, Section 3
+			var algs cryptobyte.String
+			if !extData.ReadUint8LengthPrefixed(&algs) || algs.Empty() {
+				return false
+			}
+			for !algs.Empty() {
+				var alg uint16
+				if !algs.ReadUint16(&alg) {
+					return false
+				}
+				m.certCompressionAlgorithms = append(
+					m.certCompressionAlgorithms, CertCompressionAlgo(alg))
+			}
+		case utlsExtensionDelegatedCredentials:
+			// RFC 9345, Section 4.1.1
+			var sigAndAlgs cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&sigAndAlgs) || sigAndAlgs.Empty() {
+				return false
+			}
+			for !sigAndAlgs.Empty() {
+				var sigAndAlg uint16
+				if !sigAndAlgs.ReadUint16(&sigAndAlg) {
+					return false
+				}
+				m.delegatedCredentialSchemes = append(
+					m.delegatedCredentialSchemes, SignatureScheme(sigAndAlg))
+			}
+		case extensionCertificateAuthorities:
+			// RFC 8446, Section 4.2.4
+			var auths cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&auths) || auths.Empty() {
+				return false
+			}
+			for !auths.Empty() {
+				var ca []byte
+				if !readUint16LengthPrefixed(&auths, &ca) || len(ca) == 0 {
+					return false
+				}
+				m.certificateAuthorities = append(m.certificateAuthorities, ca)
+			}
+		case utlsExtensionCachedInfo:
+			// RFC 7924, Section 3
+			var objs cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&objs) || objs.Empty() {
+				return false
+			}
+			for !objs.Empty() {
+				var obj CachedObject
+				if !objs.ReadUint8((*uint8)(&obj.Type)) ||
+					!readUint8LengthPrefixed(&objs, &obj.Hash) || len(obj.Hash) == 0 {
+					return false
+				}
+				m.cachedInfo = append(m.cachedInfo, obj)
+			}
 		case extensionPSKModes:
 			// RFC 8446, Section 4.2.9
 			if !readUint8LengthPrefixed(&extData, &m.pskModes) {
@@ -622,6 +813,21 @@ type serverHelloMsg struct {
 	// HelloRetryRequest extensions
 	cookie        []byte
 	selectedGroup CurveID
+
+	// [uTLS] encryptedClientHello is the ECH acceptance confirmation carried
+	// in a HelloRetryRequest.
+	encryptedClientHello []byte
+
+	// [uTLS] TLS 1.2 record_size_limit
+	recordSizeLimit uint16
+
+	// [uTLS] statusRequestV2 is the empty status_request_v2 extension,
+	// sent when the server staples a CertificateStatus, see RFC 6961.
+	statusRequestV2 bool
+
+	// [uTLS] cachedInfo are the types of the cached objects the server
+	// replaces with their hash, see RFC 7924.
+	cachedInfo []CachedInformationType
 }
 
 func (m *serverHelloMsg) marshal() []byte {
@@ -659,6 +865,10 @@ func (m *serverHelloMsg) marshal() []byte {
 				b.AddUint16(extensionStatusRequest)
 				b.AddUint16(0) // empty extension_data
 			}
+			if m.statusRequestV2 { // [uTLS]
+				b.AddUint16(utlsExtensionStatusRequestV2)
+				b.AddUint16(0) // empty extension_data
+			}
 			if m.ticketSupported {
 				b.AddUint16(extensionSessionTicket)
 				b.AddUint16(0) // empty extension_data
@@ -729,6 +939,28 @@ func (m *serverHelloMsg) marshal() []byte {
 					b.AddUint16(uint16(m.selectedGroup))
 				})
 			}
+			if len(m.encryptedClientHello) > 0 {
+				b.AddUint16(utlsExtensionEncryptedClientHello)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.encryptedClientHello)
+				})
+			}
+			if m.recordSizeLimit != 0 {
+				b.AddUint16(utlsExtensionRecordSizeLimit)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(m.recordSizeLimit)
+				})
+			}
+			if len(m.cachedInfo) > 0 {
+				b.AddUint16(utlsExtensionCachedInfo)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						for _, t := range m.cachedInfo {
+							b.AddUint8(uint8(t))
+						}
+					})
+				})
+			}
 
 			extensionsPresent = len(b.BytesOrPanic()) > 2
 		})
@@ -785,6 +1017,8 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 			}
 		case extensionStatusRequest:
 			m.ocspStapling = true
+		case utlsExtensionStatusRequestV2: // [uTLS]
+			m.statusRequestV2 = true
 		case extensionSessionTicket:
 			m.ticketSupported = true
 		case utlsExtensionExtendedMasterSecret:
@@ -849,6 +1083,26 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 			if !extData.ReadUint16(&m.selectedIdentity) {
 				return false
 			}
+		case utlsExtensionEncryptedClientHello:
+			if !extData.ReadBytes(&m.encryptedClientHello, 8) {
+				return false
+			}
+		case utlsExtensionRecordSizeLimit:
+			if !extData.ReadUint16(&m.recordSizeLimit) {
+				return false
+			}
+		case utlsExtensionCachedInfo:
+			var types cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&types) || types.Empty() {
+				return false
+			}
+			for !types.Empty() {
+				var t uint8
+				if !types.ReadUint8(&t) {
+					return false
+				}
+				m.cachedInfo = append(m.cachedInfo, CachedInformationType(t))
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -863,8 +1117,17 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 }
 
 type encryptedExtensionsMsg struct {
-	raw          []byte
-	alpnProtocol string
+	raw             []byte
+	alpnProtocol    string
+	echRetryConfigs []byte // [uTLS] ECHConfigList sent on ECH rejection
+	recordSizeLimit uint16 // [uTLS]
+
+	// [uTLS] alpsCodepoint is the codepoint of the application_settings
+	// extension carrying applicationSettings, or zero if there is none.
+	alpsCodepoint       uint16
+	applicationSettings []byte
+
+	earlyData bool // [uTLS]
 }
 
 func (m *encryptedExtensionsMsg) marshal() []byte {
@@ -886,6 +1149,29 @@ func (m *encryptedExtensionsMsg) marshal() []byte {
 					})
 				})
 			}
+			if len(m.echRetryConfigs) > 0 {
+				b.AddUint16(utlsExtensionEncryptedClientHello)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.echRetryConfigs)
+				})
+			}
+			if m.recordSizeLimit != 0 {
+				b.AddUint16(utlsExtensionRecordSizeLimit)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(m.recordSizeLimit)
+				})
+			}
+			if m.alpsCodepoint != 0 {
+				b.AddUint16(m.alpsCodepoint)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.applicationSettings)
+				})
+			}
+			if m.earlyData {
+				// RFC 8446, Section 4.2.10
+				b.AddUint16(extensionEarlyData)
+				b.AddUint16(0) // empty extension_data
+			}
 		})
 	})
 
@@ -923,6 +1209,23 @@ func (m *encryptedExtensionsMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.alpnProtocol = string(proto)
+		case utlsExtensionEncryptedClientHello:
+			if extData.Empty() {
+				return false
+			}
+			m.echRetryConfigs = extData
+			extData = nil
+		case utlsExtensionRecordSizeLimit:
+			if !extData.ReadUint16(&m.recordSizeLimit) {
+				return false
+			}
+		case utlsExtensionApplicationSettings, utlsExtensionApplicationSettingsNew:
+			m.alpsCodepoint = extension
+			m.applicationSettings = append([]byte{}, extData...)
+			extData = nil
+		case extensionEarlyData:
+			// RFC 8446, Section 4.2.10
+			m.earlyData = true
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -1351,6 +1654,13 @@ func marshalCertificate(b *cryptobyte.Builder, certificate Certificate) {
 						})
 					})
 				}
+				if certificate.DelegatedCredential != nil { // [uTLS]
+					// RFC 9345, Section 4.1.1
+					b.AddUint16(utlsExtensionDelegatedCredentials)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(certificate.DelegatedCredential)
+					})
+				}
 				if certificate.SignedCertificateTimestamps != nil {
 					b.AddUint16(extensionSCT)
 					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
@@ -1386,6 +1696,47 @@ func (m *certificateMsgTLS13) unmarshal(data []byte) bool {
 	return true
 }
 
+// [uTLS] ocspResponses returns the OCSP response of the status_request
+// extension of each CertificateEntry, with nil for the certificates without
+// one, or nil if none has one. See RFC 8446, Section 4.4.2.1.
+func (m *certificateMsgTLS13) ocspResponses() [][]byte {
+	s := cryptobyte.String(m.marshal())
+	var context, certList cryptobyte.String
+	if !s.Skip(4) || !s.ReadUint8LengthPrefixed(&context) || !s.ReadUint24LengthPrefixed(&certList) {
+		return nil
+	}
+	var responses [][]byte
+	stapled := false
+	for !certList.Empty() {
+		var cert, extensions cryptobyte.String
+		if !certList.ReadUint24LengthPrefixed(&cert) || !certList.ReadUint16LengthPrefixed(&extensions) {
+			return nil
+		}
+		var response []byte
+		for !extensions.Empty() {
+			var extension uint16
+			var extData cryptobyte.String
+			if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+				return nil
+			}
+			if extension != extensionStatusRequest {
+				continue
+			}
+			var statusType uint8
+			if !extData.ReadUint8(&statusType) || statusType != statusTypeOCSP ||
+				!readUint24LengthPrefixed(&extData, &response) || len(response) == 0 {
+				return nil
+			}
+			stapled = true
+		}
+		responses = append(responses, response)
+	}
+	if !stapled {
+		return nil
+	}
+	return responses
+}
+
 func unmarshalCertificate(s *cryptobyte.String, certificate *Certificate) bool {
 	var certList cryptobyte.String
 	if !s.ReadUint24LengthPrefixed(&certList) {
@@ -1433,6 +1784,13 @@ func unmarshalCertificate(s *cryptobyte.String, certificate *Certificate) bool {
 					certificate.SignedCertificateTimestamps = append(
 						certificate.SignedCertificateTimestamps, sct)
 				}
+			case utlsExtensionDelegatedCredentials: // [uTLS]
+				// RFC 9345, Section 4.1.1
+				if extData.Empty() {
+					return false
+				}
+				certificate.DelegatedCredential = extData
+				extData = nil
 			default:
 				// Ignore unknown extensions.
 				continue
@@ -1479,6 +1837,11 @@ func (m *serverKeyExchangeMsg) unmarshal(data []byte) bool {
 type certificateStatusMsg struct {
 	raw      []byte
 	response []byte
+
+	// [uTLS] responses is the ocsp_multi list of RFC 6961, Section 2.2, with
+	// a nil response for each certificate the server has none for. The
+	// response of the leaf is also in response.
+	responses [][]byte
 }
 
 func (m *certificateStatusMsg) marshal() []byte {
@@ -1489,6 +1852,17 @@ func (m *certificateStatusMsg) marshal() []byte {
 	var b cryptobyte.Builder
 	b.AddUint8(typeCertificateStatus)
 	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		if m.responses != nil { // [uTLS]
+			b.AddUint8(statusTypeOCSPMulti)
+			b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, response := range m.responses {
+					b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(response)
+					})
+				}
+			})
+			return
+		}
 		b.AddUint8(statusTypeOCSP)
 		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
 			b.AddBytes(m.response)
@@ -1505,7 +1879,29 @@ func (m *certificateStatusMsg) unmarshal(data []byte) bool {
 
 	var statusType uint8
 	if !s.Skip(4) || // message type and uint24 length field
-		!s.ReadUint8(&statusType) || statusType != statusTypeOCSP ||
+		!s.ReadUint8(&statusType) {
+		return false
+	}
+	m.responses = nil // [uTLS]
+	if statusType == statusTypeOCSPMulti { // [uTLS]
+		var list cryptobyte.String
+		if !s.ReadUint24LengthPrefixed(&list) || list.Empty() || !s.Empty() {
+			return false
+		}
+		for !list.Empty() {
+			var response []byte
+			if !readUint24LengthPrefixed(&list, &response) {
+				return false
+			}
+			if len(response) == 0 {
+				response = nil
+			}
+			m.responses = append(m.responses, response)
+		}
+		m.response = m.responses[0]
+		return true
+	}
+	if statusType != statusTypeOCSP ||
 		!readUint24LengthPrefixed(&s, &m.response) ||
 		len(m.response) == 0 || !s.Empty() {
 		return false
@@ -137,6 +137,10 @@ func (*clientHelloMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 		}
 	}
 	m.ocspStapling = rand.Intn(10) > 5
+	m.statusRequestV2 = rand.Intn(10) > 5
+	for i := 0; i < rand.Intn(3); i++ {
+		m.cachedInfo = append(m.cachedInfo, CachedObject{CachedInformationType(rand.Intn(2) + 1), randomBytes(rand.Intn(32)+1, rand)})
+	}
 	m.supportedPoints = randomBytes(rand.Intn(5)+1, rand)
 	m.supportedCurves = make([]CurveID, rand.Intn(5)+1)
 	for i := range m.supportedCurves {
@@ -216,6 +220,12 @@ func (*serverHelloMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	if rand.Intn(10) > 5 {
 		m.ocspStapling = true
 	}
+	if rand.Intn(10) > 5 {
+		m.statusRequestV2 = true
+	}
+	if rand.Intn(10) > 5 {
+		m.cachedInfo = []CachedInformationType{CachedInformationCert}
+	}
 	if rand.Intn(10) > 5 {
 		m.ticketSupported = true
 	}
@@ -293,6 +303,9 @@ func (*certificateVerifyMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 func (*certificateStatusMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	m := &certificateStatusMsg{}
 	m.response = randomBytes(rand.Intn(10)+1, rand)
+	if rand.Intn(10) > 5 {
+		m.responses = [][]byte{m.response, nil, randomBytes(rand.Intn(10)+1, rand)}
+	}
 	return reflect.ValueOf(m)
 }
 
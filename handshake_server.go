@@ -65,6 +65,7 @@ func (hs *serverHandshakeState) handshake() error {
 	if err := hs.processClientHello(); err != nil {
 		return err
 	}
+	copy(c.serverHelloRandom[:], hs.hello.random) // [uTLS]
 
 	// For an overview of TLS handshaking, see RFC 5246, Section 7.3.
 	c.buffering = true
@@ -91,7 +92,7 @@ func (hs *serverHandshakeState) handshake() error {
 			return err
 		}
 		c.clientFinishedIsFirst = false
-		if err := hs.readFinished(nil); err != nil {
+		if err := hs.readFinished(c.clientFinished[:]); err != nil { // [uTLS] keep both verify_data
 			return err
 		}
 		c.didResume = true
@@ -115,7 +116,7 @@ func (hs *serverHandshakeState) handshake() error {
 		if err := hs.sendSessionTicket(); err != nil {
 			return err
 		}
-		if err := hs.sendFinished(nil); err != nil {
+		if err := hs.sendFinished(c.serverFinished[:]); err != nil { // [uTLS] keep both verify_data
 			return err
 		}
 		if _, err := c.flush(); err != nil {
@@ -179,7 +180,7 @@ func (hs *serverHandshakeState) processClientHello() error {
 Curves:
 	for _, curve := range hs.clientHello.supportedCurves {
 		for _, supported := range preferredCurves {
-			if supported == curve {
+			if supported == curve && !isKEMGroup(curve) { // [uTLS] TLS 1.3 only
 				supportedCurve = true
 				break Curves
 			}
@@ -233,6 +234,7 @@ Curves:
 	}
 
 	hs.hello.secureRenegotiationSupported = hs.clientHello.secureRenegotiationSupported
+	c.secureRenegotiation = hs.hello.secureRenegotiationSupported // [uTLS]
 	hs.hello.compressionMethod = compressionNone
 	if len(hs.clientHello.serverName) > 0 {
 		c.serverName = hs.clientHello.serverName
@@ -254,6 +256,13 @@ Curves:
 		}
 	}
 
+	if hs.clientHello.recordSizeLimit != 0 { // [uTLS]
+		if err := c.setPeerRecordSizeLimit(hs.clientHello.recordSizeLimit); err != nil {
+			return err
+		}
+		hs.hello.recordSizeLimit = maxPlaintext
+	}
+
 	hs.cert, err = c.config.getCertificate(clientHelloInfo(c, hs.clientHello))
 	if err != nil {
 		c.sendAlert(alertInternalError)
@@ -398,6 +407,13 @@ func (hs *serverHandshakeState) doResumeHandshake() error {
 		return err
 	}
 
+	if c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
 	hs.masterSecret = hs.sessionState.masterSecret
 
 	return nil
@@ -406,10 +422,21 @@ func (hs *serverHandshakeState) doResumeHandshake() error {
 func (hs *serverHandshakeState) doFullHandshake() error {
 	c := hs.c
 
-	if hs.clientHello.ocspStapling && len(hs.cert.OCSPStaple) > 0 {
+	if hs.clientHello.statusRequestV2 && len(hs.cert.OCSPStaple) > 0 { // [uTLS]
+		hs.hello.statusRequestV2 = true
+	} else if hs.clientHello.ocspStapling && len(hs.cert.OCSPStaple) > 0 {
 		hs.hello.ocspStapling = true
 	}
 
+	if len(hs.clientHello.cachedInfo) > 0 { // [uTLS]
+		cached := &CachedInfoExtension{Certificates: [][][]byte{hs.cert.Certificate}}
+		for _, obj := range hs.clientHello.cachedInfo {
+			if obj.Type == CachedInformationCert && cached.certificates(obj.Hash) != nil {
+				hs.hello.cachedInfo = []CachedInformationType{CachedInformationCert}
+			}
+		}
+	}
+
 	hs.hello.ticketSupported = hs.clientHello.ticketSupported && !c.config.SessionTicketsDisabled
 	hs.hello.cipherSuite = hs.suite.id
 
@@ -425,16 +452,22 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		return err
 	}
 
-	certMsg := new(certificateMsg)
-	certMsg.certificates = hs.cert.Certificate
+	var certMsg handshakeMessage = &certificateMsg{certificates: hs.cert.Certificate}
+	if hs.hello.cachedInfo != nil { // [uTLS] the client has the chain cached
+		certMsg = &cachedCertificateMsg{hash: CertificateChainHash(hs.cert.Certificate)}
+	}
 	hs.finishedHash.Write(certMsg.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, certMsg.marshal()); err != nil {
 		return err
 	}
 
-	if hs.hello.ocspStapling {
+	if hs.hello.ocspStapling || hs.hello.statusRequestV2 {
 		certStatus := new(certificateStatusMsg)
 		certStatus.response = hs.cert.OCSPStaple
+		if hs.hello.statusRequestV2 { // [uTLS] only the leaf has a response
+			certStatus.responses = make([][]byte, len(hs.cert.Certificate))
+			certStatus.responses[0] = hs.cert.OCSPStaple
+		}
 		hs.finishedHash.Write(certStatus.marshal())
 		if _, err := c.writeRecord(recordTypeHandshake, certStatus.marshal()); err != nil {
 			return err
@@ -522,6 +555,13 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		}
 	}
 
+	if c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
 	// Get client key exchange
 	ckx, ok := msg.(*clientKeyExchangeMsg)
 	if !ok {
@@ -817,5 +857,7 @@ func clientHelloInfo(c *Conn, clientHello *clientHelloMsg) *ClientHelloInfo {
 		SupportedProtos:   clientHello.alpnProtocols,
 		SupportedVersions: supportedVersions,
 		Conn:              c.conn,
+
+		CertificateAuthorities: clientHello.certificateAuthorities, // [uTLS]
 	}
 }
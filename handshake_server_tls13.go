@@ -37,6 +37,10 @@ type serverHandshakeStateTLS13 struct {
 	trafficSecret   []byte // client_application_traffic_secret_0
 	transcript      hash.Hash
 	clientFinished  []byte
+	echContext      *echServerContext // [uTLS]
+
+	usingDelegatedCredential bool // [uTLS]
+	sentApplicationSettings  bool // [uTLS]
 }
 
 func (hs *serverHandshakeStateTLS13) handshake() error {
@@ -68,6 +72,9 @@ func (hs *serverHandshakeStateTLS13) handshake() error {
 	if _, err := c.flush(); err != nil {
 		return err
 	}
+	if err := hs.readClientEncryptedExtensions(); err != nil { // [uTLS]
+		return err
+	}
 	if err := hs.readClientCertificate(); err != nil {
 		return err
 	}
@@ -90,6 +97,10 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 	hs.hello.vers = VersionTLS12
 	hs.hello.supportedVersion = c.vers
 
+	if err := hs.processEncryptedClientHello(); err != nil { // [uTLS]
+		return err
+	}
+
 	if len(hs.clientHello.supportedVersions) == 0 {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: client used the legacy version field to negotiate TLS 1.3")
@@ -203,17 +214,28 @@ GroupSelection:
 		clientKeyShare = &hs.clientHello.keyShares[0]
 	}
 
-	if _, ok := curveForCurveID(selectedGroup); selectedGroup != X25519 && !ok {
+	if _, ok := curveForCurveID(selectedGroup); selectedGroup != X25519 && !isKEMGroup(selectedGroup) && !ok {
 		c.sendAlert(alertInternalError)
 		return errors.New("tls: CurvePreferences includes unsupported curve")
 	}
-	params, err := generateECDHEParameters(c.config.rand(), selectedGroup)
-	if err != nil {
-		c.sendAlert(alertInternalError)
-		return err
+	if isKEMGroup(selectedGroup) {
+		// [uTLS] the server share of a KEM depends on the client share.
+		serverShare, sharedKey, err := kemServerShare(c.config.rand(), selectedGroup, clientKeyShare.data)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		hs.hello.serverShare = keyShare{group: selectedGroup, data: serverShare}
+		hs.sharedKey = sharedKey
+	} else {
+		params, err := generateECDHEParameters(c.config.rand(), selectedGroup)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		hs.hello.serverShare = keyShare{group: selectedGroup, data: params.PublicKey()}
+		hs.sharedKey = params.SharedKey(clientKeyShare.data)
 	}
-	hs.hello.serverShare = keyShare{group: selectedGroup, data: params.PublicKey()}
-	hs.sharedKey = params.SharedKey(clientKeyShare.data)
 	if hs.sharedKey == nil {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: invalid client key share")
@@ -389,6 +411,21 @@ func (hs *serverHandshakeStateTLS13) pickCertificate() error {
 	}
 	hs.cert = certificate
 
+	// [uTLS] Authenticate with the delegated credential of the certificate
+	// if the client accepts it, see RFC 9345, Section 4.1.1.
+	if certificate.DelegatedCredential != nil && len(hs.clientHello.delegatedCredentialSchemes) > 0 {
+		dc, err := parseDelegatedCredential(certificate.DelegatedCredential)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		if isSupportedSignatureAlgorithm(dc.CertVerifyAlgorithm, hs.clientHello.delegatedCredentialSchemes) &&
+			isSupportedSignatureAlgorithm(dc.Algorithm, hs.clientHello.supportedSignatureAlgorithms) {
+			hs.sigAlg = dc.CertVerifyAlgorithm
+			hs.usingDelegatedCredential = true
+		}
+	}
+
 	return nil
 }
 
@@ -425,6 +462,16 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		selectedGroup:     selectedGroup,
 	}
 
+	if hs.echContext != nil && hs.echContext.accepted { // [uTLS]
+		helloRetryRequest.encryptedClientHello = make([]byte, 8)
+		confirmation, err := hs.echAcceptConfirmation(echHRRAcceptConfirmationLabel, helloRetryRequest.marshal())
+		if err != nil {
+			return err
+		}
+		helloRetryRequest.encryptedClientHello = confirmation
+		helloRetryRequest.raw = nil
+	}
+
 	hs.transcript.Write(helloRetryRequest.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, helloRetryRequest.marshal()); err != nil {
 		return err
@@ -445,6 +492,11 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		return unexpectedMessageError(clientHello, msg)
 	}
 
+	clientHello, err = hs.processSecondEncryptedClientHello(clientHello) // [uTLS]
+	if err != nil {
+		return err
+	}
+
 	if len(clientHello.keyShares) != 1 || clientHello.keyShares[0].group != selectedGroup {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: client sent invalid key share in second ClientHello")
@@ -527,6 +579,17 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 	c := hs.c
 
 	hs.transcript.Write(hs.clientHello.marshal())
+	if hs.echContext != nil && hs.echContext.accepted { // [uTLS]
+		copy(hs.hello.random[24:], make([]byte, 8))
+		hs.hello.raw = nil
+		confirmation, err := hs.echAcceptConfirmation(echAcceptConfirmationLabel, hs.hello.marshal())
+		if err != nil {
+			return err
+		}
+		copy(hs.hello.random[24:], confirmation)
+		hs.hello.raw = nil
+	}
+	copy(c.serverHelloRandom[:], hs.hello.random) // [uTLS]
 	hs.transcript.Write(hs.hello.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
 		return err
@@ -570,6 +633,28 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 		}
 	}
 
+	if settings, ok := c.config.ApplicationSettings[c.clientProtocol]; ok && c.clientProtocol != "" { // [uTLS]
+		for _, proto := range hs.clientHello.alpsProtocols {
+			if proto == c.clientProtocol {
+				encryptedExtensions.alpsCodepoint = hs.clientHello.alpsCodepoint
+				encryptedExtensions.applicationSettings = settings
+				hs.sentApplicationSettings = true
+				break
+			}
+		}
+	}
+
+	if hs.echContext != nil && !hs.echContext.accepted { // [uTLS]
+		encryptedExtensions.echRetryConfigs = c.config.echRetryConfigs()
+	}
+
+	if hs.clientHello.recordSizeLimit != 0 { // [uTLS]
+		if err := c.setPeerRecordSizeLimit(hs.clientHello.recordSizeLimit); err != nil {
+			return err
+		}
+		encryptedExtensions.recordSizeLimit = maxPlaintext + 1
+	}
+
 	hs.transcript.Write(encryptedExtensions.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, encryptedExtensions.marshal()); err != nil {
 		return err
@@ -582,6 +667,30 @@ func (hs *serverHandshakeStateTLS13) requestClientCert() bool {
 	return hs.c.config.ClientAuth >= RequestClientCert && !hs.usingPSK
 }
 
+// compressCertificate returns certMsg compressed with the first algorithm
+// offered by the client that has a Config.CertificateCompressors entry, or nil
+// if there is none. [uTLS]
+func (hs *serverHandshakeStateTLS13) compressCertificate(certMsg *certificateMsgTLS13) (*compressedCertificateMsg, error) {
+	compressors := hs.c.config.CertificateCompressors
+	for _, alg := range hs.clientHello.certCompressionAlgorithms {
+		compress := compressors[alg]
+		if compress == nil {
+			continue
+		}
+		body := certMsg.marshal()[4:]
+		compressed, err := compress(body)
+		if err != nil {
+			return nil, errors.New("tls: failed to compress certificate: " + err.Error())
+		}
+		return &compressedCertificateMsg{
+			algorithm:                    alg,
+			uncompressedLength:           uint32(len(body)),
+			compressedCertificateMessage: compressed,
+		}, nil
+	}
+	return nil, nil
+}
+
 func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 	c := hs.c
 
@@ -611,9 +720,20 @@ func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 	certMsg.certificate = *hs.cert
 	certMsg.scts = hs.clientHello.scts && len(hs.cert.SignedCertificateTimestamps) > 0
 	certMsg.ocspStapling = hs.clientHello.ocspStapling && len(hs.cert.OCSPStaple) > 0
+	if !hs.usingDelegatedCredential { // [uTLS]
+		certMsg.certificate.DelegatedCredential = nil
+	}
 
-	hs.transcript.Write(certMsg.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, certMsg.marshal()); err != nil {
+	var msg handshakeMessage = certMsg
+	if compressed, err := hs.compressCertificate(certMsg); err != nil { // [uTLS]
+		c.sendAlert(alertInternalError)
+		return err
+	} else if compressed != nil {
+		msg = compressed
+		c.certCompressionAlgorithm = compressed.algorithm
+	}
+	hs.transcript.Write(msg.marshal())
+	if _, err := c.writeRecord(recordTypeHandshake, msg.marshal()); err != nil {
 		return err
 	}
 
@@ -633,9 +753,13 @@ func (hs *serverHandshakeStateTLS13) sendServerCertificate() error {
 	if sigType == signatureRSAPSS {
 		signOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: sigHash}
 	}
-	sig, err := hs.cert.PrivateKey.(crypto.Signer).Sign(c.config.rand(), h.Sum(nil), signOpts)
+	priv := hs.cert.PrivateKey
+	if hs.usingDelegatedCredential { // [uTLS]
+		priv = hs.cert.DelegatedCredentialPrivateKey
+	}
+	sig, err := priv.(crypto.Signer).Sign(c.config.rand(), h.Sum(nil), signOpts)
 	if err != nil {
-		public := hs.cert.PrivateKey.(crypto.Signer).Public()
+		public := priv.(crypto.Signer).Public()
 		if rsaKey, ok := public.(*rsa.PublicKey); ok && sigType == signatureRSAPSS &&
 			rsaKey.N.BitLen()/8 < sigHash.Size()*2+2 { // key too small for RSA-PSS
 			c.sendAlert(alertHandshakeFailure)
@@ -688,12 +812,14 @@ func (hs *serverHandshakeStateTLS13) sendServerFinished() error {
 		return err
 	}
 
-	c.ekm = hs.suite.exportKeyingMaterial(hs.masterSecret, hs.transcript)
+	expMasterSecret := hs.suite.deriveSecret(hs.masterSecret, exporterLabel, hs.transcript)
+	c.config.keySecret(keyLogLabelExporter, hs.clientHello.random, expMasterSecret) // [uTLS]
+	c.ekm = hs.suite.exportKeyingMaterial(expMasterSecret)
 
 	// If we did not request client certificates, at this point we can
 	// precompute the client finished and roll the transcript forward to send
 	// session tickets in our first flight.
-	if !hs.requestClientCert() {
+	if !hs.requestClientCert() && !hs.sentApplicationSettings { // [uTLS]
 		if err := hs.sendSessionTickets(); err != nil {
 			return err
 		}
@@ -766,6 +892,14 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 	c := hs.c
 
 	if !hs.requestClientCert() {
+		// Make sure the connection is still being verified whether or not
+		// the server requested a client certificate.
+		if c.config.VerifyConnection != nil {
+			if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+				c.sendAlert(alertBadCertificate)
+				return err
+			}
+		}
 		return nil
 	}
 
@@ -788,6 +922,13 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 		return err
 	}
 
+	if c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
 	if len(certMsg.certificate.Certificate) != 0 {
 		msg, err = c.readHandshake()
 		if err != nil {
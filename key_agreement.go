@@ -42,6 +42,9 @@ func (ka rsaKeyAgreement) processClientKeyExchange(config *Config, cert *Certifi
 	if !ok {
 		return nil, errors.New("tls: certificate private key does not implement crypto.Decrypter")
 	}
+	if config.Bugs.RSANonConstantTime { // [uTLS]
+		return decryptPreMasterSecretNonConstantTime(config, priv, ciphertext)
+	}
 	// Perform constant time RSA PKCS#1 v1.5 decryption
 	preMasterSecret, err := priv.Decrypt(config.rand(), ciphertext, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: 48})
 	if err != nil {
@@ -142,6 +145,9 @@ func (ka *ecdheKeyAgreement) generateServerKeyExchange(config *Config, cert *Cer
 	var curveID CurveID
 NextCandidate:
 	for _, candidate := range preferredCurves {
+		if isKEMGroup(candidate) {
+			continue // [uTLS] TLS 1.3 only
+		}
 		for _, c := range clientHello.supportedCurves {
 			if candidate == c {
 				curveID = c
@@ -21,6 +21,7 @@ import (
 
 const (
 	resumptionBinderLabel         = "res binder"
+	clientEarlyTrafficLabel       = "c e traffic"
 	clientHandshakeTrafficLabel   = "c hs traffic"
 	serverHandshakeTrafficLabel   = "s hs traffic"
 	clientApplicationTrafficLabel = "c ap traffic"
@@ -89,9 +90,8 @@ func (c *cipherSuiteTLS13) finishedHash(baseKey []byte, transcript hash.Hash) []
 }
 
 // exportKeyingMaterial implements RFC5705 exporters for TLS 1.3 according to
-// RFC 8446, Section 7.5.
-func (c *cipherSuiteTLS13) exportKeyingMaterial(masterSecret []byte, transcript hash.Hash) func(string, []byte, int) ([]byte, error) {
-	expMasterSecret := c.deriveSecret(masterSecret, exporterLabel, transcript)
+// RFC 8446, Section 7.5. expMasterSecret is derived with exporterLabel.
+func (c *cipherSuiteTLS13) exportKeyingMaterial(expMasterSecret []byte) func(string, []byte, int) ([]byte, error) {
 	return func(label string, context []byte, length int) ([]byte, error) {
 		secret := c.deriveSecret(expMasterSecret, label, nil)
 		h := c.hash.New()
@@ -109,6 +109,12 @@ type ecdheParameters interface {
 }
 
 func generateECDHEParameters(rand io.Reader, curveID CurveID) (ecdheParameters, error) {
+	switch curveID { // [uTLS]
+	case X25519Kyber768Draft00:
+		return generateX25519Kyber768Parameters(rand)
+	case X25519MLKEM768, MLKEM768:
+		return generateMLKEM768Parameters(rand, curveID == X25519MLKEM768)
+	}
 	if curveID == X25519 {
 		p := &x25519Parameters{}
 		if _, err := io.ReadFull(rand, p.privateKey[:]); err != nil {
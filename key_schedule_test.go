@@ -173,3 +173,32 @@ func TestExtract(t *testing.T) {
 		})
 	}
 }
+
+func TestExportKeyingMaterialTLS13(t *testing.T) {
+	// The exporter_master_secret of the RFC 8448, Section 3, handshake.
+	expMasterSecret := parseVector(
+		`exp master (32 octets):  fe 22 f8 81 17 6e da 18 eb 8f 44 52 9e 67
+		92 c5 0c 9a 3f 89 45 2f 68 d8 ae 31 1b 43 09 d3 cf 50`)
+	tests := []struct {
+		context []byte
+		want    []byte
+	}{
+		{nil, parseVector(`1a d2 99 30 bb 45 69 15 3c d3 b0 38 11 7f 75 18 12 2e b4 6c fd
+			f0 91 fd 8e b9 73 ea 6f c5 e1 24 4c fc 8a d7 bb 2c 41 a0 03 4a`)},
+		// In TLS 1.3 a nil context is the same as an empty one.
+		{[]byte{}, parseVector(`1a d2 99 30 bb 45 69 15 3c d3 b0 38 11 7f 75 18 12 2e b4 6c fd
+			f0 91 fd 8e b9 73 ea 6f c5 e1 24 4c fc 8a d7 bb 2c 41 a0 03 4a`)},
+		{[]byte("context"), parseVector(`b0 ac 13 49 5b 3b 3e 10 7b 1c 54 4b 15 23 9f 77 ab 46 50
+			1b 6b 31 5e c7 d4 98 61 12 66 2d 33 20 a2 a0 ab ce df 4a 7b 5a 9f 90`)},
+	}
+	ekm := cipherSuitesTLS13[0].exportKeyingMaterial(expMasterSecret)
+	for _, tt := range tests {
+		got, err := ekm("EXPORTER-test", tt.context, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("context %q: exported % x, want % x", tt.context, got, tt.want)
+		}
+	}
+}
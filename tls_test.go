@@ -599,7 +599,7 @@ func TestWarningAlertFlood(t *testing.T) {
 }
 
 func TestCloneFuncFields(t *testing.T) {
-	const expectedCount = 5
+	const expectedCount = 11
 	called := 0
 
 	c1 := Config{
@@ -623,6 +623,27 @@ func TestCloneFuncFields(t *testing.T) {
 			called |= 1 << 4
 			return nil
 		},
+		GetRootCAs: func(string) *x509.CertPool {
+			called |= 1 << 5
+			return nil
+		},
+		RecordPadding: func(int) int {
+			called |= 1 << 6
+			return 0
+		},
+		VerifyConnection: func(ConnectionState) error {
+			called |= 1 << 7
+			return nil
+		},
+		KeySecretsCallback: func(string, []byte, []byte) {
+			called |= 1 << 8
+		},
+		OnRawCertificates: func([][]byte) {
+			called |= 1 << 9
+		},
+		UnsafeServerHelloCallback: func([]byte) {
+			called |= 1 << 10
+		},
 	}
 
 	c2 := c1.Clone()
@@ -632,6 +653,12 @@ func TestCloneFuncFields(t *testing.T) {
 	c2.GetClientCertificate(nil)
 	c2.GetConfigForClient(nil)
 	c2.VerifyPeerCertificate(nil, nil)
+	c2.GetRootCAs("")
+	c2.RecordPadding(0)
+	c2.VerifyConnection(ConnectionState{})
+	c2.KeySecretsCallback("", nil, nil)
+	c2.OnRawCertificates(nil)
+	c2.UnsafeServerHelloCallback(nil)
 
 	if called != (1<<expectedCount)-1 {
 		t.Fatalf("expected %d calls but saw calls %b", expectedCount, called)
@@ -655,7 +682,7 @@ func TestCloneNonFuncFields(t *testing.T) {
 		switch fn := typ.Field(i).Name; fn {
 		case "Rand":
 			f.Set(reflect.ValueOf(io.Reader(os.Stdin)))
-		case "Time", "GetCertificate", "GetConfigForClient", "VerifyPeerCertificate", "GetClientCertificate":
+		case "Time", "GetCertificate", "GetConfigForClient", "VerifyPeerCertificate", "GetClientCertificate", "GetRootCAs", "RecordPadding", "VerifyConnection", "KeySecretsCallback", "OnRawCertificates", "UnsafeServerHelloCallback":
 			// DeepEqual can't compare functions. If you add a
 			// function field to this list, you must also change
 			// TestCloneFuncFields to ensure that the func field is
@@ -678,7 +705,7 @@ func TestCloneNonFuncFields(t *testing.T) {
 			f.Set(reflect.ValueOf("b"))
 		case "ClientAuth":
 			f.Set(reflect.ValueOf(VerifyClientCertIfGiven))
-		case "InsecureSkipVerify", "SessionTicketsDisabled", "DynamicRecordSizingDisabled", "PreferServerCipherSuites":
+		case "InsecureSkipVerify", "SessionTicketsDisabled", "DynamicRecordSizingDisabled", "PreferServerCipherSuites", "EnforceNextProtoSelection", "VerifyStapledOCSP":
 			f.Set(reflect.ValueOf(true))
 		case "MinVersion", "MaxVersion":
 			f.Set(reflect.ValueOf(uint16(VersionTLS12)))
@@ -690,6 +717,20 @@ func TestCloneNonFuncFields(t *testing.T) {
 			f.Set(reflect.ValueOf([]CurveID{CurveP256}))
 		case "Renegotiation":
 			f.Set(reflect.ValueOf(RenegotiateOnceAsClient))
+		case "HandshakeTimeout":
+			f.Set(reflect.ValueOf(time.Second))
+		case "CertificatePolicy":
+			f.Set(reflect.ValueOf(&CertificatePolicy{MinRSAKeySize: 2048}))
+		case "OCSPPolicy":
+			f.Set(reflect.ValueOf(&OCSPPolicy{}))
+		case "EncryptedClientHelloKeys":
+			f.Set(reflect.ValueOf([]EncryptedClientHelloKey{{Config: []byte{1}, PrivateKey: []byte{2}, SendAsRetry: true}}))
+		case "ApplicationSettings":
+			f.Set(reflect.ValueOf(map[string][]byte{"h2": {1}}))
+		case "CertificateCompressors":
+			f.Set(reflect.ValueOf(map[CertCompressionAlgo]func([]byte) ([]byte, error){CertCompressionZlib: nil}))
+		case "Bugs":
+			f.Set(reflect.ValueOf(ProtocolBugs{RSANonConstantTime: true}))
 		default:
 			t.Errorf("all fields must be accounted for, but saw unknown field %q", fn)
 		}
@@ -1024,6 +1065,55 @@ func TestConnectionState(t *testing.T) {
 	}
 }
 
+func TestServerHelloRandom(t *testing.T) {
+	for _, v := range []uint16{VersionTLS12, VersionTLS13} {
+		c, s := localPipe(t)
+		recorder := &recordingConn{Conn: c}
+		done := make(chan ConnectionState, 1)
+		go func() {
+			serverConfig := testConfig.Clone()
+			serverConfig.MaxVersion = v
+			serverConfig.Rand = nil // testConfig would make the random all zeros
+			server := Server(s, serverConfig)
+			if err := server.Handshake(); err != nil {
+				t.Errorf("%x: server handshake failed: %v", v, err)
+			}
+			done <- server.ConnectionState()
+			s.Close()
+		}()
+
+		client := Client(recorder, &Config{InsecureSkipVerify: true, MaxVersion: v})
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%x: client handshake failed: %v", v, err)
+		}
+		cs, ss := client.ConnectionState(), <-done
+		c.Close()
+
+		// The first flow read by the client starts with the ServerHello
+		// record: a record header, the handshake header, the version, and
+		// then the random.
+		recorder.Lock()
+		serverFlight := recorder.flows[1]
+		recorder.Unlock()
+		const randomOffset = recordHeaderLen + 4 + 2
+		if len(serverFlight) < randomOffset+32 || serverFlight[recordHeaderLen] != typeServerHello {
+			t.Fatalf("%x: server flight does not start with a ServerHello", v)
+		}
+		var want [32]byte
+		copy(want[:], serverFlight[randomOffset:])
+		if want == ([32]byte{}) {
+			t.Fatalf("%x: ServerHello random is all zeros", v)
+		}
+
+		if cs.ServerHelloRandom != want {
+			t.Errorf("%x: client ServerHelloRandom %x, expected %x", v, cs.ServerHelloRandom, want)
+		}
+		if ss.ServerHelloRandom != want {
+			t.Errorf("%x: server ServerHelloRandom %x, expected %x", v, ss.ServerHelloRandom, want)
+		}
+	}
+}
+
 // TestEscapeRoute tests that the library will still work if support for TLS 1.3
 // is dropped later in the Go 1.12 cycle.
 func TestEscapeRoute(t *testing.T) {
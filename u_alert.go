@@ -0,0 +1,55 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import "net"
+
+// A RemoteAlertError is the error of a client Conn or UConn which received a
+// fatal alert from the server, returned by Handshake, or by Read once the
+// handshake completed. It wraps a *net.OpError for the "remote error"
+// operation, so that the alert and the version of the server can be told
+// without matching error strings.
+type RemoteAlertError struct {
+	Err error
+
+	alert alert
+	vers  uint16
+}
+
+func (e *RemoteAlertError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RemoteAlertError) Unwrap() error {
+	return e.Err
+}
+
+// Alert returns the AlertDescription the server sent, for example 40 for
+// handshake_failure or 70 for protocol_version, see RFC 8446, Section 6.
+func (e *RemoteAlertError) Alert() uint8 {
+	return uint8(e.alert)
+}
+
+// PeerVersion returns the version negotiated with the server, or if the
+// server sent the alert in response to the ClientHello, before negotiating
+// one, the version of the record carrying the alert.
+func (e *RemoteAlertError) PeerVersion() uint16 {
+	return e.vers
+}
+
+// remoteAlertError returns the error reporting the fatal alert a, received
+// from the peer in a record of version recordVers. Servers return the
+// *net.OpError of crypto/tls, clients wrap it in a *RemoteAlertError.
+func (c *Conn) remoteAlertError(a alert, recordVers uint16) error {
+	err := &net.OpError{Op: "remote error", Err: a}
+	if !c.isClient {
+		return err
+	}
+	vers := recordVers
+	if c.haveVers {
+		vers = c.vers
+	}
+	return &RemoteAlertError{Err: err, alert: a, vers: vers}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRemoteAlertError(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		server    func(*Config)
+		id        ClientHelloID
+		wantAlert alert
+		wantVers  uint16
+	}{
+		{
+			name:      "version rejected",
+			server:    func(c *Config) { c.MinVersion = VersionTLS13 },
+			id:        HelloChrome_58,
+			wantAlert: alertProtocolVersion,
+			wantVers:  VersionTLS10,
+		},
+		{
+			name: "no client certificate",
+			server: func(c *Config) {
+				c.MaxVersion = VersionTLS12
+				c.ClientAuth = RequireAnyClientCert
+			},
+			id:        HelloChrome_124,
+			wantAlert: alertBadCertificate,
+			wantVers:  VersionTLS12,
+		},
+	} {
+		c, s := localPipe(t)
+		serverConfig := testConfig.Clone()
+		test.server(serverConfig)
+		go func() {
+			defer s.Close()
+			Server(s, serverConfig).Handshake()
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, test.id)
+		err := client.Handshake()
+		c.Close()
+		e, ok := err.(interface {
+			Alert() uint8
+			PeerVersion() uint16
+		})
+		if !ok {
+			t.Errorf("%s: got error %v (%T), want one exposing the alert", test.name, err, err)
+			continue
+		}
+		if e.Alert() != uint8(test.wantAlert) || e.PeerVersion() != test.wantVers {
+			t.Errorf("%s: got alert %d from version %#04x, want %d from %#04x", test.name, e.Alert(), e.PeerVersion(), test.wantAlert, test.wantVers)
+		}
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) || opErr.Err != error(test.wantAlert) {
+			t.Errorf("%s: the error does not wrap the *net.OpError carrying the alert", test.name)
+		}
+	}
+}
+
+func TestRemoteAlertErrorConn(t *testing.T) {
+	// A plain Conn gets a RemoteAlertError from a failed handshake.
+	c, s := localPipe(t)
+	serverConfig := testConfig.Clone()
+	serverConfig.MinVersion = VersionTLS13
+	go func() {
+		defer s.Close()
+		Server(s, serverConfig).Handshake()
+	}()
+	clientConfig := testConfig.Clone()
+	clientConfig.MaxVersion = VersionTLS12
+	err := Client(c, clientConfig).Handshake()
+	c.Close()
+	var alertErr *RemoteAlertError
+	if !errors.As(err, &alertErr) {
+		t.Fatalf("Handshake error = %v (%T), want a *RemoteAlertError", err, err)
+	}
+	if alertErr.Alert() != uint8(alertProtocolVersion) || alertErr.PeerVersion() != VersionTLS10 {
+		t.Errorf("Handshake: got alert %d from version %#04x, want %d from %#04x",
+			alertErr.Alert(), alertErr.PeerVersion(), alertProtocolVersion, VersionTLS10)
+	}
+
+	// And so does a Read after the handshake.
+	c, s = localPipe(t)
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		server := Server(s, testConfig)
+		if err := server.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		done <- server.sendAlert(alertInternalError)
+	}()
+	client := Client(c, testConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Read(make([]byte, 1))
+	if serverErr := <-done; serverErr != nil && !errors.Is(serverErr, alertInternalError) {
+		t.Fatalf("server: %v", serverErr)
+	}
+	if !errors.As(err, &alertErr) {
+		t.Fatalf("Read error = %v (%T), want a *RemoteAlertError", err, err)
+	}
+	if alertErr.Alert() != uint8(alertInternalError) || alertErr.PeerVersion() != VersionTLS13 {
+		t.Errorf("Read: got alert %d from version %#04x, want %d from %#04x",
+			alertErr.Alert(), alertErr.PeerVersion(), alertInternalError, VersionTLS13)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Err != error(alertInternalError) {
+		t.Error("Read: the error does not wrap the *net.OpError carrying the alert")
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import "strings"
+
+// An AlpnError is the error of a client handshake which offered application
+// protocols with ALPN but to which the server selected none, returned if
+// Config.EnforceNextProtoSelection is set.
+type AlpnError struct {
+	// Offered are the protocols the client offered.
+	Offered []string
+	// Selected is the protocol the server selected, always empty.
+	Selected string
+}
+
+func (e *AlpnError) Error() string {
+	return "tls: server selected no application protocol, offered " + strings.Join(e.Offered, ", ")
+}
+
+// checkALPNSelected returns an *AlpnError if Config.EnforceNextProtoSelection
+// is set and the client offered the protocols offered, but the server
+// selected none.
+func (c *Conn) checkALPNSelected(offered []string) error {
+	if !c.config.EnforceNextProtoSelection || len(offered) == 0 || c.clientProtocol != "" {
+		return nil
+	}
+	c.sendAlert(alertNoApplicationProtocol)
+	return &AlpnError{Offered: append([]string(nil), offered...)}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEnforceNextProtoSelection(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		for _, test := range []struct {
+			name        string
+			serverProto []string
+			enforce     bool
+			wantProto   string
+			wantErr     bool
+		}{
+			{name: "no overlap", serverProto: []string{"http/1.1"}},
+			{name: "no overlap enforced", serverProto: []string{"http/1.1"}, enforce: true, wantErr: true},
+			{name: "no server ALPN enforced", enforce: true, wantErr: true},
+			{name: "overlap enforced", serverProto: []string{"http/1.1", "h2"}, enforce: true, wantProto: "h2"},
+		} {
+			c, s := localPipe(t)
+			serverConfig := testConfig.Clone()
+			serverConfig.MaxVersion = version
+			serverConfig.NextProtos = test.serverProto
+			done := make(chan error, 1)
+			go func() {
+				defer s.Close()
+				done <- Server(s, serverConfig).Handshake()
+			}()
+
+			// The client requires h2.
+			spec, err := UTLSIdToSpec(HelloChrome_Auto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ext := range spec.Extensions {
+				if alpn, ok := ext.(*ALPNExtension); ok {
+					alpn.AlpnProtocols = []string{"h2"}
+				}
+			}
+			client := UClient(c, &Config{
+				ServerName:                "example.golang",
+				InsecureSkipVerify:        true,
+				EnforceNextProtoSelection: test.enforce,
+			}, HelloCustom)
+			if err := client.ApplyPreset(&spec); err != nil {
+				t.Fatal(err)
+			}
+			err = client.Handshake()
+			c.Close()
+			serverErr := <-done
+
+			if test.wantErr {
+				var alpnErr *AlpnError
+				if !errors.As(err, &alpnErr) {
+					t.Fatalf("%x, %s: got error %v, want an *AlpnError", version, test.name, err)
+				}
+				if !reflect.DeepEqual(alpnErr.Offered, []string{"h2"}) || alpnErr.Selected != "" {
+					t.Errorf("%x, %s: AlpnError offered %q, selected %q", version, test.name, alpnErr.Offered, alpnErr.Selected)
+				}
+				if serverErr == nil {
+					t.Errorf("%x, %s: the server handshake succeeded", version, test.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%x, %s: %v", version, test.name, err)
+			}
+			if v := client.ConnectionState().Version; v != version {
+				t.Errorf("%x, %s: negotiated %x", version, test.name, v)
+			}
+			if proto := client.ConnectionState().NegotiatedProtocol; proto != test.wantProto {
+				t.Errorf("%x, %s: negotiated protocol %q, want %q", version, test.name, proto, test.wantProto)
+			}
+		}
+	}
+}
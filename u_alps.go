@@ -0,0 +1,155 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// typeClientEncryptedExtensions is the handshake message a client sends its
+// application settings in, after the server's Finished, see
+// draft-vvv-tls-alps-01, Section 4.
+const typeClientEncryptedExtensions uint8 = 203
+
+type clientEncryptedExtensionsMsg struct {
+	raw                 []byte
+	alpsCodepoint       uint16
+	applicationSettings []byte
+}
+
+func (m *clientEncryptedExtensionsMsg) marshal() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientEncryptedExtensions)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			if m.alpsCodepoint != 0 {
+				b.AddUint16(m.alpsCodepoint)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.applicationSettings)
+				})
+			}
+		})
+	})
+
+	m.raw = b.BytesOrPanic()
+	return m.raw
+}
+
+func (m *clientEncryptedExtensionsMsg) unmarshal(data []byte) bool {
+	*m = clientEncryptedExtensionsMsg{raw: data}
+	s := cryptobyte.String(data)
+
+	var extensions cryptobyte.String
+	if !s.Skip(4) || // message type and uint24 length field
+		!s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		return false
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) ||
+			!extensions.ReadUint16LengthPrefixed(&extData) {
+			return false
+		}
+		switch extension {
+		case utlsExtensionApplicationSettings, utlsExtensionApplicationSettingsNew:
+			m.alpsCodepoint = extension
+			m.applicationSettings = append([]byte{}, extData...)
+		}
+	}
+
+	return true
+}
+
+// PeerApplicationSettings returns the application settings (ALPS) the server
+// sent for the negotiated ALPN protocol, or nil if ALPS was not negotiated.
+// It is only valid once the handshake has completed.
+func (uconn *UConn) PeerApplicationSettings() []byte {
+	uconn.handshakeMutex.Lock()
+	defer uconn.handshakeMutex.Unlock()
+	return uconn.peerApplicationSettings
+}
+
+// processApplicationSettings checks the application_settings extension of the
+// server's EncryptedExtensions, which is only allowed for the negotiated ALPN
+// protocol, if the client offered ALPS for it with the same codepoint.
+func (hs *clientHandshakeStateTLS13) processApplicationSettings(ee *encryptedExtensionsMsg) error {
+	c := hs.c
+
+	if ee.alpsCodepoint == 0 {
+		return nil
+	}
+	var alps *ApplicationSettingsExtension
+	if hs.uconn != nil {
+		alps = hs.uconn.applicationSettings
+	}
+	if alps == nil || alps.codepoint() != ee.alpsCodepoint || c.clientProtocol == "" ||
+		!alps.supportsProtocol(c.clientProtocol) {
+		c.sendAlert(alertUnsupportedExtension)
+		return errors.New("tls: server sent unrequested application settings")
+	}
+	c.peerApplicationSettings = ee.applicationSettings
+	return nil
+}
+
+// sendClientEncryptedExtensions sends the client's application settings for
+// the negotiated ALPN protocol if the server sent its own.
+func (hs *clientHandshakeStateTLS13) sendClientEncryptedExtensions() error {
+	c := hs.c
+
+	if c.peerApplicationSettings == nil {
+		return nil
+	}
+	alps := hs.uconn.applicationSettings
+	msg := &clientEncryptedExtensionsMsg{
+		alpsCodepoint:       alps.codepoint(),
+		applicationSettings: alps.Settings[c.clientProtocol],
+	}
+	hs.transcript.Write(msg.marshal())
+	if _, err := c.writeRecord(recordTypeHandshake, msg.marshal()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readClientEncryptedExtensions reads the client's application settings if
+// the server sent its own in EncryptedExtensions.
+func (hs *serverHandshakeStateTLS13) readClientEncryptedExtensions() error {
+	c := hs.c
+
+	if !hs.sentApplicationSettings {
+		return nil
+	}
+
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	ee, ok := msg.(*clientEncryptedExtensionsMsg)
+	if !ok {
+		c.sendAlert(alertUnexpectedMessage)
+		return unexpectedMessageError(ee, msg)
+	}
+	if ee.alpsCodepoint != hs.clientHello.alpsCodepoint {
+		c.sendAlert(alertMissingExtension)
+		return errors.New("tls: client did not send application settings")
+	}
+	hs.transcript.Write(ee.marshal())
+
+	c.peerApplicationSettings = ee.applicationSettings
+
+	// The client Finished could not be precomputed in sendServerFinished.
+	if !hs.requestClientCert() {
+		return hs.sendSessionTickets()
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testALPSHandshake performs a handshake between a HelloChrome_113 client,
+// whose application_settings extension is adjusted by configure, and a server
+// negotiating h2 with the given ALPS settings.
+func testALPSHandshake(t *testing.T, configure func(*ApplicationSettingsExtension), serverSettings map[string][]byte) (client *UConn, server *Conn, err error) {
+	c, s := localPipe(t)
+	serverConfig := testConfig.Clone()
+	serverConfig.NextProtos = []string{"h2"}
+	serverConfig.ApplicationSettings = serverSettings
+	server = Server(s, serverConfig)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- server.Handshake()
+	}()
+
+	client = UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloChrome_113)
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range client.Extensions {
+		if alps, ok := ext.(*ApplicationSettingsExtension); ok {
+			configure(alps)
+		}
+	}
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	err = client.Handshake()
+	c.Close()
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	return client, server, err
+}
+
+func TestApplicationSettings(t *testing.T) {
+	serverSettings := []byte{0x00, 0x01, 0x00, 0x00, 0x10, 0x00}
+	clientSettings := []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x64}
+
+	for _, newCodepoint := range []bool{false, true} {
+		client, server, err := testALPSHandshake(t, func(alps *ApplicationSettingsExtension) {
+			alps.Settings = map[string][]byte{"h2": clientSettings}
+			alps.NewCodepoint = newCodepoint
+		}, map[string][]byte{"h2": serverSettings})
+		if err != nil {
+			t.Fatalf("new codepoint %v: %v", newCodepoint, err)
+		}
+		if got := client.PeerApplicationSettings(); !bytes.Equal(got, serverSettings) {
+			t.Errorf("new codepoint %v: client received settings %x, want %x", newCodepoint, got, serverSettings)
+		}
+		if got := server.peerApplicationSettings; !bytes.Equal(got, clientSettings) {
+			t.Errorf("new codepoint %v: server received settings %x, want %x", newCodepoint, got, clientSettings)
+		}
+
+		wantCodepoint := utlsExtensionApplicationSettings
+		if newCodepoint {
+			wantCodepoint = utlsExtensionApplicationSettingsNew
+		}
+		ids := clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw)
+		found := false
+		for _, id := range ids {
+			found = found || id == wantCodepoint
+		}
+		if !found {
+			t.Errorf("new codepoint %v: ClientHello extensions %v lack %d", newCodepoint, ids, wantCodepoint)
+		}
+	}
+}
+
+func TestApplicationSettingsNotNegotiated(t *testing.T) {
+	// ALPS offered for a protocol other than the negotiated one.
+	client, server, err := testALPSHandshake(t, func(alps *ApplicationSettingsExtension) {
+		alps.SupportedProtocols = []string{"http/1.1"}
+	}, map[string][]byte{"h2": {1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.PeerApplicationSettings() != nil || server.peerApplicationSettings != nil {
+		t.Error("application settings exchanged for a protocol the client did not offer them for")
+	}
+
+	// A server without settings for the negotiated protocol.
+	client, _, err = testALPSHandshake(t, func(*ApplicationSettingsExtension) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.PeerApplicationSettings() != nil {
+		t.Error("application settings received from a server without any")
+	}
+}
+
+func TestApplicationSettingsEmpty(t *testing.T) {
+	client, server, err := testALPSHandshake(t, func(*ApplicationSettingsExtension) {}, map[string][]byte{"h2": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.PeerApplicationSettings(); got == nil || len(got) != 0 {
+		t.Errorf("client received settings %#v, want empty non-nil settings", got)
+	}
+	if got := server.peerApplicationSettings; got == nil || len(got) != 0 {
+		t.Errorf("server received settings %#v, want empty non-nil settings", got)
+	}
+}
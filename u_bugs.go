@@ -0,0 +1,42 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto"
+	"errors"
+)
+
+// ProtocolBugs makes a Config misbehave on purpose, to build deliberately
+// vulnerable peers for testing scanners and detection tools. Each of them
+// makes the connections insecure. The zero value has none enabled.
+type ProtocolBugs struct {
+	// RSANonConstantTime makes servers decrypt the pre-master secret of the
+	// RSA key exchange without the countermeasures against Bleichenbacher's
+	// attack (RFC 5246, Section 7.4.7.1): a ClientKeyExchange with invalid
+	// PKCS #1 v1.5 padding or length aborts the handshake right away, with
+	// a handshake_failure alert, and in variable time. Otherwise the
+	// handshake continues with a random pre-master secret, and fails at the
+	// Finished message like one with a wrong key.
+	//
+	// INSECURE: it turns the server into a padding oracle, which lets
+	// attackers decrypt recorded RSA key exchanges and forge signatures with
+	// its key. Only use it in test harnesses.
+	RSANonConstantTime bool
+}
+
+// decryptPreMasterSecretNonConstantTime decrypts an RSA pre-master secret,
+// returning an error if its padding or length is invalid, see
+// ProtocolBugs.RSANonConstantTime.
+func decryptPreMasterSecretNonConstantTime(config *Config, priv crypto.Decrypter, ciphertext []byte) ([]byte, error) {
+	preMasterSecret, err := priv.Decrypt(config.rand(), ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(preMasterSecret) != 48 {
+		return nil, errors.New("tls: invalid pre-master secret length")
+	}
+	return preMasterSecret, nil
+}
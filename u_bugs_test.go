@@ -0,0 +1,44 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestRSANonConstantTime(t *testing.T) {
+	encrypt := func(plaintext []byte) *clientKeyExchangeMsg {
+		ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, &testRSAPrivateKey.PublicKey, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &clientKeyExchangeMsg{ciphertext: append([]byte{byte(len(ciphertext) >> 8), byte(len(ciphertext))}, ciphertext...)}
+	}
+	preMasterSecret := bytes.Repeat([]byte{0x03}, 48)
+	valid := encrypt(preMasterSecret)
+	shortSecret := encrypt(preMasterSecret[:47])
+	badPadding := &clientKeyExchangeMsg{ciphertext: append([]byte{0, 128}, bytes.Repeat([]byte{0x42}, 128)...)}
+
+	for _, bug := range []bool{false, true} {
+		config := &Config{Bugs: ProtocolBugs{RSANonConstantTime: bug}}
+		got, err := rsaKeyAgreement{}.processClientKeyExchange(config, &testConfig.Certificates[0], valid, VersionTLS12)
+		if err != nil || !bytes.Equal(got, preMasterSecret) {
+			t.Errorf("bug %v: valid ClientKeyExchange decrypted to %x, %v", bug, got, err)
+		}
+		for name, ckx := range map[string]*clientKeyExchangeMsg{"short secret": shortSecret, "bad padding": badPadding} {
+			got, err := rsaKeyAgreement{}.processClientKeyExchange(config, &testConfig.Certificates[0], ckx, VersionTLS12)
+			// The error is the oracle an attacker observes.
+			if bug && err == nil {
+				t.Errorf("%s: accepted with RSANonConstantTime", name)
+			}
+			if !bug && (err != nil || len(got) != 48) {
+				t.Errorf("%s: got %x, %v, want a random pre-master secret", name, got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// A CachedInformationType is the type of a CachedObject, see RFC 7924.
+type CachedInformationType uint8
+
+const (
+	CachedInformationCert    CachedInformationType = 1
+	CachedInformationCertReq CachedInformationType = 2
+)
+
+// A CachedObject is an object the client has cached, identified by the hash
+// of its contents, see CachedInfoExtension.
+type CachedObject struct {
+	Type CachedInformationType
+	Hash []byte
+}
+
+// CachedInfoExtension is the cached_info extension, see RFC 7924. It lists the
+// objects the client has cached, so that the server can send the hash of one
+// instead of its contents.
+//
+// Only the certificate chains are supported: a TLS 1.2 server which has one of
+// the CachedInformationCert objects sends its hash instead of the
+// certificates, and the chain of Certificates with that hash is used as if the
+// server had sent it. If there is none, the handshake fails. TLS 1.3 servers
+// ignore the extension.
+type CachedInfoExtension struct {
+	// CachedObjects are the objects offered to the server. The hash of a
+	// CachedInformationCert object is that of a certificate chain, see
+	// CertificateChainHash.
+	CachedObjects []CachedObject
+
+	// Certificates are the cached certificate chains, each the raw ASN.1
+	// certificates of a server, leaf first.
+	Certificates [][][]byte
+}
+
+// NewCachedInfoExtension returns a CachedInfoExtension offering the
+// certificate chains certificates, each the raw ASN.1 certificates of a
+// server, leaf first, such as the Raw fields of
+// ConnectionState.PeerCertificates.
+func NewCachedInfoExtension(certificates ...[][]byte) *CachedInfoExtension {
+	e := &CachedInfoExtension{Certificates: certificates}
+	for _, chain := range certificates {
+		e.CachedObjects = append(e.CachedObjects, CachedObject{CachedInformationCert, CertificateChainHash(chain)})
+	}
+	return e
+}
+
+// CertificateChainHash returns the hash identifying the certificate chain
+// certificates in the cached_info extension: the SHA-256 hash of the
+// certificate_list of the TLS 1.2 Certificate message.
+func CertificateChainHash(certificates [][]byte) []byte {
+	h := sha256.Sum256((&certificateMsg{certificates: certificates}).marshal()[4:])
+	return h[:]
+}
+
+// certificates returns the cached certificate chain with the given hash, or
+// nil if there is none.
+func (e *CachedInfoExtension) certificates(hash []byte) [][]byte {
+	for _, chain := range e.Certificates {
+		if bytes.Equal(CertificateChainHash(chain), hash) {
+			return chain
+		}
+	}
+	return nil
+}
+
+func (e *CachedInfoExtension) writeToUConn(uc *UConn) error {
+	if len(e.CachedObjects) == 0 {
+		return errors.New("tls: CachedInfoExtension without cached objects")
+	}
+	for _, obj := range e.CachedObjects {
+		if len(obj.Hash) == 0 || len(obj.Hash) > 255 {
+			return errors.New("tls: invalid cached object hash length")
+		}
+	}
+	if e.Len() > 0xffff+4 {
+		return errors.New("tls: cached objects list is too long")
+	}
+	uc.cachedInfo = e
+	return nil
+}
+
+func (e *CachedInfoExtension) Len() int {
+	n := 6
+	for _, obj := range e.CachedObjects {
+		n += 2 + len(obj.Hash)
+	}
+	return n
+}
+
+func (e *CachedInfoExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	// https://tools.ietf.org/html/rfc7924#section-3
+	b[0] = byte(utlsExtensionCachedInfo >> 8)
+	b[1] = byte(utlsExtensionCachedInfo)
+	b[2] = byte((e.Len() - 4) >> 8)
+	b[3] = byte(e.Len() - 4)
+	b[4] = byte((e.Len() - 6) >> 8)
+	b[5] = byte(e.Len() - 6)
+	i := 6
+	for _, obj := range e.CachedObjects {
+		b[i] = byte(obj.Type)
+		b[i+1] = byte(len(obj.Hash))
+		copy(b[i+2:], obj.Hash)
+		i += 2 + len(obj.Hash)
+	}
+	return e.Len(), io.EOF
+}
+
+// cachedCertificateMsg is the Certificate message of a TLS 1.2 server which
+// sends the hash of a certificate chain the client has cached, see RFC 7924,
+// Section 4.1.
+type cachedCertificateMsg struct {
+	raw  []byte
+	hash []byte
+}
+
+func (m *cachedCertificateMsg) marshal() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeCertificate)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.hash)
+		})
+	})
+
+	m.raw = b.BytesOrPanic()
+	return m.raw
+}
+
+func (m *cachedCertificateMsg) unmarshal(data []byte) bool {
+	m.raw = data
+	s := cryptobyte.String(data[4:])
+	return readUint8LengthPrefixed(&s, &m.hash) && len(m.hash) > 0 && s.Empty()
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCachedInfoExtension(t *testing.T) {
+	ext := &CachedInfoExtension{CachedObjects: []CachedObject{
+		{CachedInformationCert, []byte{1, 2, 3}},
+		{CachedInformationCertReq, []byte{4}},
+	}}
+	b := make([]byte, ext.Len())
+	if _, err := ext.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	want := []byte{0x00, 0x19, 0x00, 0x0a, 0x00, 0x08, 0x01, 0x03, 0x01, 0x02, 0x03, 0x02, 0x01, 0x04}
+	if !bytes.Equal(b, want) {
+		t.Errorf("extension = %x, want %x", b, want)
+	}
+
+	chain := testConfig.Certificates[0].Certificate
+	other := [][]byte{testConfig.Certificates[1].Certificate[0]}
+	for _, test := range []struct {
+		name       string
+		ext        *CachedInfoExtension
+		wantCached bool
+		wantErr    string
+	}{
+		{name: "cached", ext: NewCachedInfoExtension(other, chain), wantCached: true},
+		{name: "not cached by the server", ext: NewCachedInfoExtension(other)},
+		{
+			name:    "not cached by the client",
+			ext:     &CachedInfoExtension{CachedObjects: NewCachedInfoExtension(chain).CachedObjects},
+			wantErr: "not cached",
+		},
+	} {
+		c, s := localPipe(t)
+		serverConfig := testConfig.Clone()
+		serverConfig.MaxVersion = VersionTLS12
+		go func() {
+			defer s.Close()
+			Server(s, serverConfig).Handshake()
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			TLSVersMax:         VersionTLS12,
+			TLSVersMin:         VersionTLS12,
+			CipherSuites:       []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			CompressionMethods: []byte{compressionNone},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{Curves: []CurveID{X25519}},
+				&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PSSWithSHA256, PKCS1WithSHA256}},
+				test.ext,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		err := client.Handshake()
+		c.Close()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if client.cachedCertificates != test.wantCached {
+			t.Errorf("%s: server sent the hash of its chain: %v, want %v", test.name, client.cachedCertificates, test.wantCached)
+		}
+		peer := client.ConnectionState().PeerCertificates
+		if len(peer) != len(chain) || !bytes.Equal(peer[0].Raw, chain[0]) {
+			t.Errorf("%s: the server certificates are not the cached chain", test.name)
+		}
+	}
+}
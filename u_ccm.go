@@ -0,0 +1,224 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ccm implements the CCM mode of NIST SP 800-38C and RFC 3610, which
+// crypto/cipher does not provide, for a 128-bit block cipher.
+type ccm struct {
+	block     cipher.Block
+	tagSize   int
+	nonceSize int
+}
+
+var errCCMOpen = errors.New("tls: CCM message authentication failed")
+
+// newCCM returns block in CCM mode with the given tag and nonce sizes. The
+// tag size is an even number from 4 to 16, and the nonce size is 7 to 13,
+// which leaves 15 - nonceSize bytes to encode the length of the messages.
+func newCCM(block cipher.Block, tagSize, nonceSize int) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 {
+		return nil, errors.New("tls: CCM requires a 128-bit block cipher")
+	}
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, errors.New("tls: invalid CCM tag size")
+	}
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, errors.New("tls: invalid CCM nonce size")
+	}
+	return &ccm{block: block, tagSize: tagSize, nonceSize: nonceSize}, nil
+}
+
+func (c *ccm) NonceSize() int { return c.nonceSize }
+func (c *ccm) Overhead() int  { return c.tagSize }
+
+// maxLength returns the length of the longest message whose length can be
+// encoded in the counter blocks.
+func (c *ccm) maxLength() uint64 {
+	l := 15 - c.nonceSize
+	if l >= 8 {
+		return 1<<64 - 1
+	}
+	return 1<<(8*uint(l)) - 1
+}
+
+// counterBlock returns the counter block A_0, whose encryption masks the tag.
+// The following counter blocks, which encrypt the message, are obtained by
+// incrementing it.
+func (c *ccm) counterBlock(nonce []byte) []byte {
+	a := make([]byte, 16)
+	a[0] = byte(15 - c.nonceSize - 1)
+	copy(a[1:], nonce)
+	return a
+}
+
+// mac returns the CBC-MAC of the B_0 block for nonce and plaintext, of the
+// encoded additionalData and of plaintext.
+func (c *ccm) mac(nonce, plaintext, additionalData []byte) []byte {
+	var b [16]byte
+	l := 15 - c.nonceSize
+	b[0] = byte((c.tagSize-2)/2<<3 | (l - 1))
+	if len(additionalData) > 0 {
+		b[0] |= 1 << 6
+	}
+	copy(b[1:], nonce)
+	n := uint64(len(plaintext))
+	for i := 15; i > c.nonceSize; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+
+	mac := make([]byte, 16)
+	c.block.Encrypt(mac, b[:])
+	update := func(data []byte) {
+		for len(data) > 0 {
+			n := subtle.XORBytes(mac, mac, data)
+			c.block.Encrypt(mac, mac)
+			data = data[n:]
+		}
+	}
+
+	if len(additionalData) > 0 {
+		var header []byte
+		switch {
+		case len(additionalData) < 1<<16-1<<8:
+			header = binary.BigEndian.AppendUint16(nil, uint16(len(additionalData)))
+		case uint64(len(additionalData)) <= 1<<32-1:
+			header = binary.BigEndian.AppendUint32([]byte{0xff, 0xfe}, uint32(len(additionalData)))
+		default:
+			header = binary.BigEndian.AppendUint64([]byte{0xff, 0xff}, uint64(len(additionalData)))
+		}
+		// The encoded length and the additional data are padded together
+		// to a multiple of the block size.
+		update(padToBlock(append(header, additionalData...)))
+	}
+	update(padToBlock(plaintext))
+	return mac
+}
+
+// padToBlock returns data padded with zeros to a multiple of 16 bytes.
+func padToBlock(data []byte) []byte {
+	if len(data)%16 == 0 {
+		return data
+	}
+	padded := make([]byte, len(data)+16-len(data)%16)
+	copy(padded, data)
+	return padded
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("tls: incorrect nonce length given to CCM")
+	}
+	if uint64(len(plaintext)) > c.maxLength() {
+		panic("tls: message too large for CCM")
+	}
+	ret, out := sliceForAppend(dst, len(plaintext)+c.tagSize)
+
+	tag := c.mac(nonce, plaintext, additionalData)
+	a := c.counterBlock(nonce)
+	s0 := make([]byte, 16)
+	c.block.Encrypt(s0, a)
+	a[15] = 1
+	cipher.NewCTR(c.block, a).XORKeyStream(out, plaintext)
+	subtle.XORBytes(out[len(plaintext):], tag[:c.tagSize], s0)
+	return ret
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		panic("tls: incorrect nonce length given to CCM")
+	}
+	if len(ciphertext) < c.tagSize || uint64(len(ciphertext)-c.tagSize) > c.maxLength() {
+		return nil, errCCMOpen
+	}
+	tag := ciphertext[len(ciphertext)-c.tagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-c.tagSize]
+	ret, out := sliceForAppend(dst, len(ciphertext))
+
+	a := c.counterBlock(nonce)
+	s0 := make([]byte, 16)
+	c.block.Encrypt(s0, a)
+	a[15] = 1
+	cipher.NewCTR(c.block, a).XORKeyStream(out, ciphertext)
+
+	expected := c.mac(nonce, out, additionalData)
+	subtle.XORBytes(expected, expected, s0)
+	if subtle.ConstantTimeCompare(expected[:c.tagSize], tag) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errCCMOpen
+	}
+	return ret, nil
+}
+
+// aeadAESCCM returns the AES-CCM AEAD of the TLS 1.2 cipher suites of RFC
+// 6655 and RFC 7251, with a 16-byte tag. Like with AES-GCM, the nonce is the
+// 4-byte fixed part derived from the master secret followed by the 8-byte
+// explicit part sent in each record.
+func aeadAESCCM(key, noncePrefix []byte) aead {
+	return aeadAESCCMWithTagSize(key, noncePrefix, 16)
+}
+
+// aeadAESCCM8 is aeadAESCCM with an 8-byte tag.
+func aeadAESCCM8(key, noncePrefix []byte) aead {
+	return aeadAESCCMWithTagSize(key, noncePrefix, 8)
+}
+
+func aeadAESCCMWithTagSize(key, noncePrefix []byte, tagSize int) aead {
+	if len(noncePrefix) != noncePrefixLength {
+		panic("tls: internal error: wrong nonce length")
+	}
+	aes, err := aesNewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := newCCM(aes, tagSize, aeadNonceLength)
+	if err != nil {
+		panic(err)
+	}
+
+	ret := &prefixNonceAEAD{aead: aead}
+	copy(ret.nonce[:], noncePrefix)
+	return ret
+}
+
+// aeadAESCCMTLS13 returns the AES-CCM AEAD of the TLS_AES_128_CCM_SHA256
+// TLS 1.3 cipher suite, whose nonce is the record sequence number XORed with
+// nonceMask.
+func aeadAESCCMTLS13(key, nonceMask []byte) aead {
+	return aeadAESCCMTLS13WithTagSize(key, nonceMask, 16)
+}
+
+// aeadAESCCM8TLS13 is aeadAESCCMTLS13 with an 8-byte tag, for
+// TLS_AES_128_CCM_8_SHA256.
+func aeadAESCCM8TLS13(key, nonceMask []byte) aead {
+	return aeadAESCCMTLS13WithTagSize(key, nonceMask, 8)
+}
+
+func aeadAESCCMTLS13WithTagSize(key, nonceMask []byte, tagSize int) aead {
+	if len(nonceMask) != aeadNonceLength {
+		panic("tls: internal error: wrong nonce length")
+	}
+	aes, err := aesNewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := newCCM(aes, tagSize, aeadNonceLength)
+	if err != nil {
+		panic(err)
+	}
+
+	ret := &xorNonceAEAD{aead: aead}
+	copy(ret.nonceMask[:], nonceMask)
+	return ret
+}
@@ -0,0 +1,241 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCCMVectors(t *testing.T) {
+	for _, test := range []struct {
+		name                      string
+		key, nonce, ad, plaintext string
+		tagSize                   int
+		ciphertext                string
+	}{
+		{
+			// NIST SP 800-38C, Appendix C.1.
+			"SP 800-38C C.1",
+			"404142434445464748494a4b4c4d4e4f", "10111213141516", "0001020304050607", "20212223",
+			4, "7162015b4dac255d",
+		},
+		{
+			// NIST SP 800-38C, Appendix C.2.
+			"SP 800-38C C.2",
+			"404142434445464748494a4b4c4d4e4f", "1011121314151617", "000102030405060708090a0b0c0d0e0f",
+			"202122232425262728292a2b2c2d2e2f",
+			6, "d2a1f0e051ea5f62081a7792073d593d1fc64fbfaccd",
+		},
+		{
+			// RFC 3610, Packet Vector #1.
+			"RFC 3610 #1",
+			"c0c1c2c3c4c5c6c7c8c9cacbcccdcecf", "00000003020100a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+			8, "588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0",
+		},
+	} {
+		block, err := aes.NewCipher(decodeHex(t, test.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := newCCM(block, test.tagSize, len(decodeHex(t, test.nonce)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, ad, plaintext := decodeHex(t, test.nonce), decodeHex(t, test.ad), decodeHex(t, test.plaintext)
+		ciphertext := aead.Seal([]byte{0xff}, nonce, plaintext, ad)
+		if want := append([]byte{0xff}, decodeHex(t, test.ciphertext)...); !bytes.Equal(ciphertext, want) {
+			t.Errorf("%s: Seal = %x, want %x", test.name, ciphertext, want)
+			continue
+		}
+		opened, err := aead.Open(nil, nonce, ciphertext[1:], ad)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("%s: Open = %x, %v", test.name, opened, err)
+		}
+		ciphertext[len(ciphertext)-1] ^= 1
+		if _, err := aead.Open(nil, nonce, ciphertext[1:], ad); err == nil {
+			t.Errorf("%s: Open accepted a modified tag", test.name)
+		}
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCCMAEADs(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	fixedNonce := bytes.Repeat([]byte{0x24}, aeadNonceLength)
+	for _, test := range []struct {
+		name     string
+		aead     aead
+		overhead int
+	}{
+		{"AES-CCM", aeadAESCCM(key, fixedNonce[:noncePrefixLength]), 16},
+		{"AES-CCM-8", aeadAESCCM8(key, fixedNonce[:noncePrefixLength]), 8},
+		{"TLS 1.3 AES-CCM", aeadAESCCMTLS13(key, fixedNonce), 16},
+		{"TLS 1.3 AES-CCM-8", aeadAESCCM8TLS13(key, fixedNonce), 8},
+	} {
+		if test.aead.Overhead() != test.overhead {
+			t.Errorf("%s: overhead is %d, want %d", test.name, test.aead.Overhead(), test.overhead)
+		}
+		seq := []byte{0, 0, 0, 0, 0, 0, 0, 7}
+		ad := []byte("additional data")
+		for _, n := range []int{0, 1, 16, 1000} {
+			plaintext := bytes.Repeat([]byte{byte(n)}, n)
+			ciphertext := test.aead.Seal(nil, seq, plaintext, ad)
+			if len(ciphertext) != n+test.overhead {
+				t.Errorf("%s: sealed %d bytes into %d", test.name, n, len(ciphertext))
+			}
+			opened, err := test.aead.Open(nil, seq, ciphertext, ad)
+			if err != nil || !bytes.Equal(opened, plaintext) {
+				t.Errorf("%s: Open of %d bytes = %x, %v", test.name, n, opened, err)
+			}
+			if _, err := test.aead.Open(nil, []byte{0, 0, 0, 0, 0, 0, 0, 8}, ciphertext, ad); err == nil {
+				t.Errorf("%s: Open accepted the wrong sequence number", test.name)
+			}
+		}
+	}
+}
+
+// ccmTestCertificate returns a self-signed ECDSA P-256 certificate for
+// iot.example.com, as the CCM suites require.
+func ccmTestCertificate(t *testing.T) Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "iot.example.com"},
+		DNSNames:     []string{"iot.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCCMCipherSuites(t *testing.T) {
+	cert := ccmTestCertificate(t)
+	for _, suite := range []uint16{
+		TLS_ECDHE_ECDSA_WITH_AES_128_CCM,
+		TLS_ECDHE_ECDSA_WITH_AES_256_CCM,
+		TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+		TLS_ECDHE_ECDSA_WITH_AES_256_CCM_8,
+	} {
+		c, s := localPipe(t)
+		go func() {
+			defer s.Close()
+			server := Server(s, &Config{
+				Certificates: []Certificate{cert},
+				CipherSuites: []uint16{suite},
+				MaxVersion:   VersionTLS12,
+			})
+			io.Copy(server, server)
+		}()
+
+		client := UClient(c, &Config{ServerName: "iot.example.com", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			TLSVersMax:         VersionTLS12,
+			TLSVersMin:         VersionTLS12,
+			CipherSuites:       []uint16{suite},
+			CompressionMethods: []byte{compressionNone},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{Curves: []CurveID{CurveP256}},
+				&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256}},
+				&UtlsExtendedMasterSecretExtension{},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%#04x: %v", suite, err)
+		}
+		if got := client.ConnectionState().CipherSuite; got != suite {
+			t.Errorf("negotiated %#04x, want %#04x", got, suite)
+		}
+		msg := bytes.Repeat([]byte("ccm"), 1000)
+		if _, err := client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		echo := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, echo); err != nil || !bytes.Equal(echo, msg) {
+			t.Errorf("%#04x: echo failed: %v", suite, err)
+		}
+		client.Close()
+	}
+}
+
+func TestCCMCipherSuitesTLS13(t *testing.T) {
+	// The TLS 1.3 cipher suites of a server are not configurable, so make
+	// the CCM ones the only choice while the test runs.
+	once.Do(initDefaultCipherSuites)
+	defaultSuites := varDefaultCipherSuitesTLS13
+	defer func() { varDefaultCipherSuitesTLS13 = defaultSuites }()
+	varDefaultCipherSuitesTLS13 = []uint16{TLS_AES_128_CCM_SHA256, TLS_AES_128_CCM_8_SHA256}
+
+	cert := ccmTestCertificate(t)
+	for _, suite := range []uint16{TLS_AES_128_CCM_SHA256, TLS_AES_128_CCM_8_SHA256} {
+		c, s := localPipe(t)
+		go func() {
+			defer s.Close()
+			server := Server(s, &Config{Certificates: []Certificate{cert}})
+			io.Copy(server, server)
+		}()
+
+		client := UClient(c, &Config{ServerName: "iot.example.com", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			CipherSuites:       []uint16{suite},
+			CompressionMethods: []byte{compressionNone},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{Curves: []CurveID{X25519}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256}},
+				&KeyShareExtension{KeyShares: []KeyShare{{Group: X25519}}},
+				&SupportedVersionsExtension{Versions: []uint16{VersionTLS13}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%#04x: %v", suite, err)
+		}
+		if state := client.ConnectionState(); state.Version != VersionTLS13 || state.CipherSuite != suite {
+			t.Errorf("negotiated %#04x over %#04x, want %#04x over TLS 1.3", state.CipherSuite, state.Version, suite)
+		}
+		msg := bytes.Repeat([]byte("ccm"), 1000)
+		if _, err := client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		echo := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, echo); err != nil || !bytes.Equal(echo, msg) {
+			t.Errorf("%#04x: echo failed: %v", suite, err)
+		}
+		client.Close()
+	}
+}
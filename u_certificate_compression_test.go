@@ -0,0 +1,245 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// brotliStored encodes data as a brotli stream of uncompressed meta-blocks,
+// since the brotli package only implements decompression.
+func brotliStored(data []byte) []byte {
+	var out []byte
+	var acc uint32
+	var nbits uint
+	writeBits := func(v uint32, n uint) {
+		acc |= v << nbits
+		for nbits += n; nbits >= 8; nbits -= 8 {
+			out = append(out, byte(acc))
+			acc >>= 8
+		}
+	}
+	flush := func() {
+		if nbits > 0 {
+			writeBits(0, 8-nbits)
+		}
+	}
+
+	writeBits(0, 1) // WBITS = 16
+	for len(data) > 0 {
+		n := len(data)
+		if n > 1<<16 {
+			n = 1 << 16
+		}
+		writeBits(0, 1)            // ISLAST
+		writeBits(0, 2)            // MNIBBLES = 4
+		writeBits(uint32(n-1), 16) // MLEN - 1
+		writeBits(1, 1)            // ISUNCOMPRESSED
+		flush()
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	writeBits(1, 1) // ISLAST
+	writeBits(1, 1) // ISLASTEMPTY
+	flush()
+	return out
+}
+
+func zlibCompress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func zstdCompress(data []byte) ([]byte, error) {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	return w.EncodeAll(data, nil), nil
+}
+
+func TestCertificateCompressionHandshake(t *testing.T) {
+	compressors := map[CertCompressionAlgo]func([]byte) ([]byte, error){
+		CertCompressionZlib:   zlibCompress,
+		CertCompressionBrotli: func(b []byte) ([]byte, error) { return brotliStored(b), nil },
+		CertCompressionZstd:   zstdCompress,
+	}
+	for alg, compress := range compressors {
+		c, s := localPipe(t)
+		var used bool
+		serverConfig := testConfig.Clone()
+		serverConfig.CertificateCompressors = map[CertCompressionAlgo]func([]byte) ([]byte, error){
+			alg: func(b []byte) ([]byte, error) {
+				used = true
+				return compress(b)
+			},
+		}
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- Server(s, serverConfig).Handshake()
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{X25519}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+				}},
+				&KeyShareExtension{[]KeyShare{{Group: X25519}}},
+				&SupportedVersionsExtension{[]uint16{VersionTLS13, VersionTLS12}},
+				&UtlsCompressCertExtension{[]CertCompressionAlgo{
+					CertCompressionZlib, CertCompressionBrotli, CertCompressionZstd,
+				}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("algorithm %d: client: %v", alg, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("algorithm %d: server: %v", alg, err)
+		}
+		c.Close()
+
+		if !used {
+			t.Errorf("algorithm %d: server did not compress the certificate", alg)
+		}
+		state := client.ConnectionState()
+		peer := state.PeerCertificates
+		if len(peer) == 0 || !bytes.Equal(peer[0].Raw, testConfig.Certificates[0].Certificate[0]) {
+			t.Errorf("algorithm %d: client did not receive the server certificate", alg)
+		}
+		if state.CertCompressionAlgorithm != alg {
+			t.Errorf("algorithm %d: CertCompressionAlgorithm is %d", alg, state.CertCompressionAlgorithm)
+		}
+	}
+}
+
+func TestCompressedCertificateLimits(t *testing.T) {
+	certMsg := &certificateMsgTLS13{certificate: testConfig.Certificates[0]}
+	body := certMsg.marshal()[4:]
+	compressed, err := zlibCompress(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m compressedCertificateMsg
+	if !m.unmarshal((&compressedCertificateMsg{
+		algorithm:                    CertCompressionZlib,
+		uncompressedLength:           uint32(len(body)),
+		compressedCertificateMessage: compressed,
+	}).marshal()) {
+		t.Fatal("failed to unmarshal a marshaled compressedCertificateMsg")
+	}
+	if _, err := m.toCertificateMsg(); err != nil {
+		t.Fatalf("valid compressed certificate: %v", err)
+	}
+
+	bomb, err := zlibCompress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		length uint32
+		data   []byte
+	}{
+		{"oversized length", maxDecompressedCertificateLength + 1, bomb},
+		{"longer than advertised", uint32(len(body) - 1), compressed},
+		{"shorter than advertised", uint32(len(body) + 1), compressed},
+		{"bomb", maxDecompressedCertificateLength, bomb},
+	} {
+		m := &compressedCertificateMsg{
+			algorithm:                    CertCompressionZlib,
+			uncompressedLength:           test.length,
+			compressedCertificateMessage: test.data,
+		}
+		if _, err := m.toCertificateMsg(); err == nil {
+			t.Errorf("%s: decompression succeeded", test.name)
+		}
+	}
+}
+
+func TestCertificateCompressionParrots(t *testing.T) {
+	compressors := map[CertCompressionAlgo]func([]byte) ([]byte, error){
+		CertCompressionBrotli: func(b []byte) ([]byte, error) { return brotliStored(b), nil },
+		CertCompressionZstd:   zstdCompress,
+	}
+	for _, test := range []struct {
+		helloID ClientHelloID
+		alg     CertCompressionAlgo
+	}{
+		{HelloChrome_Auto, CertCompressionBrotli},
+		{HelloFirefox_128, CertCompressionBrotli},
+		{HelloFirefox_128, CertCompressionZstd},
+	} {
+		c, s := localPipe(t)
+		var used bool
+		serverConfig := testConfig.Clone()
+		serverConfig.CertificateCompressors = map[CertCompressionAlgo]func([]byte) ([]byte, error){
+			test.alg: func(b []byte) ([]byte, error) {
+				used = true
+				return compressors[test.alg](b)
+			},
+		}
+		done := make(chan error, 1)
+		var serverAlg CertCompressionAlgo
+		go func() {
+			defer s.Close()
+			server := Server(s, serverConfig)
+			err := server.Handshake()
+			serverAlg = server.ConnectionState().CertCompressionAlgorithm
+			done <- err
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, test.helloID)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%v, algorithm %d: client: %v", test.helloID, test.alg, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%v, algorithm %d: server: %v", test.helloID, test.alg, err)
+		}
+		c.Close()
+		if !used {
+			t.Errorf("%v: server did not compress the certificate with algorithm %d", test.helloID, test.alg)
+		}
+		if got := client.ConnectionState().CertCompressionAlgorithm; got != test.alg || serverAlg != test.alg {
+			t.Errorf("%v: CertCompressionAlgorithm is %d on the client and %d on the server, want %d",
+				test.helloID, got, serverAlg, test.alg)
+		}
+	}
+
+	// Without a compressor on the server, the certificate is not compressed.
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		Server(s, testConfig).Handshake()
+	}()
+	client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloChrome_Auto)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := client.ConnectionState().CertCompressionAlgorithm; got != 0 {
+		t.Errorf("CertCompressionAlgorithm is %d for an uncompressed certificate", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+)
+
+// A CertificatePolicy restricts the server certificate chains a client
+// accepts, see Config.CertificatePolicy. The zero value accepts any chain.
+type CertificatePolicy struct {
+	// SignatureAlgorithms, if not empty, lists the signature algorithms
+	// allowed on the certificates of the chain, for example to reject
+	// SHA-1. The signature of a self-signed root is not checked, as roots
+	// are trusted by configuration rather than by their signature.
+	SignatureAlgorithms []x509.SignatureAlgorithm
+
+	// MinRSAKeySize, if not zero, is the smallest RSA modulus, in bits,
+	// allowed for the public keys of the chain, roots included.
+	MinRSAKeySize int
+}
+
+// verifyChains returns the chains among verifiedChains that comply with the
+// policy, or an error if there are none. If verification was skipped, and
+// verifiedChains is empty, the policy is checked against the certificates
+// presented by the server instead.
+func (p *CertificatePolicy) verifyChains(certs []*x509.Certificate, verifiedChains [][]*x509.Certificate) ([][]*x509.Certificate, error) {
+	if len(verifiedChains) == 0 {
+		return nil, p.check(certs, false)
+	}
+
+	var compliant [][]*x509.Certificate
+	var firstErr error
+	for _, chain := range verifiedChains {
+		if err := p.check(chain, true); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		compliant = append(compliant, chain)
+	}
+	if len(compliant) == 0 {
+		return nil, firstErr
+	}
+	return compliant, nil
+}
+
+// check applies the policy to chain, leaf first. If endsWithRoot is true the
+// last certificate is the trust anchor of a verified chain, otherwise only a
+// self-signed certificate is treated as a root.
+func (p *CertificatePolicy) check(chain []*x509.Certificate, endsWithRoot bool) error {
+	for i, cert := range chain {
+		if rsaKey, ok := cert.PublicKey.(*rsa.PublicKey); ok && p.MinRSAKeySize != 0 &&
+			rsaKey.N.BitLen() < p.MinRSAKeySize {
+			return fmt.Errorf("tls: certificate %q has a %d-bit RSA key, the policy requires at least %d bits",
+				cert.Subject, rsaKey.N.BitLen(), p.MinRSAKeySize)
+		}
+
+		isRoot := i == len(chain)-1 && (endsWithRoot || bytes.Equal(cert.RawIssuer, cert.RawSubject))
+		if isRoot || len(p.SignatureAlgorithms) == 0 {
+			continue
+		}
+		allowed := false
+		for _, alg := range p.SignatureAlgorithms {
+			if cert.SignatureAlgorithm == alg {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("tls: certificate %q is signed with %v, which the policy does not allow",
+				cert.Subject, cert.SignatureAlgorithm)
+		}
+	}
+	return nil
+}
+
+// certSignatureSchemesPolicy returns the policy allowing the certificate
+// signature algorithms of schemes, offered in signature_algorithms_cert.
+func certSignatureSchemesPolicy(schemes []SignatureScheme) *CertificatePolicy {
+	// An algorithm no certificate is signed with, so that schemes without
+	// an x509 equivalent do not leave the list empty, allowing anything.
+	p := &CertificatePolicy{SignatureAlgorithms: []x509.SignatureAlgorithm{-1}}
+	for _, scheme := range schemes {
+		switch scheme {
+		case PKCS1WithSHA1:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.SHA1WithRSA)
+		case PKCS1WithSHA256:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.SHA256WithRSA)
+		case PKCS1WithSHA384:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.SHA384WithRSA)
+		case PKCS1WithSHA512:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.SHA512WithRSA)
+		case PSSWithSHA256:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.SHA256WithRSAPSS)
+		case PSSWithSHA384:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.SHA384WithRSAPSS)
+		case PSSWithSHA512:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.SHA512WithRSAPSS)
+		case ECDSAWithSHA1:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.ECDSAWithSHA1)
+		case ECDSAWithP256AndSHA256:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.ECDSAWithSHA256)
+		case ECDSAWithP384AndSHA384:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.ECDSAWithSHA384)
+		case ECDSAWithP521AndSHA512:
+			p.SignatureAlgorithms = append(p.SignatureAlgorithms, x509.ECDSAWithSHA512)
+		}
+	}
+	return p
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// policyTestChain returns a root, intermediate and leaf certificate for
+// policy.example.com. The intermediate is signed with intermediateAlg and the
+// leaf has a leafBits RSA key.
+func policyTestChain(t *testing.T, intermediateAlg x509.SignatureAlgorithm, leafBits int) (Certificate, *x509.CertPool) {
+	newCert := func(serial int64, name string, isCA bool, bits int, alg x509.SignatureAlgorithm, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			SignatureAlgorithm:    alg,
+			BasicConstraintsValid: true,
+			IsCA:                  isCA,
+		}
+		if isCA {
+			template.KeyUsage = x509.KeyUsageCertSign
+		} else {
+			template.DNSNames = []string{name}
+			template.KeyUsage = x509.KeyUsageDigitalSignature
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+
+	root, rootKey := newCert(1, "Policy Root", true, 2048, x509.SHA256WithRSA, nil, nil)
+	intermediate, intermediateKey := newCert(2, "Policy Intermediate", true, 2048, intermediateAlg, root, rootKey)
+	leaf, leafKey := newCert(3, "policy.example.com", false, leafBits, x509.SHA256WithRSA, intermediate, intermediateKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	return Certificate{Certificate: [][]byte{leaf.Raw, intermediate.Raw}, PrivateKey: leafKey}, pool
+}
+
+func testCertificatePolicyHandshake(t *testing.T, cert Certificate, clientConfig *Config) error {
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		Server(s, &Config{Certificates: []Certificate{cert}}).Handshake()
+	}()
+	clientConfig.ServerName = "policy.example.com"
+	err := Client(c, clientConfig).Handshake()
+	c.Close()
+	return err
+}
+
+func TestCertificatePolicy(t *testing.T) {
+	policy := &CertificatePolicy{
+		SignatureAlgorithms: []x509.SignatureAlgorithm{x509.SHA256WithRSA, x509.ECDSAWithSHA256},
+		MinRSAKeySize:       2048,
+	}
+
+	cert, roots := policyTestChain(t, x509.SHA256WithRSA, 2048)
+	if err := testCertificatePolicyHandshake(t, cert, &Config{RootCAs: roots, CertificatePolicy: policy}); err != nil {
+		t.Errorf("RSA-2048 SHA-256 chain: %v", err)
+	}
+
+	// crypto/x509 itself rejects SHA-1 signatures, so check the policy against
+	// the presented chain with normal verification disabled.
+	cert, _ = policyTestChain(t, x509.SHA1WithRSA, 2048)
+	if err := testCertificatePolicyHandshake(t, cert, &Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("SHA-1 intermediate without a policy: %v", err)
+	}
+	err := testCertificatePolicyHandshake(t, cert, &Config{InsecureSkipVerify: true, CertificatePolicy: policy})
+	if err == nil || !strings.Contains(err.Error(), "Policy Intermediate") {
+		t.Errorf("SHA-1 intermediate: got error %v, want one naming the intermediate", err)
+	}
+
+	cert, roots = policyTestChain(t, x509.SHA256WithRSA, 1024)
+	err = testCertificatePolicyHandshake(t, cert, &Config{RootCAs: roots, CertificatePolicy: policy})
+	if err == nil || !strings.Contains(err.Error(), "1024-bit") {
+		t.Errorf("RSA-1024 leaf: got error %v, want one about the key size", err)
+	}
+}
+
+func TestSignatureAlgorithmsCertExtension(t *testing.T) {
+	ext := &SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: []SignatureScheme{PKCS1WithSHA256, ECDSAWithP256AndSHA256}}
+	b := make([]byte, ext.Len())
+	if _, err := ext.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	if want := []byte{0x00, 0x32, 0x00, 0x06, 0x00, 0x04, 0x04, 0x01, 0x04, 0x03}; !bytes.Equal(b, want) {
+		t.Errorf("extension = %x, want %x", b, want)
+	}
+
+	handshake := func(cert Certificate, roots *x509.CertPool, schemes ...SignatureScheme) error {
+		c, s := localPipe(t)
+		go func() {
+			defer s.Close()
+			Server(s, &Config{Certificates: []Certificate{cert}}).Handshake()
+		}()
+		defer c.Close()
+		client := UClient(c, &Config{ServerName: "policy.example.com", RootCAs: roots}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			TLSVersMax:         VersionTLS12,
+			TLSVersMin:         VersionTLS12,
+			CipherSuites:       []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			CompressionMethods: []byte{compressionNone},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{Curves: []CurveID{X25519}},
+				&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PSSWithSHA256, PKCS1WithSHA256}},
+				&SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: schemes},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return client.Handshake()
+	}
+
+	cert, roots := policyTestChain(t, x509.SHA384WithRSA, 2048)
+	if err := handshake(cert, roots, PKCS1WithSHA256, PKCS1WithSHA384); err != nil {
+		t.Errorf("advertised chain: %v", err)
+	}
+	err := handshake(cert, roots, PKCS1WithSHA256, ECDSAWithP256AndSHA256)
+	if err == nil || !strings.Contains(err.Error(), "Policy Intermediate") {
+		t.Errorf("SHA-384 intermediate: got error %v, want one naming the intermediate", err)
+	}
+}
+
+func TestOnRawCertificates(t *testing.T) {
+	cert, roots := policyTestChain(t, x509.SHA256WithRSA, 2048)
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		for _, trusted := range []bool{false, true} {
+			c, s := localPipe(t)
+			go func() {
+				defer s.Close()
+				Server(s, &Config{Certificates: []Certificate{cert}, MaxVersion: vers}).Handshake()
+			}()
+
+			var received [][]byte
+			config := &Config{
+				ServerName: "policy.example.com",
+				OnRawCertificates: func(rawCerts [][]byte) {
+					received = rawCerts
+				},
+			}
+			if trusted {
+				config.RootCAs = roots
+			}
+			client := UClient(c, config, HelloChrome_Auto)
+			err := client.Handshake()
+			c.Close()
+			if trusted != (err == nil) {
+				t.Errorf("version %x, trusted %v: handshake error %v", vers, trusted, err)
+			}
+			if len(received) != len(cert.Certificate) {
+				t.Fatalf("version %x, trusted %v: OnRawCertificates got %d certificates, want %d",
+					vers, trusted, len(received), len(cert.Certificate))
+			}
+			for i := range received {
+				if !bytes.Equal(received[i], cert.Certificate[i]) {
+					t.Errorf("version %x, trusted %v: certificate %d differs from the one sent", vers, trusted, i)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,610 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// errSpecApplied is returned when mutating a ClientHelloSpec that was already
+// passed to ApplyPreset: its extensions are shared with the UConn and hold
+// state generated for it, such as key shares, which would no longer match.
+var errSpecApplied = errors.New("tls: ClientHelloSpec was already applied, mutate a fresh one from UTLSIdToSpec instead")
+
+// UTLSIdToSpec returns a new ClientHelloSpec for the preset id, which may be
+// mutated and applied with ApplyPreset.
+func UTLSIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
+	return utlsIdToSpec(id)
+}
+
+// InsertExtension inserts ext before the extension at index, or appends it if
+// index is len(spec.Extensions).
+func (spec *ClientHelloSpec) InsertExtension(index int, ext TLSExtension) error {
+	if spec.applied {
+		return errSpecApplied
+	}
+	if index < 0 || index > len(spec.Extensions) {
+		return fmt.Errorf("tls: extension index %d out of range [0, %d]", index, len(spec.Extensions))
+	}
+	spec.Extensions = append(spec.Extensions, nil)
+	copy(spec.Extensions[index+1:], spec.Extensions[index:])
+	spec.Extensions[index] = ext
+	return nil
+}
+
+// RemoveExtensionByType removes the first extension of type extType, and
+// reports whether there was one. GREASE extensions are removed by passing
+// GREASE_PLACEHOLDER.
+func (spec *ClientHelloSpec) RemoveExtensionByType(extType uint16) (bool, error) {
+	if spec.applied {
+		return false, errSpecApplied
+	}
+	for i, ext := range spec.Extensions {
+		if t, ok := extensionType(ext); ok && t == extType {
+			spec.Extensions = append(spec.Extensions[:i], spec.Extensions[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SwapExtensions swaps the extensions at indexes i and j.
+func (spec *ClientHelloSpec) SwapExtensions(i, j int) error {
+	if spec.applied {
+		return errSpecApplied
+	}
+	for _, index := range []int{i, j} {
+		if index < 0 || index >= len(spec.Extensions) {
+			return fmt.Errorf("tls: extension index %d out of range [0, %d)", index, len(spec.Extensions))
+		}
+	}
+	spec.Extensions[i], spec.Extensions[j] = spec.Extensions[j], spec.Extensions[i]
+	return nil
+}
+
+// PermuteExtensions shuffles the extensions of spec like Chrome, which has
+// permuted its extensions on every connection since version 110, so that a
+// fixed order does not single it out. Like BoringSSL, it uses a Fisher-Yates
+// shuffle and keeps the GREASE extensions first and last, followed by the
+// padding and pre_shared_key extensions. The order only depends on seed, to
+// reproduce it, for instance in tests; HelloChrome_Shuffle draws a new one for
+// every connection.
+//
+// An error is returned if spec was applied, or if its PreSharedKeyExtension
+// is not the last extension.
+func (spec *ClientHelloSpec) PermuteExtensions(seed uint64) error {
+	if spec.applied {
+		return errSpecApplied
+	}
+	for i, ext := range spec.Extensions {
+		if isPreSharedKeyExtension(ext) && i != len(spec.Extensions)-1 {
+			return errors.New("tls: PreSharedKeyExtension must be the last extension")
+		}
+	}
+	s := new(PRNGSeed)
+	binary.BigEndian.PutUint64(s[:], seed)
+	r, err := newPRNGWithSeed(s)
+	if err != nil {
+		return err
+	}
+	spec.permuteExtensions(r)
+	return nil
+}
+
+// permuteExtensions shuffles the extensions of spec with r, except for the
+// ones Chrome keeps in place, see PermuteExtensions.
+func (spec *ClientHelloSpec) permuteExtensions(r *prng) {
+	exts := spec.Extensions
+	start, end := 0, len(exts)
+	if end > 0 {
+		if _, ok := exts[0].(*UtlsGREASEExtension); ok {
+			start++
+		}
+	}
+	for ; end > start; end-- {
+		switch exts[end-1].(type) {
+		case *UtlsGREASEExtension, *UtlsPaddingExtension, *PreSharedKeyExtension:
+			continue
+		}
+		break
+	}
+	permuted := exts[start:end]
+	r.rand.Shuffle(len(permuted), func(i, j int) {
+		permuted[i], permuted[j] = permuted[j], permuted[i]
+	})
+}
+
+// Clone returns a deep copy of spec, to apply the same ClientHello structure
+// to several UConns, for instance ones racing to different addresses of a
+// server. The copy shares no slices or maps with spec, so the key shares,
+// GREASE values and padding generated for a connection stay out of the
+// others. Functions, such as GetPaddingLen, and sessions are shared.
+//
+// A spec passed to ApplyPreset already holds the state generated for its
+// UConn, so it cannot be cloned, clone it beforehand instead.
+func (spec *ClientHelloSpec) Clone() (ClientHelloSpec, error) {
+	if spec.applied {
+		return ClientHelloSpec{}, errSpecApplied
+	}
+	clone := *spec
+	deepCopy(reflect.ValueOf(&clone).Elem())
+	return clone, nil
+}
+
+// deepCopy replaces the slices and maps reachable from v, which must be
+// settable, with copies. The structs pointed to by interfaces, such as
+// TLSExtensions, are copied too, while other pointers and functions are kept.
+// Unexported fields are shallow copied.
+func deepCopy(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		for i := 0; i < c.Len(); i++ {
+			deepCopy(c.Index(i))
+		}
+		v.Set(c)
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(iter.Value())
+			deepCopy(elem)
+			c.SetMapIndex(iter.Key(), elem)
+		}
+		v.Set(c)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			deepCopy(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				deepCopy(f)
+			}
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if e := v.Elem(); e.Kind() == reflect.Ptr && !e.IsNil() && e.Elem().Kind() == reflect.Struct {
+			c := reflect.New(e.Elem().Type())
+			c.Elem().Set(e.Elem())
+			deepCopy(c.Elem())
+			v.Set(c)
+		}
+	}
+}
+
+// A ClientHelloMutation is a single change to the extensions of a
+// ClientHelloSpec: the swap of the extensions at indexes I and J, or, if J is
+// -1, the omission of the extension at I.
+type ClientHelloMutation struct {
+	I, J int
+}
+
+func (m ClientHelloMutation) String() string {
+	if m.J < 0 {
+		return fmt.Sprintf("omit %d", m.I)
+	}
+	return fmt.Sprintf("swap %d and %d", m.I, m.J)
+}
+
+// Apply applies m to spec, which must have the extensions of the spec m was
+// generated from. As applied specs can not be mutated, a fresh spec, for
+// example from UTLSIdToSpec, is needed for each mutation.
+func (m ClientHelloMutation) Apply(spec *ClientHelloSpec) error {
+	if m.J >= 0 {
+		return spec.SwapExtensions(m.I, m.J)
+	}
+	if spec.applied {
+		return errSpecApplied
+	}
+	if m.I < 0 || m.I >= len(spec.Extensions) {
+		return fmt.Errorf("tls: extension index %d out of range [0, %d)", m.I, len(spec.Extensions))
+	}
+	spec.Extensions = append(spec.Extensions[:m.I:m.I], spec.Extensions[m.I+1:]...)
+	return nil
+}
+
+// Mutations returns a generator of the single-extension swaps and omissions
+// of spec, to probe which ClientHellos a server accepts. The mutations are
+// generated lazily, and yield is called with each of them until it returns
+// false; with Go 1.23 or later the generator can be ranged over.
+//
+// Mutations that produce an invalid ClientHello are skipped: the
+// pre_shared_key extension stays last, and neither supported_versions nor the
+// extensions TLS 1.3 requires, such as key_share, are omitted while TLS 1.3 is
+// offered. Swaps of two
+// extensions of the same type are skipped too.
+func (spec *ClientHelloSpec) Mutations() func(yield func(ClientHelloMutation) bool) {
+	exts := spec.Extensions
+	return func(yield func(ClientHelloMutation) bool) {
+		for i := range exts {
+			for j := i + 1; j < len(exts); j++ {
+				if !swapValid(exts[i], exts[j]) {
+					continue
+				}
+				if !yield(ClientHelloMutation{i, j}) {
+					return
+				}
+			}
+		}
+		for i := range exts {
+			if !omissionValid(exts, i) {
+				continue
+			}
+			if !yield(ClientHelloMutation{i, -1}) {
+				return
+			}
+		}
+	}
+}
+
+func swapValid(a, b TLSExtension) bool {
+	if isPreSharedKeyExtension(a) || isPreSharedKeyExtension(b) {
+		return false
+	}
+	typeA, okA := extensionType(a)
+	typeB, okB := extensionType(b)
+	return !okA || !okB || typeA != typeB
+}
+
+func omissionValid(exts []TLSExtension, i int) bool {
+	tls13, psk := false, false
+	for _, ext := range exts {
+		switch ext := ext.(type) {
+		case *SupportedVersionsExtension:
+			for _, v := range ext.Versions {
+				tls13 = tls13 || v == VersionTLS13
+			}
+		case *PreSharedKeyExtension:
+			psk = true
+		}
+	}
+	switch exts[i].(type) {
+	case *SupportedVersionsExtension, *KeyShareExtension, *SupportedCurvesExtension,
+		*SignatureAlgorithmsExtension:
+		return !tls13
+	case *PSKKeyExchangeModesExtension:
+		return !psk
+	}
+	return true
+}
+
+// extensionType returns the type ext is sent with, or false if it can not be
+// determined before the ClientHello is built.
+func extensionType(ext TLSExtension) (uint16, bool) {
+	switch e := ext.(type) {
+	case *UtlsGREASEExtension:
+		return GREASE_PLACEHOLDER, true
+	case *UtlsPaddingExtension:
+		return utlsExtensionPadding, true
+	case *GenericExtension:
+		return e.Id, true
+	case *ECHExtension:
+		return utlsExtensionEncryptedClientHello, true
+	case *PreSharedKeyExtension:
+		return extensionPreSharedKey, true
+	}
+	b := make([]byte, ext.Len())
+	if n, _ := ext.Read(b); n < 2 {
+		return 0, false
+	}
+	return uint16(b[0])<<8 | uint16(b[1]), true
+}
+
+// SetExtensions replaces the extensions of the ClientHello, after the preset
+// or the ClientHelloSpec was applied, and builds the handshake state again,
+// see BuildHandshakeState. Extensions which were already part of the
+// ClientHello keep their state, such as their GREASE values and key shares,
+// while new ones are prepared as ApplyPreset would. The padding and the PSK
+// binders are recomputed over the new ClientHello.
+//
+// SetExtensions returns an error, leaving the ClientHello unchanged, if the
+// extensions would make an invalid ClientHello: for instance a key_share
+// without TLS 1.3 in supported_versions, TLS 1.3 without key_share, or a
+// pre_shared_key extension which is not the last one. It is not supported
+// with HelloGolang, and must be called before the handshake.
+func (uconn *UConn) SetExtensions(exts []TLSExtension) error {
+	if uconn.clientHelloSent() {
+		return errClientHelloSent
+	}
+	if uconn.ClientHelloID == HelloGolang {
+		return errors.New("tls: SetExtensions is not supported with HelloGolang")
+	}
+	if !uconn.ClientHelloBuilt {
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return err
+		}
+	}
+	if err := checkExtensions(exts); err != nil {
+		return err
+	}
+
+	saved := uconn.saveExtensionState()
+	greaseSeen := 0
+	for _, ext := range exts {
+		if containsExtension(saved.extensions, ext) {
+			if _, ok := ext.(*UtlsGREASEExtension); ok {
+				greaseSeen++
+			}
+			continue
+		}
+		if err := uconn.prepareExtension(ext, &greaseSeen); err != nil {
+			return uconn.restoreExtensionState(saved, err)
+		}
+	}
+	if err := checkDuplicateExtensions(exts); err != nil {
+		return uconn.restoreExtensionState(saved, err)
+	}
+
+	if err := uconn.rebuildWithExtensions(exts); err != nil {
+		return uconn.restoreExtensionState(saved, err)
+	}
+	return nil
+}
+
+// extensionState is the state of a UConn which preparing extensions and
+// building the ClientHello with them change, saved by SetExtensions.
+type extensionState struct {
+	extensions     []TLSExtension
+	ticketSessions []*ClientSessionState // of the session_ticket extensions
+	handshake      ClientHandshakeState
+	hello          ClientHelloMsg
+	ecdheParams    map[CurveID]EcdheParameters
+	ech            *echClientContext
+
+	nextProtos       []string
+	serverName       string
+	curvePreferences []CurveID
+	renegotiation    RenegotiationSupport
+	minVersion       uint16
+	maxVersion       uint16
+
+	recordSizeLimit            uint16
+	statusRequestV2            bool
+	extCompressCerts           bool
+	certSignatureSchemes       []SignatureScheme
+	delegatedCredentialSchemes []SignatureScheme
+	applicationSettings        *ApplicationSettingsExtension
+	certificateAuthorities     [][]byte
+	cachedInfo                 *CachedInfoExtension
+}
+
+func (uconn *UConn) saveExtensionState() *extensionState {
+	s := &extensionState{
+		extensions:  uconn.Extensions,
+		handshake:   uconn.HandshakeState,
+		hello:       *uconn.HandshakeState.Hello,
+		ecdheParams: make(map[CurveID]EcdheParameters),
+		ech:         uconn.ech,
+
+		nextProtos:       uconn.config.NextProtos,
+		serverName:       uconn.config.ServerName,
+		curvePreferences: uconn.config.CurvePreferences,
+		renegotiation:    uconn.config.Renegotiation,
+		minVersion:       uconn.config.MinVersion,
+		maxVersion:       uconn.config.MaxVersion,
+
+		recordSizeLimit:            uconn.recordSizeLimit,
+		statusRequestV2:            uconn.statusRequestV2,
+		extCompressCerts:           uconn.extCompressCerts,
+		certSignatureSchemes:       uconn.certSignatureSchemes,
+		delegatedCredentialSchemes: uconn.delegatedCredentialSchemes,
+		applicationSettings:        uconn.applicationSettings,
+		certificateAuthorities:     uconn.certificateAuthorities,
+		cachedInfo:                 uconn.cachedInfo,
+	}
+	for id, params := range uconn.HandshakeState.State13.EcdheParams {
+		s.ecdheParams[id] = params
+	}
+	for _, ext := range uconn.Extensions {
+		if st, ok := ext.(*SessionTicketExtension); ok {
+			s.ticketSessions = append(s.ticketSessions, st.Session)
+		}
+	}
+	return s
+}
+
+// restoreExtensionState restores the state saved by saveExtensionState after
+// SetExtensions failed with err, and builds the previous ClientHello again. It
+// returns err, along with the error of that build, if any.
+func (uconn *UConn) restoreExtensionState(s *extensionState, err error) error {
+	uconn.HandshakeState = s.handshake
+	*uconn.HandshakeState.Hello = s.hello
+	uconn.HandshakeState.State13.EcdheParams = s.ecdheParams
+	uconn.ech = s.ech
+	i := 0
+	for _, ext := range s.extensions {
+		if st, ok := ext.(*SessionTicketExtension); ok {
+			st.Session = s.ticketSessions[i]
+			i++
+		}
+	}
+
+	uconn.config.NextProtos = s.nextProtos
+	uconn.config.ServerName = s.serverName
+	uconn.config.CurvePreferences = s.curvePreferences
+	uconn.config.Renegotiation = s.renegotiation
+	uconn.config.MinVersion = s.minVersion
+	uconn.config.MaxVersion = s.maxVersion
+
+	uconn.recordSizeLimit = s.recordSizeLimit
+	uconn.statusRequestV2 = s.statusRequestV2
+	uconn.extCompressCerts = s.extCompressCerts
+	uconn.certSignatureSchemes = s.certSignatureSchemes
+	uconn.delegatedCredentialSchemes = s.delegatedCredentialSchemes
+	uconn.applicationSettings = s.applicationSettings
+	uconn.certificateAuthorities = s.certificateAuthorities
+	uconn.cachedInfo = s.cachedInfo
+
+	// The extensions of the previous ClientHello, such as the padding, may
+	// have been updated for the new one.
+	if rebuildErr := uconn.rebuildWithExtensions(s.extensions); rebuildErr != nil {
+		return fmt.Errorf("%w (restoring the previous extensions: %w)", err, rebuildErr)
+	}
+	return err
+}
+
+// InsertExtensionBefore inserts ext before the first extension of type id in
+// the ClientHello, see SetExtensions. GREASE extensions are designated by
+// GREASE_PLACEHOLDER.
+func (uconn *UConn) InsertExtensionBefore(id uint16, ext TLSExtension) error {
+	if !uconn.ClientHelloBuilt {
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return err
+		}
+	}
+	for i, e := range uconn.Extensions {
+		if t, ok := extensionType(e); ok && t == id {
+			exts := make([]TLSExtension, 0, len(uconn.Extensions)+1)
+			exts = append(exts, uconn.Extensions[:i]...)
+			exts = append(exts, ext)
+			exts = append(exts, uconn.Extensions[i:]...)
+			return uconn.SetExtensions(exts)
+		}
+	}
+	return fmt.Errorf("tls: the ClientHello has no extension of type %d", id)
+}
+
+// RemoveExtension removes the first extension of type id from the
+// ClientHello, see SetExtensions. GREASE extensions are designated by
+// GREASE_PLACEHOLDER.
+func (uconn *UConn) RemoveExtension(id uint16) error {
+	if !uconn.ClientHelloBuilt {
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return err
+		}
+	}
+	for i, e := range uconn.Extensions {
+		if t, ok := extensionType(e); ok && t == id {
+			exts := make([]TLSExtension, 0, len(uconn.Extensions)-1)
+			exts = append(exts, uconn.Extensions[:i]...)
+			exts = append(exts, uconn.Extensions[i+1:]...)
+			return uconn.SetExtensions(exts)
+		}
+	}
+	return fmt.Errorf("tls: the ClientHello has no extension of type %d", id)
+}
+
+// rebuildWithExtensions builds the handshake state again with exts, forgetting
+// what the previous extensions set in the ClientHello.
+func (uconn *UConn) rebuildWithExtensions(exts []TLSExtension) error {
+	hasVersions := func(exts []TLSExtension) bool {
+		for _, ext := range exts {
+			if _, ok := ext.(*SupportedVersionsExtension); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if hasVersions(exts) || hasVersions(uconn.Extensions) {
+		if err := uconn.SetTLSVers(0, 0, exts); err != nil {
+			return err
+		}
+	}
+
+	hello := uconn.HandshakeState.Hello
+	hello.NextProtoNeg = false
+	hello.OcspStapling = false
+	hello.Scts = false
+	hello.Ems = false
+	hello.SecureRenegotiationSupported = false
+	hello.AlpnProtocols = nil
+	hello.KeyShares = nil
+	hello.EarlyData = false
+	hello.PskModes = nil
+	hello.PskIdentities = nil
+	hello.PskBinders = nil
+	uconn.recordSizeLimit = 0
+	uconn.statusRequestV2 = false
+	hello.SupportedSignatureAlgorithmsCert = nil
+	uconn.certSignatureSchemes = nil
+	uconn.delegatedCredentialSchemes = nil
+	uconn.applicationSettings = nil
+	uconn.cachedInfo = nil
+
+	uconn.Extensions = exts
+	return uconn.BuildHandshakeState()
+}
+
+// checkExtensions checks that exts make a valid ClientHello.
+func checkExtensions(exts []TLSExtension) error {
+	tls13 := false
+	var keyShare, psk, pskModes, curves, sigAlgs bool
+	for i, ext := range exts {
+		switch ext := ext.(type) {
+		case *SupportedVersionsExtension:
+			for _, v := range ext.Versions {
+				tls13 = tls13 || v == VersionTLS13
+			}
+		case *KeyShareExtension:
+			keyShare = true
+		case *PreSharedKeyExtension:
+			if i != len(exts)-1 {
+				return errors.New("tls: PreSharedKeyExtension must be the last extension")
+			}
+			psk = true
+		case *PSKKeyExchangeModesExtension:
+			pskModes = true
+		case *SupportedCurvesExtension:
+			curves = true
+		case *SignatureAlgorithmsExtension:
+			sigAlgs = true
+		}
+	}
+	switch {
+	case !tls13 && (keyShare || psk || pskModes):
+		return errors.New("tls: key_share and pre_shared_key extensions require TLS 1.3 in the supported_versions extension")
+	case tls13 && !(keyShare && curves && sigAlgs):
+		return errors.New("tls: TLS 1.3 requires the key_share, supported_groups and signature_algorithms extensions")
+	case psk && !pskModes:
+		return errors.New("tls: the pre_shared_key extension requires the psk_key_exchange_modes extension")
+	}
+	return nil
+}
+
+// checkDuplicateExtensions checks that exts, once prepared, has at most one
+// extension of each type.
+func checkDuplicateExtensions(exts []TLSExtension) error {
+	seen := make(map[uint16]bool)
+	for _, ext := range exts {
+		t, ok := extensionType(ext)
+		if g, isGREASE := ext.(*UtlsGREASEExtension); isGREASE {
+			t = g.Value
+		}
+		if !ok {
+			continue
+		}
+		if seen[t] {
+			return fmt.Errorf("tls: the ClientHello has several extensions of type %d", t)
+		}
+		seen[t] = true
+	}
+	return nil
+}
+
+// containsExtension reports whether exts holds ext itself, not a copy.
+func containsExtension(exts []TLSExtension, ext TLSExtension) bool {
+	if !reflect.TypeOf(ext).Comparable() {
+		return false
+	}
+	for _, e := range exts {
+		if reflect.TypeOf(e) == reflect.TypeOf(ext) && e == ext {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,467 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestClientHelloSpecMutation(t *testing.T) {
+	spec, err := UTLSIdToSpec(HelloFirefox_102)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := spec.RemoveExtensionByType(utlsExtensionDelegatedCredentials); !ok || err != nil {
+		t.Fatalf("RemoveExtensionByType(delegated_credentials) = %v, %v", ok, err)
+	}
+	if ok, err := spec.RemoveExtensionByType(utlsExtensionDelegatedCredentials); ok || err != nil {
+		t.Fatalf("second RemoveExtensionByType(delegated_credentials) = %v, %v", ok, err)
+	}
+	if err := spec.InsertExtension(1, &GenericExtension{Id: 0x1234, Data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.InsertExtension(len(spec.Extensions)+1, &SCTExtension{}); err == nil {
+		t.Error("InsertExtension past the end succeeded")
+	}
+	// Swap supported_groups and ec_point_formats.
+	if err := spec.SwapExtensions(4, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.SwapExtensions(0, len(spec.Extensions)); err == nil {
+		t.Error("SwapExtensions past the end succeeded")
+	}
+
+	uconn := UClient(nil, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{0, 0x1234, 23, 65281, 11, 10, 35, 16, 5, 51, 43, 13, 45, 28, 21}
+	if got := clientHelloExtensionIDs(t, uconn.HandshakeState.Hello.Raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("extensions = %v, want %v", got, want)
+	}
+
+	// The applied spec shares its extensions with uconn.
+	if err := spec.InsertExtension(0, &SCTExtension{}); err != errSpecApplied {
+		t.Errorf("InsertExtension on an applied spec: got %v, want %v", err, errSpecApplied)
+	}
+	if _, err := spec.RemoveExtensionByType(extensionServerName); err != errSpecApplied {
+		t.Errorf("RemoveExtensionByType on an applied spec: got %v, want %v", err, errSpecApplied)
+	}
+	if err := spec.SwapExtensions(0, 1); err != errSpecApplied {
+		t.Errorf("SwapExtensions on an applied spec: got %v, want %v", err, errSpecApplied)
+	}
+}
+
+func TestClientHelloSpecRemoveGREASE(t *testing.T) {
+	spec, err := UTLSIdToSpec(HelloChrome_113)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(spec.Extensions)
+	for i := 0; i < 2; i++ {
+		if ok, err := spec.RemoveExtensionByType(GREASE_PLACEHOLDER); !ok || err != nil {
+			t.Fatalf("RemoveExtensionByType(GREASE) #%d = %v, %v", i, ok, err)
+		}
+	}
+	if ok, _ := spec.RemoveExtensionByType(GREASE_PLACEHOLDER); ok {
+		t.Error("removed a third GREASE extension")
+	}
+	if len(spec.Extensions) != n-2 {
+		t.Errorf("%d extensions left, want %d", len(spec.Extensions), n-2)
+	}
+}
+
+func TestClientHelloSpecMutations(t *testing.T) {
+	base, err := UTLSIdToSpec(HelloChrome_Auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutations []ClientHelloMutation
+	base.Mutations()(func(m ClientHelloMutation) bool {
+		mutations = append(mutations, m)
+		return true
+	})
+	seen := make(map[ClientHelloMutation]bool)
+	for _, m := range mutations {
+		if seen[m] {
+			t.Errorf("%v generated twice", m)
+		}
+		seen[m] = true
+		if m.J >= 0 {
+			_, greaseI := base.Extensions[m.I].(*UtlsGREASEExtension)
+			_, greaseJ := base.Extensions[m.J].(*UtlsGREASEExtension)
+			if greaseI && greaseJ {
+				t.Errorf("%v swaps the GREASE extensions", m)
+			}
+			continue
+		}
+		switch base.Extensions[m.I].(type) {
+		case *SupportedVersionsExtension, *KeyShareExtension, *SupportedCurvesExtension,
+			*SignatureAlgorithmsExtension:
+			t.Errorf("%v omits %T from a TLS 1.3 ClientHello", m, base.Extensions[m.I])
+		}
+	}
+	if !seen[ClientHelloMutation{0, 1}] || !seen[ClientHelloMutation{1, -1}] {
+		t.Errorf("missing mutations from %v", mutations)
+	}
+
+	var n int
+	base.Mutations()(func(ClientHelloMutation) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("yield called %d times after returning false, want 3", n)
+	}
+
+	for _, m := range mutations {
+		spec, err := UTLSIdToSpec(HelloChrome_Auto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Apply(&spec); err != nil {
+			t.Fatalf("%v: %v", m, err)
+		}
+
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- Server(s, testConfig).Handshake()
+		}()
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(&spec); err != nil {
+			t.Fatalf("%v: %v", m, err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Errorf("%v: client: %v", m, err)
+		}
+		c.Close()
+		if err := <-done; err != nil {
+			t.Errorf("%v: server: %v", m, err)
+		}
+	}
+}
+
+func TestClientHelloSpecMutationsPSK(t *testing.T) {
+	spec := resumptionSpec(true)
+	last := len(spec.Extensions) - 1
+	spec.Mutations()(func(m ClientHelloMutation) bool {
+		if m.J >= 0 && (m.I == last || m.J == last) {
+			t.Errorf("%v moves the PreSharedKeyExtension", m)
+		}
+		if _, ok := spec.Extensions[m.I].(*PSKKeyExchangeModesExtension); ok && m.J < 0 {
+			t.Errorf("%v omits psk_key_exchange_modes along with pre_shared_key", m)
+		}
+		return true
+	})
+}
+
+func TestUConnSetExtensions(t *testing.T) {
+	uconn := UClient(nil, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloChrome_113)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	keyShares := uconn.HandshakeState.Hello.KeyShares
+
+	if err := uconn.RemoveExtension(extensionALPN); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.InsertExtensionBefore(extensionServerName, &GenericExtension{Id: 0x1234, Data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	// Move the last extension, padding, first.
+	n := len(uconn.Extensions)
+	exts := append([]TLSExtension{uconn.Extensions[n-1]}, uconn.Extensions[:n-1]...)
+	if err := uconn.SetExtensions(exts); err != nil {
+		t.Fatal(err)
+	}
+
+	got := clientHelloExtensionIDs(t, uconn.HandshakeState.Hello.Raw)
+	var want []uint16
+	for _, ext := range uconn.SentExtensions() {
+		id, _ := extensionType(ext)
+		if g, ok := ext.(*UtlsGREASEExtension); ok {
+			id = g.Value
+		}
+		want = append(want, id)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extensions = %v, want %v", got, want)
+	}
+	for i, id := range got {
+		if id == extensionALPN {
+			t.Error("the ClientHello still has an ALPN extension")
+		}
+		if id == extensionServerName && (i == 0 || got[i-1] != 0x1234) {
+			t.Errorf("the generic extension was not inserted before server_name: %v", got)
+		}
+	}
+	if uconn.HandshakeState.Hello.AlpnProtocols != nil {
+		t.Error("the removed ALPN extension still sets AlpnProtocols")
+	}
+	if !reflect.DeepEqual(uconn.HandshakeState.Hello.KeyShares, keyShares) {
+		t.Error("the key shares changed")
+	}
+
+	// Invalid ClientHellos are refused and leave it unchanged.
+	raw := append([]byte{}, uconn.HandshakeState.Hello.Raw...)
+	if err := uconn.RemoveExtension(extensionSupportedVersions); err == nil {
+		t.Error("removing supported_versions with a key_share succeeded")
+	}
+	if err := uconn.RemoveExtension(extensionALPN); err == nil {
+		t.Error("removing a missing extension succeeded")
+	}
+	if err := uconn.SetExtensions(append(uconn.Extensions[:len(uconn.Extensions):len(uconn.Extensions)], &PreSharedKeyExtension{}, &SCTExtension{})); err == nil {
+		t.Error("a pre_shared_key extension before another one was accepted")
+	}
+	if err := uconn.InsertExtensionBefore(extensionServerName, &SNIExtension{}); err == nil {
+		t.Error("a duplicate server_name extension was accepted")
+	}
+	// Preparing the refused extensions leaves no trace either.
+	certCompAlgs := uconn.HandshakeState.State13.CertCompAlgs
+	nextProtos := uconn.config.NextProtos
+	if err := uconn.SetExtensions(append([]TLSExtension{
+		&ALPNExtension{AlpnProtocols: []string{"spdy/3"}},
+		&CompressCertificateExtension{Algorithms: []CertCompressionAlgo{CertCompressionZstd}},
+	}, uconn.Extensions...)); err == nil {
+		t.Error("a duplicate compress_certificate extension was accepted")
+	}
+	if !reflect.DeepEqual(uconn.HandshakeState.State13.CertCompAlgs, certCompAlgs) {
+		t.Errorf("a refused extension set the certificate compression algorithms %v", uconn.HandshakeState.State13.CertCompAlgs)
+	}
+	if !reflect.DeepEqual(uconn.config.NextProtos, nextProtos) {
+		t.Errorf("a refused extension set NextProtos to %q", uconn.config.NextProtos)
+	}
+	if !bytes.Equal(uconn.HandshakeState.Hello.Raw, raw) {
+		t.Error("a refused mutation changed the ClientHello")
+	}
+
+	// The mutated ClientHello completes a handshake.
+	c, s := localPipe(t)
+	serverConfig := testConfig.Clone()
+	serverConfig.NextProtos = []string{"h2"}
+	go func() {
+		defer s.Close()
+		Server(s, serverConfig).Handshake()
+	}()
+	uconn.SetUnderlyingConn(c)
+	if err := uconn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if p := uconn.ConnectionState().NegotiatedProtocol; p != "" {
+		t.Errorf("negotiated %q without offering ALPN", p)
+	}
+}
+
+func TestClientHelloSpecClone(t *testing.T) {
+	spec, err := UTLSIdToSpec(HelloChrome_Auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := func() (*ClientHelloSpec, *clientHelloMsg) {
+		clone, err := spec.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(&clone); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		m := new(clientHelloMsg)
+		if !m.unmarshal(uconn.HandshakeState.Hello.Raw) {
+			t.Fatal("failed to parse the ClientHello")
+		}
+		return &clone, m
+	}
+	extensionTypes := func(spec *ClientHelloSpec) []uint16 {
+		var types []uint16
+		for _, ext := range spec.Extensions {
+			typ, _ := extensionType(ext)
+			types = append(types, typ)
+		}
+		return types
+	}
+
+	clone1, hello1 := build()
+	clone2, hello2 := build()
+	if !reflect.DeepEqual(extensionTypes(clone1), extensionTypes(clone2)) {
+		t.Errorf("the clones have the extensions %v and %v", extensionTypes(clone1), extensionTypes(clone2))
+	}
+	if len(hello1.keyShares) == 0 || len(hello1.keyShares) != len(hello2.keyShares) {
+		t.Fatalf("the ClientHellos have %d and %d key shares", len(hello1.keyShares), len(hello2.keyShares))
+	}
+	for i := range hello1.keyShares {
+		if len(hello1.keyShares[i].data) > 1 && bytes.Equal(hello1.keyShares[i].data, hello2.keyShares[i].data) {
+			t.Errorf("the clones share the %v key share", hello1.keyShares[i].group)
+		}
+	}
+
+	for i, ext := range spec.Extensions {
+		// Pointers to distinct zero-size values may be equal.
+		if reflect.TypeOf(ext).Elem().Size() != 0 && ext == clone1.Extensions[i] {
+			t.Errorf("the clones share the %T extension", ext)
+		}
+		if ks, ok := ext.(*KeyShareExtension); ok {
+			for _, share := range ks.KeyShares {
+				if len(share.Data) > 1 {
+					t.Errorf("building a clone generated a %v key share in the spec", share.Group)
+				}
+			}
+		}
+		if padding, ok := clone1.Extensions[i].(*UtlsPaddingExtension); ok {
+			padding.PaddingLen++
+			if other := clone2.Extensions[i].(*UtlsPaddingExtension); other.PaddingLen == padding.PaddingLen {
+				t.Error("changing the padding of a clone changed the other")
+			}
+		}
+	}
+
+	if _, err := clone1.Clone(); err != errSpecApplied {
+		t.Errorf("Clone of an applied spec: got error %v, want errSpecApplied", err)
+	}
+}
+
+func TestClientHelloSpecPermuteExtensions(t *testing.T) {
+	// permuted returns the Chrome spec, with a PreSharedKeyExtension, with its
+	// extensions permuted with seed.
+	permuted := func(seed uint64) []TLSExtension {
+		spec, err := UTLSIdToSpec(HelloChrome_Shuffle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec.Extensions = append(spec.Extensions, &PreSharedKeyExtension{})
+		if err := spec.PermuteExtensions(seed); err != nil {
+			t.Fatal(err)
+		}
+		return spec.Extensions
+	}
+	original, err := UTLSIdToSpec(HelloChrome_Shuffle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original.Extensions = append(original.Extensions, &PreSharedKeyExtension{})
+	n := len(original.Extensions)
+	types := func(exts []TLSExtension) []string {
+		var s []string
+		for _, ext := range exts {
+			s = append(s, reflect.TypeOf(ext).String())
+		}
+		return s
+	}
+
+	orders := make(map[string]bool)
+	for seed := uint64(0); seed < 20; seed++ {
+		exts := permuted(seed)
+		if !reflect.DeepEqual(types(exts), types(permuted(seed))) {
+			t.Fatalf("seed %d: the order is not reproducible", seed)
+		}
+		// The first GREASE, and the last GREASE, padding and pre_shared_key
+		// extensions are anchored.
+		for _, i := range []int{0, n - 3, n - 2, n - 1} {
+			if reflect.TypeOf(exts[i]) != reflect.TypeOf(original.Extensions[i]) {
+				t.Errorf("seed %d: extension %d moved: %v", seed, i, types(exts))
+			}
+		}
+		sorted := types(exts)
+		sort.Strings(sorted)
+		want := types(original.Extensions)
+		sort.Strings(want)
+		if !reflect.DeepEqual(sorted, want) {
+			t.Fatalf("seed %d: extensions %v are not a permutation of %v", seed, sorted, want)
+		}
+		orders[strings.Join(types(exts), ",")] = true
+	}
+	if len(orders) < 10 {
+		t.Errorf("only %d extension orders for 20 seeds", len(orders))
+	}
+
+	spec := ClientHelloSpec{Extensions: []TLSExtension{&SNIExtension{}, &PreSharedKeyExtension{}, &ALPNExtension{}}}
+	if err := spec.PermuteExtensions(1); err == nil {
+		t.Error("PermuteExtensions accepted a PreSharedKeyExtension that is not the last extension")
+	}
+	spec, err = UTLSIdToSpec(HelloChrome_Shuffle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom).ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.PermuteExtensions(1); err != errSpecApplied {
+		t.Errorf("PermuteExtensions on an applied spec: got %v, want %v", err, errSpecApplied)
+	}
+}
+
+func TestHelloChromeShuffle(t *testing.T) {
+	extensionIDs := func(id ClientHelloID, spec *ClientHelloSpec, randSeed int64) []uint16 {
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com", Rand: mathrand.New(mathrand.NewSource(randSeed))}, id)
+		if spec != nil {
+			if err := uconn.ApplyPreset(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		// The padding depends on the length of the GREASE ECH payload,
+		// drawn from Config.Rand.
+		var ids []uint16
+		for _, id := range clientHelloExtensionIDs(t, uconn.HandshakeState.Hello.Raw) {
+			if isGREASEValue(id) {
+				id = GREASE_PLACEHOLDER
+			}
+			if id != utlsExtensionPadding {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	// A seeded HelloChrome_Shuffle permutes the extensions like
+	// PermuteExtensions with the same seed, whatever Config.Rand is.
+	for seed := int64(0); seed < 5; seed++ {
+		spec, err := UTLSIdToSpec(HelloChrome_Shuffle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := spec.PermuteExtensions(uint64(seed)); err != nil {
+			t.Fatal(err)
+		}
+		want := extensionIDs(HelloCustom, &spec, 0)
+		if got := extensionIDs(HelloChrome_Shuffle.WithSeed(seed), nil, seed+1); !reflect.DeepEqual(got, want) {
+			t.Errorf("seed %d: extensions %v, want %v", seed, got, want)
+		}
+	}
+
+	// Without a seed, the order is drawn from Config.Rand.
+	orders := make(map[string]bool)
+	for seed := int64(0); seed < 10; seed++ {
+		orders[fmt.Sprint(extensionIDs(HelloChrome_Shuffle, nil, seed))] = true
+	}
+	if len(orders) < 5 {
+		t.Errorf("only %d extension orders in 10 connections", len(orders))
+	}
+
+	if got := UClient(nil, nil, HelloChrome_Shuffle.WithSeed(1)).ClientHelloIDResolved(); got != HelloChrome_Shuffle {
+		t.Errorf("a seeded HelloChrome_Shuffle resolves to %s", got.Str())
+	}
+}
@@ -5,8 +5,10 @@
 package tls
 
 import (
+	"crypto"
 	"crypto/hmac"
 	"crypto/sha512"
+	"encoding/binary"
 	"fmt"
 )
 
@@ -16,15 +18,25 @@ import (
 // Supported things, that have changed their ID are prefixed with "Old"
 // Supported but disabled things are prefixed with "Disabled". We will _enable_ them.
 const (
-	utlsExtensionPadding              uint16 = 21
-	utlsExtensionExtendedMasterSecret uint16 = 23 // https://tools.ietf.org/html/rfc7627
+	utlsExtensionPadding                uint16 = 21
+	utlsExtensionExtendedMasterSecret   uint16 = 23     // https://tools.ietf.org/html/rfc7627
+	utlsExtensionStatusRequestV2        uint16 = 17     // https://tools.ietf.org/html/rfc6961
+	utlsExtensionCachedInfo             uint16 = 25     // https://tools.ietf.org/html/rfc7924
+	utlsExtensionRecordSizeLimit        uint16 = 28     // https://tools.ietf.org/html/rfc8449
+	utlsExtensionDelegatedCredentials   uint16 = 34     // https://tools.ietf.org/html/rfc9345
+	utlsExtensionQUICTransportParams    uint16 = 57     // https://tools.ietf.org/html/rfc9001
+	utlsExtensionApplicationSettings    uint16 = 17513  // https://datatracker.ietf.org/doc/html/draft-vvv-tls-alps
+	utlsExtensionApplicationSettingsNew uint16 = 17613  // codepoint of ALPS used by newer Chrome versions
+	utlsExtensionEncryptedClientHello   uint16 = 0xfe0d // https://datatracker.ietf.org/doc/draft-ietf-tls-esni/
 
 	// extensions with 'fake' prefix break connection, if server echoes them back
 	fakeExtensionChannelID uint16 = 30032 // not IANA assigned
-
-	fakeRecordSizeLimit uint16 = 0x001c
 )
 
+// statusTypeOCSPMulti is the CertificateStatusType of a status_request_v2
+// request for the OCSP responses of the whole chain, see RFC 6961.
+const statusTypeOCSPMulti uint8 = 2
+
 const (
 	OLD_TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256   = uint16(0xcc13)
 	OLD_TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 = uint16(0xcc14)
@@ -57,12 +69,28 @@ var (
 	FakeFFDHE3072 = uint16(0x0101)
 )
 
+// X25519Kyber768Draft00 is the hybrid post-quantum key exchange of X25519 and
+// Kyber768 (round 3), see draft-tls-westerbaan-xyber768d00. It is only used
+// with TLS 1.3, and by servers only if listed in Config.CurvePreferences.
+const X25519Kyber768Draft00 CurveID = 0x6399
+
+// X25519MLKEM768 is the hybrid post-quantum key exchange of ML-KEM-768 and
+// X25519, and MLKEM768 is ML-KEM-768 alone, for testing servers' readiness
+// for clients without a classical key share. Like X25519Kyber768Draft00 they
+// are only used with TLS 1.3, and by servers only if listed in
+// Config.CurvePreferences.
+const (
+	X25519MLKEM768 CurveID = 0x11ec
+	MLKEM768       CurveID = 0x0201
+)
+
 // https://tools.ietf.org/html/draft-ietf-tls-certificate-compression-04
 type CertCompressionAlgo uint16
 
 const (
 	CertCompressionZlib   CertCompressionAlgo = 0x0001
 	CertCompressionBrotli CertCompressionAlgo = 0x0002
+	CertCompressionZstd   CertCompressionAlgo = 0x0003
 )
 
 const (
@@ -77,7 +105,8 @@ type ClientHelloID struct {
 	// Not used in randomized, custom handshake, and default Go.
 	Version string
 
-	// Seed is only used for randomized fingerprints to seed PRNG.
+	// Seed is only used for randomized fingerprints to seed PRNG, and by
+	// HelloChrome_Shuffle to draw the extension order.
 	// Must not be modified once set.
 	Seed *PRNGSeed
 }
@@ -86,6 +115,17 @@ func (p *ClientHelloID) Str() string {
 	return fmt.Sprintf("%s-%s", p.Client, p.Version)
 }
 
+// WithSeed returns id seeded with seed, so that a randomized ClientHelloID,
+// such as HelloRandomizedALPN, always generates the same ClientHelloSpec.
+// Once a randomized ClientHelloID without a seed is used, the seed it drew
+// is available from UConn.ClientHelloID.
+func (id ClientHelloID) WithSeed(seed int64) ClientHelloID {
+	s := new(PRNGSeed)
+	binary.BigEndian.PutUint64(s[:], uint64(seed))
+	id.Seed = s
+	return id
+}
+
 func (p *ClientHelloID) IsSet() bool {
 	return (p.Client == "") && (p.Version == "")
 }
@@ -96,10 +136,13 @@ const (
 	helloRandomized       = "Randomized"
 	helloRandomizedALPN   = "Randomized-ALPN"
 	helloRandomizedNoALPN = "Randomized-NoALPN"
+	helloRandomizedTLS13  = "Randomized-TLS13"
+	helloRandomizedTLS12  = "Randomized-TLS12"
 	helloCustom           = "Custom"
 	helloFirefox          = "Firefox"
 	helloOpera            = "Opera"
 	helloChrome           = "Chrome"
+	helloEdge             = "Edge"
 	helloIOS              = "iOS"
 	helloSafari           = "Safari"
 	helloAndroid          = "Android"
@@ -110,7 +153,7 @@ const (
 
 type ClientHelloSpec struct {
 	CipherSuites       []uint16       // nil => default
-	CompressionMethods []uint8        // nil => no compression
+	CompressionMethods []uint8        // nil => null only; sent verbatim, but compression is never used
 	Extensions         []TLSExtension // nil => no extensions
 
 	TLSVersMin uint16 // [1.0-1.3] default: parse from .Extensions, if SupportedVersions ext is not present => 1.0
@@ -121,6 +164,8 @@ type ClientHelloSpec struct {
 	GetSessionID func(ticket []byte) [32]byte
 
 	// TLSFingerprintLink string // ?? link to tlsfingerprint.io for informational purposes
+
+	applied bool // set by ApplyPreset, see InsertExtension
 }
 
 var (
@@ -139,18 +184,43 @@ var (
 	HelloRandomizedALPN   = ClientHelloID{helloRandomizedALPN, helloAutoVers, nil}
 	HelloRandomizedNoALPN = ClientHelloID{helloRandomizedNoALPN, helloAutoVers, nil}
 
+	// HelloRandomized_TLS13 and HelloRandomized_TLS12 randomize like
+	// HelloRandomized, but only offer a single version, and only the cipher
+	// suites, signature algorithms and extensions a client of that version
+	// sends.
+	HelloRandomized_TLS13 = ClientHelloID{helloRandomizedTLS13, helloAutoVers, nil}
+	HelloRandomized_TLS12 = ClientHelloID{helloRandomizedTLS12, helloAutoVers, nil}
+
 	// The rest will will parrot given browser.
-	HelloFirefox_Auto = HelloFirefox_102
+	HelloFirefox_Auto = HelloFirefox_128
 	HelloFirefox_55   = ClientHelloID{helloFirefox, "55", nil}
 	HelloFirefox_56   = ClientHelloID{helloFirefox, "56", nil}
 	HelloFirefox_63   = ClientHelloID{helloFirefox, "63", nil}
 	HelloFirefox_65   = ClientHelloID{helloFirefox, "65", nil}
 	HelloFirefox_102  = ClientHelloID{helloFirefox, "102", nil}
+	HelloFirefox_128  = ClientHelloID{helloFirefox, "128", nil}
+
+	// HelloFirefox_128_Kyber is HelloFirefox_128 as sent by the builds which
+	// offer the X25519Kyber768Draft00 draft group and key share in place of
+	// X25519MLKEM768.
+	HelloFirefox_128_Kyber = ClientHelloID{helloFirefox, "128-Kyber", nil}
+
+	// HelloFirefox_Tor is the ClientHello of Tor Browser 14.0, which is built
+	// on Firefox ESR 128: it is HelloFirefox_128, X25519MLKEM768 key share
+	// included, without the session_ticket extension, as Tor Browser
+	// disables the session identifiers, nor the GREASE
+	// encrypted_client_hello extension, as it disables ECH. Its version
+	// tracks the Tor Browser release, not the Firefox one, and is updated
+	// with it.
+	HelloFirefox_Tor = ClientHelloID{helloFirefox, "Tor", nil}
 
 	HelloOpera_Auto = HelloOpera_89
 	HelloOpera_89   = ClientHelloID{helloOpera, "89", nil}
 
-	HelloChrome_Auto = HelloChrome_113
+	// HelloChrome_Auto is the newest Chrome parrot, so its fingerprint
+	// changes across uTLS releases. Use LatestChromeVersion to find out
+	// which one it is, and that versioned ID to pin it.
+	HelloChrome_Auto = HelloChrome_124
 	HelloChrome_58   = ClientHelloID{helloChrome, "58", nil}
 	HelloChrome_62   = ClientHelloID{helloChrome, "62", nil}
 	HelloChrome_70   = ClientHelloID{helloChrome, "70", nil}
@@ -159,17 +229,46 @@ var (
 	HelloChrome_100  = ClientHelloID{helloChrome, "100", nil}
 	HelloChrome_103  = ClientHelloID{helloChrome, "103", nil}
 	HelloChrome_113  = ClientHelloID{helloChrome, "113", nil}
+	HelloChrome_120  = ClientHelloID{helloChrome, "120", nil}
+	HelloChrome_124  = ClientHelloID{helloChrome, "124", nil}
+
+	// HelloChrome_Shuffle is the ClientHello of HelloChrome_Auto with its
+	// extensions permuted on every connection, as Chrome does, see
+	// ClientHelloSpec.PermuteExtensions. The order is drawn from Config.Rand,
+	// or from the seed of HelloChrome_Shuffle.WithSeed to reproduce it.
+	HelloChrome_Shuffle = ClientHelloID{helloChrome, "Shuffle", nil}
+
+	// HelloChrome_H3 is the ClientHello Chrome sends in QUIC Initial
+	// packets to negotiate HTTP/3, with the transport parameters of its
+	// QUIC stack. It is only meant for UConn.QUICClientHello, see also
+	// UConn.QUICTransportParameters.
+	HelloChrome_H3 = ClientHelloID{helloChrome, "H3", nil}
+
+	// Edge is built on Chromium, and sends the ClientHello of the Chromium
+	// version it is based on, byte for byte. The HelloEdge IDs let callers
+	// mimic Edge by name.
+	HelloEdge_Auto = HelloEdge_122
+	HelloEdge_122  = ClientHelloID{helloEdge, "122", nil}
 
 	HelloIOS_Auto = HelloIOS_15_5
 	HelloIOS_11_1 = ClientHelloID{helloIOS, "111", nil} // legacy "111" means 11.1
 	HelloIOS_12_1 = ClientHelloID{helloIOS, "12.1", nil}
 	HelloIOS_15_5 = ClientHelloID{helloIOS, "15.5", nil}
 
+	HelloSafari_iOS_17_0 = ClientHelloID{helloIOS, "17.0", nil}
+	HelloSafari_17_iOS   = HelloSafari_iOS_17_0
+
 	HelloSafari_Auto = HelloSafari_15_5
 	HelloSafari_15_3 = ClientHelloID{helloSafari, "15.3", nil}
 	HelloSafari_15_5 = ClientHelloID{helloSafari, "15.5", nil}
 )
 
+// LatestChromeVersion returns the versioned ClientHelloID of the newest Chrome
+// parrot, which HelloChrome_Auto resolves to.
+func LatestChromeVersion() ClientHelloID {
+	return helloAutoIDs[helloChrome]
+}
+
 // based on spec's GreaseStyle, GREASE_PLACEHOLDER may be replaced by another GREASE value
 // https://tools.ietf.org/html/draft-ietf-tls-grease-01
 const GREASE_PLACEHOLDER = 0x0a0a
@@ -191,6 +290,22 @@ func init() {
 			suiteECDHE | suiteTLS12 | suiteDefaultOff, nil, nil, aeadChaCha20Poly1305},
 		{OLD_TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, 32, 0, 12, ecdheECDSAKA,
 			suiteECDHE | suiteECDSA | suiteTLS12 | suiteDefaultOff, nil, nil, aeadChaCha20Poly1305},
+
+		// AES-CCM cipher suites, RFC 7251, offered by embedded servers.
+		{TLS_ECDHE_ECDSA_WITH_AES_128_CCM, 16, 0, 4, ecdheECDSAKA,
+			suiteECDHE | suiteECDSA | suiteTLS12 | suiteDefaultOff, nil, nil, aeadAESCCM},
+		{TLS_ECDHE_ECDSA_WITH_AES_256_CCM, 32, 0, 4, ecdheECDSAKA,
+			suiteECDHE | suiteECDSA | suiteTLS12 | suiteDefaultOff, nil, nil, aeadAESCCM},
+		{TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8, 16, 0, 4, ecdheECDSAKA,
+			suiteECDHE | suiteECDSA | suiteTLS12 | suiteDefaultOff, nil, nil, aeadAESCCM8},
+		{TLS_ECDHE_ECDSA_WITH_AES_256_CCM_8, 32, 0, 4, ecdheECDSAKA,
+			suiteECDHE | suiteECDSA | suiteTLS12 | suiteDefaultOff, nil, nil, aeadAESCCM8},
+	}...)
+
+	// Never offered nor selected by default, like the TLS 1.2 CCM suites.
+	cipherSuitesTLS13 = append(cipherSuitesTLS13, []*cipherSuiteTLS13{
+		{TLS_AES_128_CCM_SHA256, 16, aeadAESCCMTLS13, crypto.SHA256},
+		{TLS_AES_128_CCM_8_SHA256, 16, aeadAESCCM8TLS13, crypto.SHA256},
 	}...)
 
 	utlsSupportedGroups = map[CurveID]bool{
@@ -205,7 +320,7 @@ func init() {
 // This option does not change the shape of parrots (i.e. same ciphers will be offered either way).
 // Must be called before establishing any connections.
 func EnableWeakCiphers() {
-	utlsSupportedCipherSuites = append(cipherSuites, []*cipherSuite{
+	utlsSupportedCipherSuites = append(utlsSupportedCipherSuites, []*cipherSuite{
 		{DISABLED_TLS_RSA_WITH_AES_256_CBC_SHA256, 32, 32, 16, rsaKA,
 			suiteTLS12 | suiteDefaultOff, cipherAES, macSHA256, nil},
 
@@ -5,8 +5,6 @@
 package tls
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/cipher"
 	"encoding/binary"
 	"errors"
@@ -15,6 +13,9 @@ import (
 	"net"
 	"strconv"
 	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
 )
 
 type UConn struct {
@@ -31,14 +32,54 @@ type UConn struct {
 
 	greaseSeed [ssl_grease_last_index]uint16
 
+	greasePRNGSeed *PRNGSeed // set by SetGREASESeed
+	greaseRand     io.Reader // the PRNG seeded with greasePRNGSeed, if any
+
 	extCompressCerts bool
+
+	recordSizeLimit uint16 // record_size_limit offered in the ClientHello, if any
+	statusRequestV2 bool   // whether the ClientHello offers status_request_v2
+
+	delegatedCredentialSchemes []SignatureScheme // delegated_credentials schemes offered in the ClientHello, if any
+
+	applicationSettings *ApplicationSettingsExtension // application_settings offered in the ClientHello, if any
+
+	certificateAuthorities [][]byte // certificate_authorities offered in the ClientHello, if any
+
+	cachedInfo *CachedInfoExtension // cached_info offered in the ClientHello, if any
+
+	ech *echClientContext // non-nil once SetECHConfigs has enabled ECH
+
+	externalPSKs []externalPSK // offered in the pre_shared_key extension, see AddExternalPSK
+
+	offerPooledSession bool // set by ClientSessionPool.UClient
+
+	ticketSession *ClientSessionState // set by SetSessionTicket
+
+	helloTime time.Time // when the ClientHello was first built, see obfuscatedTicketAge
+
+	earlyData *earlyDataState // set by EnableEarlyData
+
+	// clientRandom and legacySessionID, if non-nil, replace the generated
+	// ClientHello random and legacy_session_id, see SetClientRandom and
+	// SetLegacySessionID.
+	clientRandom    []byte
+	legacySessionID []byte
 }
 
 // UClient returns a new uTLS client, with behavior depending on clientHelloID.
 // Config CAN be nil, but make sure to eventually specify ServerName.
+//
+// The UConn works on a copy of config, as building a mimicked ClientHello
+// sets fields such as NextProtos and CurvePreferences, so the same Config may
+// be passed to UClient from many goroutines at once. Changes made to config
+// after UClient returns do not affect the UConn; the ClientSessionCache is
+// shared, and sessions are resumed across all the UConns using it.
 func UClient(conn net.Conn, config *Config, clientHelloID ClientHelloID) *UConn {
 	if config == nil {
 		config = &Config{}
+	} else {
+		config = config.Clone()
 	}
 	tlsConn := Conn{conn: conn, config: config, isClient: true}
 	handshakeState := ClientHandshakeState{C: &tlsConn, Hello: &ClientHelloMsg{}}
@@ -47,6 +88,12 @@ func UClient(conn net.Conn, config *Config, clientHelloID ClientHelloID) *UConn
 	return &uconn
 }
 
+// ClientHelloIDResolved returns the parrot the ClientHelloID stands for, such
+// as HelloChrome_124 for a ClientHelloID{"Chrome", "0", nil}.
+func (uconn *UConn) ClientHelloIDResolved() ClientHelloID {
+	return resolveClientHelloID(uconn.ClientHelloID)
+}
+
 // BuildHandshakeState behavior varies based on ClientHelloID and
 // whether it was already called before.
 // If HelloGolang:
@@ -61,6 +108,15 @@ func UClient(conn net.Conn, config *Config, clientHelloID ClientHelloID) *UConn
 // default/mimicked ClientHello.
 func (uconn *UConn) BuildHandshakeState() error {
 	if uconn.ClientHelloID == HelloGolang {
+		if uconn.ech != nil {
+			return errors.New("tls: Encrypted Client Hello is not supported with HelloGolang")
+		}
+		if len(uconn.externalPSKs) > 0 {
+			return errors.New("tls: external PSKs are not supported with HelloGolang")
+		}
+		if uconn.ticketSession != nil {
+			return errors.New("tls: SetSessionTicket is not supported with HelloGolang")
+		}
 		if uconn.ClientHelloBuilt {
 			return nil
 		}
@@ -74,6 +130,8 @@ func (uconn *UConn) BuildHandshakeState() error {
 		uconn.HandshakeState.Hello = hello.getPublicPtr()
 		uconn.HandshakeState.State13.EcdheParams = ecdheParamMapToPublic(ecdheParams)
 		uconn.HandshakeState.C = uconn.Conn
+		uconn.applyClientRandomAndSessionID()
+		uconn.loadGolangSession()
 	} else {
 		if !uconn.ClientHelloBuilt {
 			err := uconn.applyPresetByID(uconn.ClientHelloID)
@@ -81,12 +139,26 @@ func (uconn *UConn) BuildHandshakeState() error {
 				return err
 			}
 		}
+		if uconn.helloTime.IsZero() {
+			uconn.helloTime = uconn.config.time()
+		}
 
+		uconn.addPooledPSKExtension()
+		if err := uconn.applyTicketSession(); err != nil {
+			return err
+		}
+		if err := uconn.addExternalPSKExtensions(); err != nil {
+			return err
+		}
 		err := uconn.ApplyConfig()
 		if err != nil {
 			return err
 		}
-		err = uconn.MarshalClientHello()
+		if err := uconn.addEarlyDataExtension(); err != nil {
+			return err
+		}
+		uconn.applyClientRandomAndSessionID()
+		err = uconn.marshalHello()
 		if err != nil {
 			return err
 		}
@@ -95,6 +167,24 @@ func (uconn *UConn) BuildHandshakeState() error {
 	return nil
 }
 
+// loadGolangSession adds the session to resume, if any, to the ClientHello
+// built by crypto/tls for HelloGolang, and marshals it. The ticket age and
+// binders are thus computed once, and the ClientHello the handshake sends is
+// the one MarshalClientHello returns.
+func (uconn *UConn) loadGolangSession() {
+	hello := uconn.HandshakeState.Hello.getPrivatePtr()
+	if uconn.HandshakeState.Session == nil {
+		_, session, earlySecret, binderKey := uconn.loadSession(hello)
+		if session != nil {
+			uconn.HandshakeState.Session = session
+			uconn.HandshakeState.State13.EarlySecret = earlySecret
+			uconn.HandshakeState.State13.BinderKey = binderKey
+		}
+	}
+	hello.marshal()
+	uconn.HandshakeState.Hello = hello.getPublicPtr()
+}
+
 // SetSessionState sets the session ticket, which may be preshared or fake.
 // If session is nil, the body of session ticket extension will be unset,
 // but the extension itself still MAY be present for mimicking purposes.
@@ -140,19 +230,181 @@ func (uconn *UConn) SetSessionCache(cache ClientSessionCache) {
 	uconn.HandshakeState.Hello.TicketSupported = true
 }
 
+// errClientHelloSent is returned by the ClientHello setters once the
+// handshake has run.
+var errClientHelloSent = errors.New("tls: the ClientHello was already sent")
+
 // SetClientRandom sets client random explicitly.
-// BuildHandshakeFirst() must be called before SetClientRandom.
 // r must to be 32 bytes long.
+// It takes effect the next time the handshake state is built, so it may be
+// called before BuildHandshakeState, or the handshake, to reproduce a
+// captured ClientHello. It does not change the values drawn from
+// Config.Rand, so the GREASE values stay the same for a given Rand, see also
+// SetGreaseSeed.
 func (uconn *UConn) SetClientRandom(r []byte) error {
+	if uconn.clientHelloSent() {
+		return errClientHelloSent
+	}
 	if len(r) != 32 {
 		return errors.New("Incorrect client random length! Expected: 32, got: " + strconv.Itoa(len(r)))
 	} else {
+		uconn.clientRandom = make([]byte, 32)
+		copy(uconn.clientRandom, r)
 		uconn.HandshakeState.Hello.Random = make([]byte, 32)
 		copy(uconn.HandshakeState.Hello.Random, r)
 		return nil
 	}
 }
 
+// SetLegacySessionID sets the legacy_session_id of the ClientHello
+// explicitly, replacing the random or ticket-derived one. id must be at most
+// 32 bytes long, and may be empty.
+// Like SetClientRandom, it takes effect the next time the handshake state is
+// built.
+func (uconn *UConn) SetLegacySessionID(id []byte) error {
+	if uconn.clientHelloSent() {
+		return errClientHelloSent
+	}
+	if len(id) > 32 {
+		return errors.New("tls: legacy session ID is " + strconv.Itoa(len(id)) + " bytes long, expected at most 32")
+	}
+	uconn.legacySessionID = make([]byte, len(id))
+	copy(uconn.legacySessionID, id)
+	uconn.HandshakeState.Hello.SessionId = make([]byte, len(id))
+	copy(uconn.HandshakeState.Hello.SessionId, id)
+	return nil
+}
+
+// SetGREASESeed makes all the GREASE of the ClientHello derive from seed
+// rather than from Config.Rand, so that it can be reproduced independently of
+// the randomness of the key shares. Like SetClientRandom, it takes effect the
+// next time the handshake state is built.
+//
+// The seed keys a PRNG, as the seed of a ClientHelloID does. Its first 12
+// bytes are the GREASE slots of BoringSSL, two bytes each, in this order:
+// the cipher suite, the group of supported_groups and key_share, the first
+// and the second GREASE extension, the version of supported_versions, and a
+// slot unused by the parrots. A GREASE encrypted_client_hello extension then
+// draws its HPKE suite, config ID and payload length choices (3 bytes), its
+// X25519 enc key (32 bytes) and its payload from the same stream.
+//
+// Two UConns with the same seed and ClientHelloSpec send the same GREASE.
+// Their ClientHellos are byte-identical if the client random, the legacy
+// session ID and Config.Rand, from which the key shares are drawn, are the
+// same as well.
+func (uconn *UConn) SetGREASESeed(seed [32]byte) {
+	uconn.greasePRNGSeed = new(PRNGSeed)
+	*uconn.greasePRNGSeed = seed
+}
+
+// SetGREASEPRNGSeed is SetGREASESeed with a PRNGSeed. If seed is nil, the
+// GREASE is drawn from Config.Rand again.
+func (uconn *UConn) SetGREASEPRNGSeed(seed *PRNGSeed) {
+	if seed == nil {
+		uconn.greasePRNGSeed = nil
+		return
+	}
+	uconn.SetGREASESeed(*seed)
+}
+
+// SetGreaseSeed calls SetGREASESeed with seed in the first 8 bytes,
+// little-endian, and the others zero.
+func (uconn *UConn) SetGreaseSeed(seed uint64) {
+	var b [32]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	uconn.SetGREASESeed(b)
+}
+
+// SetSessionID is SetLegacySessionID.
+func (uconn *UConn) SetSessionID(id []byte) error {
+	return uconn.SetLegacySessionID(id)
+}
+
+// FinalExtensionOrder returns the types of the extensions of the ClientHello
+// built by BuildHandshakeState, in the order they are sent, that is after
+// randomized parrots shuffled them and with the chosen GREASE values. It
+// returns nil if the ClientHello was not built yet.
+func (uconn *UConn) FinalExtensionOrder() []uint16 {
+	raw := uconn.HandshakeState.Hello.Raw
+	if len(raw) < 4 {
+		return nil
+	}
+	s := cryptobyte.String(raw[4:])
+	var vers uint16
+	var random []byte
+	var sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.ReadUint16(&vers) || !s.ReadBytes(&random, 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) ||
+		!s.ReadUint16LengthPrefixed(&extensions) {
+		return nil
+	}
+	order := []uint16{}
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil
+		}
+		order = append(order, extType)
+	}
+	return order
+}
+
+// SentExtensions returns the extensions of the ClientHello built by
+// BuildHandshakeState, in the order they are sent. Unlike the Extensions of
+// the ClientHelloSpec, GREASE extensions carry their chosen Value, the
+// PreSharedKeyExtension its binders, an early_data extension is only
+// included if early data is offered, a padding extension only if it pads,
+// and with Encrypted Client Hello they are the extensions of the
+// ClientHelloOuter.
+//
+// The returned extensions are the ones of the UConn, and must not be
+// modified. It returns nil if the ClientHello was not built yet, or with
+// HelloGolang.
+func (uconn *UConn) SentExtensions() []TLSExtension {
+	if !uconn.ClientHelloBuilt || uconn.ClientHelloID == HelloGolang {
+		return nil
+	}
+	exts := uconn.Extensions
+	if uconn.ech != nil {
+		_, exts = uconn.ech.extensions(exts)
+	}
+	sent := make([]TLSExtension, 0, len(exts))
+	for _, ext := range exts {
+		if _, ok := ext.(*EarlyDataExtension); ok && !uconn.HandshakeState.Hello.EarlyData {
+			continue
+		}
+		if ext.Len() == 0 {
+			// A padding extension which does not pad is not sent.
+			continue
+		}
+		sent = append(sent, ext)
+	}
+	return sent
+}
+
+// clientHelloSent reports whether the handshake ran, successfully or not,
+// after which the ClientHello can no longer be changed.
+func (uconn *UConn) clientHelloSent() bool {
+	return uconn.handshakeComplete() || uconn.handshakeErr != nil
+}
+
+// applyClientRandomAndSessionID overrides the ClientHello fields set with
+// SetClientRandom and SetLegacySessionID.
+func (uconn *UConn) applyClientRandomAndSessionID() {
+	hello := uconn.HandshakeState.Hello
+	if uconn.clientRandom != nil {
+		hello.Random = make([]byte, 32)
+		copy(hello.Random, uconn.clientRandom)
+	}
+	if uconn.legacySessionID != nil {
+		hello.SessionId = make([]byte, len(uconn.legacySessionID))
+		copy(hello.SessionId, uconn.legacySessionID)
+	}
+}
+
 func (uconn *UConn) SetSNI(sni string) {
 	hname := hostnameInSNI(sni)
 	uconn.config.ServerName = hname
@@ -180,6 +432,10 @@ func (c *UConn) Handshake() error {
 	c.in.Lock()
 	defer c.in.Unlock()
 
+	if c.config.HandshakeTimeout != 0 {
+		defer c.applyHandshakeTimeout(c.config.HandshakeTimeout)()
+	}
+
 	if c.isClient {
 		// [uTLS section begins]
 		err := c.BuildHandshakeState()
@@ -207,6 +463,31 @@ func (c *UConn) Handshake() error {
 	return c.handshakeErr
 }
 
+// applyHandshakeTimeout sets deadlines on the underlying connection that
+// expire after timeout, unless the deadlines set on c expire earlier. It
+// returns a function restoring the deadlines set on c.
+func (c *Conn) applyHandshakeTimeout(timeout time.Duration) (restore func()) {
+	deadline := time.Now().Add(timeout)
+	earliest := func(t time.Time) time.Time {
+		if t.IsZero() || deadline.Before(t) {
+			return deadline
+		}
+		return t
+	}
+
+	c.deadlineMutex.Lock()
+	c.conn.SetReadDeadline(earliest(c.readDeadline))
+	c.conn.SetWriteDeadline(earliest(c.writeDeadline))
+	c.deadlineMutex.Unlock()
+
+	return func() {
+		c.deadlineMutex.Lock()
+		defer c.deadlineMutex.Unlock()
+		c.conn.SetReadDeadline(c.readDeadline)
+		c.conn.SetWriteDeadline(c.writeDeadline)
+	}
+}
+
 // Copy-pasted from tls.Conn in its entirety. But c.Handshake() is now utls' one, not tls.
 // Write writes data to the connection.
 func (c *UConn) Write(b []byte) (int, error) {
@@ -311,7 +592,14 @@ func (c *UConn) clientHandshake() (err error) {
 	}
 	// [uTLS section ends]
 
-	cacheKey, session, earlySecret, binderKey := c.loadSession(hello)
+	var cacheKey string
+	var session *ClientSessionState
+	var earlySecret, binderKey []byte
+	if c.ech == nil { // uTLS: ECH connections do not resume sessions
+		cacheKey, session, earlySecret, binderKey = c.loadSession(hello)
+	} else {
+		hello.random = c.ech.outerRandom
+	}
 	if cacheKey != "" && session != nil {
 		defer func() {
 			// If we got a handshake failure when resuming a session, throw away
@@ -336,6 +624,9 @@ func (c *UConn) clientHandshake() (err error) {
 	if _, err := c.writeRecord(recordTypeHandshake, hello.marshal()); err != nil {
 		return err
 	}
+	if err := c.sendEarlyData(hello); err != nil {
+		return err
+	}
 
 	msg, err := c.readHandshake()
 	if err != nil {
@@ -361,12 +652,25 @@ func (c *UConn) clientHandshake() (err error) {
 			hs13.earlySecret = earlySecret
 			hs13.binderKey = binderKey
 		}
+		hs13.sentDummyCCS = c.earlyDataSent()
 		// In TLS 1.3, session tickets are delivered after the handshake.
 		err = hs13.handshake()
 		if handshakeState := hs13.toPublic13(); handshakeState != nil {
 			c.HandshakeState = *handshakeState
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		return c.writeDeferredEarlyData()
+	}
+	if c.earlyDataSent() {
+		// The record layer holds the early data key, so no alert is sent.
+		return errors.New("tls: server selected TLS 1.2 after the client sent early data")
+	}
+
+	if c.ech != nil {
+		// ECH is only defined for TLS 1.3, so it was rejected.
+		c.echPublicName = c.ech.config.PublicName
 	}
 
 	hs12 := c.HandshakeState.toPrivate12()
@@ -379,13 +683,16 @@ func (c *UConn) clientHandshake() (err error) {
 	if err != nil {
 		return err
 	}
+	if c.ech != nil {
+		return c.echRejectionError(c.ech)
+	}
 
 	// If we had a successful handshake and hs.session is different from
 	// the one already cached - cache a new one.
 	if cacheKey != "" && hs12.session != nil && session != hs12.session {
 		c.config.ClientSessionCache.Put(cacheKey, hs12.session)
 	}
-	return nil
+	return c.writeDeferredEarlyData()
 }
 
 func (uconn *UConn) ApplyConfig() error {
@@ -398,15 +705,108 @@ func (uconn *UConn) ApplyConfig() error {
 	return nil
 }
 
-func (uconn *UConn) MarshalClientHello() error {
+// MarshalClientHello returns a copy of the ClientHello handshake message,
+// without the record header, exactly as the handshake would send it,
+// including the padding and the PSK binders. It builds the handshake state
+// first if it was not built yet, see BuildHandshakeState, and otherwise
+// returns the ClientHello last built. It does not write to the network, and
+// must be called before the handshake.
+func (uconn *UConn) MarshalClientHello() ([]byte, error) {
+	if uconn.clientHelloSent() {
+		return nil, errClientHelloSent
+	}
+	if !uconn.ClientHelloBuilt {
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte{}, uconn.HandshakeState.Hello.Raw...), nil
+}
+
+// marshalHello marshals the ClientHello with uconn.Extensions into
+// HandshakeState.Hello.Raw. The PSK binders, if any, are computed last, over
+// the whole ClientHello.
+func (uconn *UConn) marshalHello() error {
+	return uconn.marshalHelloWithTranscript(nil)
+}
+
+// marshalHelloWithTranscript is marshalHello, with the PSK binders computed
+// over transcript followed by the ClientHello, as they are in the ClientHello
+// answering a HelloRetryRequest.
+func (uconn *UConn) marshalHelloWithTranscript(transcript []byte) error {
+	hello := uconn.HandshakeState.Hello
+	if len(hello.PskIdentities) == 0 {
+		// Early data is only indicated along with a PSK.
+		hello.EarlyData = false
+	}
+	if uconn.ech != nil {
+		return uconn.marshalClientHelloECH()
+	}
+	raw, err := marshalClientHello(hello, uconn.Extensions)
+	if err != nil {
+		return err
+	}
+	hello.Raw = raw
+	return uconn.updatePSKBinders(transcript)
+}
+
+func isPreSharedKeyExtension(ext TLSExtension) bool {
+	_, ok := ext.(*PreSharedKeyExtension)
+	return ok
+}
+
+// updatePSKBinders computes the binders of the PreSharedKeyExtension, if it
+// offers any PSK, over transcript followed by the marshaled ClientHello, see
+// RFC 8446, Section 4.2.11.2.
+func (uconn *UConn) updatePSKBinders(transcript []byte) error {
 	hello := uconn.HandshakeState.Hello
+	if len(hello.PskIdentities) == 0 {
+		return nil
+	}
+	if n := len(uconn.Extensions); n == 0 || !isPreSharedKeyExtension(uconn.Extensions[n-1]) {
+		return errors.New("tls: PreSharedKeyExtension must be the last extension")
+	}
+
+	private := hello.getPrivatePtr()
+	truncatedHello := private.marshalWithoutBinders()
+	var binders [][]byte
+	if len(private.pskIdentities) > len(uconn.externalPSKs) {
+		// The first identity is the session to resume.
+		suite := cipherSuiteTLS13ByID(uconn.HandshakeState.Session.cipherSuite)
+		if suite == nil {
+			return errors.New("tls: unknown cipher suite of the resumed session")
+		}
+		h := suite.hash.New()
+		h.Write(transcript)
+		h.Write(truncatedHello)
+		binders = append(binders, suite.finishedHash(uconn.HandshakeState.State13.BinderKey, h))
+	}
+	private.updateBinders(append(binders, uconn.externalPSKBinders(transcript, truncatedHello)...))
+	hello.PskBinders = private.pskBinders
+	return nil
+}
+
+// marshalClientHello marshals hello with the given extensions, updating the
+// padding extension, if any, to the resulting length.
+func marshalClientHello(hello *ClientHelloMsg, extensions []TLSExtension) ([]byte, error) {
 	headerLength := 2 + 32 + 1 + len(hello.SessionId) +
 		2 + len(hello.CipherSuites)*2 +
 		1 + len(hello.CompressionMethods)
 
+	// The early_data extension is only sent along with a PSK.
+	omitted := func(ext TLSExtension) bool {
+		_, ok := ext.(*EarlyDataExtension)
+		return ok && !hello.EarlyData
+	}
+
 	extensionsLen := 0
+	numExtensions := 0
 	var paddingExt *UtlsPaddingExtension
-	for _, ext := range uconn.Extensions {
+	for _, ext := range extensions {
+		if omitted(ext) {
+			continue
+		}
+		numExtensions++
 		if pe, ok := ext.(*UtlsPaddingExtension); !ok {
 			// If not padding - just add length of extension to total length
 			extensionsLen += ext.Len()
@@ -415,7 +815,7 @@ func (uconn *UConn) MarshalClientHello() error {
 			if paddingExt == nil {
 				paddingExt = pe
 			} else {
-				return errors.New("Multiple padding extensions!")
+				return nil, errors.New("Multiple padding extensions!")
 			}
 		}
 	}
@@ -427,52 +827,48 @@ func (uconn *UConn) MarshalClientHello() error {
 	}
 
 	helloLen := headerLength
-	if len(uconn.Extensions) > 0 {
+	if numExtensions > 0 {
 		helloLen += 2 + extensionsLen // 2 bytes for extensions' length
 	}
 
-	helloBuffer := bytes.Buffer{}
-	bufferedWriter := bufio.NewWriterSize(&helloBuffer, helloLen+4) // 1 byte for tls record type, 3 for length
-	// We use buffered Writer to avoid checking write errors after every Write(): whenever first error happens
-	// Write() will become noop, and error will be accessible via Flush(), which is called once in the end
-
-	binary.Write(bufferedWriter, binary.BigEndian, typeClientHello)
-	helloLenBytes := []byte{byte(helloLen >> 16), byte(helloLen >> 8), byte(helloLen)} // poor man's uint24
-	binary.Write(bufferedWriter, binary.BigEndian, helloLenBytes)
-	binary.Write(bufferedWriter, binary.BigEndian, hello.Vers)
-
-	binary.Write(bufferedWriter, binary.BigEndian, hello.Random)
-
-	binary.Write(bufferedWriter, binary.BigEndian, uint8(len(hello.SessionId)))
-	binary.Write(bufferedWriter, binary.BigEndian, hello.SessionId)
-
-	binary.Write(bufferedWriter, binary.BigEndian, uint16(len(hello.CipherSuites)<<1))
+	// The ClientHello is marshaled in a single allocation, 1 byte for the
+	// message type and 3 for its length.
+	b := make([]byte, 0, 4+helloLen)
+	b = append(b, typeClientHello, byte(helloLen>>16), byte(helloLen>>8), byte(helloLen))
+	b = append(b, byte(hello.Vers>>8), byte(hello.Vers))
+	b = append(b, hello.Random...)
+	b = append(b, uint8(len(hello.SessionId)))
+	b = append(b, hello.SessionId...)
+	b = append(b, byte(len(hello.CipherSuites)>>7), byte(len(hello.CipherSuites)<<1))
 	for _, suite := range hello.CipherSuites {
-		binary.Write(bufferedWriter, binary.BigEndian, suite)
+		b = append(b, byte(suite>>8), byte(suite))
 	}
-
-	binary.Write(bufferedWriter, binary.BigEndian, uint8(len(hello.CompressionMethods)))
-	binary.Write(bufferedWriter, binary.BigEndian, hello.CompressionMethods)
-
-	if len(uconn.Extensions) > 0 {
-		binary.Write(bufferedWriter, binary.BigEndian, uint16(extensionsLen))
-		for _, ext := range uconn.Extensions {
-			bufferedWriter.ReadFrom(ext)
+	b = append(b, uint8(len(hello.CompressionMethods)))
+	b = append(b, hello.CompressionMethods...)
+
+	if numExtensions > 0 {
+		b = append(b, byte(extensionsLen>>8), byte(extensionsLen))
+		for _, ext := range extensions {
+			if omitted(ext) {
+				continue
+			}
+			n := ext.Len()
+			if len(b)+n > cap(b) {
+				break
+			}
+			b = b[:len(b)+n]
+			if _, err := io.ReadFull(ext, b[len(b)-n:]); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	err := bufferedWriter.Flush()
-	if err != nil {
-		return err
+	if len(b) != 4+helloLen {
+		return nil, errors.New("utls: unexpected ClientHello length. Expected: " + strconv.Itoa(4+helloLen) +
+			". Got: " + strconv.Itoa(len(b)))
 	}
 
-	if helloBuffer.Len() != 4+helloLen {
-		return errors.New("utls: unexpected ClientHello length. Expected: " + strconv.Itoa(4+helloLen) +
-			". Got: " + strconv.Itoa(helloBuffer.Len()))
-	}
-
-	hello.Raw = helloBuffer.Bytes()
-	return nil
+	return b, nil
 }
 
 // get current state of cipher and encrypt zeros to get keystream
@@ -506,7 +902,7 @@ func (uconn *UConn) SetTLSVers(minTLSVers, maxTLSVers uint16, specExtensions []T
 					minVers := uint16(0)
 					maxVers := uint16(0)
 					for _, vers := range versions {
-						if vers == GREASE_PLACEHOLDER {
+						if isGREASEValue(vers) {
 							continue
 						}
 						if maxVers < vers || maxVers == 0 {
@@ -538,7 +934,7 @@ func (uconn *UConn) SetTLSVers(minTLSVers, maxTLSVers uint16, specExtensions []T
 		}
 	}
 
-	if minTLSVers < VersionTLS10 || minTLSVers > VersionTLS12 {
+	if minTLSVers < VersionTLS10 || minTLSVers > VersionTLS13 {
 		return fmt.Errorf("uTLS does not support 0x%X as min version", minTLSVers)
 	}
 
@@ -553,6 +949,19 @@ func (uconn *UConn) SetTLSVers(minTLSVers, maxTLSVers uint16, specExtensions []T
 	return nil
 }
 
+// SetUserData attaches v to the connection, for instance to correlate it with
+// the request it serves. It is passed to the handshake callbacks as the
+// UserData of CertificateRequestInfo and of the ConnectionState given to
+// Config.VerifyConnection. SetUserData must not be called during the handshake.
+func (uconn *UConn) SetUserData(v interface{}) {
+	uconn.userData = v
+}
+
+// UserData returns the value set with SetUserData, or nil.
+func (uconn *UConn) UserData() interface{} {
+	return uconn.userData
+}
+
 func (uconn *UConn) SetUnderlyingConn(c net.Conn) {
 	uconn.Conn.conn = c
 }
@@ -6,12 +6,18 @@ package tls
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -643,3 +649,2790 @@ func TestUTLSMakeConnWithCompleteHandshake(t *testing.T) {
 
 	serverTls.Write(serverMsg)
 }
+
+func TestUTLSChrome_120ClientHello(t *testing.T) {
+	// GREASE values are drawn on every connection, and the padding depends
+	// on the length of the ClientHello.
+	extensions := func(id ClientHelloID) []uint16 {
+		var ids []uint16
+		for _, ext := range clientHelloExtensionIDs(t, captureUTLSClientHello(t, id)) {
+			if isGREASEValue(ext) {
+				ext = GREASE_PLACEHOLDER
+			}
+			if ext != utlsExtensionPadding {
+				ids = append(ids, ext)
+			}
+		}
+		return ids
+	}
+
+	chrome113 := extensions(HelloChrome_113)
+	for _, ext := range chrome113 {
+		if ext == utlsExtensionEncryptedClientHello {
+			t.Errorf("HelloChrome_113 sends encrypted_client_hello: %v", chrome113)
+		}
+	}
+	n := len(chrome113)
+	want := append(append(chrome113[:n-1:n-1], utlsExtensionEncryptedClientHello), chrome113[n-1])
+	if got := extensions(HelloChrome_120); !reflect.DeepEqual(got, want) {
+		t.Errorf("HelloChrome_120 extensions = %v, want %v", got, want)
+	}
+}
+
+// TestUTLSFirefoxExtensionOrder checks the Firefox presets against the
+// extension order of the corresponding releases. Firefox does not shuffle its
+// extensions, so any change here is a fingerprint change.
+func TestUTLSFirefoxExtensionOrder(t *testing.T) {
+	for _, test := range []struct {
+		helloID    ClientHelloID
+		extensions []uint16
+	}{
+		// The padding extension is only sent by 55 and 56 for ClientHellos
+		// between 256 and 511 bytes, which the ones sent here are not.
+		{HelloFirefox_55, []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 13}},
+		{HelloFirefox_56, []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 13}},
+		{HelloFirefox_63, []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 51, 43, 13, 45, 28, 21}},
+		{HelloFirefox_65, []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 51, 43, 13, 45, 28, 21}},
+		{HelloFirefox_102, []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 34, 51, 43, 13, 45, 28, 21}},
+		{HelloFirefox_128, []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 34, 51, 43, 13, 45, 28, 27, 65037}},
+		{HelloFirefox_Tor, []uint16{0, 23, 65281, 10, 11, 16, 5, 34, 51, 43, 13, 45, 28, 27}},
+	} {
+		got := clientHelloExtensionIDs(t, captureUTLSClientHello(t, test.helloID))
+		if !reflect.DeepEqual(got, test.extensions) {
+			t.Errorf("%s: extensions = %v, want %v", test.helloID.Str(), got, test.extensions)
+		}
+	}
+}
+
+func TestUTLSFirefox_128ClientHello(t *testing.T) {
+	hello := captureUTLSClientHello(t, HelloFirefox_128)
+
+	wantExtensions := []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 34, 51, 43, 13, 45, 28, 27, 65037}
+	if got := clientHelloExtensionIDs(t, hello); !reflect.DeepEqual(got, wantExtensions) {
+		t.Errorf("extensions = %v, want %v", got, wantExtensions)
+	}
+
+	m := new(clientHelloMsg)
+	if !m.unmarshal(hello) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	wantCurves := []CurveID{X25519MLKEM768, X25519, CurveP256, CurveP384, CurveP521,
+		CurveID(FakeFFDHE2048), CurveID(FakeFFDHE3072)}
+	if !reflect.DeepEqual(m.supportedCurves, wantCurves) {
+		t.Errorf("supported groups = %v, want %v", m.supportedCurves, wantCurves)
+	}
+	delegatedCredentials := []byte{0x00, 0x22, 0x00, 0x0a, 0x00, 0x08, 0x04, 0x03, 0x05, 0x03, 0x06, 0x03, 0x02, 0x03}
+	if !bytes.Contains(hello, delegatedCredentials) {
+		t.Errorf("delegated_credentials extension %x not found", delegatedCredentials)
+	}
+}
+
+func TestUTLSFirefox_128KeyShares(t *testing.T) {
+	m := new(clientHelloMsg)
+	if !m.unmarshal(captureUTLSClientHello(t, HelloFirefox_128)) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	var shares []CurveID
+	for _, ks := range m.keyShares {
+		shares = append(shares, ks.group)
+	}
+	if wantShares := []CurveID{X25519MLKEM768, X25519, CurveP256}; !reflect.DeepEqual(shares, wantShares) {
+		t.Errorf("key shares = %v, want %v", shares, wantShares)
+	}
+	if len(m.keyShares) > 0 && len(m.keyShares[0].data) != x25519MLKEM768ClientShareSize {
+		t.Errorf("X25519MLKEM768 key share is %d bytes, want %d", len(m.keyShares[0].data), x25519MLKEM768ClientShareSize)
+	}
+	if len(m.cipherSuites) != 17 {
+		t.Errorf("%d cipher suites, want 17", len(m.cipherSuites))
+	}
+}
+
+func TestUTLSFirefox_128_KyberClientHello(t *testing.T) {
+	m := new(clientHelloMsg)
+	if !m.unmarshal(captureUTLSClientHello(t, HelloFirefox_128_Kyber)) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	firefox := new(clientHelloMsg)
+	if !firefox.unmarshal(captureUTLSClientHello(t, HelloFirefox_128)) {
+		t.Fatal("failed to parse the Firefox ClientHello")
+	}
+	wantCurves := append([]CurveID{X25519Kyber768Draft00}, firefox.supportedCurves[1:]...)
+	if !reflect.DeepEqual(m.supportedCurves, wantCurves) {
+		t.Errorf("supported groups = %v, want %v", m.supportedCurves, wantCurves)
+	}
+	var shares []CurveID
+	for _, ks := range m.keyShares {
+		shares = append(shares, ks.group)
+	}
+	if wantShares := []CurveID{X25519Kyber768Draft00, X25519, CurveP256}; !reflect.DeepEqual(shares, wantShares) {
+		t.Errorf("key shares = %v, want %v", shares, wantShares)
+	}
+	if len(m.keyShares) > 0 && len(m.keyShares[0].data) != x25519Kyber768ClientShareSize {
+		t.Errorf("X25519Kyber768Draft00 key share is %d bytes, want %d", len(m.keyShares[0].data), x25519Kyber768ClientShareSize)
+	}
+	if !reflect.DeepEqual(m.cipherSuites, firefox.cipherSuites) {
+		t.Errorf("cipher suites = %x, want the Firefox 128 ones %x", m.cipherSuites, firefox.cipherSuites)
+	}
+}
+
+func TestUTLSFirefox_TorClientHello(t *testing.T) {
+	hello := captureUTLSClientHello(t, HelloFirefox_Tor)
+	m := new(clientHelloMsg)
+	if !m.unmarshal(hello) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	if m.ticketSupported {
+		t.Error("Tor Browser ClientHello offers session tickets")
+	}
+
+	// Apart from that and ECH, it is the Firefox 128 ClientHello, with the
+	// same groups and key shares.
+	firefox := new(clientHelloMsg)
+	if !firefox.unmarshal(captureUTLSClientHello(t, HelloFirefox_128)) {
+		t.Fatal("failed to parse the Firefox ClientHello")
+	}
+	if !reflect.DeepEqual(m.supportedCurves, firefox.supportedCurves) {
+		t.Errorf("supported groups = %v, want the Firefox ones %v", m.supportedCurves, firefox.supportedCurves)
+	}
+	var shares, firefoxShares []CurveID
+	for _, ks := range m.keyShares {
+		shares = append(shares, ks.group)
+	}
+	for _, ks := range firefox.keyShares {
+		firefoxShares = append(firefoxShares, ks.group)
+	}
+	if len(shares) == 0 || shares[0] != X25519MLKEM768 || !reflect.DeepEqual(shares, firefoxShares) {
+		t.Errorf("key shares = %v, want the Firefox ones %v", shares, firefoxShares)
+	}
+	if !reflect.DeepEqual(m.cipherSuites, firefox.cipherSuites) {
+		t.Errorf("cipher suites = %x, want the Firefox ones %x", m.cipherSuites, firefox.cipherSuites)
+	}
+	if !reflect.DeepEqual(m.supportedSignatureAlgorithms, firefox.supportedSignatureAlgorithms) {
+		t.Errorf("signature algorithms = %v, want the Firefox ones %v",
+			m.supportedSignatureAlgorithms, firefox.supportedSignatureAlgorithms)
+	}
+	if !reflect.DeepEqual(m.alpnProtocols, []string{"h2", "http/1.1"}) {
+		t.Errorf("ALPN protocols = %q", m.alpnProtocols)
+	}
+
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		Server(s, testConfig).Handshake()
+	}()
+	client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloFirefox_Tor)
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUTLSChrome_124ClientHello(t *testing.T) {
+	hello := captureUTLSClientHello(t, HelloChrome_124)
+
+	// compress_certificate, application_settings and the GREASE ECH are
+	// adjacent, followed by the last GREASE extension. The padding is left
+	// out, as the X25519Kyber768Draft00 key share makes the ClientHello
+	// longer than 512 bytes.
+	var ids []uint16
+	for _, id := range clientHelloExtensionIDs(t, hello) {
+		if isGREASEValue(id) {
+			id = GREASE_PLACEHOLDER
+		}
+		ids = append(ids, id)
+	}
+	wantExtensions := []uint16{GREASE_PLACEHOLDER, 0, 23, 65281, 10, 11, 35, 16, 5, 13, 18, 51, 45, 43,
+		27, 17513, 65037, GREASE_PLACEHOLDER}
+	if !reflect.DeepEqual(ids, wantExtensions) {
+		t.Errorf("extensions = %v, want %v", ids, wantExtensions)
+	}
+	if got, want := ja4(t, hello), "t13d1516h2_8daaf6152771_02713d6af862"; got != want {
+		t.Errorf("JA4 is %s, want %s", got, want)
+	}
+
+	m := new(clientHelloMsg)
+	if !m.unmarshal(hello) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	if len(m.supportedCurves) != 5 || !isGREASEValue(uint16(m.supportedCurves[0])) ||
+		!reflect.DeepEqual(m.supportedCurves[1:], []CurveID{X25519Kyber768Draft00, X25519, CurveP256, CurveP384}) {
+		t.Errorf("supported groups = %v", m.supportedCurves)
+	}
+	var shares []CurveID
+	for _, ks := range m.keyShares {
+		shares = append(shares, ks.group)
+	}
+	if len(shares) != 3 || !isGREASEValue(uint16(shares[0])) ||
+		!reflect.DeepEqual(shares[1:], []CurveID{X25519Kyber768Draft00, X25519}) {
+		t.Errorf("key shares = %v", shares)
+	}
+	if len(m.keyShares) > 1 && len(m.keyShares[1].data) != x25519Kyber768ClientShareSize {
+		t.Errorf("X25519Kyber768Draft00 key share is %d bytes, want %d", len(m.keyShares[1].data), x25519Kyber768ClientShareSize)
+	}
+}
+
+func TestUTLSSafari_iOS_17_0ClientHello(t *testing.T) {
+	hello := captureUTLSClientHello(t, HelloSafari_iOS_17_0)
+
+	ids := clientHelloExtensionIDs(t, hello)
+	for _, id := range ids {
+		if id == extensionCompressCertificate {
+			t.Errorf("unexpected compress_certificate extension")
+		}
+	}
+	if padded := ids[len(ids)-1] == utlsExtensionPadding; padded && len(hello) != 512 {
+		t.Errorf("padded ClientHello is %d bytes, expected 512", len(hello))
+	} else if !padded && len(hello) > 0xff && len(hello) < 0x200 {
+		t.Errorf("%d byte ClientHello was not padded", len(hello))
+	}
+
+	m := new(clientHelloMsg)
+	if !m.unmarshal(hello) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	wantSignatureAlgorithms := []SignatureScheme{ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+		ECDSAWithP384AndSHA384, ECDSAWithSHA1, PSSWithSHA384, PSSWithSHA384, PKCS1WithSHA384,
+		PSSWithSHA512, PKCS1WithSHA512, PKCS1WithSHA1}
+	if !reflect.DeepEqual(m.supportedSignatureAlgorithms, wantSignatureAlgorithms) {
+		t.Errorf("signature algorithms = %v, want %v", m.supportedSignatureAlgorithms, wantSignatureAlgorithms)
+	}
+}
+
+func TestUTLSSafari_17_iOSClientHello(t *testing.T) {
+	if HelloSafari_17_iOS != HelloSafari_iOS_17_0 {
+		t.Fatalf("HelloSafari_17_iOS = %+v, want HelloSafari_iOS_17_0", HelloSafari_17_iOS)
+	}
+	m := new(clientHelloMsg)
+	if !m.unmarshal(captureUTLSClientHello(t, HelloSafari_17_iOS)) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	wantCipherSuites := []uint16{TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384, TLS_CHACHA20_POLY1305_SHA256,
+		TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}
+	if len(m.cipherSuites) < len(wantCipherSuites)+1 || !isGREASEValue(m.cipherSuites[0]) ||
+		!reflect.DeepEqual(m.cipherSuites[1:len(wantCipherSuites)+1], wantCipherSuites) {
+		t.Errorf("cipher suites = %x, want GREASE followed by %x", m.cipherSuites, wantCipherSuites)
+	}
+	if m.vers != VersionTLS12 {
+		t.Errorf("legacy version = %x, want %x", m.vers, VersionTLS12)
+	}
+	if !bytes.Equal(m.compressionMethods, []byte{compressionNone}) {
+		t.Errorf("compression methods = %x, want %x", m.compressionMethods, []byte{compressionNone})
+	}
+	// iOS Safari offers psk_dhe_ke but, unlike desktop, no session_ticket.
+	if !reflect.DeepEqual(m.pskModes, []uint8{pskModeDHE}) {
+		t.Errorf("psk_key_exchange_modes = %v, want [%d]", m.pskModes, pskModeDHE)
+	}
+	if m.ticketSupported {
+		t.Errorf("unexpected session_ticket extension")
+	}
+}
+
+// captureUTLSClientHello returns the ClientHello message sent by a uTLS
+// client using helloID, checking the record layer header on the way.
+func captureUTLSClientHello(t *testing.T, helloID ClientHelloID) []byte {
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		UClient(clientConn, &Config{ServerName: "example.com"}, helloID).Handshake()
+	}()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(serverConn, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != byte(recordTypeHandshake) || header[1] != 0x03 || header[2] != 0x01 {
+		t.Errorf("unexpected record header %x, expected a handshake record with version 0x0301", header[:3])
+	}
+	hello := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(serverConn, hello); err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+func TestUTLSRecordSizeLimit(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		for _, padding := range []bool{false, true} {
+			if padding && version != VersionTLS13 {
+				continue
+			}
+			testUTLSRecordSizeLimit(t, version, padding)
+		}
+	}
+}
+
+func testUTLSRecordSizeLimit(t *testing.T, version uint16, padding bool) {
+	const limit = 256
+	message := bytes.Repeat([]byte("x"), 1000)
+
+	clientConn, serverConn := localPipe(t)
+	recorder := &writeSizeConn{Conn: serverConn}
+	serverConfig := testConfig.Clone()
+	serverConfig.MaxVersion = version
+	if padding {
+		serverConfig.RecordPadding = func(int) int { return maxPlaintext }
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		server := Server(recorder, serverConfig)
+		if err := server.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		recorder.sizes = nil
+		_, err := server.Write(message)
+		done <- err
+	}()
+
+	spec, err := utlsIdToSpec(HelloFirefox_128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ext := range spec.Extensions {
+		if _, ok := ext.(*RecordSizeLimitExtension); ok {
+			spec.Extensions[i] = &RecordSizeLimitExtension{Limit: limit}
+		}
+	}
+	client := UClient(clientConn, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+	if err := client.ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("%x: handshake failed: %v", version, err)
+	}
+	got, err := io.ReadAll(io.LimitReader(client, int64(len(message))))
+	if err != nil {
+		t.Fatalf("%x: read failed: %v", version, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("%x: server failed: %v", version, err)
+	}
+	if !bytes.Equal(got, message) {
+		t.Errorf("%x: client read %d bytes, which do not match what the server sent", version, len(got))
+	}
+	if client.peerRecordSizeLimit == 0 {
+		t.Errorf("%x: server did not send record_size_limit", version)
+	}
+
+	// AES-128-GCM adds a 16 byte tag and, in TLS 1.2, an 8 byte explicit nonce.
+	maxRecord := recordHeaderLen + limit + 16
+	if version == VersionTLS12 {
+		maxRecord += 8
+	}
+	for _, size := range recorder.sizes {
+		if size > maxRecord {
+			t.Errorf("%x: server sent a %d byte record, expected at most %d", version, size, maxRecord)
+		}
+		if padding && size != maxRecord {
+			t.Errorf("%x: padded record is %d bytes, expected %d", version, size, maxRecord)
+		}
+	}
+
+	client.Close()
+	serverConn.Close()
+}
+
+func TestUTLSRecordSizeLimitTooSmall(t *testing.T) {
+	clientConn, serverConn := localPipe(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- Server(serverConn, testConfig.Clone()).Handshake()
+		serverConn.Close()
+	}()
+
+	client := UClient(clientConn, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+	if err := client.ApplyPreset(&ClientHelloSpec{
+		Extensions: []TLSExtension{
+			&SupportedCurvesExtension{[]CurveID{X25519}},
+			&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+			&RecordSizeLimitExtension{Limit: 63},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Handshake(); err == nil {
+		t.Error("expected the handshake to fail")
+	}
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "record_size_limit") {
+		t.Errorf("expected the server to reject the record_size_limit, got %v", err)
+	}
+	clientConn.Close()
+}
+
+func TestUTLSRecordSizeLimitOverflow(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConn, serverConn := localPipe(t)
+		serverConfig := testConfig.Clone()
+		serverConfig.MaxVersion = version
+
+		done := make(chan error, 1)
+		go func() {
+			defer serverConn.Close()
+			server := Server(serverConn, serverConfig)
+			if err := server.Handshake(); err != nil {
+				done <- err
+				return
+			}
+			// Ignore the limit advertised by the client.
+			server.peerRecordSizeLimit = 0
+			if _, err := server.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+				done <- err
+				return
+			}
+			_, err := server.Read(make([]byte, 1))
+			done <- err
+		}()
+
+		client := UClient(clientConn, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{X25519}},
+				&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+				}},
+				&KeyShareExtension{[]KeyShare{{Group: X25519}}},
+				&SupportedVersionsExtension{[]uint16{VersionTLS13, VersionTLS12}},
+				&RecordSizeLimitExtension{Limit: 256},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%x: handshake failed: %v", version, err)
+		}
+		if _, err := client.Read(make([]byte, 1000)); err == nil || !strings.Contains(err.Error(), "record overflow") {
+			t.Errorf("%x: expected a record overflow, got %v", version, err)
+		}
+		clientConn.Close()
+		if err := <-done; err == nil || !strings.Contains(err.Error(), "record overflow") {
+			t.Errorf("%x: expected the server to receive a record_overflow alert, got %v", version, err)
+		}
+	}
+}
+
+func TestRecordSizeLimitExtension(t *testing.T) {
+	ext := &RecordSizeLimitExtension{Limit: 0x4001}
+	b := make([]byte, ext.Len())
+	if _, err := ext.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	if want := []byte{0x00, 0x1c, 0x00, 0x02, 0x40, 0x01}; !bytes.Equal(b, want) {
+		t.Errorf("marshaled record_size_limit %x, want %x", b, want)
+	}
+}
+
+func TestGenericExtension(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5}
+	ext := NewGenericExtension(0xabcd, data)
+	data[0] = 0
+	want := []byte{0xab, 0xcd, 0x00, 0x05, 1, 2, 3, 4, 5}
+	b := make([]byte, ext.Len())
+	if _, err := ext.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("marshaled GenericExtension %x, want %x", b, want)
+	}
+
+	spec, err := utlsIdToSpec(HelloChrome_113)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const position = 5
+	spec.Extensions = append(spec.Extensions[:position],
+		append([]TLSExtension{ext}, spec.Extensions[position:]...)...)
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	raw := uconn.HandshakeState.Hello.Raw
+	if ids := clientHelloExtensionIDs(t, raw); ids[position] != 0xabcd {
+		t.Errorf("GenericExtension is not at position %d of %v", position, ids)
+	}
+	if !bytes.Contains(raw, want) {
+		t.Errorf("ClientHello does not contain the GenericExtension verbatim")
+	}
+	// A JA3 fingerprint with its id yields an empty GenericExtension.
+	ja3Spec, err := ClientHelloSpecFromJA3("771,4865,0-43981-43,29,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext, ok := ja3Spec.Extensions[1].(*GenericExtension); !ok || ext.Id != 0xabcd {
+		t.Errorf("extension 43981 of a JA3 fingerprint is %#v", ja3Spec.Extensions[1])
+	}
+
+	uconn = UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(&ClientHelloSpec{Extensions: []TLSExtension{
+		&GenericExtension{Id: 0xabcd, Data: make([]byte, 0x10000)},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err == nil {
+		t.Error("a GenericExtension longer than 65535 bytes was accepted")
+	}
+}
+
+func TestApplicationSettingsExtension(t *testing.T) {
+	// application_settings as sent by Chrome 113.
+	chrome := []byte{0x44, 0x69, 0x00, 0x05, 0x00, 0x03, 0x02, 0x68, 0x32}
+
+	ext := &ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}}
+	b := make([]byte, ext.Len())
+	if _, err := ext.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, chrome) {
+		t.Errorf("marshaled application_settings %x, want %x", b, chrome)
+	}
+
+	if hello := captureUTLSClientHello(t, HelloChrome_113); !bytes.Contains(hello, chrome) {
+		t.Errorf("HelloChrome_113 does not send application_settings for h2")
+	}
+
+	// application_settings_new, as sent by Chrome 133 and later, for h2.
+	chromeNew := []byte{0x44, 0xcd, 0x00, 0x05, 0x00, 0x03, 0x02, 0x68, 0x32}
+	ext = &ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}, NewCodepoint: true}
+	b = make([]byte, ext.Len())
+	if _, err := ext.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, chromeNew) {
+		t.Errorf("marshaled application_settings_new %x, want %x", b, chromeNew)
+	}
+
+	// The codepoint is preserved when fingerprinting a ClientHello.
+	for _, newCodepoint := range []bool{false, true} {
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloChrome_113)
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range uconn.Extensions {
+			if alps, ok := e.(*ApplicationSettingsExtension); ok {
+				alps.NewCodepoint = newCodepoint
+			}
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		raw := uconn.HandshakeState.Hello.Raw
+		record := append([]byte{byte(recordTypeHandshake), 0x03, 0x01, byte(len(raw) >> 8), byte(len(raw))}, raw...)
+		spec, err := (&Fingerprinter{}).FingerprintClientHello(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, e := range spec.Extensions {
+			if alps, ok := e.(*ApplicationSettingsExtension); ok {
+				found = true
+				if alps.NewCodepoint != newCodepoint || len(alps.SupportedProtocols) != 1 || alps.SupportedProtocols[0] != "h2" {
+					t.Errorf("fingerprinted %+v, want NewCodepoint %v for h2", alps, newCodepoint)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("NewCodepoint %v: fingerprinted ClientHello has no ApplicationSettingsExtension", newCodepoint)
+		}
+	}
+}
+
+func TestUTLSSetClientRandomAndLegacySessionID(t *testing.T) {
+	random := bytes.Repeat([]byte{0x42}, 32)
+	sessionID := bytes.Repeat([]byte{0x17}, 32)
+
+	for _, helloID := range []ClientHelloID{HelloGolang, HelloChrome_Auto, HelloFirefox_Auto} {
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- Server(s, testConfig).Handshake()
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, helloID)
+		if err := client.SetClientRandom(random); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetLegacySessionID(sessionID); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		hello := client.HandshakeState.Hello
+		if !bytes.Equal(hello.Random, random) {
+			t.Errorf("%v: client random = %x, want %x", helloID, hello.Random, random)
+		}
+		if !bytes.Equal(hello.SessionId, sessionID) {
+			t.Errorf("%v: legacy session ID = %x, want %x", helloID, hello.SessionId, sessionID)
+		}
+		if helloID != HelloGolang {
+			parsed := new(clientHelloMsg)
+			if !parsed.unmarshal(hello.Raw) {
+				t.Fatalf("%v: failed to parse the marshaled ClientHello", helloID)
+			}
+			if !bytes.Equal(parsed.random, random) || !bytes.Equal(parsed.sessionId, sessionID) {
+				t.Errorf("%v: marshaled ClientHello does not carry the set random and session ID", helloID)
+			}
+		}
+
+		if err := client.Handshake(); err != nil {
+			t.Errorf("%v: handshake failed: %v", helloID, err)
+		}
+		c.Close()
+		if err := <-done; err != nil {
+			t.Errorf("%v: server handshake failed: %v", helloID, err)
+		}
+	}
+}
+
+func TestUTLSReproducibleClientHello(t *testing.T) {
+	random := bytes.Repeat([]byte{0x42}, 32)
+	sessionID := bytes.Repeat([]byte{0x17}, 32)
+	build := func(fixed bool) *UConn {
+		config := &Config{ServerName: "example.com", Rand: mathrand.New(mathrand.NewSource(1))}
+		uconn := UClient(&net.TCPConn{}, config, HelloChrome_113)
+		if fixed {
+			if err := uconn.SetClientRandom(random); err != nil {
+				t.Fatal(err)
+			}
+			if err := uconn.SetSessionID(sessionID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		return uconn
+	}
+
+	first, second := build(true), build(true)
+	if !bytes.Equal(first.HandshakeState.Hello.Raw, second.HandshakeState.Hello.Raw) {
+		t.Error("ClientHellos built from the same Rand, random and session ID differ")
+	}
+
+	// The fixed random must not shift the GREASE values drawn from Rand.
+	unfixed := build(false)
+	got := clientHelloExtensionIDs(t, first.HandshakeState.Hello.Raw)
+	want := clientHelloExtensionIDs(t, unfixed.HandshakeState.Hello.Raw)
+	if !reflect.DeepEqual(got, want) || first.HandshakeState.Hello.CipherSuites[0] != unfixed.HandshakeState.Hello.CipherSuites[0] {
+		t.Errorf("SetClientRandom changed the GREASE values: extensions %x, want %x", got, want)
+	}
+}
+
+func TestUTLSSetClientRandomAfterHandshake(t *testing.T) {
+	c, s := localPipe(t)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- Server(s, testConfig.Clone()).Handshake()
+	}()
+	client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloChrome_113)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if err := client.SetClientRandom(make([]byte, 32)); err != errClientHelloSent {
+		t.Errorf("SetClientRandom after the handshake: got %v, want %v", err, errClientHelloSent)
+	}
+	if err := client.SetSessionID(nil); err != errClientHelloSent {
+		t.Errorf("SetSessionID after the handshake: got %v, want %v", err, errClientHelloSent)
+	}
+}
+
+func TestUTLSSetClientRandomAndLegacySessionIDLength(t *testing.T) {
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloChrome_Auto)
+	if err := uconn.SetClientRandom(make([]byte, 31)); err == nil {
+		t.Error("expected an error for a 31 byte client random")
+	}
+	if err := uconn.SetLegacySessionID(make([]byte, 33)); err == nil {
+		t.Error("expected an error for a 33 byte legacy session ID")
+	}
+	if err := uconn.SetLegacySessionID(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(uconn.HandshakeState.Hello.SessionId); n != 0 {
+		t.Errorf("legacy session ID is %d bytes long, expected it to be empty", n)
+	}
+}
+
+func TestUTLSHandshakeTimeout(t *testing.T) {
+	// A server that never answers the ClientHello.
+	c, s := localPipe(t)
+	defer s.Close()
+	go io.Copy(io.Discard, s)
+
+	client := UClient(c, &Config{ServerName: "example.golang", HandshakeTimeout: 100 * time.Millisecond}, HelloChrome_Auto)
+	done := make(chan error, 1)
+	go func() { done <- client.Handshake() }()
+	select {
+	case err := <-done:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("expected a timeout error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("handshake did not time out")
+	}
+	c.Close()
+
+	// A normal handshake is not affected, and the timeout does not apply to
+	// the established connection.
+	c, s = localPipe(t)
+	serverDone := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		server := Server(s, testConfig)
+		if err := server.Handshake(); err != nil {
+			serverDone <- err
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		_, err := server.Write([]byte("hello"))
+		serverDone <- err
+	}()
+
+	client = UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true, HandshakeTimeout: 100 * time.Millisecond}, HelloChrome_Auto)
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("read after the handshake failed: %v", err)
+	}
+	if err := <-serverDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUTLSUserData(t *testing.T) {
+	type requestInfo struct{ id string }
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		c, s := localPipe(t)
+		serverConfig := testConfig.Clone()
+		serverConfig.MaxVersion = version
+		serverConfig.ClientAuth = RequestClientCert
+		serverVerified := false
+		serverConfig.VerifyConnection = func(cs ConnectionState) error {
+			serverVerified = cs.UserData == nil
+			return nil
+		}
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- Server(s, serverConfig).Handshake()
+		}()
+
+		var verifyData, certData interface{}
+		var peerCertificates []*x509.Certificate
+		client := UClient(c, &Config{
+			ServerName:         "example.golang",
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs ConnectionState) error {
+				verifyData, peerCertificates = cs.UserData, cs.PeerCertificates
+				return nil
+			},
+			GetClientCertificate: func(cri *CertificateRequestInfo) (*Certificate, error) {
+				certData = cri.UserData
+				return &Certificate{}, nil
+			},
+		}, HelloChrome_113)
+		data := &requestInfo{id: "req-42"}
+		client.SetUserData(data)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%x: %v", version, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%x: server: %v", version, err)
+		}
+		c.Close()
+
+		if client.UserData() != data {
+			t.Errorf("%x: UserData() = %v, want %v", version, client.UserData(), data)
+		}
+		if verifyData != data || certData != data {
+			t.Errorf("%x: callbacks saw user data %v and %v, want %v", version, verifyData, certData, data)
+		}
+		if len(peerCertificates) == 0 {
+			t.Errorf("%x: VerifyConnection did not see the server certificates", version)
+		}
+		if !serverVerified {
+			t.Errorf("%x: server VerifyConnection was not called without user data", version)
+		}
+	}
+}
+
+func TestUTLSVerifyConnectionError(t *testing.T) {
+	c, s := localPipe(t)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- Server(s, testConfig.Clone()).Handshake()
+	}()
+
+	client := UClient(c, &Config{
+		ServerName:         "example.golang",
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs ConnectionState) error {
+			return fmt.Errorf("rejected %s", cs.UserData)
+		},
+	}, HelloChrome_113)
+	client.SetUserData("req-43")
+	err := client.Handshake()
+	c.Close()
+	if err == nil || err.Error() != "rejected req-43" {
+		t.Errorf("got error %v, want the VerifyConnection one", err)
+	}
+	if err := <-done; err == nil {
+		t.Error("server handshake succeeded")
+	}
+}
+
+func TestUTLSExportKeyingMaterial(t *testing.T) {
+	stdCert := tls.Certificate{
+		Certificate: testConfig.Certificates[0].Certificate,
+		PrivateKey:  testConfig.Certificates[0].PrivateKey,
+	}
+	// crypto/tls only exports from TLS 1.2 connections with Extended Master
+	// Secret, which uTLS implements on the client side only.
+	for _, test := range []struct {
+		version    uint16
+		utlsClient bool
+	}{
+		{VersionTLS12, true},
+		{VersionTLS13, true},
+		{VersionTLS13, false},
+	} {
+		c, s := localPipe(t)
+		var conn *Conn
+		var handshake func() error
+		var stdConn *tls.Conn
+		if test.utlsClient {
+			spec, err := UTLSIdToSpec(HelloChrome_Auto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.version == VersionTLS12 {
+				// Allowing renegotiation disables TLS 1.2 exporters.
+				spec.RemoveExtensionByType(extensionRenegotiationInfo)
+			}
+			client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+			if err := client.ApplyPreset(&spec); err != nil {
+				t.Fatal(err)
+			}
+			conn, handshake = client.Conn, client.Handshake
+			stdConn = tls.Server(s, &tls.Config{Certificates: []tls.Certificate{stdCert}, MaxVersion: test.version})
+		} else {
+			conn = Server(s, testConfig)
+			handshake = conn.Handshake
+			stdConn = tls.Client(c, &tls.Config{InsecureSkipVerify: true, MinVersion: test.version})
+		}
+
+		if _, err := conn.ExportKeyingMaterial("EXPORTER-test", nil, 32); err == nil {
+			t.Errorf("%x: ExportKeyingMaterial before the handshake succeeded", test.version)
+		}
+		state := conn.ConnectionState()
+		if _, err := state.ExportKeyingMaterial("EXPORTER-test", nil, 32); err == nil {
+			t.Errorf("%x: ConnectionState.ExportKeyingMaterial before the handshake succeeded", test.version)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- stdConn.Handshake()
+		}()
+		if err := handshake(); err != nil {
+			t.Fatalf("%x: %v", test.version, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%x: crypto/tls: %v", test.version, err)
+		}
+		if v := conn.ConnectionState().Version; v != test.version {
+			t.Fatalf("negotiated %x, want %x", v, test.version)
+		}
+
+		stdState := stdConn.ConnectionState()
+		for _, context := range [][]byte{nil, {}, []byte("context")} {
+			got, err := conn.ExportKeyingMaterial("EXPORTER-test", context, 42)
+			if err != nil {
+				t.Fatalf("%x: %v", test.version, err)
+			}
+			want, err := stdState.ExportKeyingMaterial("EXPORTER-test", context, 42)
+			if err != nil {
+				t.Fatalf("%x: crypto/tls: %v", test.version, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%x, uTLS client %v, context %q: exported %x, crypto/tls exported %x",
+					test.version, test.utlsClient, context, got, want)
+			}
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestUTLSResumptionTicketLifetime(t *testing.T) {
+	cache := NewLRUClientSessionCache(1)
+	start := time.Now()
+	handshake := func(now time.Time) (didResume bool) {
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			server := Server(s, testConfig)
+			if err := server.Handshake(); err != nil {
+				done <- err
+				return
+			}
+			// Make the client read the NewSessionTicket message.
+			_, err := server.Write([]byte{1})
+			done <- err
+		}()
+
+		client := UClient(c, &Config{
+			ServerName:         "example.golang",
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+			Time:               func() time.Time { return now },
+		}, HelloGolang)
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		c.Close()
+		if v := client.ConnectionState().Version; v != VersionTLS13 {
+			t.Fatalf("negotiated %x, want TLS 1.3", v)
+		}
+		return client.ConnectionState().DidResume
+	}
+
+	if handshake(start) {
+		t.Fatal("first handshake resumed")
+	}
+	if !handshake(start.Add(time.Hour)) {
+		t.Error("handshake with a fresh ticket did not resume")
+	}
+	// The server would still accept the ticket, but its lifetime has passed
+	// for the client.
+	if handshake(start.Add(maxSessionTicketLifetime + 2*time.Hour)) {
+		t.Error("handshake with an expired ticket resumed")
+	}
+	if !handshake(start.Add(maxSessionTicketLifetime + 3*time.Hour)) {
+		t.Error("handshake with the ticket from the full handshake did not resume")
+	}
+}
+
+func TestUTLSParrotSkipsExpiredTicket(t *testing.T) {
+	c, _ := localPipe(t)
+	defer c.Close()
+	cache := NewLRUClientSessionCache(1)
+	config := &Config{ServerName: "example.golang", ClientSessionCache: cache}
+	cache.Put("example.golang", &ClientSessionState{
+		vers:          VersionTLS13,
+		sessionTicket: []byte{1, 2, 3},
+		useBy:         time.Now().Add(-time.Minute),
+	})
+
+	client := UClient(c, config, HelloChrome_Auto)
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := client.HandshakeState.Hello.SessionTicket; len(ticket) != 0 {
+		t.Errorf("sent the expired ticket %x", ticket)
+	}
+	if session, ok := cache.Get("example.golang"); ok && session != nil {
+		t.Error("the expired session was not evicted")
+	}
+}
+
+func TestUTLSClientHelloIDResolved(t *testing.T) {
+	if got := LatestChromeVersion(); got != HelloChrome_Auto || got.Version == helloAutoVers {
+		t.Errorf("LatestChromeVersion() = %v, want the versioned HelloChrome_Auto", got.Str())
+	}
+	for client, want := range helloAutoIDs {
+		id := ClientHelloID{client, helloAutoVers, nil}
+		uconn := UClient(nil, &Config{ServerName: "example.com"}, id)
+		if got := uconn.ClientHelloIDResolved(); got != want {
+			t.Errorf("%s resolved to %s, want %s", id.Str(), got.Str(), want.Str())
+		}
+		if _, err := utlsIdToSpec(id); err != nil {
+			t.Errorf("%s: %v", id.Str(), err)
+		}
+	}
+	if got := UClient(nil, nil, HelloChrome_100).ClientHelloIDResolved(); got != HelloChrome_100 {
+		t.Errorf("HelloChrome_100 resolved to %s", got.Str())
+	}
+}
+
+func TestUTLSFinalExtensionOrder(t *testing.T) {
+	seed := &PRNGSeed{}
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	id := ClientHelloID{helloRandomized, helloAutoVers, seed}
+
+	var orders [2][]uint16
+	for i := range orders {
+		uconn := UClient(nil, &Config{ServerName: "example.com", Rand: mathrand.New(mathrand.NewSource(0))}, id)
+		if order := uconn.FinalExtensionOrder(); order != nil {
+			t.Errorf("order before BuildHandshakeState = %v, want nil", order)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		orders[i] = uconn.FinalExtensionOrder()
+		if want := clientHelloExtensionIDs(t, uconn.HandshakeState.Hello.Raw); !reflect.DeepEqual(orders[i], want) {
+			t.Errorf("FinalExtensionOrder() = %v, the ClientHello has %v", orders[i], want)
+		}
+	}
+	if !reflect.DeepEqual(orders[0], orders[1]) {
+		t.Errorf("the same seed gave the extension orders %v and %v", orders[0], orders[1])
+	}
+}
+
+func TestUTLSSentExtensions(t *testing.T) {
+	for _, id := range []ClientHelloID{HelloChrome_Auto, HelloFirefox_Auto, HelloSafari_Auto, HelloRandomized} {
+		uconn := UClient(nil, &Config{ServerName: "example.com"}, id)
+		if exts := uconn.SentExtensions(); exts != nil {
+			t.Errorf("%s: extensions before BuildHandshakeState = %v, want nil", id.Str(), exts)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The extensions, marshaled in order, must be the extensions block
+		// of the ClientHello.
+		var marshaled []byte
+		for _, ext := range uconn.SentExtensions() {
+			b := make([]byte, ext.Len())
+			if _, err := ext.Read(b); err != nil && err != io.EOF {
+				t.Fatalf("%s: %T: %v", id.Str(), ext, err)
+			}
+			if g, ok := ext.(*UtlsGREASEExtension); ok && g.Value != uint16(b[0])<<8|uint16(b[1]) {
+				t.Errorf("%s: GREASE extension Value %#04x, sent as %x", id.Str(), g.Value, b[:2])
+			}
+			marshaled = append(marshaled, b...)
+		}
+		raw := uconn.HandshakeState.Hello.Raw
+		if !bytes.HasSuffix(raw, marshaled) || len(raw) < len(marshaled)+2 ||
+			int(raw[len(raw)-len(marshaled)-2])<<8|int(raw[len(raw)-len(marshaled)-1]) != len(marshaled) {
+			t.Errorf("%s: the sent extensions do not match the extensions of the ClientHello", id.Str())
+		}
+	}
+
+	if exts := UClient(nil, &Config{ServerName: "example.com"}, HelloGolang).SentExtensions(); exts != nil {
+		t.Errorf("HelloGolang extensions = %v, want nil", exts)
+	}
+}
+
+func TestUTLSSetGreaseSeed(t *testing.T) {
+	// greaseValues returns the GREASE values of a HelloChrome_Auto ClientHello
+	// built with the GREASE seed, and its first key share.
+	greaseValues := func(seed uint64) (grease []uint16, keyShare []byte) {
+		uconn := UClient(nil, &Config{ServerName: "example.com"}, HelloChrome_Auto)
+		uconn.SetGreaseSeed(seed)
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		m := new(clientHelloMsg)
+		if !m.unmarshal(uconn.HandshakeState.Hello.Raw) {
+			t.Fatal("failed to parse the ClientHello")
+		}
+		var values []uint16
+		values = append(values, m.cipherSuites...)
+		values = append(values, uconn.FinalExtensionOrder()...)
+		for _, group := range m.supportedCurves {
+			values = append(values, uint16(group))
+		}
+		for _, ks := range m.keyShares {
+			values = append(values, uint16(ks.group))
+			if !isGREASEValue(uint16(ks.group)) && keyShare == nil {
+				keyShare = ks.data
+			}
+		}
+		values = append(values, m.supportedVersions...)
+		for _, v := range values {
+			if isGREASEValue(v) {
+				grease = append(grease, v)
+			}
+		}
+		return grease, keyShare
+	}
+
+	grease1, keyShare1 := greaseValues(1)
+	grease2, keyShare2 := greaseValues(1)
+	// GREASE cipher suite, two extensions, group, key share and version.
+	if len(grease1) != 6 {
+		t.Fatalf("found GREASE values %x, want 6", grease1)
+	}
+	if !reflect.DeepEqual(grease1, grease2) {
+		t.Errorf("the same seed gave the GREASE values %x and %x", grease1, grease2)
+	}
+	if bytes.Equal(keyShare1, keyShare2) {
+		t.Error("the GREASE seed also fixed the key share")
+	}
+	if grease3, _ := greaseValues(2); reflect.DeepEqual(grease1, grease3) {
+		t.Errorf("different seeds gave the same GREASE values %x", grease1)
+	}
+}
+
+func TestUTLSSetGREASESeed(t *testing.T) {
+	random := bytes.Repeat([]byte{1}, 32)
+	sessionID := bytes.Repeat([]byte{2}, 32)
+	// hello returns a HelloChrome_Auto ClientHello, which has GREASE in all
+	// the slots and a GREASE ECH extension, built with the GREASE seed.
+	hello := func(seed [32]byte, rand io.Reader) []byte {
+		uconn := UClient(nil, &Config{ServerName: "example.com", Rand: rand}, HelloChrome_Auto)
+		uconn.SetGREASESeed(seed)
+		if err := uconn.SetClientRandom(random); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.SetLegacySessionID(sessionID); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := uconn.MarshalClientHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	seed := [32]byte{1, 2, 3}
+	if h1, h2 := hello(seed, zeroSource{}), hello(seed, zeroSource{}); !bytes.Equal(h1, h2) {
+		t.Errorf("the same seed and Rand gave different ClientHellos:\n%x\n%x", h1, h2)
+	}
+
+	// Only the key shares depend on Config.Rand.
+	h1, h2 := hello(seed, zeroSource{}), hello(seed, nil)
+	if bytes.Equal(h1, h2) {
+		t.Fatal("the GREASE seed also fixed the key shares")
+	}
+	for _, id := range clientHelloExtensionIDs(t, h1) {
+		ext1, _ := clientHelloExtension(t, h1, id)
+		ext2, _ := clientHelloExtension(t, h2, id)
+		if id != extensionKeyShare && !bytes.Equal(ext1, ext2) {
+			t.Errorf("extension %#04x = %x and %x with the same seed", id, ext1, ext2)
+		}
+	}
+
+	ech1, _ := clientHelloExtension(t, h1, utlsExtensionEncryptedClientHello)
+	ech2, _ := clientHelloExtension(t, hello([32]byte{4, 5, 6}, zeroSource{}), utlsExtensionEncryptedClientHello)
+	if len(ech1) == 0 || bytes.Equal(ech1, ech2) {
+		t.Errorf("different seeds gave the same GREASE ECH extension %x", ech1)
+	}
+
+	// SetGreaseSeed is the uint64 form of the same seed.
+	uconn := UClient(nil, &Config{ServerName: "example.com", Rand: zeroSource{}}, HelloChrome_Auto)
+	uconn.SetGreaseSeed(0x0102)
+	uconn.SetClientRandom(random)
+	uconn.SetLegacySessionID(sessionID)
+	raw, err := uconn.MarshalClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hello([32]byte{2, 1}, zeroSource{}); !bytes.Equal(raw, want) {
+		t.Error("SetGreaseSeed and SetGREASESeed gave different ClientHellos")
+	}
+
+	// SetGREASEPRNGSeed takes the same seed as a PRNGSeed, and a nil one
+	// draws the GREASE from Config.Rand again.
+	prngHello := func(seeds ...*PRNGSeed) []byte {
+		uconn := UClient(nil, &Config{ServerName: "example.com", Rand: zeroSource{}}, HelloChrome_Auto)
+		for _, seed := range seeds {
+			uconn.SetGREASEPRNGSeed(seed)
+		}
+		uconn.SetClientRandom(random)
+		uconn.SetLegacySessionID(sessionID)
+		raw, err := uconn.MarshalClientHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	if !bytes.Equal(prngHello((*PRNGSeed)(&seed)), hello(seed, zeroSource{})) {
+		t.Error("SetGREASEPRNGSeed and SetGREASESeed gave different ClientHellos")
+	}
+	if !bytes.Equal(prngHello((*PRNGSeed)(&seed), nil), prngHello()) {
+		t.Error("SetGREASEPRNGSeed(nil) did not clear the seed")
+	}
+}
+
+func resumptionSpec(earlyData bool) *ClientHelloSpec {
+	extensions := []TLSExtension{
+		&SNIExtension{},
+		&SupportedCurvesExtension{[]CurveID{X25519}},
+		&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+		}},
+		&KeyShareExtension{[]KeyShare{{Group: X25519}}},
+		&PSKKeyExchangeModesExtension{[]uint8{pskModeDHE}},
+		&SupportedVersionsExtension{[]uint16{VersionTLS13, VersionTLS12}},
+	}
+	if earlyData {
+		extensions = append(extensions, &EarlyDataExtension{})
+	}
+	extensions = append(extensions,
+		&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
+		&PreSharedKeyExtension{})
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+		Extensions:   extensions,
+	}
+}
+
+func TestUTLSPreSharedKeyExtension(t *testing.T) {
+	cache := NewLRUClientSessionCache(1)
+	config := &Config{ServerName: "example.golang", InsecureSkipVerify: true, ClientSessionCache: cache}
+	handshake := func() (didResume bool) {
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			server := Server(s, testConfig)
+			if err := server.Handshake(); err != nil {
+				done <- err
+				return
+			}
+			// Make the client read the NewSessionTicket message.
+			_, err := server.Write([]byte{1})
+			done <- err
+		}()
+
+		client := UClient(c, config, HelloCustom)
+		if err := client.ApplyPreset(resumptionSpec(false)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		c.Close()
+		return client.ConnectionState().DidResume
+	}
+
+	if handshake() {
+		t.Fatal("first handshake resumed")
+	}
+	if !handshake() {
+		t.Error("handshake offering the cached session did not resume")
+	}
+}
+
+// retryWithCookie plays a TLS 1.3 server which answers the ClientHello read
+// from s with a HelloRetryRequest carrying cookie, and returns both
+// ClientHellos.
+func retryWithCookie(s net.Conn, cookie []byte) (first, second *clientHelloMsg, err error) {
+	readClientHello := func() (*clientHelloMsg, error) {
+		for {
+			header := make([]byte, recordHeaderLen)
+			if _, err := io.ReadFull(s, header); err != nil {
+				return nil, err
+			}
+			record := make([]byte, int(header[3])<<8|int(header[4]))
+			if _, err := io.ReadFull(s, record); err != nil {
+				return nil, err
+			}
+			// Skip the ChangeCipherSpec of the middlebox compatibility mode.
+			if recordType(header[0]) == recordTypeChangeCipherSpec {
+				continue
+			}
+			var ch clientHelloMsg
+			if !ch.unmarshal(record) {
+				return nil, errors.New("malformed ClientHello")
+			}
+			return &ch, nil
+		}
+	}
+
+	if first, err = readClientHello(); err != nil {
+		return nil, nil, err
+	}
+	hrr := (&serverHelloMsg{
+		vers:              VersionTLS12,
+		random:            helloRetryRequestRandom,
+		sessionId:         first.sessionId,
+		cipherSuite:       TLS_AES_128_GCM_SHA256,
+		compressionMethod: compressionNone,
+		supportedVersion:  VersionTLS13,
+		selectedGroup:     CurveP256,
+		cookie:            cookie,
+	}).marshal()
+	if _, err := s.Write(append([]byte{byte(recordTypeHandshake), 3, 3, byte(len(hrr) >> 8), byte(len(hrr))}, hrr...)); err != nil {
+		return nil, nil, err
+	}
+	if second, err = readClientHello(); err != nil {
+		return nil, nil, err
+	}
+	return first, second, nil
+}
+
+func TestUTLSHelloRetryRequestState(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		curves    []CurveID
+		wantGroup CurveID
+		wantHRR   bool
+	}{
+		{"key share accepted", []CurveID{X25519}, X25519, false},
+		// The client only sends an X25519 key share.
+		{"HelloRetryRequest", []CurveID{CurveP256}, CurveP256, true},
+	} {
+		c, s := localPipe(t)
+		serverConfig := testConfig.Clone()
+		serverConfig.CurvePreferences = test.curves
+		go func() {
+			defer s.Close()
+			Server(s, serverConfig).Handshake()
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloChrome_Auto)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		c.Close()
+		state := client.ConnectionState()
+		if state.KeyShareGroup != test.wantGroup || state.DidHelloRetryRequest != test.wantHRR || state.HelloRetryRequestCookie != nil {
+			t.Errorf("%s: KeyShareGroup %v, DidHelloRetryRequest %v, HelloRetryRequestCookie %x", test.name,
+				state.KeyShareGroup, state.DidHelloRetryRequest, state.HelloRetryRequestCookie)
+		}
+	}
+
+	// The server sends a cookie in its HelloRetryRequest.
+	c, s := localPipe(t)
+	cookie := []byte("hrr cookie")
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		_, second, err := retryWithCookie(s, cookie)
+		if err == nil && !bytes.Equal(second.cookie, cookie) {
+			err = errors.New("the second ClientHello did not echo the cookie")
+		}
+		done <- err
+	}()
+
+	client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloChrome_Auto)
+	if err := client.Handshake(); err == nil {
+		t.Fatal("handshake with a scripted server succeeded")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	state := client.ConnectionState()
+	if !state.DidHelloRetryRequest || !bytes.Equal(state.HelloRetryRequestCookie, cookie) {
+		t.Errorf("DidHelloRetryRequest %v, HelloRetryRequestCookie %q, want the cookie %q", state.DidHelloRetryRequest, state.HelloRetryRequestCookie, cookie)
+	}
+}
+
+func TestUTLSHelloRetryRequestCookie(t *testing.T) {
+	customSpec := func() *ClientHelloSpec {
+		return &ClientHelloSpec{
+			TLSVersMin:   VersionTLS12,
+			TLSVersMax:   VersionTLS13,
+			CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedVersionsExtension{Versions: []uint16{VersionTLS13, VersionTLS12}},
+				&SupportedCurvesExtension{Curves: []CurveID{X25519, CurveP256}},
+				&KeyShareExtension{KeyShares: []KeyShare{{Group: X25519}}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PSSWithSHA256}},
+				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
+			},
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		id   ClientHelloID
+		spec *ClientHelloSpec
+	}{
+		{"Chrome", HelloChrome_Auto, nil},
+		{"Firefox", HelloFirefox_Auto, nil},
+		{"custom spec", HelloCustom, customSpec()},
+	} {
+		c, s := localPipe(t)
+		cookie := []byte("hrr cookie")
+		type hellos struct {
+			first, second *clientHelloMsg
+			err           error
+		}
+		done := make(chan hellos, 1)
+		go func() {
+			defer s.Close()
+			first, second, err := retryWithCookie(s, cookie)
+			done <- hellos{first, second, err}
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, test.id)
+		if test.spec != nil {
+			if err := client.ApplyPreset(test.spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		client.Handshake()
+		c.Close()
+		h := <-done
+		if h.err != nil {
+			t.Fatalf("%s: server: %v", test.name, h.err)
+		}
+		if !bytes.Equal(h.second.cookie, cookie) {
+			t.Errorf("%s: the second ClientHello did not echo the cookie", test.name)
+		}
+
+		// The cookie goes right after supported_versions, and the other
+		// extensions keep their order.
+		var want []uint16
+		for _, id := range clientHelloExtensionIDs(t, h.first.raw) {
+			want = append(want, id)
+			if id == extensionSupportedVersions {
+				want = append(want, extensionCookie)
+			}
+		}
+		if got := clientHelloExtensionIDs(t, h.second.raw); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: second ClientHello extensions %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestUTLSCompressionMethods(t *testing.T) {
+	spec := &ClientHelloSpec{
+		TLSVersMax:         VersionTLS12,
+		TLSVersMin:         VersionTLS10,
+		CipherSuites:       []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		CompressionMethods: []uint8{1, compressionNone}, // DEFLATE, null
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{X25519}},
+			&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PSSWithSHA256, PKCS1WithSHA256}},
+		},
+	}
+
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		Server(s, testConfig.Clone()).Handshake()
+	}()
+	// The name fingerprintAndRebuild sets.
+	client := UClient(c, &Config{ServerName: "example.com", InsecureSkipVerify: true}, HelloCustom)
+	if err := client.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	hello := client.HandshakeState.Hello.Raw
+	var m clientHelloMsg
+	if !m.unmarshal(hello) || !bytes.Equal(m.compressionMethods, []uint8{1, compressionNone}) {
+		t.Errorf("compression methods %v, want the ones of the spec", m.compressionMethods)
+	}
+
+	fingerprinted, rebuilt := fingerprintAndRebuild(t, &Fingerprinter{}, hello)
+	if !bytes.Equal(fingerprinted.CompressionMethods, []uint8{1, compressionNone}) || !bytes.Equal(rebuilt, hello) {
+		t.Errorf("the compression methods did not round-trip: %v", fingerprinted.CompressionMethods)
+	}
+}
+
+func TestUTLSPreSharedKeyBinders(t *testing.T) {
+	// The server only accepts P-256, so it sends a HelloRetryRequest to each
+	// ClientHello with an X25519 key share.
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+	cache := NewLRUClientSessionCache(1)
+	handshake := func(mutate bool) (didResume bool) {
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			server := Server(s, serverConfig)
+			if err := server.Handshake(); err != nil {
+				done <- err
+				return
+			}
+			// Make the client read the NewSessionTicket message.
+			_, err := server.Write([]byte{1})
+			done <- err
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true, ClientSessionCache: cache}, HelloCustom)
+		spec := resumptionSpec(false)
+		for _, ext := range spec.Extensions {
+			if ext, ok := ext.(*SupportedCurvesExtension); ok {
+				ext.Curves = []CurveID{X25519, CurveP256}
+			}
+		}
+		if err := client.ApplyPreset(spec); err != nil {
+			t.Fatal(err)
+		}
+		if mutate {
+			// Changing the spec after the ClientHello was built changes
+			// the length of the extensions the binder covers.
+			if err := client.BuildHandshakeState(); err != nil {
+				t.Fatal(err)
+			}
+			client.Extensions = append([]TLSExtension{&GenericExtension{Id: 0xfe01, Data: []byte("mutated")}}, client.Extensions...)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		c.Close()
+		if ks := client.HandshakeState.Hello.KeyShares; len(ks) != 1 || ks[0].Group != CurveP256 {
+			t.Error("the server did not send a HelloRetryRequest")
+		}
+		return client.ConnectionState().DidResume
+	}
+
+	if handshake(false) {
+		t.Fatal("first handshake resumed")
+	}
+	// The server rejects the handshake if a binder is invalid.
+	if !handshake(false) {
+		t.Error("handshake through a HelloRetryRequest did not resume")
+	}
+	if !handshake(true) {
+		t.Error("handshake with a spec changed after BuildHandshakeState did not resume")
+	}
+}
+
+func TestUTLSEarlyDataWithPreSharedKey(t *testing.T) {
+	c, _ := localPipe(t)
+	defer c.Close()
+	cache := NewLRUClientSessionCache(1)
+	config := &Config{ServerName: "example.golang", InsecureSkipVerify: true, ClientSessionCache: cache}
+
+	client := UClient(c, config, HelloCustom)
+	if err := client.ApplyPreset(resumptionSpec(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw) {
+		if id == extensionEarlyData || id == extensionPreSharedKey {
+			t.Errorf("extension %d sent without a session to resume", id)
+		}
+	}
+
+	suite := cipherSuiteTLS13ByID(TLS_AES_128_GCM_SHA256)
+	session := &ClientSessionState{
+		sessionTicket: []byte("ticket"),
+		vers:          VersionTLS13,
+		cipherSuite:   TLS_AES_128_GCM_SHA256,
+		masterSecret:  bytes.Repeat([]byte{1}, suite.hash.Size()),
+		receivedAt:    time.Now(),
+		useBy:         time.Now().Add(time.Hour),
+		nonce:         []byte{2},
+	}
+	cache.Put("example.golang", session)
+
+	client = UClient(c, config, HelloCustom)
+	if err := client.ApplyPreset(resumptionSpec(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	raw := client.HandshakeState.Hello.Raw
+	ids := clientHelloExtensionIDs(t, raw)
+	earlyData := -1
+	for i, id := range ids {
+		if id == extensionEarlyData {
+			earlyData = i
+		}
+	}
+	if earlyData < 0 {
+		t.Errorf("early_data is missing from %v", ids)
+	}
+	if ids[len(ids)-1] != extensionPreSharedKey {
+		t.Errorf("pre_shared_key is not the last extension of %v", ids)
+	}
+
+	var m clientHelloMsg
+	if !m.unmarshal(raw) {
+		t.Fatal("failed to unmarshal the ClientHello")
+	}
+	if !m.earlyData || len(m.pskIdentities) != 1 || !bytes.Equal(m.pskIdentities[0].label, session.sessionTicket) {
+		t.Fatalf("ClientHello offers identities %v, early data %v", m.pskIdentities, m.earlyData)
+	}
+	psk := suite.expandLabel(session.masterSecret, "resumption", session.nonce, suite.hash.Size())
+	binderKey := suite.deriveSecret(suite.extract(psk, nil), resumptionBinderLabel, nil)
+	transcript := suite.hash.New()
+	transcript.Write(m.marshalWithoutBinders())
+	if want := suite.finishedHash(binderKey, transcript); !bytes.Equal(m.pskBinders[0], want) {
+		t.Errorf("binder = %x, want %x", m.pskBinders[0], want)
+	}
+
+	client = UClient(c, config, HelloCustom)
+	spec := resumptionSpec(true)
+	spec.Extensions = append(spec.Extensions, &SCTExtension{})
+	if err := client.ApplyPreset(spec); err == nil {
+		t.Error("ApplyPreset accepted a PreSharedKeyExtension that is not the last extension")
+	}
+}
+
+// TestUTLSSharedConfig is meant to be run with -race.
+func TestUTLSSharedConfig(t *testing.T) {
+	config := &Config{
+		ServerName:         "example.golang",
+		InsecureSkipVerify: true,
+		ClientSessionCache: NewLRUClientSessionCache(1),
+	}
+	handshake := func(helloID ClientHelloID, readTicket bool) (didResume bool, err error) {
+		c, s := localPipe(t)
+		defer c.Close()
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			server := Server(s, testConfig)
+			if err := server.Handshake(); err != nil {
+				done <- err
+				return
+			}
+			_, err := server.Write([]byte{1})
+			done <- err
+		}()
+
+		client := UClient(c, config, helloID)
+		if helloID == HelloCustom {
+			if err := client.ApplyPreset(resumptionSpec(false)); err != nil {
+				return false, err
+			}
+		}
+		if err := client.Handshake(); err != nil {
+			return false, err
+		}
+		if readTicket {
+			if _, err := client.Read(make([]byte, 1)); err != nil {
+				return false, err
+			}
+		}
+		if err := <-done; err != nil {
+			return false, fmt.Errorf("server: %v", err)
+		}
+		return client.ConnectionState().DidResume, nil
+	}
+
+	// Cache a session for the HelloCustom connections to resume.
+	if _, err := handshake(HelloCustom, true); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		helloID := HelloChrome_Auto
+		if i%2 == 0 {
+			helloID = HelloCustom
+		}
+		go func() {
+			didResume, err := handshake(helloID, false)
+			if err == nil && helloID == HelloCustom && !didResume {
+				err = errors.New("did not resume the cached session")
+			}
+			if err != nil {
+				err = fmt.Errorf("%s: %v", helloID.Str(), err)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if config.NextProtos != nil || config.CurvePreferences != nil || config.MinVersion != 0 {
+		t.Errorf("UClient modified the shared Config: %+v", config)
+	}
+}
+
+// pskOnlyServer completes a psk_ke handshake with psk on c, selecting the
+// first identity and sending a ServerHello without a key_share, and then sends
+// "hello". binderLabel tells resumption and external PSKs apart.
+func pskOnlyServer(c *Conn, suite *cipherSuiteTLS13, psk []byte, binderLabel string) error {
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	ch, ok := msg.(*clientHelloMsg)
+	if !ok {
+		return unexpectedMessageError(ch, msg)
+	}
+	if len(ch.pskIdentities) == 0 {
+		return errors.New("the client did not offer a PSK")
+	}
+	earlySecret := suite.extract(psk, nil)
+	binderKey := suite.deriveSecret(earlySecret, binderLabel, nil)
+	transcript := suite.hash.New()
+	transcript.Write(ch.marshalWithoutBinders())
+	if !bytes.Equal(ch.pskBinders[0], suite.finishedHash(binderKey, transcript)) {
+		return errors.New("invalid PSK binder")
+	}
+
+	c.vers, c.haveVers = VersionTLS13, true
+	c.in.version, c.out.version = VersionTLS13, VersionTLS13
+	sh := &serverHelloMsg{
+		vers:                    VersionTLS12,
+		supportedVersion:        VersionTLS13,
+		random:                  make([]byte, 32),
+		sessionId:               ch.sessionId,
+		cipherSuite:             suite.id,
+		selectedIdentityPresent: true,
+	}
+	transcript = suite.hash.New()
+	transcript.Write(ch.marshal())
+	transcript.Write(sh.marshal())
+	if _, err := c.writeRecord(recordTypeHandshake, sh.marshal()); err != nil {
+		return err
+	}
+
+	handshakeSecret := suite.extract(nil, suite.deriveSecret(earlySecret, "derived", nil))
+	clientSecret := suite.deriveSecret(handshakeSecret, clientHandshakeTrafficLabel, transcript)
+	serverSecret := suite.deriveSecret(handshakeSecret, serverHandshakeTrafficLabel, transcript)
+	c.in.setTrafficSecret(suite, clientSecret)
+	c.out.setTrafficSecret(suite, serverSecret)
+
+	ee := &encryptedExtensionsMsg{}
+	transcript.Write(ee.marshal())
+	if _, err := c.writeRecord(recordTypeHandshake, ee.marshal()); err != nil {
+		return err
+	}
+	finished := &finishedMsg{verifyData: suite.finishedHash(serverSecret, transcript)}
+	transcript.Write(finished.marshal())
+	if _, err := c.writeRecord(recordTypeHandshake, finished.marshal()); err != nil {
+		return err
+	}
+
+	masterSecret := suite.extract(nil, suite.deriveSecret(handshakeSecret, "derived", nil))
+	clientAppSecret := suite.deriveSecret(masterSecret, clientApplicationTrafficLabel, transcript)
+	serverAppSecret := suite.deriveSecret(masterSecret, serverApplicationTrafficLabel, transcript)
+
+	msg, err = c.readHandshake()
+	if err != nil {
+		return err
+	}
+	clientFinished, ok := msg.(*finishedMsg)
+	if !ok {
+		return unexpectedMessageError(clientFinished, msg)
+	}
+	if !bytes.Equal(clientFinished.verifyData, suite.finishedHash(clientSecret, transcript)) {
+		return errors.New("invalid client Finished")
+	}
+
+	c.in.setTrafficSecret(suite, clientAppSecret)
+	c.out.setTrafficSecret(suite, serverAppSecret)
+	_, err = c.writeRecord(recordTypeApplicationData, []byte("hello"))
+	return err
+}
+
+func TestUTLSPSKOnlyResumption(t *testing.T) {
+	suite := cipherSuiteTLS13ByID(TLS_AES_128_GCM_SHA256)
+	session := &ClientSessionState{
+		sessionTicket: []byte("ticket"),
+		vers:          VersionTLS13,
+		cipherSuite:   TLS_AES_128_GCM_SHA256,
+		masterSecret:  bytes.Repeat([]byte{1}, suite.hash.Size()),
+		receivedAt:    time.Now(),
+		useBy:         time.Now().Add(time.Hour),
+		nonce:         []byte{2},
+	}
+	psk := suite.expandLabel(session.masterSecret, "resumption", session.nonce, suite.hash.Size())
+
+	for _, modes := range [][]uint8{{pskModePlain}, {pskModeDHE}} {
+		cache := NewLRUClientSessionCache(1)
+		cache.Put("example.golang", session)
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- pskOnlyServer(Server(s, testConfig), suite, psk, resumptionBinderLabel)
+		}()
+
+		client := UClient(c, &Config{
+			ServerName:         "example.golang",
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+		}, HelloCustom)
+		spec := resumptionSpec(false)
+		for _, ext := range spec.Extensions {
+			if ext, ok := ext.(*PSKKeyExchangeModesExtension); ok {
+				ext.Modes = modes
+			}
+		}
+		if err := client.ApplyPreset(spec); err != nil {
+			t.Fatal(err)
+		}
+		err := client.Handshake()
+		if modes[0] == pskModeDHE {
+			// Without psk_ke, the ServerHello must carry a key share.
+			if err == nil {
+				t.Error("psk_dhe_ke handshake completed without a server key share")
+			}
+			c.Close()
+			<-done
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !client.ConnectionState().DidResume {
+			t.Error("psk_ke handshake did not resume")
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Errorf("read %q, want %q", buf, "hello")
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		c.Close()
+	}
+}
+
+func TestUTLSExternalPSK(t *testing.T) {
+	suite := cipherSuiteTLS13ByID(TLS_AES_128_GCM_SHA256)
+	key := bytes.Repeat([]byte{3}, 32)
+
+	for _, serverKey := range [][]byte{key, bytes.Repeat([]byte{4}, 32)} {
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- pskOnlyServer(Server(s, testConfig), suite, serverKey, externalBinderLabel)
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang"}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{X25519}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PSSWithSHA256}},
+				&KeyShareExtension{[]KeyShare{{Group: X25519}}},
+				&SupportedVersionsExtension{[]uint16{VersionTLS13, VersionTLS12}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.AddExternalPSK([]byte("mesh"), key, crypto.SHA256); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		ids := clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw)
+		if n := len(ids); n < 2 || ids[n-2] != extensionPSKModes || ids[n-1] != extensionPreSharedKey {
+			t.Errorf("extensions = %v, want psk_key_exchange_modes and pre_shared_key last", ids)
+		}
+
+		err := client.Handshake()
+		if !bytes.Equal(serverKey, key) {
+			if err == nil {
+				t.Error("handshake with a mismatched external PSK succeeded")
+			}
+			c.Close()
+			if err := <-done; err == nil || !strings.Contains(err.Error(), "binder") {
+				t.Errorf("server: got %v, want an invalid binder error", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certs := client.ConnectionState().PeerCertificates; len(certs) != 0 {
+			t.Error("the server authenticated with a certificate")
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Errorf("read %q, want %q", buf, "hello")
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		c.Close()
+	}
+
+	client := UClient(nil, &Config{ServerName: "example.golang"}, HelloGolang)
+	if err := client.AddExternalPSK([]byte("mesh"), key, crypto.SHA1); err == nil {
+		t.Error("AddExternalPSK accepted SHA-1")
+	}
+	if err := client.AddExternalPSK([]byte("mesh"), key, crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BuildHandshakeState(); err == nil {
+		t.Error("HelloGolang offered an external PSK")
+	}
+}
+
+func TestUTLSRandomizedSpec(t *testing.T) {
+	build := func(helloID ClientHelloID, spec *ClientHelloSpec) []byte {
+		uconn := UClient(nil, &Config{ServerName: "example.com", Rand: mathrand.New(mathrand.NewSource(0))}, helloID)
+		if spec != nil {
+			if err := uconn.ApplyPreset(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatalf("%s: %v", helloID.Str(), err)
+		}
+		return uconn.HandshakeState.Hello.Raw
+	}
+
+	distinct := make(map[string]bool)
+	for seed := int64(0); seed < 300; seed++ {
+		spec, err := UTLSRandomizedSpec(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello := build(HelloCustom, spec)
+		if again := build(HelloRandomized.WithSeed(seed), nil); !bytes.Equal(hello, again) {
+			t.Fatalf("seed %d: HelloRandomized differs from UTLSRandomizedSpec", seed)
+		}
+		distinct[fmt.Sprint(clientHelloExtensionIDs(t, hello))] = true
+
+		for _, helloID := range []ClientHelloID{HelloRandomizedALPN, HelloRandomizedNoALPN} {
+			hasALPN := false
+			for _, id := range clientHelloExtensionIDs(t, build(helloID.WithSeed(seed), nil)) {
+				hasALPN = hasALPN || id == extensionALPN
+			}
+			if hasALPN != (helloID == HelloRandomizedALPN) {
+				t.Errorf("%s, seed %d: ALPN extension present: %v", helloID.Str(), seed, hasALPN)
+			}
+		}
+	}
+	if len(distinct) < 100 {
+		t.Errorf("only %d distinct extension lists out of 300 seeds", len(distinct))
+	}
+
+	uconn := UClient(nil, &Config{ServerName: "example.com"}, HelloRandomized)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	if uconn.ClientHelloID.Seed == nil {
+		t.Error("the seed of HelloRandomized is not exposed")
+	}
+}
+
+func TestUTLSRandomizedSingleVersion(t *testing.T) {
+	// The PSS signature algorithms the spec may prefer need an RSA key larger
+	// than the one of testConfig.
+	cert, roots := policyTestChain(t, x509.SHA256WithRSA, 2048)
+	for _, test := range []struct {
+		id      ClientHelloID
+		version uint16
+	}{
+		{HelloRandomized_TLS13, VersionTLS13},
+		{HelloRandomized_TLS12, VersionTLS12},
+	} {
+		for seed := int64(0); seed < 20; seed++ {
+			c, s := localPipe(t)
+			go func() {
+				defer s.Close()
+				Server(s, &Config{Certificates: []Certificate{cert}}).Handshake()
+			}()
+
+			client := UClient(c, &Config{ServerName: "policy.example.com", RootCAs: roots}, test.id.WithSeed(seed))
+			if err := client.BuildHandshakeState(); err != nil {
+				t.Fatalf("%s, seed %d: %v", test.id.Str(), seed, err)
+			}
+			hello := client.HandshakeState.Hello
+			var m clientHelloMsg
+			if !m.unmarshal(hello.Raw) {
+				t.Fatalf("%s, seed %d: malformed ClientHello", test.id.Str(), seed)
+			}
+			for _, suite := range m.cipherSuites {
+				if isTLS13 := cipherSuiteTLS13ByID(suite) != nil; isTLS13 != (test.version == VersionTLS13) {
+					t.Errorf("%s, seed %d: offered cipher suite %#04x", test.id.Str(), seed, suite)
+				}
+			}
+			if test.version == VersionTLS13 {
+				if !reflect.DeepEqual(m.supportedVersions, []uint16{VersionTLS13}) {
+					t.Errorf("%s, seed %d: supported versions %x", test.id.Str(), seed, m.supportedVersions)
+				}
+				for _, scheme := range m.supportedSignatureAlgorithms {
+					if scheme == PKCS1WithSHA1 || scheme == ECDSAWithSHA1 {
+						t.Errorf("%s, seed %d: offered signature algorithm %v", test.id.Str(), seed, scheme)
+					}
+				}
+				if m.ticketSupported || len(m.supportedPoints) > 0 || m.secureRenegotiationSupported || m.ems {
+					t.Errorf("%s, seed %d: offered a TLS 1.2 extension", test.id.Str(), seed)
+				}
+			} else if len(m.supportedVersions) > 0 || len(m.keyShares) > 0 {
+				t.Errorf("%s, seed %d: offered a TLS 1.3 extension", test.id.Str(), seed)
+			}
+
+			again := UClient(nil, &Config{ServerName: "policy.example.com"}, test.id.WithSeed(seed))
+			if err := again.BuildHandshakeState(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(clientHelloExtensionIDs(t, hello.Raw), clientHelloExtensionIDs(t, again.HandshakeState.Hello.Raw)) ||
+				!reflect.DeepEqual(hello.CipherSuites, again.HandshakeState.Hello.CipherSuites) {
+				t.Errorf("%s, seed %d: the seeded spec is not reproducible", test.id.Str(), seed)
+			}
+
+			if err := client.Handshake(); err != nil {
+				t.Fatalf("%s, seed %d: %v", test.id.Str(), seed, err)
+			}
+			if v := client.ConnectionState().Version; v != test.version {
+				t.Errorf("%s, seed %d: negotiated version %x, want %x", test.id.Str(), seed, v, test.version)
+			}
+			c.Close()
+		}
+	}
+}
+
+func TestUTLSKeySecretsCallback(t *testing.T) {
+	record := func(secrets map[string]string) func(string, []byte, []byte) {
+		return func(label string, clientRandom, secret []byte) {
+			secrets[label] = fmt.Sprintf("%x %x", clientRandom, secret)
+		}
+	}
+	clientSecrets, serverSecrets := make(map[string]string), make(map[string]string)
+	var keyLog bytes.Buffer
+
+	c, s := localPipe(t)
+	serverConfig := testConfig.Clone()
+	serverConfig.KeySecretsCallback = record(serverSecrets)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- Server(s, serverConfig).Handshake()
+	}()
+	client := UClient(c, &Config{
+		ServerName:         "example.golang",
+		InsecureSkipVerify: true,
+		KeyLogWriter:       &keyLog,
+		KeySecretsCallback: record(clientSecrets),
+	}, HelloChrome_Auto)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	c.Close()
+
+	labels := []string{keyLogLabelClientHandshake, keyLogLabelServerHandshake,
+		keyLogLabelClientTraffic, keyLogLabelServerTraffic, keyLogLabelExporter}
+	if len(clientSecrets) != len(labels) {
+		t.Errorf("client reported %d secrets, want %d", len(clientSecrets), len(labels))
+	}
+	for _, label := range labels {
+		if clientSecrets[label] == "" || clientSecrets[label] != serverSecrets[label] {
+			t.Errorf("%s: client reported %q, server reported %q", label, clientSecrets[label], serverSecrets[label])
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(keyLog.String()), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if clientSecrets[fields[0]] != fields[1] {
+			t.Errorf("%s: KeyLogWriter wrote %q, callback got %q", fields[0], fields[1], clientSecrets[fields[0]])
+		}
+	}
+}
+
+func TestUTLSMarshalClientHello(t *testing.T) {
+	suite := cipherSuiteTLS13ByID(TLS_AES_128_GCM_SHA256)
+	for _, test := range []struct {
+		name    string
+		helloID ClientHelloID
+		spec    *ClientHelloSpec
+		wantPSK bool
+	}{
+		{"Chrome", HelloChrome_Auto, nil, false},
+		{"Firefox", HelloFirefox_128, nil, false},
+		{"PSK", HelloCustom, resumptionSpec(false), true},
+		{"Golang", HelloGolang, nil, true},
+	} {
+		// The failed handshake drops the session from the cache.
+		cache := NewLRUClientSessionCache(1)
+		cache.Put("example.golang", &ClientSessionState{
+			sessionTicket: []byte("ticket"),
+			vers:          VersionTLS13,
+			cipherSuite:   TLS_AES_128_GCM_SHA256,
+			masterSecret:  bytes.Repeat([]byte{1}, suite.hash.Size()),
+			receivedAt:    time.Now(),
+			useBy:         time.Now().Add(time.Hour),
+			nonce:         []byte{2},
+		})
+		config := &Config{ServerName: "example.golang", InsecureSkipVerify: true, ClientSessionCache: cache}
+
+		c, s := localPipe(t)
+		client := UClient(c, config, test.helloID)
+		if test.spec != nil {
+			if err := client.ApplyPreset(test.spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		marshaled, err := client.MarshalClientHello()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		again, err := client.MarshalClientHello()
+		if err != nil || !bytes.Equal(again, marshaled) {
+			t.Errorf("%s: MarshalClientHello is not stable: %v", test.name, err)
+		}
+		if test.wantPSK {
+			ids := clientHelloExtensionIDs(t, marshaled)
+			if ids[len(ids)-1] != extensionPreSharedKey {
+				t.Errorf("%s: pre_shared_key is missing from %v", test.name, ids)
+			}
+		}
+
+		sent := make(chan []byte, 1)
+		go func() {
+			defer s.Close()
+			header := make([]byte, recordHeaderLen)
+			if _, err := io.ReadFull(s, header); err != nil {
+				sent <- nil
+				return
+			}
+			body := make([]byte, int(header[3])<<8|int(header[4]))
+			io.ReadFull(s, body)
+			sent <- body
+		}()
+		client.Handshake()
+		c.Close()
+		if wire := <-sent; !bytes.Equal(wire, marshaled) {
+			t.Errorf("%s: sent ClientHello\n%x\ndiffers from the marshaled one\n%x", test.name, wire, marshaled)
+		}
+
+		if _, err := client.MarshalClientHello(); err == nil {
+			t.Errorf("%s: MarshalClientHello succeeded after the handshake", test.name)
+		}
+	}
+}
+
+func TestUTLSEdge(t *testing.T) {
+	// The JA4 of Chrome and Edge 120 to 123, without the padding extension.
+	const chromiumJA4 = "t13d1516h2_8daaf6152771_02713d6af862"
+
+	build := func(id ClientHelloID, seed int64) []byte {
+		uconn := UClient(nil, &Config{ServerName: "example.com", Rand: mathrand.New(mathrand.NewSource(seed))}, id)
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatalf("%s: %v", id.Str(), err)
+		}
+		return uconn.HandshakeState.Hello.Raw
+	}
+	// extensionSet returns the sorted extensions, without GREASE and padding.
+	extensionSet := func(ids []uint16) []uint16 {
+		var set []uint16
+		for _, id := range ids {
+			if !isGREASEValue(id) && id != utlsExtensionPadding {
+				set = append(set, id)
+			}
+		}
+		sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+		return set
+	}
+
+	// The extensions of Chromium 122, pinned rather than taken from a Chrome
+	// parrot, which Edge does not follow.
+	chrome := []uint16{0, 5, 10, 11, 13, 16, 18, 23, 27, 35, 43, 45, 51, 17513, 65037, 65281}
+	orders := make(map[string]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		raw := build(HelloEdge_122, seed)
+		ids := clientHelloExtensionIDs(t, raw)
+		if !reflect.DeepEqual(extensionSet(ids), chrome) {
+			t.Fatalf("seed %d: extensions %v differ from the ones of Chromium 122", seed, ids)
+		}
+		padded := ids[len(ids)-1] == utlsExtensionPadding
+		if padded {
+			ids = ids[:len(ids)-1]
+		}
+		if first, last := ids[0], ids[len(ids)-1]; !isGREASEValue(first) || !isGREASEValue(last) || first == last {
+			t.Errorf("seed %d: extensions %v do not start and end with distinct GREASE", seed, ids)
+		}
+		if got := ja4(t, raw); !padded && got != chromiumJA4 {
+			t.Errorf("seed %d: JA4 is %s, want %s", seed, got, chromiumJA4)
+		}
+		orders[fmt.Sprint(ids[1:len(ids)-1])] = true
+	}
+	if len(orders) < 10 {
+		t.Errorf("only %d extension orders in 20 connections", len(orders))
+	}
+
+	c, s := localPipe(t)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- Server(s, testConfig).Handshake()
+	}()
+	client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloEdge_Auto)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	c.Close()
+}
+
+func TestCertificateAuthoritiesExtension(t *testing.T) {
+	ext := &CertificateAuthoritiesExtension{CertificateAuthorities: [][]byte{{1, 2, 3}, {4}}}
+	want := []byte{0x00, 0x2f, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x03, 1, 2, 3, 0x00, 0x01, 4}
+	b := make([]byte, ext.Len())
+	if _, err := ext.Read(b); err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("marshaled CertificateAuthoritiesExtension %x, want %x", b, want)
+	}
+
+	// Chrome pads its ClientHello to 512 bytes unless it is already larger.
+	for _, n := range []int{1, 500} {
+		cas := make([][]byte, n)
+		for i := range cas {
+			cas[i] = bytes.Repeat([]byte{byte(i)}, 100)
+		}
+		spec, err := utlsIdToSpec(HelloChrome_83)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := len(spec.Extensions) - 1 // padding
+		spec.Extensions = append(spec.Extensions[:last:last],
+			&CertificateAuthoritiesExtension{CertificateAuthorities: cas}, spec.Extensions[last])
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(&spec); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		raw := uconn.HandshakeState.Hello.Raw
+		var m clientHelloMsg
+		if !m.unmarshal(raw) {
+			t.Fatalf("%d CAs: failed to unmarshal the ClientHello", n)
+		}
+		if !reflect.DeepEqual(m.certificateAuthorities, cas) {
+			t.Errorf("%d CAs: ClientHello lists %d certificate authorities", n, len(m.certificateAuthorities))
+		}
+		padding := spec.Extensions[len(spec.Extensions)-1].(*UtlsPaddingExtension)
+		if n == 1 && len(raw) != 512 {
+			t.Errorf("padded ClientHello is %d bytes, want 512", len(raw))
+		}
+		if n > 1 && padding.WillPad {
+			t.Errorf("a %d bytes ClientHello was padded", len(raw))
+		}
+
+		fingerprinted, err := (&Fingerprinter{}).FingerprintClientHello(clientHelloRecord(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed *CertificateAuthoritiesExtension
+		for _, ext := range fingerprinted.Extensions {
+			if ext, ok := ext.(*CertificateAuthoritiesExtension); ok {
+				parsed = ext
+			}
+		}
+		if parsed == nil {
+			t.Fatalf("%d CAs: Fingerprinter did not parse certificate_authorities", n)
+		}
+		if !reflect.DeepEqual(parsed.CertificateAuthorities, cas) {
+			t.Errorf("%d CAs: fingerprinted certificate authorities differ", n)
+		}
+	}
+
+	for name, cas := range map[string][][]byte{
+		"empty list":    nil,
+		"empty name":    {{}},
+		"list too long": {make([]byte, 0x8000), make([]byte, 0x8000)},
+	} {
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(&ClientHelloSpec{Extensions: []TLSExtension{
+			&CertificateAuthoritiesExtension{CertificateAuthorities: cas},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err == nil {
+			t.Errorf("%s: CertificateAuthoritiesExtension was accepted", name)
+		}
+	}
+}
+
+func TestUTLSCertificateAuthorities(t *testing.T) {
+	rsaCert, err := X509KeyPair([]byte(clientCertificatePEM), []byte(clientKeyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaCert, err := X509KeyPair([]byte(clientECDSACertificatePEM), []byte(clientECDSAKeyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(ecdsaCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := [][]byte{leaf.RawIssuer}
+
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		var seenCAs [][]byte
+		serverConfig := testConfig.Clone()
+		serverConfig.MaxVersion = version
+		serverConfig.ClientAuth = RequireAnyClientCert
+		serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+			seenCAs = info.CertificateAuthorities
+			return nil, nil
+		}
+
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		server := Server(s, serverConfig)
+		go func() {
+			defer s.Close()
+			done <- server.Handshake()
+		}()
+		// The server does not list certificate authorities in its
+		// CertificateRequest, so the client picks the certificate issued by
+		// the one it advertised rather than the first one.
+		client := UClient(c, &Config{
+			ServerName:         "example.golang",
+			InsecureSkipVerify: true,
+			Certificates:       []Certificate{rsaCert, ecdsaCert},
+		}, HelloCustom)
+		spec, err := utlsIdToSpec(HelloChrome_113)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec.Extensions = append([]TLSExtension{&CertificateAuthoritiesExtension{CertificateAuthorities: cas}}, spec.Extensions...)
+		if err := client.ApplyPreset(&spec); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%x: %v", version, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%x: server: %v", version, err)
+		}
+		c.Close()
+		if !reflect.DeepEqual(seenCAs, cas) {
+			t.Errorf("%x: server saw certificate authorities %x, want %x", version, seenCAs, cas)
+		}
+		peer := server.ConnectionState().PeerCertificates
+		if len(peer) == 0 || !bytes.Equal(peer[0].Raw, ecdsaCert.Certificate[0]) {
+			t.Errorf("%x: client did not send the certificate issued by the advertised CA", version)
+		}
+	}
+}
+
+func TestUTLSSetSessionTicket(t *testing.T) {
+	tls12Spec := func() *ClientHelloSpec {
+		return &ClientHelloSpec{
+			CipherSuites: []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{X25519}},
+				&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PKCS1WithSHA256}},
+				&SessionTicketExtension{},
+				&SupportedVersionsExtension{[]uint16{VersionTLS12}},
+			},
+		}
+	}
+	handshake := func(spec *ClientHelloSpec, setup func(*UConn) error, cache ClientSessionCache) *UConn {
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			server := Server(s, testConfig)
+			if err := server.Handshake(); err != nil {
+				done <- err
+				return
+			}
+			// Make the client read the NewSessionTicket message.
+			_, err := server.Write([]byte{1})
+			done <- err
+		}()
+
+		client := UClient(c, &Config{
+			ServerName:         "example.golang",
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+		}, HelloCustom)
+		if err := client.ApplyPreset(spec); err != nil {
+			t.Fatal(err)
+		}
+		if setup != nil {
+			if err := setup(client); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+		c.Close()
+		return client
+	}
+
+	// Harvest a ticket from a full handshake, then resume it on a connection
+	// without a session cache.
+	cache := NewLRUClientSessionCache(1)
+	handshake(tls12Spec(), nil, cache)
+	session, ok := cache.Get("example.golang")
+	if !ok || session.vers != VersionTLS12 {
+		t.Fatal("no TLS 1.2 session was cached")
+	}
+	client := handshake(tls12Spec(), func(uconn *UConn) error {
+		return uconn.SetSessionTicket(session.sessionTicket, session.masterSecret, session.vers, session.cipherSuite)
+	}, nil)
+	if !client.ConnectionState().DidResume {
+		t.Error("TLS 1.2 handshake with the injected ticket did not resume")
+	}
+
+	cache = NewLRUClientSessionCache(1)
+	handshake(resumptionSpec(false), nil, cache)
+	session, ok = cache.Get("example.golang")
+	if !ok || session.vers != VersionTLS13 {
+		t.Fatal("no TLS 1.3 session was cached")
+	}
+	suite := cipherSuiteTLS13ByID(session.cipherSuite)
+	psk := suite.expandLabel(session.masterSecret, "resumption", session.nonce, suite.hash.Size())
+	spec := resumptionSpec(false)
+	spec.Extensions = spec.Extensions[:len(spec.Extensions)-1] // appended by SetSessionTicket
+	client = handshake(spec, func(uconn *UConn) error {
+		return uconn.SetSessionTicket(session.sessionTicket, psk, session.vers, session.cipherSuite)
+	}, nil)
+	if !client.ConnectionState().DidResume {
+		t.Error("TLS 1.3 handshake with the injected ticket did not resume")
+	}
+	ids := clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw)
+	if ids[len(ids)-1] != extensionPreSharedKey {
+		t.Errorf("extensions = %v, want pre_shared_key last", ids)
+	}
+
+	client = UClient(nil, &Config{ServerName: "example.golang"}, HelloCustom)
+	if err := client.ApplyPreset(tls12Spec()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetSessionTicket([]byte("ticket"), make([]byte, masterSecretLength), VersionTLS12, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256); err == nil {
+		t.Error("SetSessionTicket accepted a cipher suite missing from the spec")
+	}
+	if err := client.SetSessionTicket([]byte("ticket"), make([]byte, 32), VersionTLS12, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); err == nil {
+		t.Error("SetSessionTicket accepted a short master secret")
+	}
+
+	client = UClient(nil, &Config{ServerName: "example.golang"}, HelloCustom)
+	if err := client.ApplyPreset(tls12Spec()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetSessionTicket([]byte("ticket"), make([]byte, 32), VersionTLS13, TLS_AES_128_GCM_SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BuildHandshakeState(); err == nil {
+		t.Error("BuildHandshakeState offered a TLS 1.3 ticket with a TLS 1.2 spec")
+	}
+}
+
+func TestBoringPaddingStyle(t *testing.T) {
+	for _, test := range []struct {
+		unpaddedLen int
+		paddingLen  int
+		willPad     bool
+	}{
+		{200, 0, false},
+		{255, 0, false},
+		{256, 252, true},
+		{400, 108, true},
+		{507, 1, true},
+		{508, 1, true},
+		{511, 1, true},
+		{512, 0, false},
+	} {
+		paddingLen, willPad := BoringPaddingStyle(test.unpaddedLen)
+		if paddingLen != test.paddingLen || willPad != test.willPad {
+			t.Errorf("BoringPaddingStyle(%d) = %d, %v, want %d, %v", test.unpaddedLen,
+				paddingLen, willPad, test.paddingLen, test.willPad)
+		}
+	}
+
+	// build returns the ClientHello of a Chrome-like spec with a filler
+	// extension carrying fillerLen bytes, and the length it had before padding.
+	build := func(fillerLen int) (raw []byte, unpaddedLen int) {
+		spec := &ClientHelloSpec{
+			CipherSuites: []uint16{GREASE_PLACEHOLDER, TLS_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&UtlsGREASEExtension{},
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{GREASE_PLACEHOLDER, X25519, CurveP256}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+				}},
+				&KeyShareExtension{[]KeyShare{{Group: GREASE_PLACEHOLDER, Data: []byte{0}}, {Group: X25519}}},
+				&SupportedVersionsExtension{[]uint16{GREASE_PLACEHOLDER, VersionTLS13, VersionTLS12}},
+				&GenericExtension{Id: 0xff01, Data: make([]byte, fillerLen)},
+				&UtlsGREASEExtension{},
+				&UtlsPaddingExtension{GetPaddingLen: func(n int) (int, bool) {
+					unpaddedLen = n
+					return BoringPaddingStyle(n)
+				}},
+			},
+		}
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(spec); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		return uconn.HandshakeState.Hello.Raw, unpaddedLen
+	}
+
+	_, unpaddedLen := build(0)
+	if unpaddedLen >= 400 {
+		t.Fatalf("the spec is already %d bytes long without filler", unpaddedLen)
+	}
+	raw, unpaddedLen := build(400 - unpaddedLen)
+	if unpaddedLen != 400 {
+		t.Fatalf("unpadded ClientHello is %d bytes, want 400", unpaddedLen)
+	}
+	if len(raw) < 512 {
+		t.Errorf("padded ClientHello is %d bytes, want at least 512", len(raw))
+	}
+	ids := clientHelloExtensionIDs(t, raw)
+	if last := ids[len(ids)-1]; last != utlsExtensionPadding {
+		t.Errorf("last extension is %d, want padding", last)
+	}
+
+	raw, _ = build(600)
+	ids = clientHelloExtensionIDs(t, raw)
+	if last := ids[len(ids)-1]; last == utlsExtensionPadding {
+		t.Errorf("a %d bytes ClientHello was padded", len(raw))
+	}
+}
+
+func TestUTLSGREASEVersion(t *testing.T) {
+	// A GREASE key share without data gets the single zero byte Chrome sends.
+	spec := &ClientHelloSpec{
+		CipherSuites: []uint16{GREASE_PLACEHOLDER, TLS_AES_128_GCM_SHA256},
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{GREASE_PLACEHOLDER, X25519}},
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256, PSSWithSHA256}},
+			&KeyShareExtension{KeyShares: []KeyShare{{Group: GREASE_PLACEHOLDER}, {Group: X25519}}},
+			&SupportedVersionsExtension{Versions: []uint16{GREASE_PLACEHOLDER, VersionTLS13, VersionTLS12}},
+		},
+	}
+	hello := func(seed uint64) *clientHelloMsg {
+		spec, err := spec.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		uconn := UClient(nil, &Config{ServerName: "example.com"}, HelloCustom)
+		uconn.SetGreaseSeed(seed)
+		if err := uconn.ApplyPreset(&spec); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		m := new(clientHelloMsg)
+		if !m.unmarshal(uconn.HandshakeState.Hello.Raw) {
+			t.Fatal("failed to parse the ClientHello")
+		}
+		return m
+	}
+
+	m := hello(1)
+	if len(m.supportedVersions) != 3 || !isGREASEValue(m.supportedVersions[0]) {
+		t.Fatalf("supported_versions = %x, want a GREASE version first", m.supportedVersions)
+	}
+	if v := hello(1).supportedVersions[0]; v != m.supportedVersions[0] {
+		t.Errorf("the same seed gave the GREASE versions %x and %x", m.supportedVersions[0], v)
+	}
+	if len(m.keyShares) != 2 || !isGREASEValue(uint16(m.keyShares[0].group)) ||
+		!bytes.Equal(m.keyShares[0].data, []byte{0}) {
+		t.Errorf("the GREASE key share is %x: %x", m.keyShares[0].group, m.keyShares[0].data)
+	}
+
+	// Servers ignore the GREASE version, key share and group.
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		server := Server(s, testConfig)
+		io.Copy(server, server)
+	}()
+	defer c.Close()
+	uconn := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+	uconn.SetGreaseSeed(1)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if v := uconn.ConnectionState().Version; v != VersionTLS13 {
+		t.Errorf("negotiated version %#04x, want TLS 1.3", v)
+	}
+}
+
+func TestUTLSServerSecureRenegotiation(t *testing.T) {
+	// The initial handshake must carry an empty renegotiation_info.
+	testClientHelloFailure(t, testConfig, &clientHelloMsg{
+		vers:                         VersionTLS12,
+		random:                       make([]byte, 32),
+		cipherSuites:                 []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		compressionMethods:           []uint8{compressionNone},
+		secureRenegotiationSupported: true,
+		secureRenegotiation:          make([]byte, 12),
+	}, "initial handshake had non-empty renegotiation extension")
+
+	for _, test := range []struct {
+		name       string
+		signal     TLSExtension // nil for the SCSV
+		wantSecure bool
+	}{
+		{"extension", &RenegotiationInfoExtension{Renegotiation: RenegotiateOnceAsClient}, true},
+		{"SCSV", nil, true},
+		{"none", &UtlsExtendedMasterSecretExtension{}, false},
+	} {
+		suites := []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+		extensions := []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{X25519}},
+			&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PSSWithSHA256, PKCS1WithSHA256}},
+		}
+		if test.signal == nil {
+			suites = append(suites, FAKE_TLS_EMPTY_RENEGOTIATION_INFO_SCSV)
+		} else {
+			extensions = append(extensions, test.signal)
+		}
+
+		c, s := localPipe(t)
+		serverConfig := testConfig.Clone()
+		serverConfig.MaxVersion = VersionTLS12
+		server := Server(s, serverConfig)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- server.Handshake()
+		}()
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			TLSVersMin:   VersionTLS12,
+			TLSVersMax:   VersionTLS12,
+			CipherSuites: suites,
+			Extensions:   extensions,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%s: server: %v", test.name, err)
+		}
+		c.Close()
+
+		// Both sides record whether the ServerHello echoed the secure
+		// renegotiation, and keep the verify_data a renegotiation would
+		// be bound to.
+		if client.secureRenegotiation != test.wantSecure || server.secureRenegotiation != test.wantSecure {
+			t.Errorf("%s: secure renegotiation: client %v, server %v, want %v",
+				test.name, client.secureRenegotiation, server.secureRenegotiation, test.wantSecure)
+		}
+		if client.clientFinished != server.clientFinished || client.serverFinished != server.serverFinished {
+			t.Errorf("%s: server verify_data %x %x, client %x %x", test.name,
+				server.clientFinished, server.serverFinished, client.clientFinished, client.serverFinished)
+		}
+	}
+}
+
+func TestUTLSUnsafeServerHelloCallback(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		serverCurve CurveID
+		wantHRR     bool
+	}{
+		{"ServerHello", X25519, false},
+		// The client sends no P-256 key share, so the server retries.
+		{"HelloRetryRequest", CurveP256, true},
+	} {
+		c, s := localPipe(t)
+		serverConfig := testConfig.Clone()
+		serverConfig.CurvePreferences = []CurveID{test.serverCurve}
+		go func() {
+			defer s.Close()
+			Server(s, serverConfig).Handshake()
+		}()
+
+		var received [][]byte
+		config := &Config{
+			ServerName:         "example.golang",
+			InsecureSkipVerify: true,
+			UnsafeServerHelloCallback: func(raw []byte) {
+				received = append(received, append([]byte(nil), raw...))
+				// Modifying the message has no effect.
+				for i := range raw {
+					raw[i] = 0
+				}
+			},
+		}
+		client := UClient(c, config, HelloChrome_Auto)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		client.Close()
+
+		want := 1
+		if test.wantHRR {
+			want = 2
+		}
+		if len(received) != want {
+			t.Fatalf("%s: callback called %d times, want %d", test.name, len(received), want)
+		}
+		if test.wantHRR {
+			hrr := new(serverHelloMsg)
+			if !hrr.unmarshal(received[0]) || !bytes.Equal(hrr.random, helloRetryRequestRandom) {
+				t.Errorf("%s: first message %x is not a HelloRetryRequest", test.name, received[0])
+			}
+		}
+		if got := received[len(received)-1]; !bytes.Equal(got, client.HandshakeState.ServerHello.Raw) {
+			t.Errorf("%s: callback got %x, the handshake processed %x", test.name, got, client.HandshakeState.ServerHello.Raw)
+		}
+	}
+}
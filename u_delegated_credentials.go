@@ -0,0 +1,191 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// delegatedCredentialSignatureContext is the context string of the signature
+// over a delegated credential, see RFC 9345, Section 4.
+const delegatedCredentialSignatureContext = "TLS, server delegated credentials\x00"
+
+// maxDelegatedCredentialValidity is the longest remaining validity a
+// delegated credential may have, see RFC 9345, Section 4.1.3.
+const maxDelegatedCredentialValidity = 7 * 24 * time.Hour
+
+// oidDelegationUsage identifies the DelegationUsage certificate extension
+// that allows a certificate to issue delegated credentials.
+var oidDelegationUsage = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44363, 44}
+
+// A DelegatedCredential is a short-lived key a server authenticates with in
+// place of the key of its certificate, see RFC 9345.
+type DelegatedCredential struct {
+	// Raw is the wire encoding of the delegated credential.
+	Raw []byte
+	// ValidTime is the lifetime of the credential, counted from the
+	// NotBefore of the certificate that signed it.
+	ValidTime time.Duration
+	// CertVerifyAlgorithm is the signature scheme of the CertificateVerify
+	// message signed with the credential.
+	CertVerifyAlgorithm SignatureScheme
+	// PublicKey is the public key of the credential.
+	PublicKey crypto.PublicKey
+	// Algorithm is the signature scheme of Signature.
+	Algorithm SignatureScheme
+	// Signature is made over the credential with the private key of the
+	// certificate.
+	Signature []byte
+
+	cred []byte // the signed Credential structure
+}
+
+// NewDelegatedCredential issues a delegated credential for pub, signed with
+// the private key of cert, for use with Certificate.DelegatedCredential. The
+// credential expires validTime after the NotBefore of the leaf certificate,
+// which must carry the DelegationUsage extension for clients to accept it.
+func NewDelegatedCredential(cert *Certificate, certVerifyAlgorithm SignatureScheme, pub crypto.PublicKey, validTime time.Duration) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("tls: delegated credential requires a certificate")
+	}
+	priv, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("tls: certificate private key does not implement crypto.Signer")
+	}
+	algs := signatureSchemesForCertificate(VersionTLS13, cert)
+	if len(algs) == 0 {
+		return nil, unsupportedCertificateError(cert)
+	}
+	algorithm := algs[0]
+	if validTime <= 0 || validTime/time.Second > 0xffffffff {
+		return nil, errors.New("tls: invalid delegated credential validity")
+	}
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint32(uint32(validTime / time.Second))
+	b.AddUint16(uint16(certVerifyAlgorithm))
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(spki)
+	})
+	cred := b.BytesOrPanic()
+
+	sigType := signatureFromSignatureScheme(algorithm)
+	sigHash, err := hashFromSignatureScheme(algorithm)
+	if sigType == 0 || err != nil {
+		return nil, errors.New("tls: unsupported delegated credential signature scheme")
+	}
+	signOpts := crypto.SignerOpts(sigHash)
+	if sigType == signatureRSAPSS {
+		signOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: sigHash}
+	}
+	digest := delegatedCredentialDigest(sigHash, cert.Certificate[0], cred, algorithm)
+	sig, err := priv.Sign(rand.Reader, digest, signOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	b = cryptobyte.Builder{}
+	b.AddBytes(cred)
+	b.AddUint16(uint16(algorithm))
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(sig)
+	})
+	return b.BytesOrPanic(), nil
+}
+
+// parseDelegatedCredential parses the body of a delegated_credential
+// certificate extension.
+func parseDelegatedCredential(raw []byte) (*DelegatedCredential, error) {
+	dc := &DelegatedCredential{Raw: raw}
+	s := cryptobyte.String(raw)
+	var validTime uint32
+	var certVerifyAlgorithm, algorithm uint16
+	var spki, sig cryptobyte.String
+	if !s.ReadUint32(&validTime) || !s.ReadUint16(&certVerifyAlgorithm) ||
+		!s.ReadUint24LengthPrefixed(&spki) || spki.Empty() {
+		return nil, errors.New("tls: malformed delegated credential")
+	}
+	dc.cred = raw[:len(raw)-len(s)]
+	if !s.ReadUint16(&algorithm) || !s.ReadUint16LengthPrefixed(&sig) || !s.Empty() {
+		return nil, errors.New("tls: malformed delegated credential")
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, errors.New("tls: malformed delegated credential public key: " + err.Error())
+	}
+	dc.ValidTime = time.Duration(validTime) * time.Second
+	dc.CertVerifyAlgorithm = SignatureScheme(certVerifyAlgorithm)
+	dc.PublicKey = pub
+	dc.Algorithm = SignatureScheme(algorithm)
+	dc.Signature = sig
+	return dc, nil
+}
+
+// verify checks that the delegated credential was issued by cert, is valid at
+// now and that its CertificateVerify scheme is one of schemes, as required by
+// RFC 9345, Section 4.1.3.
+func (dc *DelegatedCredential) verify(cert *x509.Certificate, schemes []SignatureScheme, now time.Time) error {
+	hasDelegationUsage := false
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidDelegationUsage) {
+			hasDelegationUsage = true
+		}
+	}
+	if !hasDelegationUsage || cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return errors.New("tls: certificate is not allowed to issue delegated credentials")
+	}
+
+	expiry := cert.NotBefore.Add(dc.ValidTime)
+	if !now.Before(expiry) {
+		return errors.New("tls: delegated credential has expired")
+	}
+	if expiry.Sub(now) > maxDelegatedCredentialValidity {
+		return errors.New("tls: delegated credential is valid for more than 7 days")
+	}
+
+	if !isSupportedSignatureAlgorithm(dc.CertVerifyAlgorithm, schemes) ||
+		signatureFromSignatureScheme(dc.CertVerifyAlgorithm) == 0 {
+		return errors.New("tls: delegated credential uses an unsupported signature scheme")
+	}
+
+	if !isSupportedSignatureAlgorithm(dc.Algorithm, supportedSignatureAlgorithms) {
+		return errors.New("tls: invalid delegated credential signature algorithm")
+	}
+	sigType := signatureFromSignatureScheme(dc.Algorithm)
+	sigHash, err := hashFromSignatureScheme(dc.Algorithm)
+	if sigType == 0 || err != nil || sigHash == crypto.SHA1 {
+		return errors.New("tls: invalid delegated credential signature algorithm")
+	}
+	digest := delegatedCredentialDigest(sigHash, cert.Raw, dc.cred, dc.Algorithm)
+	if err := verifyHandshakeSignature(sigType, cert.PublicKey, sigHash, digest, dc.Signature); err != nil {
+		return errors.New("tls: invalid delegated credential signature")
+	}
+	return nil
+}
+
+// delegatedCredentialDigest hashes the message signed by the certificate
+// issuing a delegated credential.
+func delegatedCredentialDigest(sigHash crypto.Hash, cert, cred []byte, algorithm SignatureScheme) []byte {
+	h := sigHash.New()
+	h.Write(signaturePadding)
+	io.WriteString(h, delegatedCredentialSignatureContext)
+	h.Write(cert)
+	h.Write(cred)
+	h.Write([]byte{byte(algorithm >> 8), byte(algorithm)})
+	return h.Sum(nil)
+}
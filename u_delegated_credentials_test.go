@@ -0,0 +1,176 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDelegationCertificate returns a self-signed ECDSA certificate for
+// dc.example.com, allowed to issue delegated credentials, and a pool
+// trusting it.
+func newDelegationCertificate(t *testing.T, notBefore time.Time) (Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dc.example.com"},
+		DNSNames:              []string{"dc.example.com"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidDelegationUsage, Value: []byte{0x05, 0x00}},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// testDelegatedCredentialHandshake performs a handshake between a HelloFirefox_128
+// client, which offers delegated credentials, and a server presenting cert.
+func testDelegatedCredentialHandshake(t *testing.T, cert Certificate, roots *x509.CertPool) (ConnectionState, error) {
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		Server(s, &Config{Certificates: []Certificate{cert}}).Handshake()
+	}()
+
+	client := UClient(c, &Config{ServerName: "dc.example.com", RootCAs: roots}, HelloFirefox_128)
+	err := client.Handshake()
+	c.Close()
+	return client.ConnectionState(), err
+}
+
+func TestDelegatedCredential(t *testing.T) {
+	notBefore := time.Now().Add(-time.Hour)
+	cert, roots := newDelegationCertificate(t, notBefore)
+	dcKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := NewDelegatedCredential(&cert, ECDSAWithP256AndSHA256, dcKey.Public(), 25*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.DelegatedCredential = dc
+	cert.DelegatedCredentialPrivateKey = dcKey
+
+	state, err := testDelegatedCredentialHandshake(t, cert, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := state.DelegatedCredential
+	if got == nil {
+		t.Fatal("no delegated credential in ConnectionState")
+	}
+	if got.CertVerifyAlgorithm != ECDSAWithP256AndSHA256 || got.ValidTime != 25*time.Hour {
+		t.Errorf("unexpected delegated credential %+v", got)
+	}
+	if pub, ok := got.PublicKey.(*ecdsa.PublicKey); !ok || pub.X.Cmp(dcKey.X) != 0 || pub.Y.Cmp(dcKey.Y) != 0 {
+		t.Errorf("delegated credential public key does not match")
+	}
+
+	// Clients that don't offer delegated credentials get the certificate key.
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		Server(s, &Config{Certificates: []Certificate{cert}}).Handshake()
+	}()
+	client := UClient(c, &Config{ServerName: "dc.example.com", RootCAs: roots}, HelloChrome_113)
+	err = client.Handshake()
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ConnectionState().DelegatedCredential != nil {
+		t.Error("delegated credential used with a client that did not offer it")
+	}
+}
+
+func TestDelegatedCredentialRejected(t *testing.T) {
+	notBefore := time.Now().Add(-time.Hour)
+	cert, roots := newDelegationCertificate(t, notBefore)
+	dcKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, _ := newDelegationCertificate(t, notBefore)
+
+	for _, tc := range []struct {
+		name      string
+		issuer    *Certificate
+		validTime time.Duration
+		corrupt   bool
+		wantErr   string
+	}{
+		{"expired", &cert, 30 * time.Minute, false, "expired"},
+		{"too long", &cert, 9 * 24 * time.Hour, false, "more than 7 days"},
+		{"bad signature", &cert, 2 * time.Hour, true, "signature"},
+		{"wrong issuer", &otherCert, 2 * time.Hour, false, "signature"},
+	} {
+		dc, err := NewDelegatedCredential(tc.issuer, ECDSAWithP256AndSHA256, dcKey.Public(), tc.validTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.corrupt {
+			dc[len(dc)-1] ^= 0xff
+		}
+		serverCert := cert
+		serverCert.DelegatedCredential = dc
+		serverCert.DelegatedCredentialPrivateKey = dcKey
+
+		_, err = testDelegatedCredentialHandshake(t, serverCert, roots)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want one mentioning %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestDelegatedCredentialWithoutDelegationUsage(t *testing.T) {
+	cert := testConfig.Certificates[0]
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := NewDelegatedCredential(&cert, ECDSAWithP256AndSHA256, dcKey.Public(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := parseDelegatedCredential(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dc.verify(leaf, []SignatureScheme{ECDSAWithP256AndSHA256}, leaf.NotBefore)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("got error %v, want one about the missing DelegationUsage extension", err)
+	}
+}
@@ -0,0 +1,931 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// VersionDTLS12 is the wire version of DTLS 1.2, see RFC 6347.
+const VersionDTLS12 = 0xfefd
+
+const (
+	typeHelloVerifyRequest uint8 = 3
+
+	dtlsRecordHeaderLen    = 13 // type, version, epoch, sequence number, length
+	dtlsHandshakeHeaderLen = 12 // type, length, message_seq, fragment_offset, fragment_length
+
+	// dtlsMaxDatagram bounds the datagrams sent by a UDTLSConn, to stay
+	// below the path MTU. Handshake messages are fragmented to fit, and so
+	// is the data passed to Write.
+	dtlsMaxDatagram = 1200
+	// dtlsMaxOverhead is the most an AEAD adds to a record: an explicit
+	// nonce and a tag.
+	dtlsMaxOverhead = 8 + 16
+
+	// A flight is retransmitted when the server does not answer within
+	// dtlsInitialRetransmitTimeout, which doubles with each of at most
+	// dtlsMaxRetransmits retransmissions. See RFC 6347, Section 4.2.4.1.
+	dtlsInitialRetransmitTimeout = time.Second
+	dtlsMaxRetransmits           = 6
+
+	// dtlsMaxSequenceNumber is the last sequence number of an epoch.
+	dtlsMaxSequenceNumber = 1<<48 - 1
+)
+
+// dtlsDefaultCipherSuites are the cipher suites a UDTLSConn offers when
+// Config.CipherSuites is empty.
+var dtlsDefaultCipherSuites = []uint16{
+	TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// UDTLSConn is the client side of a DTLS 1.2 connection over a
+// net.PacketConn, as WebRTC and other protocols running over UDP use. See RFC
+// 6347. The handshake and the record protection reuse the TLS 1.2 cipher
+// suites and key agreements of this package, with the ECDHE cipher suites
+// using an AEAD only.
+//
+// The client answers a HelloVerifyRequest, reassembles fragmented handshake
+// messages and retransmits its last flight until the server answers. It
+// sends an empty Certificate if the server requests one. Renegotiation,
+// session resumption and the use_srtp extension are not supported, although
+// ConnectionState().ExportKeyingMaterial derives the DTLS-SRTP keys.
+//
+// Each Read returns data of one record at most, and each Write sends its
+// data in records that fit a datagram, which may be lost or reordered on the
+// way as in any protocol over UDP.
+type UDTLSConn struct {
+	conn   net.PacketConn
+	raddr  net.Addr
+	config *Config
+
+	handshakeMutex    sync.Mutex
+	handshakeErr      error
+	handshakeComplete bool
+
+	// in and out are the record protection of each epoch, 0 before the
+	// ChangeCipherSpec and 1 after it.
+	in, out  [2]dtlsEpoch
+	outEpoch uint16
+
+	// sendSeq and recvSeq are the message_seq of the next handshake
+	// messages to send and to return from readHandshake. Handshake messages
+	// received ahead of recvSeq wait in fragments.
+	sendSeq, recvSeq uint16
+	fragments        map[uint16]*dtlsHandshakeMessage
+	// flight is the last flight of handshake records, sealed anew with fresh
+	// sequence numbers each time it is sent.
+	flight []dtlsRecord
+
+	readMutex  sync.Mutex
+	datagram   []byte // records of the last datagram not yet processed
+	input      []byte // application data not yet returned by Read
+	readErr    error
+	readBuf    []byte
+	writeMutex sync.Mutex
+
+	cipherSuite        uint16
+	negotiatedProtocol string
+	peerCertificates   []*x509.Certificate
+	verifiedChains     [][]*x509.Certificate
+	ekm                func(label string, context []byte, length int) ([]byte, error)
+}
+
+// dtlsEpoch is the record protection of an epoch in one direction.
+type dtlsEpoch struct {
+	aead aead // nil for epoch 0, or until the keys of epoch 1 are derived
+
+	// seq is the sequence number of the next record to send on the write
+	// side, and the highest one received on the read side, in which case
+	// window has bit i set if seq-i was received, see RFC 6347, Section
+	// 4.1.2.6.
+	seq    uint64
+	window uint64
+}
+
+// dtlsRecord is a record of a flight, kept in plaintext.
+type dtlsRecord struct {
+	typ      recordType
+	epoch    uint16
+	fragment []byte
+}
+
+// dtlsHandshakeMessage is a handshake message being reassembled.
+type dtlsHandshakeMessage struct {
+	typ      uint8
+	epoch    uint16 // of the records carrying the message
+	body     []byte
+	received []bool // which bytes of body were received
+	missing  int
+}
+
+// UDTLSClient returns a new DTLS 1.2 client connection to raddr over conn.
+// The config cannot be nil: users must set either ServerName or
+// InsecureSkipVerify in the config. The handshake runs on the first Read or
+// Write, or when Handshake is called.
+func UDTLSClient(conn net.PacketConn, raddr net.Addr, config *Config) *UDTLSConn {
+	if config == nil {
+		config = &Config{}
+	}
+	return &UDTLSConn{
+		conn:      conn,
+		raddr:     raddr,
+		config:    config.Clone(),
+		fragments: make(map[uint16]*dtlsHandshakeMessage),
+	}
+}
+
+// Handshake runs the DTLS handshake, if it has not run yet. Retransmissions
+// rely on read deadlines of the underlying connection, which are cleared
+// when the handshake returns.
+func (c *UDTLSConn) Handshake() error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.handshakeErr != nil || c.handshakeComplete {
+		return c.handshakeErr
+	}
+	c.handshakeErr = c.clientHandshake()
+	c.conn.SetReadDeadline(time.Time{})
+	c.handshakeComplete = c.handshakeErr == nil
+	return c.handshakeErr
+}
+
+// dtlsCipherSuites returns the cipher suites of config a UDTLSConn can
+// offer.
+func dtlsCipherSuites(config *Config) []uint16 {
+	ids := config.CipherSuites
+	if len(ids) == 0 {
+		ids = dtlsDefaultCipherSuites
+	}
+	var suites []uint16
+	for _, id := range ids {
+		if suite := cipherSuiteByID(id); suite != nil && suite.aead != nil && suite.flags&suiteECDHE != 0 {
+			suites = append(suites, id)
+		}
+	}
+	return suites
+}
+
+// dtlsCurves returns the curves of config a UDTLSConn can offer.
+func dtlsCurves(config *Config) []CurveID {
+	if len(config.CurvePreferences) == 0 {
+		return []CurveID{X25519, CurveP256, CurveP384}
+	}
+	var curves []CurveID
+	for _, curve := range config.CurvePreferences {
+		if _, ok := curveForCurveID(curve); ok || curve == X25519 {
+			curves = append(curves, curve)
+		}
+	}
+	return curves
+}
+
+func (c *UDTLSConn) makeClientHello() (*clientHelloMsg, error) {
+	config := c.config
+	if len(config.ServerName) == 0 && !config.InsecureSkipVerify {
+		return nil, errors.New("tls: either ServerName or InsecureSkipVerify must be specified in the tls.Config")
+	}
+	hello := &clientHelloMsg{
+		vers:                         VersionTLS12,
+		random:                       make([]byte, 32),
+		cipherSuites:                 dtlsCipherSuites(config),
+		compressionMethods:           []uint8{compressionNone},
+		serverName:                   hostnameInSNI(config.ServerName),
+		supportedCurves:              dtlsCurves(config),
+		supportedPoints:              []uint8{pointFormatUncompressed},
+		supportedSignatureAlgorithms: supportedSignatureAlgorithms,
+		secureRenegotiationSupported: true,
+		alpnProtocols:                config.NextProtos,
+		ems:                          true,
+	}
+	if len(hello.cipherSuites) == 0 || len(hello.supportedCurves) == 0 {
+		return nil, errors.New("tls: no cipher suite or curve supported by DTLS is configured")
+	}
+	if _, err := io.ReadFull(config.rand(), hello.random); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	return hello, nil
+}
+
+// dtlsClientHelloBody returns the body of hello as a DTLS ClientHello, which
+// has a cookie after the session ID, see RFC 6347, Section 4.2.1.
+func dtlsClientHelloBody(hello *clientHelloMsg, cookie []byte) []byte {
+	hello.raw = nil
+	body := hello.marshal()[4:]
+	sessionEnd := 2 + 32 + 1 + len(hello.sessionId)
+	out := make([]byte, 0, len(body)+1+len(cookie))
+	out = append(out, VersionDTLS12>>8, VersionDTLS12&0xff)
+	out = append(out, body[2:sessionEnd]...)
+	out = append(out, byte(len(cookie)))
+	out = append(out, cookie...)
+	return append(out, body[sessionEnd:]...)
+}
+
+func (c *UDTLSConn) clientHandshake() error {
+	hello, err := c.makeClientHello()
+	if err != nil {
+		return err
+	}
+
+	c.flight = nil
+	clientHello := c.addHandshake(typeClientHello, dtlsClientHelloBody(hello, nil))
+	if err := c.sendFlight(); err != nil {
+		return err
+	}
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	if msg.typ == typeHelloVerifyRequest {
+		// Neither the first ClientHello nor the HelloVerifyRequest is part
+		// of the transcript, see RFC 6347, Section 4.2.6.
+		body := msg.body
+		if len(body) < 3 || len(body) != 3+int(body[2]) {
+			c.sendAlert(alertDecodeError)
+			return errors.New("tls: malformed HelloVerifyRequest")
+		}
+		c.flight = nil
+		clientHello = c.addHandshake(typeClientHello, dtlsClientHelloBody(hello, body[3:]))
+		if err := c.sendFlight(); err != nil {
+			return err
+		}
+		if msg, err = c.readHandshake(); err != nil {
+			return err
+		}
+	}
+
+	if msg.typ == typeServerHello && c.config.UnsafeServerHelloCallback != nil {
+		c.config.UnsafeServerHelloCallback(msg.tlsMessage())
+	}
+	serverHello := new(serverHelloMsg)
+	if msg.typ != typeServerHello || !serverHello.unmarshal(msg.tlsMessage()) {
+		c.sendAlert(alertUnexpectedMessage)
+		return fmt.Errorf("tls: received unexpected handshake message of type %d when waiting for ServerHello", msg.typ)
+	}
+	if serverHello.vers != VersionDTLS12 {
+		c.sendAlert(alertProtocolVersion)
+		return fmt.Errorf("tls: server selected unsupported protocol version %x", serverHello.vers)
+	}
+	suite := mutualCipherSuite(hello.cipherSuites, serverHello.cipherSuite)
+	if suite == nil {
+		c.sendAlert(alertHandshakeFailure)
+		return errors.New("tls: server chose an unconfigured cipher suite")
+	}
+	if serverHello.compressionMethod != compressionNone {
+		c.sendAlert(alertUnexpectedMessage)
+		return errors.New("tls: server selected unsupported compression format")
+	}
+	if len(serverHello.secureRenegotiation) != 0 {
+		c.sendAlert(alertHandshakeFailure)
+		return errors.New("tls: initial handshake had non-empty renegotiation extension")
+	}
+	if serverHello.alpnProtocol != "" {
+		offered := false
+		for _, proto := range hello.alpnProtocols {
+			offered = offered || proto == serverHello.alpnProtocol
+		}
+		if !offered {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server advertised unrequested ALPN extension")
+		}
+	}
+	transcript := newFinishedHash(VersionTLS12, suite)
+	transcript.Write(clientHello)
+	transcript.Write(msg.raw(c.recvSeq - 1))
+
+	if msg, err = c.readHandshake(); err != nil {
+		return err
+	}
+	certMsg := new(certificateMsg)
+	if msg.typ != typeCertificate || !certMsg.unmarshal(msg.tlsMessage()) || len(certMsg.certificates) == 0 {
+		c.sendAlert(alertUnexpectedMessage)
+		return fmt.Errorf("tls: received unexpected handshake message of type %d when waiting for Certificate", msg.typ)
+	}
+	transcript.Write(msg.raw(c.recvSeq - 1))
+	if err := c.verifyServerCertificate(certMsg.certificates); err != nil {
+		return err
+	}
+
+	ka := suite.ka(VersionTLS12)
+	if msg, err = c.readHandshake(); err != nil {
+		return err
+	}
+	skx := new(serverKeyExchangeMsg)
+	if msg.typ != typeServerKeyExchange || !skx.unmarshal(msg.tlsMessage()) {
+		c.sendAlert(alertUnexpectedMessage)
+		return fmt.Errorf("tls: received unexpected handshake message of type %d when waiting for ServerKeyExchange", msg.typ)
+	}
+	transcript.Write(msg.raw(c.recvSeq - 1))
+	if err := ka.processServerKeyExchange(c.config, hello, serverHello, c.peerCertificates[0], skx); err != nil {
+		c.sendAlert(alertUnexpectedMessage)
+		return err
+	}
+
+	if msg, err = c.readHandshake(); err != nil {
+		return err
+	}
+	certRequested := false
+	if certReq := (&certificateRequestMsg{hasSignatureAlgorithm: true}); msg.typ == typeCertificateRequest && certReq.unmarshal(msg.tlsMessage()) {
+		certRequested = true
+		transcript.Write(msg.raw(c.recvSeq - 1))
+		if msg, err = c.readHandshake(); err != nil {
+			return err
+		}
+	}
+	if msg.typ != typeServerHelloDone || len(msg.body) != 0 {
+		c.sendAlert(alertUnexpectedMessage)
+		return fmt.Errorf("tls: received unexpected handshake message of type %d when waiting for ServerHelloDone", msg.typ)
+	}
+	transcript.Write(msg.raw(c.recvSeq - 1))
+
+	c.flight = nil
+	if certRequested {
+		transcript.Write(c.addHandshake(typeCertificate, new(certificateMsg).marshal()[4:]))
+	}
+	preMasterSecret, ckx, err := ka.generateClientKeyExchange(c.config, hello, c.peerCertificates[0])
+	if err != nil {
+		c.sendAlert(alertInternalError)
+		return err
+	}
+	transcript.Write(c.addHandshake(typeClientKeyExchange, ckx.marshal()[4:]))
+
+	var masterSecret []byte
+	if serverHello.ems {
+		masterSecret = extendedMasterFromPreMasterSecret(VersionTLS12, suite, preMasterSecret, transcript)
+	} else {
+		masterSecret = masterFromPreMasterSecret(VersionTLS12, suite, preMasterSecret, hello.random, serverHello.random)
+	}
+	if err := c.config.writeKeyLog(keyLogLabelTLS12, hello.random, masterSecret); err != nil {
+		c.sendAlert(alertInternalError)
+		return errors.New("tls: failed to write to key log: " + err.Error())
+	}
+	_, _, clientKey, serverKey, clientIV, serverIV :=
+		keysFromMasterSecret(VersionTLS12, suite, masterSecret, hello.random, serverHello.random, suite.macLen, suite.keyLen, suite.ivLen)
+	c.out[1].aead = suite.aead(clientKey, clientIV)
+	c.in[1].aead = suite.aead(serverKey, serverIV)
+
+	c.flight = append(c.flight, dtlsRecord{recordTypeChangeCipherSpec, 0, []byte{1}})
+	c.outEpoch = 1
+	finished := &finishedMsg{verifyData: transcript.clientSum(masterSecret)}
+	transcript.Write(c.addHandshake(typeFinished, finished.marshal()[4:]))
+	if err := c.sendFlight(); err != nil {
+		return err
+	}
+
+	if msg, err = c.readHandshake(); err != nil {
+		return err
+	}
+	serverFinished := new(finishedMsg)
+	if msg.typ != typeFinished || msg.epoch != 1 || !serverFinished.unmarshal(msg.tlsMessage()) {
+		c.sendAlert(alertUnexpectedMessage)
+		return fmt.Errorf("tls: received unexpected handshake message of type %d when waiting for Finished", msg.typ)
+	}
+	verify := transcript.serverSum(masterSecret)
+	if len(verify) != len(serverFinished.verifyData) ||
+		subtle.ConstantTimeCompare(verify, serverFinished.verifyData) != 1 {
+		c.sendAlert(alertHandshakeFailure)
+		return errors.New("tls: server's Finished message was incorrect")
+	}
+
+	c.cipherSuite = suite.id
+	c.negotiatedProtocol = serverHello.alpnProtocol
+	c.ekm = ekmFromMasterSecret(VersionTLS12, suite, masterSecret, hello.random, serverHello.random)
+	return nil
+}
+
+// verifyServerCertificate parses and verifies the certificates of the
+// server like Conn.verifyServerCertificate.
+func (c *UDTLSConn) verifyServerCertificate(certificates [][]byte) error {
+	if c.config.OnRawCertificates != nil {
+		c.config.OnRawCertificates(certificates)
+	}
+
+	certs := make([]*x509.Certificate, len(certificates))
+	for i, asn1Data := range certificates {
+		cert, err := x509.ParseCertificate(asn1Data)
+		if err != nil {
+			c.sendAlert(alertBadCertificate)
+			return errors.New("tls: failed to parse certificate from server: " + err.Error())
+		}
+		certs[i] = cert
+	}
+
+	if !c.config.InsecureSkipVerify {
+		opts := x509.VerifyOptions{
+			Roots:         c.config.RootCAs,
+			CurrentTime:   c.config.time(),
+			DNSName:       c.config.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		if c.config.GetRootCAs != nil {
+			if roots := c.config.GetRootCAs(opts.DNSName); roots != nil {
+				opts.Roots = roots
+			}
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		var err error
+		c.verifiedChains, err = certs[0].Verify(opts)
+		if err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
+	if c.config.CertificatePolicy != nil {
+		var err error
+		c.verifiedChains, err = c.config.CertificatePolicy.verifyChains(certs, c.verifiedChains)
+		if err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
+	if c.config.VerifyPeerCertificate != nil {
+		if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
+	switch certs[0].PublicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		c.sendAlert(alertUnsupportedCertificate)
+		return fmt.Errorf("tls: server's certificate contains an unsupported type of public key: %T", certs[0].PublicKey)
+	}
+
+	c.peerCertificates = certs
+	return nil
+}
+
+// addHandshake appends a handshake message to the flight, fragmented to fit
+// datagrams, and returns it unfragmented, as the transcript covers it. See
+// RFC 6347, Section 4.2.6.
+func (c *UDTLSConn) addHandshake(typ uint8, body []byte) []byte {
+	seq := c.sendSeq
+	c.sendSeq++
+	maxFragment := dtlsMaxDatagram - dtlsRecordHeaderLen - dtlsHandshakeHeaderLen - dtlsMaxOverhead
+	for offset := 0; ; offset += maxFragment {
+		end := offset + maxFragment
+		if end > len(body) {
+			end = len(body)
+		}
+		fragment := dtlsHandshakeHeader(typ, len(body), seq, offset, end-offset)
+		fragment = append(fragment, body[offset:end]...)
+		c.flight = append(c.flight, dtlsRecord{recordTypeHandshake, c.outEpoch, fragment})
+		if end == len(body) {
+			break
+		}
+	}
+	return append(dtlsHandshakeHeader(typ, len(body), seq, 0, len(body)), body...)
+}
+
+func dtlsHandshakeHeader(typ uint8, length int, seq uint16, offset, fragmentLength int) []byte {
+	return []byte{
+		typ, byte(length >> 16), byte(length >> 8), byte(length),
+		byte(seq >> 8), byte(seq),
+		byte(offset >> 16), byte(offset >> 8), byte(offset),
+		byte(fragmentLength >> 16), byte(fragmentLength >> 8), byte(fragmentLength),
+	}
+}
+
+// sendFlight sends the records of the flight, packed in as few datagrams as
+// fit.
+func (c *UDTLSConn) sendFlight() error {
+	var datagram []byte
+	for _, record := range c.flight {
+		sealed, err := c.sealRecord(record.typ, record.epoch, record.fragment)
+		if err != nil {
+			return err
+		}
+		if len(datagram) > 0 && len(datagram)+len(sealed) > dtlsMaxDatagram {
+			if _, err := c.conn.WriteTo(datagram, c.raddr); err != nil {
+				return err
+			}
+			datagram = nil
+		}
+		datagram = append(datagram, sealed...)
+	}
+	if len(datagram) == 0 {
+		return nil
+	}
+	_, err := c.conn.WriteTo(datagram, c.raddr)
+	return err
+}
+
+// sealRecord returns a record of fragment protected under epoch, with the
+// next sequence number of the epoch. See RFC 6347, Section 4.1.2.1.
+func (c *UDTLSConn) sealRecord(typ recordType, epoch uint16, fragment []byte) ([]byte, error) {
+	e := &c.out[epoch]
+	if e.seq > dtlsMaxSequenceNumber {
+		return nil, errors.New("tls: DTLS sequence number wraparound")
+	}
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], uint64(epoch)<<48|e.seq)
+	e.seq++
+
+	record := make([]byte, dtlsRecordHeaderLen, dtlsRecordHeaderLen+len(fragment)+dtlsMaxOverhead)
+	record[0] = byte(typ)
+	record[1], record[2] = VersionDTLS12>>8, VersionDTLS12&0xff
+	copy(record[3:11], seq[:])
+	if e.aead == nil {
+		record = append(record, fragment...)
+	} else {
+		record = append(record, seq[:e.aead.explicitNonceLen()]...)
+		record = e.aead.Seal(record, seq[:], fragment, dtlsAdditionalData(record, len(fragment)))
+	}
+	binary.BigEndian.PutUint16(record[11:13], uint16(len(record)-dtlsRecordHeaderLen))
+	return record, nil
+}
+
+// dtlsAdditionalData returns the additional data of a record with header
+// and n bytes of plaintext: its epoch, sequence number, type, version and
+// the length of the plaintext. See RFC 6347, Section 4.1.2.1.
+func dtlsAdditionalData(header []byte, n int) []byte {
+	ad := make([]byte, 13)
+	copy(ad, header[3:11])
+	ad[8] = header[0]
+	ad[9], ad[10] = header[1], header[2]
+	binary.BigEndian.PutUint16(ad[11:], uint16(n))
+	return ad
+}
+
+// readRecord returns the next record from the server, reading a datagram if
+// the last one is done. Records which are replayed, of an epoch without keys
+// or which fail to open are silently dropped, see RFC 6347, Section 4.1.2.7.
+func (c *UDTLSConn) readRecord() (typ recordType, epoch uint16, fragment []byte, err error) {
+	for {
+		for len(c.datagram) >= dtlsRecordHeaderLen {
+			header := c.datagram[:dtlsRecordHeaderLen]
+			n := int(binary.BigEndian.Uint16(header[11:13]))
+			if len(c.datagram) < dtlsRecordHeaderLen+n {
+				break
+			}
+			payload := c.datagram[dtlsRecordHeaderLen : dtlsRecordHeaderLen+n]
+			c.datagram = c.datagram[dtlsRecordHeaderLen+n:]
+
+			// A HelloVerifyRequest may come in a record of version DTLS 1.0.
+			if header[1] != 0xfe {
+				continue
+			}
+			epoch := binary.BigEndian.Uint16(header[3:5])
+			seq := binary.BigEndian.Uint64(header[3:11]) & dtlsMaxSequenceNumber
+			if epoch > 1 || (epoch == 1 && c.in[1].aead == nil) || c.in[epoch].replayed(seq) {
+				continue
+			}
+			if e := c.in[epoch].aead; e != nil {
+				explicitNonceLen := e.explicitNonceLen()
+				if len(payload) < explicitNonceLen+e.Overhead() {
+					continue
+				}
+				nonce := header[3:11]
+				if explicitNonceLen > 0 {
+					nonce = payload[:explicitNonceLen]
+				}
+				ciphertext := payload[explicitNonceLen:]
+				ad := dtlsAdditionalData(header, len(ciphertext)-e.Overhead())
+				if payload, err = e.Open(ciphertext[:0], nonce, ciphertext, ad); err != nil {
+					continue
+				}
+			}
+			c.in[epoch].markReceived(seq)
+			return recordType(header[0]), epoch, payload, nil
+		}
+
+		if c.readBuf == nil {
+			c.readBuf = make([]byte, 1<<16)
+		}
+		n, addr, err := c.conn.ReadFrom(c.readBuf)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		// The records are copied, as what they carry may outlive the next
+		// read.
+		if addr.String() == c.raddr.String() {
+			c.datagram = append([]byte(nil), c.readBuf[:n]...)
+		}
+	}
+}
+
+// replayed reports whether the record seq of the epoch was already received,
+// or is too old to tell.
+func (e *dtlsEpoch) replayed(seq uint64) bool {
+	if seq > e.seq || (e.seq == 0 && e.window == 0) {
+		return false
+	}
+	return e.seq-seq >= 64 || e.window&(1<<(e.seq-seq)) != 0
+}
+
+func (e *dtlsEpoch) markReceived(seq uint64) {
+	if seq <= e.seq && e.window != 0 {
+		e.window |= 1 << (e.seq - seq)
+		return
+	}
+	if shift := seq - e.seq; shift < 64 {
+		e.window <<= shift
+	} else {
+		e.window = 0
+	}
+	e.window |= 1
+	e.seq = seq
+}
+
+// readHandshake returns the next handshake message from the server, once
+// all its fragments arrived. Until then, the last flight is retransmitted
+// when the server does not answer in time, or when it retransmits its own
+// previous flight, which means it missed the client's. See RFC 6347, Section
+// 4.2.4.
+func (c *UDTLSConn) readHandshake() (*dtlsHandshakeMessage, error) {
+	timeout := dtlsInitialRetransmitTimeout
+	retransmits := 0
+	retransmitted := false
+	for {
+		if msg := c.fragments[c.recvSeq]; msg != nil && msg.missing == 0 {
+			delete(c.fragments, c.recvSeq)
+			c.recvSeq++
+			return msg, nil
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+		typ, epoch, fragment, err := c.readRecord()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if retransmits == dtlsMaxRetransmits {
+				return nil, errors.New("tls: DTLS handshake timed out")
+			}
+			retransmits++
+			timeout *= 2
+			if err := c.sendFlight(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case recordTypeAlert:
+			return nil, dtlsAlertError(fragment)
+		case recordTypeHandshake:
+			stale, err := c.addFragments(epoch, fragment)
+			if err != nil {
+				c.sendAlert(alertDecodeError)
+				return nil, err
+			}
+			if stale && !retransmitted {
+				retransmitted = true
+				if err := c.sendFlight(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		// A ChangeCipherSpec only announces the next epoch, which the
+		// records of the server tell anyway.
+	}
+}
+
+// addFragments stores the handshake fragments of a record received under
+// epoch, and reports whether some belong to messages already returned by
+// readHandshake.
+func (c *UDTLSConn) addFragments(epoch uint16, data []byte) (stale bool, err error) {
+	for len(data) > 0 {
+		if len(data) < dtlsHandshakeHeaderLen {
+			return stale, errors.New("tls: malformed DTLS handshake fragment")
+		}
+		typ := data[0]
+		length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		seq := binary.BigEndian.Uint16(data[4:6])
+		offset := int(data[6])<<16 | int(data[7])<<8 | int(data[8])
+		n := int(data[9])<<16 | int(data[10])<<8 | int(data[11])
+		if len(data) < dtlsHandshakeHeaderLen+n || offset+n > length || length > maxHandshake {
+			return stale, errors.New("tls: malformed DTLS handshake fragment")
+		}
+		fragment := data[dtlsHandshakeHeaderLen : dtlsHandshakeHeaderLen+n]
+		data = data[dtlsHandshakeHeaderLen+n:]
+
+		if seq < c.recvSeq {
+			stale = true
+			continue
+		}
+		// Messages far ahead are dropped, to bound what is buffered.
+		if seq-c.recvSeq > 8 {
+			continue
+		}
+		msg := c.fragments[seq]
+		if msg == nil {
+			msg = &dtlsHandshakeMessage{
+				typ:      typ,
+				epoch:    epoch,
+				body:     make([]byte, length),
+				received: make([]bool, length),
+				missing:  length,
+			}
+			c.fragments[seq] = msg
+		}
+		if msg.typ != typ || len(msg.body) != length || msg.epoch != epoch {
+			return stale, errors.New("tls: inconsistent DTLS handshake fragments")
+		}
+		copy(msg.body[offset:], fragment)
+		for i := offset; i < offset+n; i++ {
+			if !msg.received[i] {
+				msg.received[i] = true
+				msg.missing--
+			}
+		}
+	}
+	return stale, nil
+}
+
+// tlsMessage returns the message in the TLS format the unmarshalers of this
+// package take.
+func (m *dtlsHandshakeMessage) tlsMessage() []byte {
+	n := len(m.body)
+	return append([]byte{m.typ, byte(n >> 16), byte(n >> 8), byte(n)}, m.body...)
+}
+
+// raw returns the message, of message_seq seq, unfragmented as the transcript
+// covers it.
+func (m *dtlsHandshakeMessage) raw(seq uint16) []byte {
+	return append(dtlsHandshakeHeader(m.typ, len(m.body), seq, 0, len(m.body)), m.body...)
+}
+
+// dtlsAlertError returns the error an alert from the server reports, io.EOF
+// for a close_notify.
+func dtlsAlertError(data []byte) error {
+	if len(data) != 2 {
+		return errors.New("tls: malformed DTLS alert")
+	}
+	if alert(data[1]) == alertCloseNotify {
+		return io.EOF
+	}
+	return &net.OpError{Op: "remote error", Err: alert(data[1])}
+}
+
+// sendAlert sends an alert under the current epoch, on a best effort basis.
+func (c *UDTLSConn) sendAlert(err alert) error {
+	level := byte(alertLevelError)
+	if err == alertCloseNotify {
+		level = alertLevelWarning
+	}
+	record, sealErr := c.sealRecord(recordTypeAlert, c.outEpoch, []byte{level, byte(err)})
+	if sealErr != nil {
+		return sealErr
+	}
+	_, writeErr := c.conn.WriteTo(record, c.raddr)
+	return writeErr
+}
+
+// Read reads data from the connection, running the handshake first if it
+// has not run yet.
+func (c *UDTLSConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.input) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		typ, epoch, fragment, err := c.readRecord()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, err
+		}
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+		// Once the handshake is complete, only the records of epoch 1 are
+		// authenticated. The others, including the handshake records the
+		// server retransmits and plaintext alerts, are dropped, so that a
+		// spoofed datagram cannot tear the connection down.
+		if epoch != 1 {
+			continue
+		}
+		switch typ {
+		case recordTypeApplicationData:
+			c.input = fragment
+		case recordTypeAlert:
+			c.readErr = dtlsAlertError(fragment)
+		}
+	}
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// Write writes data to the connection, running the handshake first if it has
+// not run yet. Data which does not fit a datagram is split across several.
+func (c *UDTLSConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	maxFragment := dtlsMaxDatagram - dtlsRecordHeaderLen - dtlsMaxOverhead
+	n := 0
+	for len(b) > 0 {
+		m := len(b)
+		if m > maxFragment {
+			m = maxFragment
+		}
+		record, err := c.sealRecord(recordTypeApplicationData, 1, b[:m])
+		if err != nil {
+			return n, err
+		}
+		if _, err := c.conn.WriteTo(record, c.raddr); err != nil {
+			return n, err
+		}
+		n += m
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// Close sends a close_notify alert, if the handshake completed, and closes
+// the underlying connection.
+func (c *UDTLSConn) Close() error {
+	c.handshakeMutex.Lock()
+	complete := c.handshakeComplete
+	c.handshakeMutex.Unlock()
+
+	var alertErr error
+	if complete {
+		c.writeMutex.Lock()
+		alertErr = c.sendAlert(alertCloseNotify)
+		c.writeMutex.Unlock()
+	}
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+	return alertErr
+}
+
+// ConnectionState returns basic DTLS details about the connection. Its
+// Version is VersionDTLS12.
+func (c *UDTLSConn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	var state ConnectionState
+	state.HandshakeComplete = c.handshakeComplete
+	if !c.handshakeComplete {
+		return state
+	}
+	state.Version = VersionDTLS12
+	state.CipherSuite = c.cipherSuite
+	state.NegotiatedProtocol = c.negotiatedProtocol
+	state.NegotiatedProtocolIsMutual = true
+	state.PeerCertificates = c.peerCertificates
+	state.VerifiedChains = c.verifiedChains
+	state.ekm = c.ekm
+	return state
+}
+
+// LocalAddr returns the local network address.
+func (c *UDTLSConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the server.
+func (c *UDTLSConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets the read and write deadlines of the underlying
+// connection. The handshake overrides the read deadline while it runs.
+func (c *UDTLSConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection. The
+// handshake overrides it while it runs.
+func (c *UDTLSConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *UDTLSConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDTLSReplayWindow(t *testing.T) {
+	var e dtlsEpoch
+	for _, test := range []struct {
+		seq      uint64
+		replayed bool
+	}{
+		{0, false}, {0, true}, {2, false}, {1, false}, {1, true}, {2, true},
+		{100, false}, {40, false}, {40, true}, {41, false}, {36, true}, {101, false}, {41, true},
+	} {
+		if got := e.replayed(test.seq); got != test.replayed {
+			t.Errorf("record %d: replayed = %v, want %v", test.seq, got, test.replayed)
+		}
+		if !test.replayed {
+			e.markReceived(test.seq)
+		}
+	}
+}
+
+func TestUTLSDTLSOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil || testing.Short() {
+		t.Skip("openssl is not available")
+	}
+
+	cert := ccmTestCertificate(t)
+	certFile, keyFile := openSSLCertificateFiles(t, cert)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	for _, args := range [][]string{
+		{"-listen"},
+		{"-verify", "1", "-cipher", "ECDHE-ECDSA-CHACHA20-POLY1305", "-mtu", "300"},
+	} {
+		keyLogFile := filepath.Join(t.TempDir(), "keylog.txt")
+		addr, stop, waitOutput := startOpenSSLServerWithInput(t, "from openssl\n", append([]string{"-dtls1_2",
+			"-cert", certFile, "-key", keyFile, "-keylogfile", keyLogFile}, args...)...)
+
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		spoofed := &spoofingPacketConn{PacketConn: pc, from: raddr, datagrams: make(chan []byte, 1)}
+		var keyLog bytes.Buffer
+		client := UDTLSClient(spoofed, raddr, &Config{
+			ServerName:   "iot.example.com",
+			RootCAs:      roots,
+			KeyLogWriter: &keyLog,
+		})
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%v: %v\n%s", args, err, stop())
+		}
+		state := client.ConnectionState()
+		if state.Version != VersionDTLS12 || len(state.VerifiedChains) == 0 {
+			t.Errorf("%v: version %#04x, %d verified chains", args, state.Version, len(state.VerifiedChains))
+		}
+		if _, err := state.ExportKeyingMaterial("EXTRACTOR-dtls_srtp", nil, 60); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+
+		if _, err := client.Write([]byte("from utls\n")); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 100)
+		n, err := client.Read(reply)
+		if err != nil {
+			t.Fatalf("%v: %v\n%s", args, err, stop())
+		}
+		if got := string(reply[:n]); got != "from openssl\n" {
+			t.Errorf("%v: read %q from the server", args, got)
+		}
+
+		// A plaintext alert from the address of the server is dropped.
+		spoofed.datagrams <- []byte{byte(recordTypeAlert), 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0x10, 0, 0, 2,
+			alertLevelError, byte(alertHandshakeFailure)}
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := client.Read(reply); err == nil || !os.IsTimeout(err) {
+			t.Errorf("%v: Read after a spoofed alert = %v, want a timeout", args, err)
+		}
+		// s_server prints the data before it sees the end of its input.
+		printed := waitOutput("from utls")
+		client.Close()
+		if output := stop(); !printed {
+			t.Errorf("%v: openssl output lacks the data written:\n%s", args, output)
+		}
+
+		serverKeyLog, err := os.ReadFile(keyLogFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line := strings.TrimSpace(keyLog.String()); line == "" || !strings.Contains(string(serverKeyLog), line) {
+			t.Errorf("%v: OpenSSL derived another master secret than the client's %q:\n%s", args, line, serverKeyLog)
+		}
+	}
+}
+
+// spoofingPacketConn returns the datagrams sent on its channel, as if they
+// came from the address from, before reading from the PacketConn.
+type spoofingPacketConn struct {
+	net.PacketConn
+	from      net.Addr
+	datagrams chan []byte
+}
+
+func (c *spoofingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case datagram := <-c.datagrams:
+		return copy(b, datagram), c.from, nil
+	default:
+		return c.PacketConn.ReadFrom(b)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"errors"
+)
+
+// earlyDataState is the TLS 1.3 early data of a UConn, see EnableEarlyData.
+type earlyDataState struct {
+	data []byte // passed to EnableEarlyData, nil once written
+
+	// suite and secret are the cipher suite of the resumed session and the
+	// client_early_traffic_secret, set while early data is indicated in the
+	// ClientHello and until the client ends it or it is abandoned.
+	suite  *cipherSuiteTLS13
+	secret []byte
+
+	sent int // length of the prefix of data sent as early data
+}
+
+// EnableEarlyData makes the client send data as TLS 1.3 early data, also
+// known as 0-RTT data, right after its ClientHello, when it resumes a session
+// whose ticket allows it. See RFC 8446, Section 2.3 and Section 4.2.10. It
+// must be called before the handshake.
+//
+// At most the max_early_data_size of the ticket is sent early. What was not
+// sent, because no session allows early data or because the ticket limits
+// it, is written once the handshake completes, as is all of data if the
+// server rejects the early data. Either way data is delivered once, before
+// anything passed to Write. ConnectionState().EarlyDataAccepted reports
+// whether the server accepted it.
+//
+// Early data is not forward secret and may be replayed by an attacker, so
+// it should only carry requests which are safe to process twice.
+//
+// The early_data extension is sent along with the session to resume. If the
+// ClientHelloSpec has no EarlyDataExtension, one is added just before its
+// PreSharedKeyExtension, which changes the fingerprint of the ClientHello.
+func (uconn *UConn) EnableEarlyData(data []byte) {
+	if len(data) == 0 {
+		uconn.earlyData = nil
+		return
+	}
+	uconn.earlyData = &earlyDataState{data: append([]byte(nil), data...)}
+}
+
+// earlyDataSession returns the session offered as the first PSK of the
+// ClientHello, which early data is sent under, or nil if there is none.
+func (uconn *UConn) earlyDataSession() *ClientSessionState {
+	session := uconn.HandshakeState.Session
+	hello := uconn.HandshakeState.Hello
+	if session == nil || session.vers != VersionTLS13 || uconn.ech != nil ||
+		len(hello.PskIdentities) <= len(uconn.externalPSKs) {
+		return nil
+	}
+	return session
+}
+
+// earlyDataLimit returns how many bytes of early data session allows, zero
+// if its ticket does not allow early data or if it was negotiated with an
+// ALPN protocol the ClientHello does not offer.
+func (uconn *UConn) earlyDataLimit(session *ClientSessionState) int {
+	if session.alpnProtocol != "" {
+		offered := false
+		for _, proto := range uconn.HandshakeState.Hello.AlpnProtocols {
+			if proto == session.alpnProtocol {
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			return 0
+		}
+	}
+	return int(session.maxEarlyData)
+}
+
+// addEarlyDataExtension indicates early data, enabled with EnableEarlyData,
+// when the offered session allows it, adding an EarlyDataExtension before
+// the PreSharedKeyExtension if the ClientHello has none.
+func (uconn *UConn) addEarlyDataExtension() error {
+	if uconn.earlyData == nil || uconn.HandshakeState.Hello.EarlyData {
+		return nil
+	}
+	session := uconn.earlyDataSession()
+	if session == nil || uconn.earlyDataLimit(session) == 0 {
+		return nil
+	}
+	n := len(uconn.Extensions)
+	if n == 0 || !isPreSharedKeyExtension(uconn.Extensions[n-1]) {
+		return nil
+	}
+	ext := &EarlyDataExtension{}
+	uconn.Extensions = append(uconn.Extensions[:n-1:n-1], ext, uconn.Extensions[n-1])
+	return ext.writeToUConn(uconn)
+}
+
+// sendEarlyData derives the client_early_traffic_secret if hello, just sent,
+// indicates early data, and sends the early data allowed by the session, if
+// any, after a dummy change_cipher_spec record. See RFC 8446, Section 7.1 and
+// Appendix D.4.
+//
+// The early data is protected with the client_early_traffic_secret, which
+// stays the write key until the server answers. The same key protects the
+// EndOfEarlyData message if the server accepts early data, even when no data
+// was sent, as the EarlyDataExtension of a mimicked ClientHello indicates
+// early data.
+func (uconn *UConn) sendEarlyData(hello *clientHelloMsg) error {
+	if !hello.earlyData {
+		return nil
+	}
+	session := uconn.earlyDataSession()
+	if session == nil {
+		return nil
+	}
+	suite := cipherSuiteTLS13ByID(session.cipherSuite)
+	if suite == nil {
+		return errors.New("tls: unknown cipher suite of the resumed session")
+	}
+	if uconn.earlyData == nil {
+		uconn.earlyData = new(earlyDataState)
+	}
+	state := uconn.earlyData
+
+	transcript := suite.hash.New()
+	transcript.Write(hello.marshal())
+	state.suite = suite
+	state.secret = suite.deriveSecret(uconn.HandshakeState.State13.EarlySecret,
+		clientEarlyTrafficLabel, transcript)
+	if err := uconn.config.writeKeyLog(keyLogLabelClientEarlyTraffic, hello.random, state.secret); err != nil {
+		return err
+	}
+
+	n := uconn.earlyDataLimit(session)
+	if n > len(state.data) {
+		n = len(state.data)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	uconn.out.Lock()
+	defer uconn.out.Unlock()
+	// The early data records are TLS 1.3 ones, while the version is not
+	// negotiated yet. See RFC 8446, Section 5.1.
+	uconn.vers, uconn.out.version = VersionTLS13, VersionTLS13
+	defer func() { uconn.vers = 0 }()
+	if _, err := uconn.writeRecordLocked(recordTypeChangeCipherSpec, []byte{1}); err != nil {
+		return err
+	}
+	uconn.out.setTrafficSecret(suite, state.secret)
+	if _, err := uconn.writeRecordLocked(recordTypeApplicationData, state.data[:n]); err != nil {
+		return err
+	}
+	state.sent = n
+	return nil
+}
+
+// earlyDataSent reports whether early data, and the dummy change_cipher_spec
+// record before it, were sent after the ClientHello.
+func (uconn *UConn) earlyDataSent() bool {
+	return uconn.earlyData != nil && uconn.earlyData.sent > 0
+}
+
+// abandonEarlyData gives up on the early data indicated in the ClientHello,
+// which the server implicitly rejected with a HelloRetryRequest. The early
+// data must not be indicated again in the second ClientHello, which is sent
+// unprotected.
+func (uconn *UConn) abandonEarlyData() {
+	uconn.HandshakeState.Hello.EarlyData = false
+	if uconn.earlyData == nil || uconn.earlyData.secret == nil {
+		return
+	}
+	uconn.earlyData.suite, uconn.earlyData.secret = nil, nil
+
+	uconn.out.Lock()
+	defer uconn.out.Unlock()
+	uconn.out.cipher = nil
+	uconn.out.trafficSecret = nil
+	uconn.out.seq = [8]byte{}
+}
+
+// writeDeferredEarlyData writes, once the handshake completed, the data
+// passed to EnableEarlyData which the server did not accept as early data.
+func (uconn *UConn) writeDeferredEarlyData() error {
+	state := uconn.earlyData
+	if state == nil || state.data == nil {
+		return nil
+	}
+	data := state.data
+	if uconn.earlyDataAccepted {
+		data = data[state.sent:]
+	}
+	state.data = nil
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := uconn.writeRecord(recordTypeApplicationData, data)
+	return err
+}
+
+// earlyDataInFlight reports whether the ClientHello indicated early data,
+// which is still to be ended.
+func (hs *clientHandshakeStateTLS13) earlyDataInFlight() bool {
+	return hs.uconn != nil && hs.uconn.earlyData != nil && hs.uconn.earlyData.secret != nil
+}
+
+// processEarlyDataResponse checks the early_data extension of the server's
+// EncryptedExtensions, present if it accepted the early data, see RFC 8446,
+// Section 4.2.10.
+func (hs *clientHandshakeStateTLS13) processEarlyDataResponse(ee *encryptedExtensionsMsg) error {
+	c := hs.c
+	if !ee.earlyData {
+		return nil
+	}
+	if !hs.earlyDataInFlight() {
+		c.sendAlert(alertUnsupportedExtension)
+		return errors.New("tls: server accepted early data that was not offered")
+	}
+	session := hs.uconn.earlyDataSession()
+	if !c.didResume || hs.serverHello.selectedIdentity != 0 || session == nil {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: server accepted early data without resuming the first PSK")
+	}
+	if c.cipherSuite != session.cipherSuite {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: server accepted early data with another cipher suite than the session's")
+	}
+	if c.clientProtocol != session.alpnProtocol {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: server accepted early data with another ALPN protocol than the session's")
+	}
+	c.earlyDataAccepted = true
+	return nil
+}
+
+// sendEndOfEarlyData sends the EndOfEarlyData message, if the server
+// accepted early data, and switches the write key to the client handshake
+// traffic secret, which establishHandshakeKeys left aside while early data
+// was in flight.
+func (hs *clientHandshakeStateTLS13) sendEndOfEarlyData() error {
+	if !hs.earlyDataInFlight() {
+		return nil
+	}
+	c := hs.c
+	state := hs.uconn.earlyData
+
+	if c.earlyDataAccepted {
+		if state.sent == 0 {
+			c.out.setTrafficSecret(state.suite, state.secret)
+		}
+		endOfEarlyData := new(endOfEarlyDataMsg)
+		hs.transcript.Write(endOfEarlyData.marshal())
+		if _, err := c.writeRecord(recordTypeHandshake, endOfEarlyData.marshal()); err != nil {
+			return err
+		}
+	}
+	state.suite, state.secret = nil, nil
+	c.out.setTrafficSecret(hs.suite, hs.clientHandshakeSecret)
+	return nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUTLSEarlyDataClientHello(t *testing.T) {
+	suite := cipherSuiteTLS13ByID(TLS_AES_128_GCM_SHA256)
+	newSession := func(maxEarlyData uint32) *ClientSessionState {
+		return &ClientSessionState{
+			sessionTicket: []byte("ticket"),
+			vers:          VersionTLS13,
+			cipherSuite:   TLS_AES_128_GCM_SHA256,
+			masterSecret:  make([]byte, suite.hash.Size()),
+			receivedAt:    time.Now(),
+			useBy:         time.Now().Add(time.Hour),
+			nonce:         []byte{1},
+			maxEarlyData:  maxEarlyData,
+		}
+	}
+	extensionIDs := func(session *ClientSessionState, earlyData []byte) []uint16 {
+		cache := NewLRUClientSessionCache(1)
+		cache.Put("example.golang", session)
+		config := &Config{ServerName: "example.golang", InsecureSkipVerify: true, ClientSessionCache: cache}
+		client := UClient(&net.TCPConn{}, config, HelloCustom)
+		if err := client.ApplyPreset(resumptionSpec(false)); err != nil {
+			t.Fatal(err)
+		}
+		client.EnableEarlyData(earlyData)
+		if err := client.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		return clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw)
+	}
+	indicatesEarlyData := func(ids []uint16) bool {
+		for i, id := range ids {
+			if id == extensionEarlyData {
+				if i != len(ids)-2 || ids[i+1] != extensionPreSharedKey {
+					t.Errorf("early_data is not just before pre_shared_key in %v", ids)
+				}
+				return true
+			}
+		}
+		return false
+	}
+
+	if !indicatesEarlyData(extensionIDs(newSession(16384), []byte("GET /"))) {
+		t.Error("early data enabled for a session allowing it was not indicated")
+	}
+	if indicatesEarlyData(extensionIDs(newSession(16384), nil)) {
+		t.Error("early data was indicated without EnableEarlyData")
+	}
+	if indicatesEarlyData(extensionIDs(newSession(0), []byte("GET /"))) {
+		t.Error("early data was indicated for a ticket not allowing it")
+	}
+	session := newSession(16384)
+	session.alpnProtocol = "h2"
+	if indicatesEarlyData(extensionIDs(session, []byte("GET /"))) {
+		t.Error("early data was indicated without offering the ALPN protocol of the session")
+	}
+}
+
+func TestUTLSEarlyDataWithoutSession(t *testing.T) {
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		server := Server(s, testConfig.Clone())
+		io.Copy(server, server)
+	}()
+	defer c.Close()
+
+	client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloChrome_Auto)
+	client.EnableEarlyData([]byte("early "))
+	if _, err := client.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if client.ConnectionState().EarlyDataAccepted {
+		t.Error("EarlyDataAccepted is true without a session to resume")
+	}
+	echo := make([]byte, len("early data"))
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != "early data" {
+		t.Errorf("server received %q, want the early data first", echo)
+	}
+}
+
+// openSSLCertificateFiles writes cert and its private key to PEM files, for
+// openssl to use.
+func openSSLCertificateFiles(t *testing.T, cert Certificate) (certFile, keyFile string) {
+	dir := t.TempDir()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startOpenSSLServer runs "openssl s_server" with args and returns its
+// address and a function stopping it and returning its output.
+func startOpenSSLServer(t *testing.T, args ...string) (addr string, stop func() string) {
+	addr, stop, _ = startOpenSSLServerWithInput(t, "", args...)
+	return addr, stop
+}
+
+// startOpenSSLServerWithInput is like startOpenSSLServer, with input on the
+// standard input of s_server, which sends it to the first client. It also
+// returns a function waiting up to 10 seconds for s_server to print substr,
+// and reporting whether it did.
+func startOpenSSLServerWithInput(t *testing.T, input string, args ...string) (addr string, stop func() string, waitOutput func(substr string) bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = ln.Addr().String()
+	ln.Close()
+
+	cmd := exec.Command("openssl", append([]string{"s_server", "-accept", addr}, args...)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	printed := sync.NewCond(&mu)
+	var output strings.Builder
+	accepting := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer printed.Broadcast()
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			mu.Lock()
+			output.WriteString(s.Text() + "\n")
+			printed.Broadcast()
+			mu.Unlock()
+			if s.Text() == "ACCEPT" {
+				close(accepting)
+			}
+		}
+	}()
+	select {
+	case <-accepting:
+	case <-done:
+		t.Fatalf("openssl s_server failed: %s", output.String())
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("openssl s_server did not start")
+	}
+	io.WriteString(stdin, input)
+
+	stop = func() string {
+		stdin.Close()
+		time.Sleep(100 * time.Millisecond)
+		cmd.Process.Kill()
+		<-done
+		cmd.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return output.String()
+	}
+	waitOutput = func(substr string) bool {
+		timedOut := false
+		timer := time.AfterFunc(10*time.Second, func() {
+			mu.Lock()
+			timedOut = true
+			printed.Broadcast()
+			mu.Unlock()
+		})
+		defer timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+		for !strings.Contains(output.String(), substr) {
+			select {
+			case <-done:
+				return false
+			default:
+			}
+			if timedOut {
+				return false
+			}
+			printed.Wait()
+		}
+		return true
+	}
+	return addr, stop, waitOutput
+}
+
+func TestUTLSEarlyDataOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil || testing.Short() {
+		t.Skip("openssl is not available")
+	}
+
+	certFile, keyFile := openSSLCertificateFiles(t, ccmTestCertificate(t))
+	serverArgs := []string{"-cert", certFile, "-key", keyFile, "-tls1_3", "-early_data", "-num_tickets", "1"}
+
+	config := &Config{
+		ServerName:         "iot.example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: NewLRUClientSessionCache(1),
+	}
+	// connect sends data as early data to addr, and returns the state of
+	// the connection and how much data was sent early.
+	connect := func(addr, data string) (ConnectionState, int) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := UClient(conn, config, HelloCustom)
+		defer client.Close()
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{X25519, CurveP256}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256}},
+				&KeyShareExtension{[]KeyShare{{Group: X25519}}},
+				&PSKKeyExchangeModesExtension{[]uint8{pskModeDHE}},
+				&SupportedVersionsExtension{[]uint16{VersionTLS13}},
+				&PreSharedKeyExtension{},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		client.EnableEarlyData([]byte(data))
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		// Read the session ticket, sent after the handshake.
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		client.Read(make([]byte, 1))
+		return client.ConnectionState(), client.earlyData.sent
+	}
+
+	addr, stop := startOpenSSLServer(t, append(serverArgs, "-max_early_data", "8")...)
+	if state, sent := connect(addr, "full handshake\n"); state.DidResume || state.EarlyDataAccepted || sent != 0 {
+		t.Errorf("full handshake: resumed %v, early data accepted %v, %d bytes sent early",
+			state.DidResume, state.EarlyDataAccepted, sent)
+	}
+	if state, sent := connect(addr, "accepted-early-data\n"); !state.DidResume || !state.EarlyDataAccepted || sent != 8 {
+		t.Errorf("resumption: resumed %v, early data accepted %v, %d bytes sent early, want 8",
+			state.DidResume, state.EarlyDataAccepted, sent)
+	}
+	output := stop()
+	for _, want := range []string{"full handshake", "Early data received", "early-data"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("openssl output lacks %q:\n%s", want, output)
+		}
+	}
+
+	// Another server does not know the ticket keys of the first one, so it
+	// rejects the session along with its early data, sent again after the
+	// handshake. With P-256 only, it also sends a HelloRetryRequest.
+	for _, args := range [][]string{nil, {"-groups", "P-256"}} {
+		addr, stop := startOpenSSLServer(t, append(serverArgs, args...)...)
+		if state, sent := connect(addr, "rejected early data\n"); state.DidResume || state.EarlyDataAccepted || sent == 0 {
+			t.Errorf("%v: resumed %v, early data accepted %v, %d bytes sent early",
+				args, state.DidResume, state.EarlyDataAccepted, sent)
+		}
+		output := stop()
+		for _, want := range []string{"Early data was rejected", "rejected early data"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("%v: openssl output lacks %q:\n%s", args, want, output)
+			}
+		}
+	}
+}
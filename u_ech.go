@@ -0,0 +1,827 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+)
+
+// This file implements Encrypted Client Hello as specified by
+// draft-ietf-tls-esni-18. The client splits its ClientHello into a
+// ClientHelloInner, carrying the true SNI, and a ClientHelloOuter, carrying
+// the ECHConfig public name and the HPKE-sealed inner hello.
+// The ech_outer_extensions compression scheme is not used.
+
+const (
+	echConfigVersion uint16 = 0xfe0d
+
+	echClientHelloOuter uint8 = 0
+	echClientHelloInner uint8 = 1
+
+	echAcceptConfirmationLabel    = "ech accept confirmation"
+	echHRRAcceptConfirmationLabel = "hrr ech accept confirmation"
+)
+
+// ECHConfig is a single Encrypted Client Hello configuration, as published
+// by a server in the ECHConfigList of its DNS HTTPS record.
+type ECHConfig struct {
+	Version       uint16
+	ConfigID      uint8
+	KemID         uint16
+	PublicKey     []byte
+	CipherSuites  []HPKESymmetricCipherSuite
+	MaxNameLength uint8
+	PublicName    string
+	Extensions    []byte // raw, length-prefix stripped extensions block
+
+	raw []byte
+}
+
+// UnmarshalECHConfigs parses an ECHConfigList. Configs with a version other
+// than the one implemented are skipped, as required by the specification.
+func UnmarshalECHConfigs(data []byte) ([]ECHConfig, error) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() || list.Empty() {
+		return nil, errors.New("tls: malformed ECHConfigList")
+	}
+
+	var configs []ECHConfig
+	for !list.Empty() {
+		var config ECHConfig
+		var contents cryptobyte.String
+		raw := list
+		if !list.ReadUint16(&config.Version) ||
+			!list.ReadUint16LengthPrefixed(&contents) {
+			return nil, errors.New("tls: malformed ECHConfig")
+		}
+		config.raw = raw[:4+len(contents)]
+		if config.Version != echConfigVersion {
+			continue
+		}
+		if err := config.unmarshalContents(contents); err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (c *ECHConfig) unmarshalContents(s cryptobyte.String) error {
+	var suites, publicName, extensions cryptobyte.String
+	if !s.ReadUint8(&c.ConfigID) ||
+		!s.ReadUint16(&c.KemID) ||
+		!readUint16LengthPrefixed(&s, &c.PublicKey) || len(c.PublicKey) == 0 ||
+		!s.ReadUint16LengthPrefixed(&suites) || suites.Empty() ||
+		!s.ReadUint8(&c.MaxNameLength) ||
+		!s.ReadUint8LengthPrefixed(&publicName) || publicName.Empty() ||
+		!s.ReadUint16LengthPrefixed(&extensions) ||
+		!s.Empty() {
+		return errors.New("tls: malformed ECHConfig")
+	}
+	for !suites.Empty() {
+		var suite HPKESymmetricCipherSuite
+		if !suites.ReadUint16(&suite.KDFID) || !suites.ReadUint16(&suite.AEADID) {
+			return errors.New("tls: malformed ECHConfig cipher suites")
+		}
+		c.CipherSuites = append(c.CipherSuites, suite)
+	}
+	c.PublicName = string(publicName)
+	c.Extensions = extensions
+	return nil
+}
+
+// Marshal returns the wire encoding of the ECHConfig. A list of them, as
+// expected by UnmarshalECHConfigs, is built with MarshalECHConfigs.
+func (c *ECHConfig) Marshal() []byte {
+	if c.raw != nil {
+		// Parsed configs are used as received, as they are part of the
+		// HPKE info.
+		return c.raw
+	}
+	var b cryptobyte.Builder
+	b.AddUint16(c.Version)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(c.ConfigID)
+		b.AddUint16(c.KemID)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(c.PublicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, suite := range c.CipherSuites {
+				b.AddUint16(suite.KDFID)
+				b.AddUint16(suite.AEADID)
+			}
+		})
+		b.AddUint8(c.MaxNameLength)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(c.PublicName))
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(c.Extensions)
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// MarshalECHConfigs returns the ECHConfigList encoding of configs.
+func MarshalECHConfigs(configs []ECHConfig) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for i := range configs {
+			b.AddBytes(configs[i].Marshal())
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// hasMandatoryExtension reports whether the config carries an extension
+// with the high bit set, which clients must understand to use the config.
+func (c *ECHConfig) hasMandatoryExtension() bool {
+	s := cryptobyte.String(c.Extensions)
+	for !s.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !s.ReadUint16(&extType) || !s.ReadUint16LengthPrefixed(&extData) {
+			return true
+		}
+		if extType&0x8000 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ECHConfig) hpkeInfo() []byte {
+	info := []byte("tls ech\x00")
+	return append(info, c.Marshal()...)
+}
+
+// ECHRejectionError is returned by the handshake when the server did not
+// accept Encrypted Client Hello. The connection is unusable, but
+// RetryConfigs may be passed to SetECHConfigs on a new connection.
+type ECHRejectionError struct {
+	// RetryConfigList is the raw ECHConfigList sent by the server, if any.
+	RetryConfigList []byte
+	// RetryConfigs are the supported configs parsed from RetryConfigList.
+	RetryConfigs []ECHConfig
+}
+
+func (e *ECHRejectionError) Error() string {
+	if len(e.RetryConfigs) == 0 {
+		return "tls: server rejected ECH"
+	}
+	return "tls: server rejected ECH, " + strconv.Itoa(len(e.RetryConfigs)) + " retry configs provided"
+}
+
+// echClientContext is the client-side ECH state of a UConn.
+type echClientContext struct {
+	config *ECHConfig
+	suite  HPKESymmetricCipherSuite
+	hpke   *hpkeContext
+
+	outerExtension *echOuterExtension
+	outerRandom    []byte
+	innerRandom    []byte
+	innerRaw       []byte
+
+	// innerTranscript is the transcript over the ClientHelloInner, kept
+	// alongside the ClientHelloOuter one until the server's choice is known.
+	innerTranscript hash.Hash
+	retryConfigs    []byte
+
+	hrr      bool // the next ClientHello answers a HelloRetryRequest
+	rejected bool // the server did not confirm ECH acceptance
+}
+
+// SetECHConfigs enables Encrypted Client Hello with the first of configs
+// that uTLS supports. The true server name is sent in the encrypted
+// ClientHelloInner, while the SNI of the ClientHelloOuter is set to the
+// config's public name. Passing no configs disables ECH.
+//
+// ECH requires a ClientHelloID other than HelloGolang, and session
+// resumption is not attempted on ECH connections. If the server rejects ECH,
+// the handshake fails with an *ECHRejectionError.
+func (uconn *UConn) SetECHConfigs(configs []ECHConfig) error {
+	if len(configs) == 0 {
+		uconn.ech = nil
+		return nil
+	}
+	for i := range configs {
+		config := configs[i]
+		if config.Version != echConfigVersion || config.hasMandatoryExtension() ||
+			len(config.PublicName) == 0 {
+			continue
+		}
+		for _, suite := range config.CipherSuites {
+			if hpkeSupportsSuite(config.KemID, suite) {
+				uconn.ech = &echClientContext{
+					config: &config,
+					suite:  suite,
+					outerExtension: &echOuterExtension{
+						Suite:    suite,
+						ConfigID: config.ConfigID,
+					},
+				}
+				return nil
+			}
+		}
+	}
+	return errors.New("tls: no supported ECHConfig")
+}
+
+// extensions derives the ClientHelloInner and ClientHelloOuter extension
+// lists from exts. An ECHExtension, a GREASEEncryptedClientHelloExtension or
+// an encrypted_client_hello GenericExtension placeholder in exts determines
+// the position of the ECH extension, otherwise it is placed before padding.
+func (ech *echClientContext) extensions(exts []TLSExtension) (inner, outer []TLSExtension) {
+	pos := len(exts)
+	if pos > 0 {
+		if _, ok := exts[pos-1].(*UtlsPaddingExtension); ok {
+			pos--
+		}
+	}
+	placeholder := false
+	for i, ext := range exts {
+		switch ext := ext.(type) {
+		case *ECHExtension, *GREASEEncryptedClientHelloExtension:
+			placeholder = true
+		case *GenericExtension:
+			placeholder = ext.Id == utlsExtensionEncryptedClientHello
+		}
+		if placeholder {
+			pos = i
+			break
+		}
+	}
+
+	for i, ext := range exts {
+		if i == pos {
+			inner = append(inner, &echInnerExtension{})
+			outer = append(outer, ech.outerExtension)
+			if placeholder {
+				continue
+			}
+		}
+		if _, ok := ext.(*SNIExtension); ok {
+			inner = append(inner, ext)
+			outer = append(outer, &SNIExtension{ServerName: ech.config.PublicName})
+			continue
+		}
+		inner = append(inner, ext)
+		outer = append(outer, ext)
+	}
+	if pos == len(exts) {
+		inner = append(inner, &echInnerExtension{})
+		outer = append(outer, ech.outerExtension)
+	}
+	return inner, outer
+}
+
+// paddingLen returns the number of zeros appended to an
+// EncodedClientHelloInner of length n, see draft-ietf-tls-esni-18, Section 6.1.3.
+func (ech *echClientContext) paddingLen(serverName string, n int) int {
+	var padding int
+	if serverName != "" {
+		if maxLen := int(ech.config.MaxNameLength); maxLen > len(serverName) {
+			padding = maxLen - len(serverName)
+		}
+	} else {
+		padding = int(ech.config.MaxNameLength) + 9
+	}
+	return padding + 31 - ((n + padding - 1) % 32)
+}
+
+// marshalClientHelloECH marshals the ClientHelloInner and seals it into the
+// ClientHelloOuter, which becomes uconn.HandshakeState.Hello.Raw.
+func (uconn *UConn) marshalClientHelloECH() error {
+	ech := uconn.ech
+	hello := uconn.HandshakeState.Hello
+
+	innerExts, outerExts := ech.extensions(uconn.Extensions)
+	innerRaw, err := marshalClientHello(hello, innerExts)
+	if err != nil {
+		return err
+	}
+
+	// EncodedClientHelloInner omits the handshake header and the legacy
+	// session ID, which the server copies from the ClientHelloOuter.
+	sessionIDEnd := 4 + 2 + 32 + 1 + len(hello.SessionId)
+	encoded := make([]byte, 0, len(innerRaw))
+	encoded = append(encoded, innerRaw[4:4+2+32]...)
+	encoded = append(encoded, 0)
+	encoded = append(encoded, innerRaw[sessionIDEnd:]...)
+	encoded = append(encoded, make([]byte, ech.paddingLen(hello.ServerName, len(encoded)))...)
+
+	if ech.outerRandom == nil {
+		ech.outerRandom = make([]byte, 32)
+		if _, err := io.ReadFull(uconn.config.rand(), ech.outerRandom); err != nil {
+			return errors.New("tls: short read from Rand: " + err.Error())
+		}
+	}
+	if !ech.hrr {
+		// The first ClientHello may be built several times, use a fresh
+		// HPKE context for each so that it is always sealed with sequence 0.
+		enc, ctx, err := hpkeSetupBaseSender(uconn.config.rand(), ech.config.KemID, ech.suite,
+			ech.config.PublicKey, ech.config.hpkeInfo())
+		if err != nil {
+			return err
+		}
+		ech.hpke = ctx
+		ech.outerExtension.Enc = enc
+	} else {
+		ech.outerExtension.Enc = nil
+	}
+
+	outerHello := *hello
+	outerHello.Random = ech.outerRandom
+	ech.outerExtension.Payload = make([]byte, len(encoded)+ech.hpke.aead.Overhead())
+	aad, err := marshalClientHello(&outerHello, outerExts)
+	if err != nil {
+		return err
+	}
+	ech.outerExtension.Payload = ech.hpke.seal(aad[4:], encoded)
+	outerRaw, err := marshalClientHello(&outerHello, outerExts)
+	if err != nil {
+		return err
+	}
+
+	ech.innerRandom = hello.Random
+	ech.innerRaw = innerRaw
+	hello.Raw = outerRaw
+	return nil
+}
+
+// acceptConfirmation computes the ECH acceptance signal over transcript.
+func (ech *echClientContext) acceptConfirmation(suite *cipherSuiteTLS13, label string, transcript hash.Hash) []byte {
+	return suite.expandLabel(suite.extract(ech.innerRandom, nil), label, transcript.Sum(nil), 8)
+}
+
+// echContext returns the ECH state of the connection, or nil if ECH was not
+// offered.
+func (hs *clientHandshakeStateTLS13) echContext() *echClientContext {
+	if hs.uconn == nil || hs.uconn.ClientHelloID == HelloGolang {
+		return nil
+	}
+	return hs.uconn.ech
+}
+
+// processECHHelloRetryRequest updates the ClientHelloInner transcript with
+// the HelloRetryRequest in hs.serverHello and checks whether it confirms ECH
+// acceptance.
+func (hs *clientHandshakeStateTLS13) processECHHelloRetryRequest() error {
+	ech := hs.echContext()
+	if ech == nil {
+		return nil
+	}
+
+	chHash := ech.innerTranscript.Sum(nil)
+	ech.innerTranscript.Reset()
+	ech.innerTranscript.Write([]byte{typeMessageHash, 0, 0, uint8(len(chHash))})
+	ech.innerTranscript.Write(chHash)
+
+	hrr := hs.serverHello.marshal()
+	accepted := false
+	if confirmation := hs.serverHello.encryptedClientHello; len(confirmation) == 8 {
+		transcript := cloneHash(ech.innerTranscript, hs.suite.hash)
+		if transcript == nil {
+			hs.c.sendAlert(alertInternalError)
+			return errors.New("tls: internal error: failed to clone hash")
+		}
+		transcript.Write(bytes.Replace(hrr, confirmation, make([]byte, 8), 1))
+		accepted = hmac.Equal(ech.acceptConfirmation(hs.suite, echHRRAcceptConfirmationLabel, transcript), confirmation)
+	}
+	ech.rejected = !accepted
+	ech.innerTranscript.Write(hrr)
+	ech.hrr = true
+	return nil
+}
+
+// processECHServerHello checks the ECH acceptance signal in hs.serverHello
+// and, if ECH was accepted, continues the handshake with the ClientHelloInner.
+func (hs *clientHandshakeStateTLS13) processECHServerHello() error {
+	ech := hs.echContext()
+	if ech == nil {
+		return nil
+	}
+
+	if !ech.rejected {
+		transcript := cloneHash(ech.innerTranscript, hs.suite.hash)
+		if transcript == nil {
+			hs.c.sendAlert(alertInternalError)
+			return errors.New("tls: internal error: failed to clone hash")
+		}
+		serverHello := append([]byte{}, hs.serverHello.marshal()...)
+		copy(serverHello[30:38], make([]byte, 8))
+		transcript.Write(serverHello)
+		confirmation := ech.acceptConfirmation(hs.suite, echAcceptConfirmationLabel, transcript)
+		ech.rejected = !hmac.Equal(confirmation, hs.serverHello.random[24:])
+	}
+
+	if ech.rejected {
+		hs.c.echPublicName = ech.config.PublicName
+		return nil
+	}
+	hs.transcript = ech.innerTranscript
+	hs.hello.random = ech.innerRandom
+	hs.hello.raw = ech.innerRaw
+	hs.c.echAccepted = true
+	return nil
+}
+
+// echRejectionError aborts a handshake completed with the ClientHelloOuter.
+func (c *Conn) echRejectionError(ech *echClientContext) error {
+	c.sendAlert(alertECHRequired)
+	err := &ECHRejectionError{RetryConfigList: ech.retryConfigs}
+	if len(ech.retryConfigs) > 0 {
+		configs, parseErr := UnmarshalECHConfigs(ech.retryConfigs)
+		if parseErr != nil {
+			return parseErr
+		}
+		err.RetryConfigs = configs
+	}
+	return err
+}
+
+// ECHExtension enables Encrypted Client Hello from a ClientHelloSpec. When
+// the spec is applied, Configs are passed to UConn.SetECHConfigs, and the
+// position of the extension in the spec determines where the
+// encrypted_client_hello extension is sent. With no Configs, ECH is disabled
+// and the extension is omitted.
+type ECHExtension struct {
+	Configs []ECHConfig
+}
+
+func (e *ECHExtension) writeToUConn(uc *UConn) error {
+	return nil
+}
+
+// Len returns zero, the extension is replaced by its inner and outer forms
+// when the ClientHello is marshaled.
+func (e *ECHExtension) Len() int {
+	return 0
+}
+
+func (e *ECHExtension) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// GREASEEncryptedClientHelloExtension sends a GREASE encrypted_client_hello
+// extension, as Chrome does for servers it has no ECHConfig for. The
+// extension is a well-formed outer ECH extension with random contents, see
+// draft-ietf-tls-esni-18, Section 6.2. It is generated from Config.Rand, or
+// from the seed set with SetGREASESeed, the first time the ClientHello is
+// built, and kept when it is built again.
+//
+// If ECH is enabled with SetECHConfigs, the real encrypted_client_hello
+// extension takes its place.
+type GREASEEncryptedClientHelloExtension struct {
+	// CandidateCipherSuites are the HPKE suites to pick from. If empty,
+	// HKDF-SHA256 with AES-128-GCM is used.
+	CandidateCipherSuites []HPKESymmetricCipherSuite
+	// CandidatePayloadLens are the EncodedClientHelloInner lengths to pick
+	// from, the AEAD overhead is added to the chosen one. If empty, the
+	// padded ClientHelloInner sizes Chrome uses, 128 to 224 bytes in steps of
+	// 32, are used.
+	CandidatePayloadLens []uint16
+
+	cipherSuite HPKESymmetricCipherSuite
+	configID    uint8
+	enc         []byte
+	payload     []byte
+}
+
+var (
+	greaseECHDefaultCipherSuites = []HPKESymmetricCipherSuite{
+		{KDFID: HPKE_KDF_HKDF_SHA256, AEADID: HPKE_AEAD_AES_128_GCM},
+	}
+	greaseECHDefaultPayloadLens = []uint16{128, 160, 192, 224}
+)
+
+func (e *GREASEEncryptedClientHelloExtension) writeToUConn(uc *UConn) error {
+	if e.payload != nil {
+		return nil
+	}
+	suites := e.CandidateCipherSuites
+	if len(suites) == 0 {
+		suites = greaseECHDefaultCipherSuites
+	}
+	payloadLens := e.CandidatePayloadLens
+	if len(payloadLens) == 0 {
+		payloadLens = greaseECHDefaultPayloadLens
+	}
+
+	rand := uc.config.rand()
+	if uc.greaseRand != nil {
+		rand = uc.greaseRand
+	}
+	var choices [3]byte
+	if _, err := io.ReadFull(rand, choices[:]); err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	e.cipherSuite = suites[int(choices[0])%len(suites)]
+	e.configID = choices[1]
+	if hpkeAEADKeyLen(e.cipherSuite.AEADID) == 0 {
+		return fmt.Errorf("tls: unsupported HPKE AEAD %#04x in GREASE ECH", e.cipherSuite.AEADID)
+	}
+
+	// The enc of an X25519 KEM is an ephemeral public key, make it a valid one.
+	sk := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand, sk); err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	enc, err := curve25519.X25519(sk, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	e.enc = enc
+
+	// All the supported AEADs have a 16 byte tag.
+	e.payload = make([]byte, int(payloadLens[int(choices[2])%len(payloadLens)])+16)
+	if _, err := io.ReadFull(rand, e.payload); err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	return nil
+}
+
+func (e *GREASEEncryptedClientHelloExtension) Len() int {
+	return 4 + 1 + 4 + 1 + 2 + len(e.enc) + 2 + len(e.payload)
+}
+
+func (e *GREASEEncryptedClientHelloExtension) Read(b []byte) (int, error) {
+	outer := echOuterExtension{
+		Suite:    e.cipherSuite,
+		ConfigID: e.configID,
+		Enc:      e.enc,
+		Payload:  e.payload,
+	}
+	return outer.Read(b)
+}
+
+// echOuterExtension is the encrypted_client_hello extension of a
+// ClientHelloOuter.
+type echOuterExtension struct {
+	Suite    HPKESymmetricCipherSuite
+	ConfigID uint8
+	Enc      []byte
+	Payload  []byte
+}
+
+func (e *echOuterExtension) writeToUConn(uc *UConn) error {
+	return nil
+}
+
+func (e *echOuterExtension) Len() int {
+	return 4 + 1 + 4 + 1 + 2 + len(e.Enc) + 2 + len(e.Payload)
+}
+
+func (e *echOuterExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	b[0] = byte(utlsExtensionEncryptedClientHello >> 8)
+	b[1] = byte(utlsExtensionEncryptedClientHello & 0xff)
+	b[2] = byte((e.Len() - 4) >> 8)
+	b[3] = byte(e.Len() - 4)
+	b[4] = echClientHelloOuter
+	b[5] = byte(e.Suite.KDFID >> 8)
+	b[6] = byte(e.Suite.KDFID)
+	b[7] = byte(e.Suite.AEADID >> 8)
+	b[8] = byte(e.Suite.AEADID)
+	b[9] = e.ConfigID
+	b[10] = byte(len(e.Enc) >> 8)
+	b[11] = byte(len(e.Enc))
+	copy(b[12:], e.Enc)
+	i := 12 + len(e.Enc)
+	b[i] = byte(len(e.Payload) >> 8)
+	b[i+1] = byte(len(e.Payload))
+	copy(b[i+2:], e.Payload)
+	return e.Len(), io.EOF
+}
+
+// echInnerExtension is the encrypted_client_hello extension of a
+// ClientHelloInner.
+type echInnerExtension struct {
+}
+
+func (e *echInnerExtension) writeToUConn(uc *UConn) error {
+	return nil
+}
+
+func (e *echInnerExtension) Len() int {
+	return 5
+}
+
+func (e *echInnerExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	b[0] = byte(utlsExtensionEncryptedClientHello >> 8)
+	b[1] = byte(utlsExtensionEncryptedClientHello & 0xff)
+	b[2] = 0
+	b[3] = 1
+	b[4] = echClientHelloInner
+	return e.Len(), io.EOF
+}
+
+// EncryptedClientHelloKey is a key a server uses to decrypt ClientHelloInner
+// messages. See Config.EncryptedClientHelloKeys.
+type EncryptedClientHelloKey struct {
+	// Config is the marshaled ECHConfig published for this key.
+	Config []byte
+	// PrivateKey is the X25519 private key matching the config public key.
+	PrivateKey []byte
+	// SendAsRetry controls whether Config is sent to clients in
+	// retry_configs when ECH is rejected.
+	SendAsRetry bool
+}
+
+// echServerContext is the server-side ECH state of a handshake.
+type echServerContext struct {
+	hpke     *hpkeContext
+	suite    HPKESymmetricCipherSuite
+	configID uint8
+	accepted bool
+}
+
+// parseECHOuterExtension parses the body of an outer encrypted_client_hello
+// extension.
+func parseECHOuterExtension(data []byte) (suite HPKESymmetricCipherSuite, configID uint8, enc, payload []byte, err error) {
+	s := cryptobyte.String(data)
+	var echType uint8
+	if !s.ReadUint8(&echType) || echType != echClientHelloOuter ||
+		!s.ReadUint16(&suite.KDFID) || !s.ReadUint16(&suite.AEADID) ||
+		!s.ReadUint8(&configID) ||
+		!readUint16LengthPrefixed(&s, &enc) ||
+		!readUint16LengthPrefixed(&s, &payload) || len(payload) == 0 ||
+		!s.Empty() {
+		err = errors.New("tls: malformed encrypted_client_hello extension")
+	}
+	return
+}
+
+// decodeClientHelloInner reconstructs the ClientHelloInner handshake
+// message from a decrypted EncodedClientHelloInner and its ClientHelloOuter.
+func decodeClientHelloInner(encoded []byte, outer *clientHelloMsg) (*clientHelloMsg, error) {
+	s := cryptobyte.String(encoded)
+	var vers uint16
+	var random, sessionID, cipherSuites, compressionMethods, extensions []byte
+	if !s.ReadUint16(&vers) || !s.ReadBytes(&random, 32) ||
+		!readUint8LengthPrefixed(&s, &sessionID) || len(sessionID) != 0 ||
+		!readUint16LengthPrefixed(&s, &cipherSuites) ||
+		!readUint8LengthPrefixed(&s, &compressionMethods) ||
+		!readUint16LengthPrefixed(&s, &extensions) {
+		return nil, errors.New("tls: malformed EncodedClientHelloInner")
+	}
+	for _, b := range s {
+		if b != 0 {
+			return nil, errors.New("tls: EncodedClientHelloInner has non-zero padding")
+		}
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(vers)
+		b.AddBytes(random)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(outer.sessionId)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(cipherSuites)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(compressionMethods)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(extensions)
+		})
+	})
+	raw, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	inner := new(clientHelloMsg)
+	if !inner.unmarshal(raw) {
+		return nil, errors.New("tls: malformed ClientHelloInner")
+	}
+	if !bytes.Equal(inner.encryptedClientHello, []byte{echClientHelloInner}) {
+		return nil, errors.New("tls: ClientHelloInner is missing the inner encrypted_client_hello extension")
+	}
+	return inner, nil
+}
+
+// openClientHelloOuter decrypts the ClientHelloInner sealed in outer.
+func (ech *echServerContext) openClientHelloOuter(outer *clientHelloMsg, payload []byte) (*clientHelloMsg, error) {
+	aad := bytes.Replace(outer.marshal()[4:], payload, make([]byte, len(payload)), 1)
+	encoded, err := ech.hpke.open(aad, payload)
+	if err != nil {
+		return nil, err
+	}
+	return decodeClientHelloInner(encoded, outer)
+}
+
+// processEncryptedClientHello tries to decrypt the ClientHelloInner carried
+// by hs.clientHello with the configured EncryptedClientHelloKeys. On success
+// the handshake continues with the ClientHelloInner.
+func (hs *serverHandshakeStateTLS13) processEncryptedClientHello() error {
+	c := hs.c
+	if len(hs.clientHello.encryptedClientHello) == 0 || len(c.config.EncryptedClientHelloKeys) == 0 {
+		return nil
+	}
+
+	suite, configID, enc, payload, err := parseECHOuterExtension(hs.clientHello.encryptedClientHello)
+	if err != nil {
+		c.sendAlert(alertIllegalParameter)
+		return err
+	}
+
+	hs.echContext = &echServerContext{suite: suite, configID: configID}
+	for _, key := range c.config.EncryptedClientHelloKeys {
+		configs, err := UnmarshalECHConfigs(append([]byte{byte(len(key.Config) >> 8), byte(len(key.Config))}, key.Config...))
+		if err != nil || len(configs) != 1 {
+			c.sendAlert(alertInternalError)
+			return fmt.Errorf("tls: invalid EncryptedClientHelloKeys config: %v", err)
+		}
+		config := &configs[0]
+		if config.ConfigID != configID || !hpkeSupportsSuite(config.KemID, suite) {
+			continue
+		}
+		ctx, err := hpkeSetupBaseReceiver(config.KemID, suite, enc, key.PrivateKey, config.hpkeInfo())
+		if err != nil {
+			continue
+		}
+		hs.echContext.hpke = ctx
+		inner, err := hs.echContext.openClientHelloOuter(hs.clientHello, payload)
+		if err != nil {
+			continue
+		}
+		hs.clientHello = inner
+		hs.echContext.accepted = true
+		c.echAccepted = true
+		return nil
+	}
+	return nil
+}
+
+// processSecondEncryptedClientHello decrypts the ClientHelloInner sent in
+// response to a HelloRetryRequest, using the HPKE context of the first one.
+func (hs *serverHandshakeStateTLS13) processSecondEncryptedClientHello(clientHello *clientHelloMsg) (*clientHelloMsg, error) {
+	c := hs.c
+	if hs.echContext == nil || !hs.echContext.accepted {
+		return clientHello, nil
+	}
+
+	suite, configID, enc, payload, err := parseECHOuterExtension(clientHello.encryptedClientHello)
+	if err != nil || suite != hs.echContext.suite || configID != hs.echContext.configID || len(enc) != 0 {
+		c.sendAlert(alertIllegalParameter)
+		return nil, errors.New("tls: client sent invalid encrypted_client_hello in second ClientHello")
+	}
+	inner, err := hs.echContext.openClientHelloOuter(clientHello, payload)
+	if err != nil {
+		c.sendAlert(alertDecryptError)
+		return nil, err
+	}
+	return inner, nil
+}
+
+// echAcceptConfirmation computes the ECH acceptance signal for msg, which
+// must already have the signal bytes zeroed.
+func (hs *serverHandshakeStateTLS13) echAcceptConfirmation(label string, msg []byte) ([]byte, error) {
+	transcript := cloneHash(hs.transcript, hs.suite.hash)
+	if transcript == nil {
+		hs.c.sendAlert(alertInternalError)
+		return nil, errors.New("tls: internal error: failed to clone hash")
+	}
+	transcript.Write(msg)
+	return hs.suite.expandLabel(hs.suite.extract(hs.clientHello.random, nil), label, transcript.Sum(nil), 8), nil
+}
+
+// echRetryConfigs returns the ECHConfigList to send when ECH was rejected.
+func (c *Config) echRetryConfigs() []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, key := range c.EncryptedClientHelloKeys {
+			if key.SendAsRetry {
+				b.AddBytes(key.Config)
+			}
+		}
+	})
+	list := b.BytesOrPanic()
+	if len(list) == 2 {
+		return nil
+	}
+	return list
+}
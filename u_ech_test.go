@@ -0,0 +1,299 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	mathrand "math/rand"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func newTestECHKey(t *testing.T, configID uint8, publicName string) (ECHConfig, EncryptedClientHelloKey) {
+	sk := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(sk); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := curve25519.X25519(sk, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ECHConfig{
+		Version:   echConfigVersion,
+		ConfigID:  configID,
+		KemID:     HPKE_KEM_X25519_HKDF_SHA256,
+		PublicKey: pk,
+		CipherSuites: []HPKESymmetricCipherSuite{
+			{KDFID: HPKE_KDF_HKDF_SHA256, AEADID: HPKE_AEAD_AES_128_GCM},
+		},
+		MaxNameLength: 64,
+		PublicName:    publicName,
+	}
+	return config, EncryptedClientHelloKey{Config: config.Marshal(), PrivateKey: sk, SendAsRetry: true}
+}
+
+// testECHHandshake runs a handshake between an ECH-enabled uTLS client and
+// the package server, returning the client and the server connection state.
+func testECHHandshake(t *testing.T, clientECH []ECHConfig, serverConfig *Config) (*UConn, ConnectionState, error) {
+	c, s := localPipe(t)
+	done := make(chan ConnectionState, 1)
+	go func() {
+		defer s.Close()
+		server := Server(s, serverConfig)
+		server.Handshake()
+		done <- server.ConnectionState()
+	}()
+
+	client := UClient(c, &Config{ServerName: "secret.example.com", InsecureSkipVerify: true}, HelloChrome_Auto)
+	if err := client.SetECHConfigs(clientECH); err != nil {
+		t.Fatal(err)
+	}
+	err := client.Handshake()
+	c.Close()
+	return client, <-done, err
+}
+
+func TestECHConfigsRoundTrip(t *testing.T) {
+	config, _ := newTestECHKey(t, 7, "public.example.com")
+	config.Extensions = []byte{0x00, 0x01, 0x00, 0x00}
+	list := MarshalECHConfigs([]ECHConfig{{Version: 0xfe0c, PublicName: "skipped"}, config})
+
+	configs, err := UnmarshalECHConfigs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("got %d configs, expected the unknown version to be skipped", len(configs))
+	}
+	got := configs[0]
+	if got.ConfigID != 7 || got.PublicName != "public.example.com" || got.MaxNameLength != 64 ||
+		!bytes.Equal(got.PublicKey, config.PublicKey) || len(got.CipherSuites) != 1 ||
+		!bytes.Equal(got.Extensions, config.Extensions) {
+		t.Errorf("parsed config %+v does not match %+v", got, config)
+	}
+	if !bytes.Equal(got.Marshal(), config.Marshal()) {
+		t.Errorf("re-marshaled config does not match")
+	}
+}
+
+func TestECHAccepted(t *testing.T) {
+	config, key := newTestECHKey(t, 1, "public.example.com")
+	serverConfig := testConfig.Clone()
+	serverConfig.EncryptedClientHelloKeys = []EncryptedClientHelloKey{key}
+
+	client, serverState, err := testECHHandshake(t, []ECHConfig{config}, serverConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	clientState := client.ConnectionState()
+	if !clientState.ECHAccepted || !serverState.ECHAccepted {
+		t.Errorf("ECH not accepted, client: %v, server: %v", clientState.ECHAccepted, serverState.ECHAccepted)
+	}
+	if serverState.ServerName != "secret.example.com" {
+		t.Errorf("server saw SNI %q, expected the inner one", serverState.ServerName)
+	}
+}
+
+func TestECHAcceptedAfterHelloRetryRequest(t *testing.T) {
+	config, key := newTestECHKey(t, 1, "public.example.com")
+	serverConfig := testConfig.Clone()
+	serverConfig.EncryptedClientHelloKeys = []EncryptedClientHelloKey{key}
+	// The client only sends an X25519 key share, forcing a HelloRetryRequest.
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+
+	client, serverState, err := testECHHandshake(t, []ECHConfig{config}, serverConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	clientState := client.ConnectionState()
+	if !clientState.ECHAccepted || !serverState.ECHAccepted {
+		t.Errorf("ECH not accepted, client: %v, server: %v", clientState.ECHAccepted, serverState.ECHAccepted)
+	}
+	if serverState.ServerName != "secret.example.com" {
+		t.Errorf("server saw SNI %q, expected the inner one", serverState.ServerName)
+	}
+	if !client.ech.hrr {
+		t.Errorf("expected a HelloRetryRequest")
+	}
+}
+
+func TestECHRejectedWithRetryConfigs(t *testing.T) {
+	for _, hrr := range []bool{false, true} {
+		staleConfig, _ := newTestECHKey(t, 1, "public.example.com")
+		retryConfig, key := newTestECHKey(t, 2, "public.example.com")
+		serverConfig := testConfig.Clone()
+		serverConfig.EncryptedClientHelloKeys = []EncryptedClientHelloKey{key}
+		if hrr {
+			serverConfig.CurvePreferences = []CurveID{CurveP256}
+		}
+
+		client, serverState, err := testECHHandshake(t, []ECHConfig{staleConfig}, serverConfig)
+		var echErr *ECHRejectionError
+		if !errors.As(err, &echErr) {
+			t.Fatalf("hrr=%v: expected ECHRejectionError, got %v", hrr, err)
+		}
+		if len(echErr.RetryConfigs) != 1 || !bytes.Equal(echErr.RetryConfigs[0].Marshal(), retryConfig.Marshal()) {
+			t.Errorf("hrr=%v: unexpected retry configs %+v", hrr, echErr.RetryConfigs)
+		}
+		if client.ConnectionState().ECHAccepted || serverState.ECHAccepted {
+			t.Errorf("hrr=%v: ECH unexpectedly accepted", hrr)
+		}
+		if serverState.ServerName != "public.example.com" {
+			t.Errorf("hrr=%v: server saw SNI %q, expected the public name", hrr, serverState.ServerName)
+		}
+	}
+}
+
+func TestECHExtensionEncodeClientHelloInner(t *testing.T) {
+	config, key := newTestECHKey(t, 3, "public.example.com")
+	spec := &ClientHelloSpec{
+		CipherSuites: []uint16{TLS_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{X25519}},
+			&ECHExtension{Configs: []ECHConfig{config}},
+			&KeyShareExtension{KeyShares: []KeyShare{{Group: X25519}}},
+			&SupportedVersionsExtension{Versions: []uint16{VersionTLS13, VersionTLS12}},
+		},
+	}
+	client := UClient(&net.TCPConn{}, &Config{ServerName: "secret.example.com"}, HelloCustom)
+	if err := client.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	raw := client.HandshakeState.Hello.Raw
+
+	if got, want := clientHelloExtensionIDs(t, raw), []uint16{0, 10, utlsExtensionEncryptedClientHello, 51, 43}; !reflect.DeepEqual(got, want) {
+		t.Errorf("outer extensions = %v, want %v", got, want)
+	}
+	outer := new(clientHelloMsg)
+	if !outer.unmarshal(raw) {
+		t.Fatal("failed to parse the ClientHelloOuter")
+	}
+	if outer.serverName != "public.example.com" {
+		t.Errorf("outer SNI = %q, want the public name", outer.serverName)
+	}
+
+	suite, configID, enc, payload, err := parseECHOuterExtension(outer.encryptedClientHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configID != config.ConfigID || suite != config.CipherSuites[0] {
+		t.Errorf("unexpected config ID %d or suite %+v", configID, suite)
+	}
+	ctx, err := hpkeSetupBaseReceiver(config.KemID, suite, enc, key.PrivateKey, config.hpkeInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := bytes.Replace(raw[4:], payload, make([]byte, len(payload)), 1)
+	encoded, err := ctx.open(aad, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded)%32 != 0 {
+		t.Errorf("EncodedClientHelloInner length %d is not padded to a multiple of 32", len(encoded))
+	}
+	inner, err := decodeClientHelloInner(encoded, outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.serverName != "secret.example.com" {
+		t.Errorf("inner SNI = %q, want the true server name", inner.serverName)
+	}
+	if bytes.Equal(inner.random, outer.random) {
+		t.Error("inner and outer ClientHellos share the same random")
+	}
+	if !bytes.Equal(inner.marshal(), client.ech.innerRaw) {
+		t.Error("decoded ClientHelloInner does not match the one the client marshaled")
+	}
+}
+
+func TestECHExtensionNoConfigs(t *testing.T) {
+	spec := &ClientHelloSpec{
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&ECHExtension{},
+			&SupportedVersionsExtension{Versions: []uint16{VersionTLS13, VersionTLS12}},
+		},
+	}
+	client := UClient(&net.TCPConn{}, &Config{ServerName: "secret.example.com"}, HelloCustom)
+	if err := client.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw), []uint16{0, 43}; !reflect.DeepEqual(got, want) {
+		t.Errorf("extensions = %v, want %v", got, want)
+	}
+}
+
+func TestGREASEEncryptedClientHello(t *testing.T) {
+	build := func(seed int64) []byte {
+		config := &Config{ServerName: "example.com", Rand: mathrand.New(mathrand.NewSource(seed))}
+		uconn := UClient(&net.TCPConn{}, config, HelloChrome_120)
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		return uconn.HandshakeState.Hello.Raw
+	}
+
+	raw := build(1)
+	if !bytes.Equal(raw, build(1)) {
+		t.Error("ClientHellos built from the same seed differ")
+	}
+	if bytes.Equal(raw, build(2)) {
+		t.Error("ClientHellos built from different seeds are equal")
+	}
+
+	hello := new(clientHelloMsg)
+	if !hello.unmarshal(raw) {
+		t.Fatal("failed to parse the ClientHello")
+	}
+	suite, _, enc, payload, err := parseECHOuterExtension(hello.encryptedClientHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != (HPKESymmetricCipherSuite{KDFID: HPKE_KDF_HKDF_SHA256, AEADID: HPKE_AEAD_AES_128_GCM}) {
+		t.Errorf("unexpected suite %+v", suite)
+	}
+	if len(enc) != 32 {
+		t.Errorf("enc is %d bytes, want 32", len(enc))
+	}
+	if n := len(payload) - 16; n < 128 || n > 224 || n%32 != 0 {
+		t.Errorf("unexpected payload length %d", len(payload))
+	}
+}
+
+func TestGREASEEncryptedClientHelloReplacedByECH(t *testing.T) {
+	config, key := newTestECHKey(t, 1, "public.example.com")
+	serverConfig := testConfig.Clone()
+	serverConfig.EncryptedClientHelloKeys = []EncryptedClientHelloKey{key}
+
+	client, serverState, err := testECHHandshake(t, []ECHConfig{config}, serverConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if !client.ConnectionState().ECHAccepted || !serverState.ECHAccepted {
+		t.Error("ECH not accepted")
+	}
+	ids := clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw)
+	n := 0
+	for _, id := range ids {
+		if id == utlsExtensionEncryptedClientHello {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("ClientHelloOuter has %d encrypted_client_hello extensions, want 1: %v", n, ids)
+	}
+}
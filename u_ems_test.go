@@ -0,0 +1,136 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUTLSExtendedMasterSecretFingerprint(t *testing.T) {
+	for _, ems := range []bool{false, true} {
+		extensions := []TLSExtension{&SNIExtension{}}
+		if ems {
+			extensions = append(extensions, &UtlsExtendedMasterSecretExtension{})
+		}
+		extensions = append(extensions, &SupportedPointsExtension{SupportedPoints: []uint8{pointFormatUncompressed}})
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			Extensions:   extensions,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+
+		spec, raw := fingerprintAndRebuild(t, &Fingerprinter{}, uconn.HandshakeState.Hello.Raw)
+		found := false
+		for _, ext := range spec.Extensions {
+			_, ok := ext.(*UtlsExtendedMasterSecretExtension)
+			found = found || ok
+		}
+		if found != ems {
+			t.Errorf("EMS %v: fingerprinted spec has an UtlsExtendedMasterSecretExtension: %v", ems, found)
+		}
+		if !bytes.Equal(raw, uconn.HandshakeState.Hello.Raw) {
+			t.Errorf("EMS %v: re-marshaled ClientHello differs", ems)
+		}
+
+		ja3 := "771,49195,0-11,,0"
+		if ems {
+			ja3 = "771,49195,0-23-11,,0"
+		}
+		spec, err := ClientHelloSpecFromJA3(ja3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = false
+		for _, ext := range spec.Extensions {
+			_, ok := ext.(*UtlsExtendedMasterSecretExtension)
+			found = found || ok
+		}
+		if found != ems {
+			t.Errorf("JA3 %s: spec has an UtlsExtendedMasterSecretExtension: %v", ja3, found)
+		}
+	}
+}
+
+// TestUTLSExtendedMasterSecretOpenSSL checks that the client derives the same
+// master secret as OpenSSL, with and without the extended master secret of
+// RFC 7627, including when it signs a CertificateVerify, which comes after
+// the messages the session hash covers.
+func TestUTLSExtendedMasterSecretOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil || testing.Short() {
+		t.Skip("openssl is not available")
+	}
+
+	cert := ccmTestCertificate(t)
+	certFile, keyFile := openSSLCertificateFiles(t, cert)
+	keyLogFile := filepath.Join(t.TempDir(), "keylog.txt")
+	addr, stop := startOpenSSLServer(t, "-cert", certFile, "-key", keyFile, "-tls1_2",
+		"-Verify", "1", "-keylogfile", keyLogFile)
+
+	var keyLog bytes.Buffer
+	for _, ems := range []bool{false, true} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{
+			ServerName:         "iot.example.com",
+			InsecureSkipVerify: true,
+			Certificates:       []Certificate{cert},
+			KeyLogWriter:       &keyLog,
+		}
+		extensions := []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{CurveP256}},
+			&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256}},
+		}
+		if ems {
+			extensions = append(extensions, &UtlsExtendedMasterSecretExtension{})
+		}
+		client := UClient(conn, config, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			TLSVersMax:         VersionTLS12,
+			TLSVersMin:         VersionTLS12,
+			CipherSuites:       []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			CompressionMethods: []byte{compressionNone},
+			Extensions:         extensions,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("EMS %v: %v", ems, err)
+		}
+		if got := client.HandshakeState.ServerHello.Ems; got != ems {
+			t.Errorf("EMS %v: server negotiated the extended master secret: %v", ems, got)
+		}
+		client.Close()
+	}
+	stop()
+
+	serverKeyLog, err := os.ReadFile(keyLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(keyLog.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("client logged %d master secrets, want 2", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.Contains(string(serverKeyLog), line) {
+			t.Errorf("OpenSSL derived another master secret than the client's %q:\n%s", line, serverKeyLog)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto"
+	"errors"
+)
+
+// externalBinderLabel derives the binder key of an external PSK, see RFC 8446,
+// Section 7.1.
+const externalBinderLabel = "ext binder"
+
+// An externalPSK is a pre-shared key provisioned out of band, see
+// UConn.AddExternalPSK.
+type externalPSK struct {
+	identity []byte
+	key      []byte
+	hash     crypto.Hash
+}
+
+// suite returns a TLS 1.3 cipher suite with the hash of psk, to run its key
+// schedule.
+func (psk *externalPSK) suite() *cipherSuiteTLS13 {
+	for _, suite := range cipherSuitesTLS13 {
+		if suite.hash == psk.hash {
+			return suite
+		}
+	}
+	return nil
+}
+
+// AddExternalPSK offers a TLS 1.3 pre-shared key provisioned out of band, as
+// opposed to one from a session ticket, see RFC 8446, Section 4.2.11. The
+// server may select it with the cipher suites using hash, which must be
+// crypto.SHA256 or crypto.SHA384.
+//
+// External PSKs are listed in the pre_shared_key extension after the session
+// to resume, if any. If the ClientHelloSpec has no PreSharedKeyExtension one
+// is appended to it, along with a PSKKeyExchangeModesExtension offering both
+// psk_ke and psk_dhe_ke if it has none. External PSKs are not supported with
+// HelloGolang or Encrypted Client Hello.
+func (uconn *UConn) AddExternalPSK(identity []byte, key []byte, hash crypto.Hash) error {
+	if uconn.clientHelloSent() {
+		return errClientHelloSent
+	}
+	if hash != crypto.SHA256 && hash != crypto.SHA384 {
+		return errors.New("tls: external PSKs must use SHA-256 or SHA-384")
+	}
+	if len(identity) == 0 || len(identity) > 0xffff {
+		return errors.New("tls: invalid external PSK identity length")
+	}
+	if len(key) == 0 {
+		return errors.New("tls: empty external PSK")
+	}
+	uconn.externalPSKs = append(uconn.externalPSKs, externalPSK{
+		identity: append([]byte{}, identity...),
+		key:      append([]byte{}, key...),
+		hash:     hash,
+	})
+	return nil
+}
+
+// addExternalPSKExtensions makes sure the ClientHello carries the extensions
+// needed to offer the external PSKs.
+func (uconn *UConn) addExternalPSKExtensions() error {
+	if len(uconn.externalPSKs) == 0 {
+		return nil
+	}
+	if uconn.ech != nil {
+		return errors.New("tls: external PSKs are not supported with Encrypted Client Hello")
+	}
+
+	hasModes, hasPSK := false, false
+	for _, ext := range uconn.Extensions {
+		switch ext.(type) {
+		case *PSKKeyExchangeModesExtension:
+			hasModes = true
+		case *PreSharedKeyExtension:
+			hasPSK = true
+		}
+	}
+	if !hasPSK {
+		uconn.Extensions = append(uconn.Extensions, &PreSharedKeyExtension{})
+	}
+	if !hasModes {
+		// Before the pre_shared_key extension, which must be the last one.
+		n := len(uconn.Extensions)
+		uconn.Extensions = append(uconn.Extensions[:n-1:n-1],
+			&PSKKeyExchangeModesExtension{[]uint8{pskModePlain, pskModeDHE}}, uconn.Extensions[n-1])
+	}
+	return nil
+}
+
+// externalPSKBinders returns the binders of the external PSKs for transcript
+// followed by the ClientHello truncated before the binders.
+func (uconn *UConn) externalPSKBinders(transcript, truncatedHello []byte) [][]byte {
+	var binders [][]byte
+	for _, psk := range uconn.externalPSKs {
+		suite := psk.suite()
+		earlySecret := suite.extract(psk.key, nil)
+		binderKey := suite.deriveSecret(earlySecret, externalBinderLabel, nil)
+		h := suite.hash.New()
+		h.Write(transcript)
+		h.Write(truncatedHello)
+		binders = append(binders, suite.finishedHash(binderKey, h))
+	}
+	return binders
+}
+
+// selectedExternalPSK returns the external PSK the server selected, or nil if
+// it selected the session to resume.
+func (hs *clientHandshakeStateTLS13) selectedExternalPSK() *externalPSK {
+	if hs.uconn == nil {
+		return nil
+	}
+	external := hs.uconn.externalPSKs
+	i := int(hs.serverHello.selectedIdentity) - (len(hs.hello.pskIdentities) - len(external))
+	if i < 0 {
+		return nil
+	}
+	return &external[i]
+}
@@ -0,0 +1,516 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Fingerprinter builds a ClientHelloSpec from a captured ClientHello, so that
+// it can be mimicked with UConn.ApplyPreset.
+type Fingerprinter struct {
+	// AlwaysAddPadding adds a BoringSSL-style padding extension to the spec
+	// if the captured ClientHello has none.
+	AlwaysAddPadding bool
+
+	// KeepPSK keeps the pre_shared_key and early_data extensions, copied
+	// verbatim as GenericExtensions, instead of dropping them. The copied
+	// binders are stale, so servers will reject the offered PSK. Only use
+	// it to reproduce a capture byte for byte.
+	KeepPSK bool
+
+	// Strict makes FingerprintClientHello fail, listing the offending
+	// extensions, instead of copying an extension it cannot reproduce
+	// faithfully as a GenericExtension.
+	Strict bool
+
+	// AllowBluntMimicry relaxes Strict for extensions of a type uTLS does
+	// not implement, which are copied verbatim as GenericExtensions. Known
+	// extensions with contents uTLS cannot reproduce still cause an error.
+	AllowBluntMimicry bool
+
+	// factories parse the extensions registered with RegisterExtension.
+	factories map[uint16]func([]byte) (TLSExtension, error)
+}
+
+// RegisterExtension makes FingerprintClientHello parse the extensions of type
+// id with factory, which is passed their body, for instance to reproduce a
+// vendor-specific extension with its own type. factory is consulted before
+// the built-in parsers and the GenericExtension fallback; if it returns a
+// nil TLSExtension and no error, the extension is handled as if it was not
+// registered. An error from factory makes FingerprintClientHello fail.
+//
+// The returned extension is marshaled like any other when the spec is
+// applied. Types outside this package can implement TLSExtension by
+// embedding one of its extensions, such as GenericExtension, and overriding
+// Len and Read.
+func (f *Fingerprinter) RegisterExtension(id uint16, factory func([]byte) (TLSExtension, error)) {
+	if f.factories == nil {
+		f.factories = make(map[uint16]func([]byte) (TLSExtension, error))
+	}
+	f.factories[id] = factory
+}
+
+// FingerprintClientHello parses record, a TLS record carrying a ClientHello
+// and starting with the 5-byte record header, and returns a ClientHelloSpec
+// reproducing it, like FingerprintClientHelloBytes does with the handshake
+// message the record carries.
+func (f *Fingerprinter) FingerprintClientHello(record []byte) (*ClientHelloSpec, error) {
+	s := cryptobyte.String(record)
+	var contentType uint8
+	var recordVersion uint16
+	var fragment cryptobyte.String
+	if !s.ReadUint8(&contentType) || !s.ReadUint16(&recordVersion) ||
+		!s.ReadUint16LengthPrefixed(&fragment) {
+		return nil, errors.New("tls: unable to read the record header")
+	}
+	if recordType(contentType) != recordTypeHandshake {
+		return nil, errors.New("tls: record is not a handshake record")
+	}
+	return f.fingerprintClientHello(fragment, recordHeaderLen)
+}
+
+// FingerprintClientHelloBytes parses handshake, a ClientHello handshake
+// message starting with its type byte and without a record header, as QUIC
+// CRYPTO frames and parsers stripping the record layer carry it, and returns
+// a ClientHelloSpec reproducing it.
+//
+// Cipher suites, compression methods and the order of the extensions are
+// kept as captured, and GREASE values become GREASE placeholders. Extensions
+// whose contents depend on the connection, such as the key shares, the
+// session ticket and the padding, are regenerated when the spec is applied.
+// The pre_shared_key and early_data extensions are dropped unless KeepPSK is
+// set. Extensions uTLS does not implement, or whose contents it cannot
+// reproduce, become GenericExtensions with the captured contents, or cause an
+// error in Strict mode.
+func (f *Fingerprinter) FingerprintClientHelloBytes(handshake []byte) (*ClientHelloSpec, error) {
+	return f.fingerprintClientHello(handshake, 0)
+}
+
+// fingerprintClientHello implements FingerprintClientHelloBytes for
+// handshake, found at offset base of the caller's data, which the offsets
+// reported in errors are relative to.
+func (f *Fingerprinter) fingerprintClientHello(handshake []byte, base int) (*ClientHelloSpec, error) {
+	s := cryptobyte.String(handshake)
+	var handshakeType uint8
+	var hello cryptobyte.String
+	if !s.ReadUint8(&handshakeType) || !s.ReadUint24LengthPrefixed(&hello) {
+		return nil, errors.New("tls: unable to read the handshake message header")
+	}
+	if handshakeType != typeClientHello {
+		return nil, errors.New("tls: handshake message is not a ClientHello")
+	}
+
+	var legacyVersion uint16
+	var random, sessionID, cipherSuites, compressionMethods []byte
+	if !hello.ReadUint16(&legacyVersion) || !hello.ReadBytes(&random, 32) ||
+		!readUint8LengthPrefixed(&hello, &sessionID) ||
+		!readUint16LengthPrefixed(&hello, &cipherSuites) || len(cipherSuites)%2 != 0 ||
+		!readUint8LengthPrefixed(&hello, &compressionMethods) {
+		return nil, errors.New("tls: malformed ClientHello")
+	}
+
+	spec := &ClientHelloSpec{}
+	for c := cryptobyte.String(cipherSuites); !c.Empty(); {
+		var suite uint16
+		c.ReadUint16(&suite)
+		if isGREASEValue(suite) {
+			suite = GREASE_PLACEHOLDER
+		}
+		spec.CipherSuites = append(spec.CipherSuites, suite)
+	}
+	spec.CompressionMethods = append([]uint8{}, compressionMethods...)
+
+	if hello.Empty() {
+		// A ClientHello without extensions.
+		spec.TLSVersMin = VersionTLS10
+		spec.TLSVersMax = legacyVersion
+		return spec, nil
+	}
+
+	var extensions cryptobyte.String
+	if !hello.ReadUint16LengthPrefixed(&extensions) || !hello.Empty() {
+		return nil, errors.New("tls: malformed ClientHello extensions")
+	}
+	// The extensions block ends the ClientHello, which starts after the
+	// handshake message header.
+	helloEnd := base + len(handshake) - len(s)
+	extensionsOffset := helloEnd - len(extensions)
+	extensionsLen := len(extensions)
+
+	hasSupportedVersions := false
+	hasPadding := false
+	var unrecognized []string
+	for !extensions.Empty() {
+		offset := extensionsOffset + extensionsLen - len(extensions)
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, errors.New("tls: malformed ClientHello extensions")
+		}
+
+		switch extType {
+		case extensionPreSharedKey, extensionEarlyData:
+			if !f.KeepPSK {
+				continue
+			}
+		case extensionSupportedVersions:
+			hasSupportedVersions = true
+		case utlsExtensionPadding:
+			hasPadding = true
+		}
+
+		var ext TLSExtension
+		var err error
+		if factory := f.factories[extType]; factory != nil {
+			ext, err = factory(append([]byte{}, extData...))
+			if err != nil {
+				return nil, fmt.Errorf("tls: unable to parse extension %d: %v", extType, err)
+			}
+		}
+		if ext == nil {
+			ext, err = f.parseExtension(extType, extData)
+			if err != nil {
+				return nil, fmt.Errorf("tls: unable to parse extension %d: %v", extType, err)
+			}
+		}
+		if ext == nil {
+			if f.Strict && !(f.AllowBluntMimicry && !isKnownExtension(extType)) {
+				unrecognized = append(unrecognized, fmt.Sprintf("%d at offset %d", extType, offset))
+			}
+			ext = &GenericExtension{Id: extType, Data: append([]byte{}, extData...)}
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+	if len(unrecognized) > 0 {
+		return nil, errors.New("tls: unable to reproduce extensions " + strings.Join(unrecognized, ", "))
+	}
+
+	if !hasSupportedVersions {
+		spec.TLSVersMin = VersionTLS10
+		spec.TLSVersMax = legacyVersion
+	}
+	if f.AlwaysAddPadding && !hasPadding {
+		spec.Extensions = append(spec.Extensions, &UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle})
+	}
+	return spec, nil
+}
+
+// parseExtension returns the TLSExtension reproducing an extension of type
+// extType with body data. It returns nil if uTLS cannot reproduce it.
+func (f *Fingerprinter) parseExtension(extType uint16, data cryptobyte.String) (TLSExtension, error) {
+	if isGREASEValue(extType) {
+		return &UtlsGREASEExtension{Value: GREASE_PLACEHOLDER, Body: append([]byte{}, data...)}, nil
+	}
+
+	switch extType {
+	case extensionServerName:
+		// The name is set from the Config when the spec is applied.
+		return &SNIExtension{}, nil
+
+	case extensionStatusRequest:
+		if string(data) != "\x01\x00\x00\x00\x00" {
+			return nil, nil
+		}
+		return &StatusRequestExtension{}, nil
+
+	case utlsExtensionStatusRequestV2:
+		var items cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&items) || items.Empty() || !data.Empty() {
+			return nil, nil
+		}
+		ext := &StatusRequestV2Extension{}
+		for !items.Empty() {
+			var statusType uint8
+			var request []byte
+			if !items.ReadUint8(&statusType) || !items.ReadBytes(&request, 6) ||
+				string(request) != "\x00\x04\x00\x00\x00\x00" {
+				return nil, nil
+			}
+			ext.StatusTypes = append(ext.StatusTypes, statusType)
+		}
+		return ext, nil
+
+	case utlsExtensionCachedInfo:
+		var objs cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&objs) || objs.Empty() || !data.Empty() {
+			return nil, errors.New("malformed cached_info")
+		}
+		ext := &CachedInfoExtension{}
+		for !objs.Empty() {
+			var obj CachedObject
+			if !objs.ReadUint8((*uint8)(&obj.Type)) || !readUint8LengthPrefixed(&objs, &obj.Hash) || len(obj.Hash) == 0 {
+				return nil, errors.New("malformed cached_info")
+			}
+			obj.Hash = append([]byte{}, obj.Hash...)
+			ext.CachedObjects = append(ext.CachedObjects, obj)
+		}
+		return ext, nil
+
+	case extensionSupportedCurves:
+		var groups cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&groups) || !data.Empty() {
+			return nil, errors.New("malformed supported_groups")
+		}
+		ext := &SupportedCurvesExtension{}
+		for !groups.Empty() {
+			var group uint16
+			if !groups.ReadUint16(&group) {
+				return nil, errors.New("malformed supported_groups")
+			}
+			if isGREASEValue(group) {
+				group = GREASE_PLACEHOLDER
+			}
+			ext.Curves = append(ext.Curves, CurveID(group))
+		}
+		return ext, nil
+
+	case extensionSupportedPoints:
+		var points []byte
+		if !readUint8LengthPrefixed(&data, &points) || !data.Empty() {
+			return nil, errors.New("malformed ec_point_formats")
+		}
+		return &SupportedPointsExtension{SupportedPoints: append([]uint8{}, points...)}, nil
+
+	case extensionSignatureAlgorithms:
+		schemes, err := parseSignatureSchemeList(data)
+		if err != nil {
+			return nil, err
+		}
+		return &SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: schemes}, nil
+
+	case extensionSignatureAlgorithmsCert:
+		schemes, err := parseSignatureSchemeList(data)
+		if err != nil {
+			return nil, err
+		}
+		return &SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: schemes}, nil
+
+	case utlsExtensionDelegatedCredentials:
+		schemes, err := parseSignatureSchemeList(data)
+		if err != nil {
+			return nil, err
+		}
+		return &DelegatedCredentialsExtension{SupportedSignatureAlgorithms: schemes}, nil
+
+	case extensionALPN:
+		protocols, err := parseProtocolNameList(data)
+		if err != nil {
+			return nil, err
+		}
+		return &ALPNExtension{AlpnProtocols: protocols}, nil
+
+	case utlsExtensionApplicationSettings, utlsExtensionApplicationSettingsNew:
+		protocols, err := parseProtocolNameList(data)
+		if err != nil {
+			return nil, err
+		}
+		return &ApplicationSettingsExtension{
+			SupportedProtocols: protocols,
+			NewCodepoint:       extType == utlsExtensionApplicationSettingsNew,
+		}, nil
+
+	case extensionSCT:
+		if !data.Empty() {
+			return nil, nil
+		}
+		return &SCTExtension{}, nil
+
+	case extensionSessionTicket:
+		return &SessionTicketExtension{}, nil
+
+	case utlsExtensionPadding:
+		return &UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle}, nil
+
+	case utlsExtensionExtendedMasterSecret:
+		if !data.Empty() {
+			return nil, nil
+		}
+		return &UtlsExtendedMasterSecretExtension{}, nil
+
+	case extensionCompressCertificate:
+		var algs cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&algs) || !data.Empty() || len(algs)%2 != 0 {
+			return nil, errors.New("malformed compress_certificate")
+		}
+		ext := &CompressCertificateExtension{}
+		for !algs.Empty() {
+			var alg uint16
+			algs.ReadUint16(&alg)
+			ext.Algorithms = append(ext.Algorithms, CertCompressionAlgo(alg))
+		}
+		return ext, nil
+
+	case utlsExtensionQUICTransportParams:
+		params, err := parseQUICTransportParameters(data)
+		if err != nil {
+			return nil, err
+		}
+		return &QUICTransportParametersExtension{Parameters: params}, nil
+
+	case utlsExtensionRecordSizeLimit:
+		var limit uint16
+		if !data.ReadUint16(&limit) || !data.Empty() {
+			return nil, errors.New("malformed record_size_limit")
+		}
+		return &RecordSizeLimitExtension{Limit: limit}, nil
+
+	case extensionCertificateAuthorities:
+		var list cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&list) || !data.Empty() || list.Empty() {
+			return nil, errors.New("malformed certificate_authorities")
+		}
+		ext := &CertificateAuthoritiesExtension{}
+		for !list.Empty() {
+			var ca []byte
+			if !readUint16LengthPrefixed(&list, &ca) || len(ca) == 0 {
+				return nil, errors.New("malformed certificate_authorities")
+			}
+			ext.CertificateAuthorities = append(ext.CertificateAuthorities, append([]byte{}, ca...))
+		}
+		return ext, nil
+
+	case extensionSupportedVersions:
+		var versions cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&versions) || !data.Empty() || len(versions)%2 != 0 {
+			return nil, errors.New("malformed supported_versions")
+		}
+		ext := &SupportedVersionsExtension{}
+		for !versions.Empty() {
+			var version uint16
+			versions.ReadUint16(&version)
+			if isGREASEValue(version) {
+				version = GREASE_PLACEHOLDER
+			}
+			ext.Versions = append(ext.Versions, version)
+		}
+		return ext, nil
+
+	case extensionPSKModes:
+		var modes []byte
+		if !readUint8LengthPrefixed(&data, &modes) || !data.Empty() {
+			return nil, errors.New("malformed psk_key_exchange_modes")
+		}
+		return &PSKKeyExchangeModesExtension{Modes: append([]uint8{}, modes...)}, nil
+
+	case extensionKeyShare:
+		var shares cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&shares) || !data.Empty() {
+			return nil, errors.New("malformed key_share")
+		}
+		ext := &KeyShareExtension{}
+		for !shares.Empty() {
+			var group uint16
+			var keyExchange []byte
+			if !shares.ReadUint16(&group) || !readUint16LengthPrefixed(&shares, &keyExchange) {
+				return nil, errors.New("malformed key_share")
+			}
+			share := KeyShare{Group: CurveID(group)}
+			switch {
+			case isGREASEValue(group):
+				share.Group = GREASE_PLACEHOLDER
+				share.Data = append([]byte{}, keyExchange...)
+			case !utlsSupportedGroups[share.Group]:
+				// uTLS cannot generate a share for this group, replay it.
+				share.Data = append([]byte{}, keyExchange...)
+			}
+			ext.KeyShares = append(ext.KeyShares, share)
+		}
+		return ext, nil
+
+	case extensionCookie:
+		var cookie []byte
+		if !readUint16LengthPrefixed(&data, &cookie) || !data.Empty() {
+			return nil, errors.New("malformed cookie")
+		}
+		return &CookieExtension{Cookie: append([]byte{}, cookie...)}, nil
+
+	case extensionNextProtoNeg:
+		if !data.Empty() {
+			return nil, nil
+		}
+		return &NPNExtension{}, nil
+
+	case fakeExtensionChannelID:
+		if !data.Empty() {
+			return nil, nil
+		}
+		return &FakeChannelIDExtension{}, nil
+
+	case extensionRenegotiationInfo:
+		if string(data) != "\x00" {
+			return nil, nil
+		}
+		return &RenegotiationInfoExtension{Renegotiation: RenegotiateOnceAsClient}, nil
+
+	case utlsExtensionEncryptedClientHello:
+		// A ClientHello captured without an ECHConfig carries GREASE ECH.
+		suite, _, _, payload, err := parseECHOuterExtension(data)
+		if err != nil || len(payload) < 16 || hpkeAEADKeyLen(suite.AEADID) == 0 {
+			return nil, nil
+		}
+		return &GREASEEncryptedClientHelloExtension{
+			CandidateCipherSuites: []HPKESymmetricCipherSuite{suite},
+			CandidatePayloadLens:  []uint16{uint16(len(payload) - 16)},
+		}, nil
+	}
+	return nil, nil
+}
+
+// isKnownExtension reports whether uTLS implements extensions of type
+// extType, see Fingerprinter.parseExtension.
+func isKnownExtension(extType uint16) bool {
+	switch extType {
+	case extensionServerName, extensionStatusRequest, utlsExtensionStatusRequestV2, extensionSupportedCurves,
+		extensionSupportedPoints, extensionSignatureAlgorithms,
+		extensionSignatureAlgorithmsCert, utlsExtensionDelegatedCredentials, extensionALPN,
+		utlsExtensionApplicationSettings, utlsExtensionApplicationSettingsNew,
+		extensionSCT, extensionSessionTicket,
+		utlsExtensionPadding, utlsExtensionExtendedMasterSecret,
+		extensionCompressCertificate, utlsExtensionRecordSizeLimit,
+		utlsExtensionQUICTransportParams, extensionCertificateAuthorities, utlsExtensionCachedInfo,
+		extensionSupportedVersions, extensionPSKModes, extensionKeyShare,
+		extensionCookie, extensionNextProtoNeg, fakeExtensionChannelID,
+		extensionRenegotiationInfo, utlsExtensionEncryptedClientHello:
+		return true
+	}
+	return isGREASEValue(extType)
+}
+
+func parseSignatureSchemeList(data cryptobyte.String) ([]SignatureScheme, error) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) || !data.Empty() || len(list)%2 != 0 {
+		return nil, errors.New("malformed signature scheme list")
+	}
+	var schemes []SignatureScheme
+	for !list.Empty() {
+		var scheme uint16
+		list.ReadUint16(&scheme)
+		schemes = append(schemes, SignatureScheme(scheme))
+	}
+	return schemes, nil
+}
+
+// parseProtocolNameList parses an ALPN ProtocolNameList. An empty list is
+// returned as a non-nil empty slice.
+func parseProtocolNameList(data cryptobyte.String) ([]string, error) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) || !data.Empty() {
+		return nil, errors.New("malformed protocol name list")
+	}
+	protocols := []string{}
+	for !list.Empty() {
+		var proto cryptobyte.String
+		if !list.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+			return nil, errors.New("malformed protocol name list")
+		}
+		protocols = append(protocols, string(proto))
+	}
+	return protocols, nil
+}
@@ -0,0 +1,365 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// clientHelloRecord wraps a ClientHello handshake message in a TLS record.
+func clientHelloRecord(hello []byte) []byte {
+	return append([]byte{byte(recordTypeHandshake), 0x03, 0x01, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+}
+
+// clientHelloExtension returns the body of the extension of type extType in
+// a marshaled ClientHello, and whether it is present.
+func clientHelloExtension(t *testing.T, raw []byte, extType uint16) ([]byte, bool) {
+	s := cryptobyte.String(raw[4:])
+	var random, sessionID, ciphers, compression, extensions cryptobyte.String
+	var vers uint16
+	if !s.ReadUint16(&vers) || !s.ReadBytes((*[]byte)(&random), 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&compression) || !s.ReadUint16LengthPrefixed(&extensions) {
+		t.Fatal("malformed ClientHello")
+	}
+	for !extensions.Empty() {
+		var id uint16
+		var body cryptobyte.String
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&body) {
+			t.Fatal("malformed ClientHello extensions")
+		}
+		if id == extType {
+			return body, true
+		}
+	}
+	return nil, false
+}
+
+// fingerprintAndRebuild fingerprints the ClientHello hello, sent to
+// example.com, and marshals a new ClientHello from the resulting spec with the
+// same random and session ID.
+func fingerprintAndRebuild(t *testing.T, f *Fingerprinter, hello []byte) (*ClientHelloSpec, []byte) {
+	spec, err := f.FingerprintClientHello(clientHelloRecord(hello))
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := hello[4+2 : 4+2+32]
+	sessionID := hello[4+2+32+1 : 4+2+32+1+int(hello[4+2+32])]
+
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.SetClientRandom(random); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.SetLegacySessionID(sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	return spec, uconn.HandshakeState.Hello.Raw
+}
+
+func TestFingerprintClientHelloChrome(t *testing.T) {
+	hello := captureUTLSClientHello(t, HelloChrome_113)
+	spec, raw := fingerprintAndRebuild(t, &Fingerprinter{}, hello)
+
+	alpn, ok := spec.Extensions[7].(*ALPNExtension)
+	if !ok {
+		t.Fatalf("expected an ALPNExtension, got %T", spec.Extensions[7])
+	}
+	if want := []string{"h2", "http/1.1"}; !reflect.DeepEqual(alpn.AlpnProtocols, want) {
+		t.Errorf("ALPN protocols = %q, want %q", alpn.AlpnProtocols, want)
+	}
+
+	want, _ := clientHelloExtension(t, hello, extensionALPN)
+	got, ok := clientHelloExtension(t, raw, extensionALPN)
+	if !ok || !bytes.Equal(got, want) {
+		t.Errorf("re-marshaled ALPN extension %x, want %x", got, want)
+	}
+
+	normalize := func(ids []uint16) []uint16 {
+		for i, id := range ids {
+			if isGREASEValue(id) {
+				ids[i] = GREASE_PLACEHOLDER
+			}
+		}
+		return ids
+	}
+	if got, want := normalize(clientHelloExtensionIDs(t, raw)), normalize(clientHelloExtensionIDs(t, hello)); !reflect.DeepEqual(got, want) {
+		t.Errorf("extensions = %v, want %v", got, want)
+	}
+}
+
+func TestFingerprintClientHelloRoundTrip(t *testing.T) {
+	for _, protocols := range [][]string{{"h2", "http/1.1"}, {}, nil} {
+		extensions := []TLSExtension{
+			&SNIExtension{},
+			&UtlsExtendedMasterSecretExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{X25519, CurveP256}},
+			&SupportedPointsExtension{SupportedPoints: []uint8{pointFormatUncompressed}},
+		}
+		if protocols != nil {
+			extensions = append(extensions, &ALPNExtension{AlpnProtocols: protocols})
+		}
+		extensions = append(extensions,
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256, PSSWithSHA256}},
+			&RecordSizeLimitExtension{Limit: 0x4001},
+			&GenericExtension{Id: 0x1234, Data: []byte{1, 2, 3}},
+		)
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_AES_128_GCM_SHA256},
+			Extensions:   extensions,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		hello := uconn.HandshakeState.Hello.Raw
+
+		spec, raw := fingerprintAndRebuild(t, &Fingerprinter{}, hello)
+		if !bytes.Equal(raw, hello) {
+			t.Errorf("ALPN %q: re-marshaled ClientHello differs:\n got %x\nwant %x", protocols, raw, hello)
+		}
+
+		var alpn *ALPNExtension
+		for _, ext := range spec.Extensions {
+			if ext, ok := ext.(*ALPNExtension); ok {
+				alpn = ext
+			}
+		}
+		switch {
+		case protocols == nil && alpn != nil:
+			t.Errorf("got an ALPNExtension for a ClientHello without ALPN")
+		case protocols != nil && (alpn == nil || alpn.AlpnProtocols == nil || !reflect.DeepEqual(alpn.AlpnProtocols, protocols)):
+			t.Errorf("ALPN %q: got %#v", protocols, alpn)
+		}
+	}
+}
+
+// vendorExtension is a vendor-specific extension carrying a single level
+// byte, parsed with a factory registered with the Fingerprinter.
+type vendorExtension struct {
+	GenericExtension
+	Level uint8
+}
+
+func (e *vendorExtension) Len() int { return 5 }
+
+func (e *vendorExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	copy(b, []byte{0xfe, 0x01, 0x00, 0x01, e.Level})
+	return e.Len(), io.EOF
+}
+
+func TestFingerprintClientHelloRegisterExtension(t *testing.T) {
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(&ClientHelloSpec{
+		CipherSuites: []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&GenericExtension{Id: 0xfe01, Data: []byte{7}},
+			&GenericExtension{Id: 0xfe02, Data: []byte{1, 2}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello := uconn.HandshakeState.Hello.Raw
+
+	f := &Fingerprinter{Strict: true}
+	f.RegisterExtension(0xfe01, func(data []byte) (TLSExtension, error) {
+		if len(data) != 1 {
+			return nil, fmt.Errorf("vendor extension of %d bytes", len(data))
+		}
+		return &vendorExtension{Level: data[0]}, nil
+	})
+	// A factory declining the extension leaves it to the fallback, which
+	// Strict refuses.
+	f.RegisterExtension(0xfe02, func([]byte) (TLSExtension, error) { return nil, nil })
+	if _, err := f.FingerprintClientHello(clientHelloRecord(hello)); err == nil || !strings.Contains(err.Error(), "65026") {
+		t.Errorf("Strict fingerprinting with a declined extension: %v", err)
+	}
+
+	f.RegisterExtension(0xfe02, func(data []byte) (TLSExtension, error) {
+		return &GenericExtension{Id: 0xfe02, Data: data}, nil
+	})
+	spec, raw := fingerprintAndRebuild(t, f, hello)
+	if !bytes.Equal(raw, hello) {
+		t.Errorf("re-marshaled ClientHello differs:\n got %x\nwant %x", raw, hello)
+	}
+	if ext, ok := spec.Extensions[1].(*vendorExtension); !ok || ext.Level != 7 {
+		t.Errorf("extension parsed as %#v, want a vendorExtension with level 7", spec.Extensions[1])
+	}
+
+	f.RegisterExtension(0xfe01, func([]byte) (TLSExtension, error) { return nil, errors.New("bad level") })
+	if _, err := f.FingerprintClientHello(clientHelloRecord(hello)); err == nil || !strings.Contains(err.Error(), "bad level") {
+		t.Errorf("factory error not returned: %v", err)
+	}
+}
+
+func TestFingerprintClientHelloMalformed(t *testing.T) {
+	hello := captureUTLSClientHello(t, HelloChrome_113)
+	record := clientHelloRecord(hello)
+	for _, data := range [][]byte{
+		nil,
+		record[:3],
+		record[:len(record)-1],
+		append([]byte{byte(recordTypeApplicationData)}, record[1:]...),
+	} {
+		if _, err := (&Fingerprinter{}).FingerprintClientHello(data); err == nil {
+			t.Errorf("%x: expected an error", data)
+		}
+	}
+	for _, data := range [][]byte{
+		nil,
+		hello[:3],
+		hello[:len(hello)-1],
+		record,
+	} {
+		if _, err := (&Fingerprinter{}).FingerprintClientHelloBytes(data); err == nil {
+			t.Errorf("%x: expected an error from FingerprintClientHelloBytes", data)
+		}
+	}
+}
+
+func TestFingerprintClientHelloBytes(t *testing.T) {
+	hello := captureUTLSClientHello(t, HelloChrome_124)
+	fromRecord, err := (&Fingerprinter{}).FingerprintClientHello(clientHelloRecord(hello))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBytes, err := (&Fingerprinter{}).FingerprintClientHelloBytes(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromBytes.CipherSuites, fromRecord.CipherSuites) ||
+		fromBytes.TLSVersMax != fromRecord.TLSVersMax || len(fromBytes.Extensions) != len(fromRecord.Extensions) {
+		t.Fatalf("specs differ:\n%+v\n%+v", fromBytes, fromRecord)
+	}
+	for i := range fromBytes.Extensions {
+		if a, b := reflect.TypeOf(fromBytes.Extensions[i]), reflect.TypeOf(fromRecord.Extensions[i]); a != b {
+			t.Errorf("extension %d is a %v from the handshake message, a %v from the record", i, a, b)
+		}
+	}
+}
+
+func TestFingerprintClientHelloStrict(t *testing.T) {
+	unknown := &GenericExtension{Id: 0x1234, Data: []byte{1, 2, 3}}
+	// A status_request naming OCSP responders, which StatusRequestExtension
+	// cannot reproduce.
+	statusRequest := &GenericExtension{Id: extensionStatusRequest, Data: []byte{1, 0, 2, 0, 0, 0, 0}}
+
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(&ClientHelloSpec{
+		CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+		Extensions:   []TLSExtension{&SNIExtension{}, unknown, statusRequest},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	record := clientHelloRecord(uconn.HandshakeState.Hello.Raw)
+	unknownOffset := bytes.Index(record, []byte{0x12, 0x34, 0x00, 0x03, 1, 2, 3})
+	statusRequestOffset := bytes.Index(record, []byte{0x00, 0x05, 0x00, 0x07, 1, 0, 2})
+
+	if _, err := (&Fingerprinter{}).FingerprintClientHello(record); err != nil {
+		t.Errorf("default mode: %v", err)
+	}
+
+	_, err := (&Fingerprinter{Strict: true}).FingerprintClientHello(record)
+	if err == nil {
+		t.Fatal("strict mode: expected an error")
+	}
+	for _, want := range []string{
+		fmt.Sprintf("4660 at offset %d", unknownOffset),
+		fmt.Sprintf("5 at offset %d", statusRequestOffset),
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("strict mode: error %q does not mention %q", err, want)
+		}
+	}
+
+	_, err = (&Fingerprinter{Strict: true, AllowBluntMimicry: true}).FingerprintClientHello(record)
+	if err == nil {
+		t.Fatal("strict mode with blunt mimicry: expected an error")
+	}
+	if strings.Contains(err.Error(), "4660") || !strings.Contains(err.Error(), "5 at offset") {
+		t.Errorf("strict mode with blunt mimicry: unexpected error %q", err)
+	}
+
+	// Offsets are relative to the handshake message without a record.
+	_, err = (&Fingerprinter{Strict: true}).FingerprintClientHelloBytes(uconn.HandshakeState.Hello.Raw)
+	if want := fmt.Sprintf("4660 at offset %d", unknownOffset-recordHeaderLen); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("strict mode without a record: error %v does not mention %q", err, want)
+	}
+}
+
+func TestFingerprintClientHelloGREASEPerList(t *testing.T) {
+	build := func(spec *ClientHelloSpec) []byte {
+		config := &Config{ServerName: "example.com", Rand: mathrand.New(mathrand.NewSource(1))}
+		uconn := UClient(&net.TCPConn{}, config, HelloCustom)
+		if err := uconn.ApplyPreset(spec); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		return uconn.HandshakeState.Hello.Raw
+	}
+
+	for _, greaseKeyShare := range []bool{false, true} {
+		curves := []CurveID{GREASE_PLACEHOLDER, X25519, CurveP256}
+		keyShares := []KeyShare{{Group: X25519}}
+		if greaseKeyShare {
+			// The opposite pattern: GREASE in key_share only.
+			curves = curves[1:]
+			keyShares = append([]KeyShare{{Group: GREASE_PLACEHOLDER, Data: []byte{0}}}, keyShares...)
+		}
+		hello := build(&ClientHelloSpec{
+			CipherSuites: []uint16{GREASE_PLACEHOLDER, TLS_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&UtlsGREASEExtension{},
+				&SNIExtension{},
+				&SupportedCurvesExtension{Curves: curves},
+				&KeyShareExtension{KeyShares: keyShares},
+				&SupportedVersionsExtension{Versions: []uint16{VersionTLS13, VersionTLS12}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{ECDSAWithP256AndSHA256}},
+				&UtlsGREASEExtension{Body: []byte{}},
+			},
+		})
+
+		if last := hello[len(hello)-4:]; !isGREASEValue(uint16(last[0])<<8|uint16(last[1])) || last[2] != 0 || last[3] != 0 {
+			t.Fatalf("expected the ClientHello to end with an empty GREASE extension, got %x", last)
+		}
+
+		spec, err := (&Fingerprinter{}).FingerprintClientHello(clientHelloRecord(hello))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw := build(spec); !bytes.Equal(raw, hello) {
+			t.Errorf("GREASE key share %v: rebuilt ClientHello differs:\n got %x\nwant %x", greaseKeyShare, raw, hello)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// This file implements the subset of Hybrid Public Key Encryption (RFC 9180)
+// needed by Encrypted Client Hello: the base mode with DHKEM(X25519), the
+// HKDF-SHA2 family and the AEADs registered for TLS.
+
+// HPKE algorithm identifiers, see RFC 9180, Section 7.
+const (
+	HPKE_KEM_X25519_HKDF_SHA256 uint16 = 0x0020
+
+	HPKE_KDF_HKDF_SHA256 uint16 = 0x0001
+	HPKE_KDF_HKDF_SHA384 uint16 = 0x0002
+	HPKE_KDF_HKDF_SHA512 uint16 = 0x0003
+
+	HPKE_AEAD_AES_128_GCM       uint16 = 0x0001
+	HPKE_AEAD_AES_256_GCM       uint16 = 0x0002
+	HPKE_AEAD_CHACHA20_POLY1305 uint16 = 0x0003
+)
+
+const hpkeModeBase uint8 = 0x00
+
+// HPKESymmetricCipherSuite is a KDF and AEAD pair, as found in
+// ECHConfig.CipherSuites.
+type HPKESymmetricCipherSuite struct {
+	KDFID  uint16
+	AEADID uint16
+}
+
+func hpkeKDFHash(kdfID uint16) (crypto.Hash, bool) {
+	switch kdfID {
+	case HPKE_KDF_HKDF_SHA256:
+		return crypto.SHA256, true
+	case HPKE_KDF_HKDF_SHA384:
+		return crypto.SHA384, true
+	case HPKE_KDF_HKDF_SHA512:
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// hpkeAEADKeyLen returns Nk for the given AEAD, or zero if it is unsupported.
+func hpkeAEADKeyLen(aeadID uint16) int {
+	switch aeadID {
+	case HPKE_AEAD_AES_128_GCM:
+		return 16
+	case HPKE_AEAD_AES_256_GCM, HPKE_AEAD_CHACHA20_POLY1305:
+		return 32
+	}
+	return 0
+}
+
+func hpkeSupportsSuite(kemID uint16, suite HPKESymmetricCipherSuite) bool {
+	if kemID != HPKE_KEM_X25519_HKDF_SHA256 {
+		return false
+	}
+	_, ok := hpkeKDFHash(suite.KDFID)
+	return ok && hpkeAEADKeyLen(suite.AEADID) != 0
+}
+
+// hpkeKDF implements LabeledExtract and LabeledExpand for a given suite_id.
+type hpkeKDF struct {
+	hash    crypto.Hash
+	suiteID []byte
+}
+
+func (k hpkeKDF) labeledExtract(salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := make([]byte, 0, 7+len(k.suiteID)+len(label)+len(ikm))
+	labeledIKM = append(labeledIKM, "HPKE-v1"...)
+	labeledIKM = append(labeledIKM, k.suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(k.hash.New, labeledIKM, salt)
+}
+
+func (k hpkeKDF) labeledExpand(prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := make([]byte, 2, 2+7+len(k.suiteID)+len(label)+len(info))
+	binary.BigEndian.PutUint16(labeledInfo, uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, k.suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(k.hash.New, prk, labeledInfo), out); err != nil {
+		panic("tls: HPKE LabeledExpand invocation failed unexpectedly")
+	}
+	return out
+}
+
+var hpkeKEMX25519 = hpkeKDF{hash: crypto.SHA256, suiteID: []byte{'K', 'E', 'M', 0x00, 0x20}}
+
+// hpkeX25519Encap implements Encap for DHKEM(X25519, HKDF-SHA256). The
+// ephemeral private key is read from rand.
+func hpkeX25519Encap(rand io.Reader, pkR []byte) (sharedSecret, enc []byte, err error) {
+	skE := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand, skE); err != nil {
+		return nil, nil, err
+	}
+	enc, err = curve25519.X25519(skE, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hpkeX25519ExtractAndExpand(dh, enc, pkR), enc, nil
+}
+
+// hpkeX25519Decap implements Decap for DHKEM(X25519, HKDF-SHA256).
+func hpkeX25519Decap(enc, skR []byte) ([]byte, error) {
+	dh, err := curve25519.X25519(skR, enc)
+	if err != nil {
+		return nil, err
+	}
+	pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeX25519ExtractAndExpand(dh, enc, pkR), nil
+}
+
+func hpkeX25519ExtractAndExpand(dh, enc, pkR []byte) []byte {
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	eaePRK := hpkeKEMX25519.labeledExtract(nil, "eae_prk", dh)
+	return hpkeKEMX25519.labeledExpand(eaePRK, "shared_secret", kemContext, 32)
+}
+
+// hpkeContext is an HPKE encryption context, see RFC 9180, Section 5.2.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	seq            uint64
+	exporterSecret []byte
+	kdf            hpkeKDF
+}
+
+func newHPKEContext(kemID uint16, suite HPKESymmetricCipherSuite, sharedSecret, info []byte) (*hpkeContext, error) {
+	h, ok := hpkeKDFHash(suite.KDFID)
+	if !ok {
+		return nil, fmt.Errorf("tls: unsupported HPKE KDF %#04x", suite.KDFID)
+	}
+	keyLen := hpkeAEADKeyLen(suite.AEADID)
+	if keyLen == 0 {
+		return nil, fmt.Errorf("tls: unsupported HPKE AEAD %#04x", suite.AEADID)
+	}
+
+	var b cryptobyte.Builder
+	b.AddBytes([]byte("HPKE"))
+	b.AddUint16(kemID)
+	b.AddUint16(suite.KDFID)
+	b.AddUint16(suite.AEADID)
+	kdf := hpkeKDF{hash: h, suiteID: b.BytesOrPanic()}
+
+	pskIDHash := kdf.labeledExtract(nil, "psk_id_hash", nil)
+	infoHash := kdf.labeledExtract(nil, "info_hash", info)
+	keyScheduleContext := append([]byte{hpkeModeBase}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+
+	secret := kdf.labeledExtract(sharedSecret, "secret", nil)
+	key := kdf.labeledExpand(secret, "key", keyScheduleContext, keyLen)
+
+	var aead cipher.AEAD
+	var err error
+	switch suite.AEADID {
+	case HPKE_AEAD_AES_128_GCM, HPKE_AEAD_AES_256_GCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case HPKE_AEAD_CHACHA20_POLY1305:
+		aead, err = chacha20poly1305.New(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      kdf.labeledExpand(secret, "base_nonce", keyScheduleContext, aead.NonceSize()),
+		exporterSecret: kdf.labeledExpand(secret, "exp", keyScheduleContext, h.Size()),
+		kdf:            kdf,
+	}, nil
+}
+
+// hpkeSetupBaseSender implements SetupBaseS, returning the encapsulated key
+// and the sender context.
+func hpkeSetupBaseSender(rand io.Reader, kemID uint16, suite HPKESymmetricCipherSuite, pkR, info []byte) ([]byte, *hpkeContext, error) {
+	if kemID != HPKE_KEM_X25519_HKDF_SHA256 {
+		return nil, nil, fmt.Errorf("tls: unsupported HPKE KEM %#04x", kemID)
+	}
+	sharedSecret, enc, err := hpkeX25519Encap(rand, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err := newHPKEContext(kemID, suite, sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// hpkeSetupBaseReceiver implements SetupBaseR.
+func hpkeSetupBaseReceiver(kemID uint16, suite HPKESymmetricCipherSuite, enc, skR, info []byte) (*hpkeContext, error) {
+	if kemID != HPKE_KEM_X25519_HKDF_SHA256 {
+		return nil, fmt.Errorf("tls: unsupported HPKE KEM %#04x", kemID)
+	}
+	sharedSecret, err := hpkeX25519Decap(enc, skR)
+	if err != nil {
+		return nil, err
+	}
+	return newHPKEContext(kemID, suite, sharedSecret, info)
+}
+
+func (ctx *hpkeContext) nextNonce() []byte {
+	nonce := make([]byte, len(ctx.baseNonce))
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], ctx.seq)
+	for i := range nonce {
+		nonce[i] ^= ctx.baseNonce[i]
+	}
+	ctx.seq++
+	return nonce
+}
+
+func (ctx *hpkeContext) seal(aad, plaintext []byte) []byte {
+	return ctx.aead.Seal(nil, ctx.nextNonce(), plaintext, aad)
+}
+
+func (ctx *hpkeContext) open(aad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := ctx.aead.Open(nil, ctx.nextNonce(), ciphertext, aad)
+	if err != nil {
+		ctx.seq--
+		return nil, errors.New("tls: HPKE decryption failed")
+	}
+	return plaintext, nil
+}
+
+// export implements the secret export interface, see RFC 9180, Section 5.3.
+func (ctx *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return ctx.kdf.labeledExpand(ctx.exporterSecret, "sec", exporterContext, length)
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestHPKEVectors checks the base mode against RFC 9180, Appendix A.1.1,
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM.
+func TestHPKEVectors(t *testing.T) {
+	info := fromHex("4f6465206f6e2061204772656369616e2055726e")
+	skEm := fromHex("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736")
+	pkRm := fromHex("3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	skRm := fromHex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+	wantEnc := fromHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	wantSharedSecret := fromHex("fe0e18c9f024ce43799ae393c7e8fe8fce9d218875e8227b0187c04e7d2ea1fc")
+	wantBaseNonce := fromHex("56d890e5accaaf011cff4b7d")
+	wantExporterSecret := fromHex("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8")
+	suite := HPKESymmetricCipherSuite{KDFID: HPKE_KDF_HKDF_SHA256, AEADID: HPKE_AEAD_AES_128_GCM}
+
+	sharedSecret, enc, err := hpkeX25519Encap(bytes.NewReader(skEm), pkRm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enc, wantEnc) {
+		t.Errorf("enc = %x, want %x", enc, wantEnc)
+	}
+	if !bytes.Equal(sharedSecret, wantSharedSecret) {
+		t.Errorf("shared_secret = %x, want %x", sharedSecret, wantSharedSecret)
+	}
+
+	enc, sender, err := hpkeSetupBaseSender(bytes.NewReader(skEm), HPKE_KEM_X25519_HKDF_SHA256, suite, pkRm, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := hpkeSetupBaseReceiver(HPKE_KEM_X25519_HKDF_SHA256, suite, enc, skRm, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []*hpkeContext{sender, receiver} {
+		if !bytes.Equal(ctx.baseNonce, wantBaseNonce) {
+			t.Errorf("base_nonce = %x, want %x", ctx.baseNonce, wantBaseNonce)
+		}
+		if !bytes.Equal(ctx.exporterSecret, wantExporterSecret) {
+			t.Errorf("exporter_secret = %x, want %x", ctx.exporterSecret, wantExporterSecret)
+		}
+	}
+
+	pt := fromHex("4265617574792069732074727574682c20747275746820626561757479")
+	for _, tc := range []struct {
+		aad, ct string
+	}{
+		{"436f756e742d30", "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"},
+		{"436f756e742d31", "af2d7e9ac9ae7e270f46ba1f975be53c09f8d875bdc8535458c2494e8a6eab251c03d0c22a56b8ca42c2063b84"},
+	} {
+		aad, wantCT := fromHex(tc.aad), fromHex(tc.ct)
+		ct := sender.seal(aad, pt)
+		if !bytes.Equal(ct, wantCT) {
+			t.Errorf("seq %d: ct = %x, want %x", sender.seq-1, ct, wantCT)
+		}
+		got, err := receiver.open(aad, ct)
+		if err != nil {
+			t.Fatalf("seq %d: %v", receiver.seq, err)
+		}
+		if !bytes.Equal(got, pt) {
+			t.Errorf("seq %d: opened %x, want %x", receiver.seq-1, got, pt)
+		}
+	}
+
+	if _, err := receiver.open([]byte("Count-2"), sender.seal([]byte("Count-3"), pt)); err == nil {
+		t.Error("open succeeded with a mismatched aad")
+	}
+
+	for _, tc := range []struct {
+		context, value string
+	}{
+		{"", "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"},
+		{"00", "2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5"},
+		{"54657374436f6e74657874", "e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931"},
+	} {
+		want := fromHex(tc.value)
+		if got := sender.export(fromHex(tc.context), 32); !bytes.Equal(got, want) {
+			t.Errorf("export(%q) = %x, want %x", tc.context, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import "golang.org/x/net/http2"
+
+// HTTP/2 SETTINGS sent by the mimicked browsers in their connection preface,
+// in the order they send them.
+var (
+	http2SettingsChrome = []http2.Setting{
+		{ID: http2.SettingHeaderTableSize, Val: 65536},
+		{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+		{ID: http2.SettingInitialWindowSize, Val: 6291456},
+		{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+	}
+	// Chrome 106 and later also disable server push.
+	http2SettingsChrome106 = []http2.Setting{
+		{ID: http2.SettingHeaderTableSize, Val: 65536},
+		{ID: http2.SettingEnablePush, Val: 0},
+		{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+		{ID: http2.SettingInitialWindowSize, Val: 6291456},
+		{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+	}
+	// Chrome 116 and later no longer send SETTINGS_MAX_CONCURRENT_STREAMS.
+	http2SettingsChrome116 = []http2.Setting{
+		{ID: http2.SettingHeaderTableSize, Val: 65536},
+		{ID: http2.SettingEnablePush, Val: 0},
+		{ID: http2.SettingInitialWindowSize, Val: 6291456},
+		{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+	}
+	http2SettingsFirefox = []http2.Setting{
+		{ID: http2.SettingHeaderTableSize, Val: 65536},
+		{ID: http2.SettingInitialWindowSize, Val: 131072},
+		{ID: http2.SettingMaxFrameSize, Val: 16384},
+	}
+	http2SettingsFirefox128 = []http2.Setting{
+		{ID: http2.SettingHeaderTableSize, Val: 65536},
+		{ID: http2.SettingEnablePush, Val: 0},
+		{ID: http2.SettingInitialWindowSize, Val: 131072},
+		{ID: http2.SettingMaxFrameSize, Val: 16384},
+	}
+	http2SettingsSafari = []http2.Setting{
+		{ID: http2.SettingInitialWindowSize, Val: 4194304},
+		{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+	}
+	// Safari 17 also disables server push and RFC 7540 priorities
+	// (SETTINGS_NO_RFC7540_PRIORITIES, RFC 9218).
+	http2SettingsSafari17 = []http2.Setting{
+		{ID: http2.SettingEnablePush, Val: 0},
+		{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+		{ID: http2.SettingInitialWindowSize, Val: 2097152},
+		{ID: 0x9, Val: 1},
+	}
+)
+
+// Increments of the connection flow-control window the mimicked browsers send
+// in a WINDOW_UPDATE frame right after their SETTINGS, and the order of the
+// pseudo-header fields of their requests.
+const (
+	http2WindowUpdateChrome   = 15663105
+	http2WindowUpdateFirefox  = 12517377
+	http2WindowUpdateSafari   = 10485760
+	http2WindowUpdateSafari17 = 10420225
+)
+
+var (
+	http2HeaderOrderChrome  = []string{":method", ":authority", ":scheme", ":path"}
+	http2HeaderOrderFirefox = []string{":method", ":path", ":authority", ":scheme"}
+	http2HeaderOrderSafari  = []string{":method", ":scheme", ":path", ":authority"}
+	// Safari 17 moved :authority before :path.
+	http2HeaderOrderSafari17 = []string{":method", ":scheme", ":authority", ":path"}
+)
+
+// http2Fingerprint is the HTTP/2 behaviour of a browser that fingerprinting
+// servers look at, besides its ClientHello.
+type http2Fingerprint struct {
+	settings     []http2.Setting
+	windowUpdate uint32
+	headerOrder  []string
+}
+
+// http2FingerprintFor returns the HTTP/2 fingerprint of the browser mimicked
+// by id, and false if id does not mimic a browser.
+func http2FingerprintFor(id ClientHelloID) (http2Fingerprint, bool) {
+	switch resolveClientHelloID(id) {
+	case HelloChrome_58, HelloChrome_62, HelloChrome_70, HelloChrome_72, HelloChrome_83,
+		HelloChrome_100, HelloChrome_103, HelloOpera_89:
+		return http2Fingerprint{http2SettingsChrome, http2WindowUpdateChrome, http2HeaderOrderChrome}, true
+	case HelloChrome_113:
+		return http2Fingerprint{http2SettingsChrome106, http2WindowUpdateChrome, http2HeaderOrderChrome}, true
+	case HelloChrome_120, HelloChrome_124, HelloChrome_Shuffle, HelloEdge_122:
+		return http2Fingerprint{http2SettingsChrome116, http2WindowUpdateChrome, http2HeaderOrderChrome}, true
+	case HelloFirefox_55, HelloFirefox_56, HelloFirefox_63, HelloFirefox_65, HelloFirefox_102:
+		return http2Fingerprint{http2SettingsFirefox, http2WindowUpdateFirefox, http2HeaderOrderFirefox}, true
+	case HelloFirefox_128, HelloFirefox_128_Kyber, HelloFirefox_Tor:
+		return http2Fingerprint{http2SettingsFirefox128, http2WindowUpdateFirefox, http2HeaderOrderFirefox}, true
+	case HelloIOS_11_1, HelloIOS_12_1, HelloIOS_15_5, HelloSafari_15_3, HelloSafari_15_5:
+		return http2Fingerprint{http2SettingsSafari, http2WindowUpdateSafari, http2HeaderOrderSafari}, true
+	case HelloSafari_iOS_17_0:
+		return http2Fingerprint{http2SettingsSafari17, http2WindowUpdateSafari17, http2HeaderOrderSafari17}, true
+	}
+	return http2Fingerprint{}, false
+}
+
+// HTTP2Settings returns the SETTINGS the browser mimicked by id sends in its
+// HTTP/2 connection preface, in the order it sends them, so that an HTTP/2
+// client running over the UConn can match the TLS fingerprint. It returns
+// nil for ClientHelloIDs that do not mimic a browser.
+func (id ClientHelloID) HTTP2Settings() []http2.Setting {
+	settings, _, _, _ := HTTP2SettingsForClientHello(id)
+	return settings
+}
+
+// HTTP2SettingsForClientHello returns the HTTP/2 fingerprint of the browser
+// mimicked by id: the SETTINGS of its connection preface in the order it
+// sends them, the increment of the WINDOW_UPDATE frame it sends on stream 0
+// right after them, and the order of the pseudo-header fields of its
+// requests. ok is false for ClientHelloIDs that do not mimic a browser, such
+// as HelloGolang or HelloRandomized.
+//
+// The returned slices may be modified by the caller.
+func HTTP2SettingsForClientHello(id ClientHelloID) (settings []http2.Setting, windowUpdate uint32, headerOrder []string, ok bool) {
+	fp, ok := http2FingerprintFor(id)
+	if !ok {
+		return nil, 0, nil, false
+	}
+	settings = append([]http2.Setting(nil), fp.settings...)
+	headerOrder = append([]string(nil), fp.headerOrder...)
+	return settings, fp.windowUpdate, headerOrder, true
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2Settings(t *testing.T) {
+	for _, test := range []struct {
+		id    ClientHelloID
+		order []http2.SettingID
+	}{
+		{HelloChrome_Auto, []http2.SettingID{
+			http2.SettingHeaderTableSize, http2.SettingEnablePush,
+			http2.SettingInitialWindowSize, http2.SettingMaxHeaderListSize,
+		}},
+		{HelloChrome_113, []http2.SettingID{
+			http2.SettingHeaderTableSize, http2.SettingEnablePush, http2.SettingMaxConcurrentStreams,
+			http2.SettingInitialWindowSize, http2.SettingMaxHeaderListSize,
+		}},
+		{HelloChrome_83, []http2.SettingID{
+			http2.SettingHeaderTableSize, http2.SettingMaxConcurrentStreams,
+			http2.SettingInitialWindowSize, http2.SettingMaxHeaderListSize,
+		}},
+		{HelloFirefox_Auto, []http2.SettingID{
+			http2.SettingHeaderTableSize, http2.SettingEnablePush,
+			http2.SettingInitialWindowSize, http2.SettingMaxFrameSize,
+		}},
+		{HelloSafari_Auto, []http2.SettingID{
+			http2.SettingInitialWindowSize, http2.SettingMaxConcurrentStreams,
+		}},
+		{ClientHelloID{helloChrome, helloAutoVers, nil}, []http2.SettingID{
+			http2.SettingHeaderTableSize, http2.SettingEnablePush,
+			http2.SettingInitialWindowSize, http2.SettingMaxHeaderListSize,
+		}},
+		{HelloGolang, nil},
+		{HelloRandomized, nil},
+	} {
+		settings := test.id.HTTP2Settings()
+		if len(settings) != len(test.order) {
+			t.Errorf("%s: settings %v, want the IDs %v", test.id.Str(), settings, test.order)
+			continue
+		}
+		for i, s := range settings {
+			if s.ID != test.order[i] {
+				t.Errorf("%s: setting %d is %v, want %v", test.id.Str(), i, s.ID, test.order[i])
+			}
+			if err := s.Valid(); err != nil {
+				t.Errorf("%s: %v", test.id.Str(), err)
+			}
+		}
+	}
+
+	// Callers may modify the returned settings.
+	HelloChrome_Auto.HTTP2Settings()[0].Val = 0
+	if HelloChrome_Auto.HTTP2Settings()[0].Val == 0 {
+		t.Error("HTTP2Settings returned a shared slice")
+	}
+}
+
+func TestHTTP2SettingsForClientHello(t *testing.T) {
+	for _, test := range []struct {
+		id           ClientHelloID
+		windowUpdate uint32
+		headerOrder  string
+	}{
+		{HelloChrome_Auto, 15663105, ":method :authority :scheme :path"},
+		{HelloChrome_83, 15663105, ":method :authority :scheme :path"},
+		{HelloFirefox_Auto, 12517377, ":method :path :authority :scheme"},
+		{HelloSafari_15_5, 10485760, ":method :scheme :path :authority"},
+		{HelloSafari_iOS_17_0, 10420225, ":method :scheme :authority :path"},
+	} {
+		settings, windowUpdate, headerOrder, ok := HTTP2SettingsForClientHello(test.id)
+		if !ok {
+			t.Errorf("%s: no HTTP/2 fingerprint", test.id.Str())
+			continue
+		}
+		if len(settings) != len(test.id.HTTP2Settings()) {
+			t.Errorf("%s: settings %v do not match HTTP2Settings", test.id.Str(), settings)
+		}
+		if windowUpdate != test.windowUpdate {
+			t.Errorf("%s: WINDOW_UPDATE increment %d, want %d", test.id.Str(), windowUpdate, test.windowUpdate)
+		}
+		if got := strings.Join(headerOrder, " "); got != test.headerOrder {
+			t.Errorf("%s: pseudo-header order %q, want %q", test.id.Str(), got, test.headerOrder)
+		}
+	}
+
+	for _, id := range []ClientHelloID{HelloGolang, HelloRandomized, HelloChrome_H3} {
+		if settings, windowUpdate, headerOrder, ok := HTTP2SettingsForClientHello(id); ok || settings != nil || windowUpdate != 0 || headerOrder != nil {
+			t.Errorf("%s: unexpected HTTP/2 fingerprint", id.Str())
+		}
+	}
+
+	_, _, headerOrder, _ := HTTP2SettingsForClientHello(HelloFirefox_Auto)
+	headerOrder[0] = ""
+	if _, _, headerOrder, _ := HTTP2SettingsForClientHello(HelloFirefox_Auto); headerOrder[0] == "" {
+		t.Error("HTTP2SettingsForClientHello returned a shared slice")
+	}
+}
+
+// akamaiHTTP2 formats the HTTP/2 fingerprint of id the way the Akamai
+// fingerprint does: SETTINGS, WINDOW_UPDATE increment, PRIORITY frames and
+// the pseudo-header order.
+func akamaiHTTP2(id ClientHelloID) string {
+	settings, windowUpdate, headerOrder, _ := HTTP2SettingsForClientHello(id)
+	var s, h []string
+	for _, setting := range settings {
+		s = append(s, fmt.Sprintf("%d:%d", setting.ID, setting.Val))
+	}
+	for _, name := range headerOrder {
+		h = append(h, name[1:2])
+	}
+	return fmt.Sprintf("%s|%d|0|%s", strings.Join(s, ";"), windowUpdate, strings.Join(h, ","))
+}
+
+func TestHTTP2AkamaiFingerprint(t *testing.T) {
+	for _, test := range []struct {
+		id   ClientHelloID
+		want string
+	}{
+		{HelloChrome_124, "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"},
+		{HelloChrome_Auto, "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"},
+		{HelloEdge_122, "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"},
+		{HelloChrome_113, "1:65536;2:0;3:1000;4:6291456;6:262144|15663105|0|m,a,s,p"},
+		{HelloFirefox_128, "1:65536;2:0;4:131072;5:16384|12517377|0|m,p,a,s"},
+	} {
+		if got := akamaiHTTP2(test.id); got != test.want {
+			t.Errorf("%s: Akamai fingerprint %s, want %s", test.id.Str(), got, test.want)
+		}
+	}
+}
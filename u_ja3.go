@@ -0,0 +1,326 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ClientHelloSpecFromJA3 builds a ClientHelloSpec from a JA3 string of the form
+//
+//	SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+//
+// where each field is a dash-separated list of decimal values. The cipher
+// suites, the order of the extensions, the supported groups and the point
+// formats are reproduced exactly. GREASE values, if the fingerprint kept them,
+// become GREASE placeholders.
+//
+// JA3 only records extension types, so most extension bodies cannot be
+// recovered and are filled with Chrome-like defaults instead:
+//   - signature_algorithms (13) gets Chrome's signature scheme list,
+//   - application_layer_protocol_negotiation (16) offers "h2" and "http/1.1",
+//   - supported_versions (43) offers TLS 1.3 and TLS 1.2,
+//   - key_share (51) carries a single share for the first supported group
+//     that uTLS can generate, X25519 if there is none,
+//   - psk_key_exchange_modes (45) offers psk_dhe_ke,
+//   - compress_certificate (27) offers brotli,
+//   - record_size_limit (28) advertises 0x4001, as Firefox does,
+//   - application_settings (17513, or 17613 for newer Chrome) lists "h2",
+//   - padding (21) uses BoringPaddingStyle.
+//
+// Extensions uTLS does not implement become empty GenericExtensions, which keep
+// their position in the ClientHello but not their contents.
+func ClientHelloSpecFromJA3(ja3 string) (*ClientHelloSpec, error) {
+	fields := strings.Split(ja3, ",")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("tls: JA3 string has %d fields, expected 5", len(fields))
+	}
+
+	versions, err := parseJA3Field(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("tls: invalid JA3 SSLVersion: %v", err)
+	}
+	if len(versions) != 1 {
+		return nil, fmt.Errorf("tls: invalid JA3 SSLVersion %q", fields[0])
+	}
+	ciphers, err := parseJA3Field(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("tls: invalid JA3 Ciphers: %v", err)
+	}
+	extensions, err := parseJA3Field(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("tls: invalid JA3 Extensions: %v", err)
+	}
+	groups, err := parseJA3Field(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("tls: invalid JA3 EllipticCurves: %v", err)
+	}
+	pointFormats, err := parseJA3Field(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("tls: invalid JA3 EllipticCurvePointFormats: %v", err)
+	}
+
+	spec := &ClientHelloSpec{
+		CompressionMethods: []uint8{compressionNone},
+	}
+
+	for _, c := range ciphers {
+		if isGREASEValue(c) {
+			c = GREASE_PLACEHOLDER
+		}
+		spec.CipherSuites = append(spec.CipherSuites, c)
+	}
+
+	var curves []CurveID
+	for _, g := range groups {
+		if isGREASEValue(g) {
+			g = GREASE_PLACEHOLDER
+		}
+		curves = append(curves, CurveID(g))
+	}
+
+	var points []uint8
+	for _, p := range pointFormats {
+		if p > 0xff {
+			return nil, fmt.Errorf("tls: invalid JA3 point format %d", p)
+		}
+		points = append(points, uint8(p))
+	}
+
+	hasSupportedVersions := false
+	for _, id := range extensions {
+		var ext TLSExtension
+		switch id {
+		case extensionServerName:
+			ext = &SNIExtension{}
+		case extensionStatusRequest:
+			ext = &StatusRequestExtension{}
+		case utlsExtensionStatusRequestV2:
+			ext = &StatusRequestV2Extension{}
+		case extensionSupportedCurves:
+			ext = &SupportedCurvesExtension{Curves: curves}
+		case extensionSupportedPoints:
+			ext = &SupportedPointsExtension{SupportedPoints: points}
+		case extensionSignatureAlgorithms:
+			ext = &SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: ja3SignatureSchemes()}
+		case extensionSignatureAlgorithmsCert:
+			ext = &SignatureAlgorithmsCertExtension{SupportedSignatureAlgorithms: ja3SignatureSchemes()}
+		case extensionALPN:
+			ext = &ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}}
+		case extensionSCT:
+			ext = &SCTExtension{}
+		case utlsExtensionPadding:
+			ext = &UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle}
+		case utlsExtensionExtendedMasterSecret:
+			ext = &UtlsExtendedMasterSecretExtension{}
+		case extensionCompressCertificate:
+			ext = &CompressCertificateExtension{Algorithms: []CertCompressionAlgo{CertCompressionBrotli}}
+		case utlsExtensionRecordSizeLimit:
+			ext = &RecordSizeLimitExtension{Limit: 0x4001}
+		case utlsExtensionApplicationSettings:
+			ext = &ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}}
+		case utlsExtensionApplicationSettingsNew:
+			ext = &ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}, NewCodepoint: true}
+		case extensionSessionTicket:
+			ext = &SessionTicketExtension{}
+		case extensionSupportedVersions:
+			hasSupportedVersions = true
+			ext = &SupportedVersionsExtension{Versions: []uint16{VersionTLS13, VersionTLS12}}
+		case extensionPSKModes:
+			ext = &PSKKeyExchangeModesExtension{Modes: []uint8{pskModeDHE}}
+		case extensionKeyShare:
+			group := X25519
+			for _, curve := range curves {
+				if utlsSupportedGroups[curve] {
+					group = curve
+					break
+				}
+			}
+			ext = &KeyShareExtension{KeyShares: []KeyShare{{Group: group}}}
+		case extensionNextProtoNeg:
+			ext = &NPNExtension{}
+		case fakeExtensionChannelID:
+			ext = &FakeChannelIDExtension{}
+		case extensionRenegotiationInfo:
+			ext = &RenegotiationInfoExtension{Renegotiation: RenegotiateOnceAsClient}
+		default:
+			if isGREASEValue(id) {
+				ext = &UtlsGREASEExtension{}
+			} else {
+				ext = &GenericExtension{Id: id}
+			}
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+
+	// Without supported_versions the JA3 version is the highest one offered.
+	if !hasSupportedVersions {
+		spec.TLSVersMin = VersionTLS10
+		spec.TLSVersMax = versions[0]
+	}
+
+	return spec, nil
+}
+
+// UClientFromJA3 returns a UConn whose ClientHello reproduces the JA3
+// fingerprint ja3, using the ClientHelloSpec built by ClientHelloSpecFromJA3.
+// The reconstruction is lossy: JA3 only records the types of the extensions,
+// so the bodies ClientHelloSpecFromJA3 fills in are defaults, and the JA4 or
+// the raw bytes of the ClientHello will in general differ from those of the
+// client the fingerprint was taken from.
+//
+// Unlike ClientHelloSpecFromJA3, it returns an error if the TLS version the
+// JA3 implies is inconsistent with its cipher suites: if supported_versions
+// (43) is present but the SSLVersion is not 771, which TLS 1.3 clients
+// always send, or if none of the cipher suites can be negotiated at the
+// versions offered, such as TLS 1.3 suites alone without supported_versions.
+func UClientFromJA3(conn net.Conn, config *Config, ja3 string) (*UConn, error) {
+	spec, err := ClientHelloSpecFromJA3(ja3)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkJA3Versions(ja3, spec); err != nil {
+		return nil, err
+	}
+	uconn := UClient(conn, config, HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// checkJA3Versions checks that the SSLVersion of ja3, from which spec was
+// built, is consistent with its extensions and cipher suites.
+func checkJA3Versions(ja3 string, spec *ClientHelloSpec) error {
+	version, err := strconv.ParseUint(strings.Split(ja3, ",")[0], 10, 16)
+	if err != nil {
+		return err
+	}
+	if version < VersionTLS10 || version > VersionTLS12 {
+		return fmt.Errorf("tls: unsupported JA3 SSLVersion %d", version)
+	}
+
+	maxVersion := uint16(version)
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(*SupportedVersionsExtension); ok {
+			if version != VersionTLS12 {
+				return fmt.Errorf("tls: JA3 SSLVersion %d is inconsistent with supported_versions, which requires 771", version)
+			}
+			maxVersion = VersionTLS13
+		}
+	}
+
+	for _, id := range spec.CipherSuites {
+		if cipherSuiteTLS13ByID(id) != nil {
+			if maxVersion == VersionTLS13 {
+				return nil
+			}
+		} else if suite := cipherSuiteByID(id); suite != nil {
+			if maxVersion >= VersionTLS12 || suite.flags&suiteTLS12 == 0 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("tls: JA3 SSLVersion %d is inconsistent with its cipher suites, none can be negotiated up to version %d",
+		version, maxVersion)
+}
+
+// parseJA3Field parses a dash-separated list of decimal uint16 values. An
+// empty field is an empty list.
+func parseJA3Field(field string) ([]uint16, error) {
+	if field == "" {
+		return nil, nil
+	}
+	var values []uint16
+	for _, s := range strings.Split(field, "-") {
+		v, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, uint16(v))
+	}
+	return values, nil
+}
+
+// isGREASEValue reports whether v is one of the reserved GREASE values
+// 0x0a0a, 0x1a1a, ..., 0xfafa.
+func isGREASEValue(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// JA3S returns the JA3S fingerprint of the ServerHello, the MD5 hash, in hex,
+// of the string
+//
+//	SSLVersion,Cipher,Extensions
+//
+// where SSLVersion is the legacy_version of the ServerHello, Cipher the chosen
+// cipher suite and Extensions the types of the ServerHello extensions, dash
+// separated in the order the server sent them. If the server sent a
+// HelloRetryRequest, the fingerprint is that of the ServerHello that followed
+// it. JA3S returns an empty string if no ServerHello was received.
+func (uconn *UConn) JA3S() string {
+	uconn.handshakeMutex.Lock()
+	defer uconn.handshakeMutex.Unlock()
+
+	if uconn.HandshakeState.ServerHello == nil {
+		return ""
+	}
+	ja3s, err := ja3sString(uconn.HandshakeState.ServerHello.Raw)
+	if err != nil {
+		return ""
+	}
+	hash := md5.Sum([]byte(ja3s))
+	return hex.EncodeToString(hash[:])
+}
+
+// ja3sString returns the JA3S string of a marshaled ServerHello.
+func ja3sString(raw []byte) (string, error) {
+	s := cryptobyte.String(raw)
+	var vers, cipherSuite uint16
+	var sessionID, extensions cryptobyte.String
+	if !s.Skip(4) || // message type and uint24 length field
+		!s.ReadUint16(&vers) || !s.Skip(32) || // random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16(&cipherSuite) || !s.Skip(1) { // compression_method
+		return "", errors.New("tls: malformed ServerHello")
+	}
+	if !s.Empty() && (!s.ReadUint16LengthPrefixed(&extensions) || !s.Empty()) {
+		return "", errors.New("tls: malformed ServerHello extensions")
+	}
+
+	var ids []string
+	for !extensions.Empty() {
+		var id uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return "", errors.New("tls: malformed ServerHello extensions")
+		}
+		ids = append(ids, strconv.Itoa(int(id)))
+	}
+	return fmt.Sprintf("%d,%d,%s", vers, cipherSuite, strings.Join(ids, "-")), nil
+}
+
+// ja3SignatureSchemes returns the signature schemes of the specs built from
+// JA3 strings, which do not record them.
+func ja3SignatureSchemes() []SignatureScheme {
+	return []SignatureScheme{
+		ECDSAWithP256AndSHA256,
+		PSSWithSHA256,
+		PKCS1WithSHA256,
+		ECDSAWithP384AndSHA384,
+		PSSWithSHA384,
+		PKCS1WithSHA384,
+		PSSWithSHA512,
+		PKCS1WithSHA512,
+	}
+}
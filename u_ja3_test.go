@@ -0,0 +1,383 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func TestClientHelloSpecFromJA3(t *testing.T) {
+	const ja3 = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	wantCiphers := []uint16{4865, 4866, 4867, 49195, 49199, 49196, 49200, 52393, 52392, 49171, 49172, 156, 157, 47, 53}
+	wantExtensions := []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 13, 18, 51, 45, 43, 27, 17513, 21}
+
+	spec, err := ClientHelloSpecFromJA3(ja3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spec.Extensions[14].(*ApplicationSettingsExtension); !ok {
+		t.Errorf("expected an ApplicationSettingsExtension for 17513, got %#v", spec.Extensions[14])
+	}
+
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	raw := uconn.HandshakeState.Hello.Raw
+
+	hello := new(clientHelloMsg)
+	if !hello.unmarshal(raw) {
+		t.Fatal("failed to parse the marshaled ClientHello")
+	}
+	if !reflect.DeepEqual(hello.cipherSuites, wantCiphers) {
+		t.Errorf("cipher suites = %v, want %v", hello.cipherSuites, wantCiphers)
+	}
+	if want := []CurveID{X25519, CurveP256, CurveP384}; !reflect.DeepEqual(hello.supportedCurves, want) {
+		t.Errorf("supported groups = %v, want %v", hello.supportedCurves, want)
+	}
+	if want := []uint8{pointFormatUncompressed}; !reflect.DeepEqual(hello.supportedPoints, want) {
+		t.Errorf("point formats = %v, want %v", hello.supportedPoints, want)
+	}
+	if got := clientHelloExtensionIDs(t, raw); !reflect.DeepEqual(got, wantExtensions) {
+		t.Errorf("extensions = %v, want %v", got, wantExtensions)
+	}
+}
+
+func TestClientHelloSpecFromJA3GREASE(t *testing.T) {
+	spec, err := ClientHelloSpecFromJA3("771,2570-4865,2570-0-10-6682-30031,2570-29,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext, ok := spec.Extensions[4].(*GenericExtension); !ok || ext.Id != 30031 {
+		t.Errorf("expected a GenericExtension for the unknown extension 30031, got %#v", spec.Extensions[4])
+	}
+	if spec.CipherSuites[0] != GREASE_PLACEHOLDER {
+		t.Errorf("GREASE cipher suite not replaced by a placeholder: %#04x", spec.CipherSuites[0])
+	}
+	for _, i := range []int{0, 3} {
+		if _, ok := spec.Extensions[i].(*UtlsGREASEExtension); !ok {
+			t.Errorf("extension %d: expected UtlsGREASEExtension, got %T", i, spec.Extensions[i])
+		}
+	}
+	curves := spec.Extensions[2].(*SupportedCurvesExtension).Curves
+	if curves[0] != GREASE_PLACEHOLDER {
+		t.Errorf("GREASE group not replaced by a placeholder: %#04x", curves[0])
+	}
+}
+
+func TestClientHelloSpecFromJA3Invalid(t *testing.T) {
+	for _, ja3 := range []string{
+		"",
+		"771,4865,0,29",
+		"771,4865,0,29,0,0",
+		"771-772,4865,0,29,0",
+		"771,4865,0-x,29,0",
+		"771,4865,0,29,256",
+		"771,70000,0,29,0",
+	} {
+		if _, err := ClientHelloSpecFromJA3(ja3); err == nil {
+			t.Errorf("%q: expected an error", ja3)
+		}
+	}
+}
+
+func TestUClientFromJA3(t *testing.T) {
+	const ja3 = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		Server(s, testConfig).Handshake()
+	}()
+	uconn, err := UClientFromJA3(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, ja3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	if err := uconn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if v := uconn.ConnectionState().Version; v != VersionTLS13 {
+		t.Errorf("negotiated version %#04x, want TLS 1.3", v)
+	}
+	raw := uconn.HandshakeState.Hello.Raw
+	want := []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 13, 18, 51, 45, 43, 27, 17513, 21}
+	if got := clientHelloExtensionIDs(t, raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("extensions = %v, want %v", got, want)
+	}
+
+	for _, ja3 := range []string{
+		// A TLS 1.0 client offering CBC suites.
+		"769,49171-47,0-10-11,29-23,0",
+		// TLS 1.3 suites can come along with TLS 1.2 ones.
+		"771,4865-49195,0-10-11-13,29,0",
+	} {
+		if _, err := UClientFromJA3(nil, &Config{ServerName: "example.com"}, ja3); err != nil {
+			t.Errorf("%q: %v", ja3, err)
+		}
+	}
+
+	for _, test := range []struct {
+		ja3, wantErr string
+	}{
+		{"771,4865,0-43,29,0,0", "expected 5"},
+		{"768,47,0,29,0", "unsupported JA3 SSLVersion"},
+		{"772,4865,0-43-51,29,0", "unsupported JA3 SSLVersion"},
+		{"769,4865-49195,0-10-43-51,29,0", "inconsistent with supported_versions"},
+		{"771,4865-4866,0-10-13,29,0", "inconsistent with its cipher suites"},
+		{"769,49195-156,0-10-13,29,0", "inconsistent with its cipher suites"},
+		{"771,2570-255,0-10,29,0", "inconsistent with its cipher suites"},
+	} {
+		_, err := UClientFromJA3(nil, &Config{ServerName: "example.com"}, test.ja3)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%q: got error %v, want %q", test.ja3, err, test.wantErr)
+		}
+	}
+}
+
+// clientHelloExtensionIDs returns the extension types of a marshaled
+// ClientHello, in order.
+func clientHelloExtensionIDs(t *testing.T, raw []byte) []uint16 {
+	s := cryptobyte.String(raw[4:])
+	var random, sessionID, ciphers, compression, extensions cryptobyte.String
+	var vers uint16
+	if !s.ReadUint16(&vers) || !s.ReadBytes((*[]byte)(&random), 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&compression) || !s.ReadUint16LengthPrefixed(&extensions) {
+		t.Fatal("malformed ClientHello")
+	}
+	var ids []uint16
+	for !extensions.Empty() {
+		var id uint16
+		var body cryptobyte.String
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&body) {
+			t.Fatal("malformed ClientHello extensions")
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ja4 returns the JA4 fingerprint of a marshaled ClientHello sent over TCP,
+// see https://github.com/FoxIO-LLC/ja4.
+func ja4(t *testing.T, raw []byte) string {
+	var m clientHelloMsg
+	if !m.unmarshal(raw) {
+		t.Fatal("malformed ClientHello")
+	}
+	hash := func(values []string) string {
+		sum := sha256.Sum256([]byte(strings.Join(values, ",")))
+		return hex.EncodeToString(sum[:6])
+	}
+
+	var version uint16
+	for _, v := range m.supportedVersions {
+		if !isGREASEValue(v) && v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	if m.serverName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(m.alpnProtocols) > 0 {
+		p := m.alpnProtocols[0]
+		alpn = p[:1] + p[len(p)-1:]
+	}
+
+	var ciphers, extensions, sigAlgs []string
+	for _, c := range m.cipherSuites {
+		if !isGREASEValue(c) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", c))
+		}
+	}
+	n := 0
+	for _, id := range clientHelloExtensionIDs(t, raw) {
+		if isGREASEValue(id) {
+			continue
+		}
+		n++
+		if id != extensionServerName && id != extensionALPN {
+			extensions = append(extensions, fmt.Sprintf("%04x", id))
+		}
+	}
+	for _, s := range m.supportedSignatureAlgorithms {
+		sigAlgs = append(sigAlgs, fmt.Sprintf("%04x", uint16(s)))
+	}
+	sort.Strings(ciphers)
+	sort.Strings(extensions)
+
+	return fmt.Sprintf("t%d%s%02d%02d%s_%s_%s", version-VersionTLS13+13, sni, len(ciphers), n, alpn,
+		hash(ciphers), hash([]string{strings.Join(extensions, ",") + "_" + strings.Join(sigAlgs, ",")}))
+}
+
+// testServerHello returns a marshaled ServerHello with the given version,
+// cipher suite and empty extensions.
+func testServerHello(vers, cipherSuite uint16, extensions ...uint16) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(typeServerHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(vers)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(make([]byte, 32))
+		})
+		b.AddUint16(cipherSuite)
+		b.AddUint8(compressionNone)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, ext := range extensions {
+				b.AddUint16(ext)
+				b.AddUint16(0)
+			}
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// recordedServerHello returns the ServerHello of a testdata recording, the
+// first message of the first server flow.
+func recordedServerHello(t *testing.T, name string) []byte {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	flows, err := parseTestData(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := flows[1][recordHeaderLen:]
+	return record[:4+(int(record[1])<<16|int(record[2])<<8|int(record[3]))]
+}
+
+func TestJA3SString(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		raw  []byte
+		ja3s string
+		hash string
+	}{
+		// ServerHellos sent by OpenSSL 3.0.17 s_server to s_client, as
+		// printed by s_client -msg, and ServerHellos of the OpenSSL
+		// recordings of testdata. The JA3S strings and hashes were computed
+		// by a separate parser, not by ja3sString.
+		{"OpenSSL 3.0 TLS 1.3", fromHex(
+			"0200007603033366834ce7d529c51238ee5978a340108323f5e0e016fb3f87a9" +
+				"5c2eab1aed2e20c494f0a10ae9e472021fa18f4b767d9d2ccc80801e451feaf9" +
+				"f814e55551afc7130200002e002b0002030400330024001d002028ad3e0a69dc" +
+				"44c8bed050adc6de95de3be6dd924960cfef390fa0ad6f52c201"),
+			"771,4866,43-51", "15af977ce25de452b96affa2addb1036"},
+		{"OpenSSL 3.0 TLS 1.2", fromHex(
+			"0200003d0303efebe4ae4048444e159c8fd3c71a087e26ce34509ea22c26444f" +
+				"574e4752440100c02c000015ff01000100000b00040300010200230000001700" +
+				"00"),
+			"771,49196,65281-11-35-23", "abade5a4a7f42baf54766e5d108283b6"},
+		{"Client-TLSv13-AES128-SHA256", recordedServerHello(t, "Client-TLSv13-AES128-SHA256"),
+			"771,4865,43-51", "f4febc55ea12b31ae17cfb7e614afda8"},
+		{"Client-TLSv12-ALPN", recordedServerHello(t, "Client-TLSv12-ALPN"),
+			"771,52392,65281-11-16", "6751b57fc5959ab8a55d5197ba2981f4"},
+		{"Client-TLSv12-ECDHE-RSA-AES", recordedServerHello(t, "Client-TLSv12-ECDHE-RSA-AES"),
+			"771,49171,65281-11", "042b018de1d862323f09d5767e4068d5"},
+	} {
+		ja3s, err := ja3sString(test.raw)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if ja3s != test.ja3s {
+			t.Errorf("%s: JA3S string %q, want %q", test.name, ja3s, test.ja3s)
+		}
+		if hash := md5.Sum([]byte(ja3s)); hex.EncodeToString(hash[:]) != test.hash {
+			t.Errorf("%s: JA3S %x, want %s", test.name, hash, test.hash)
+		}
+	}
+
+	// A ServerHello without extensions, as sent by TLS 1.0 servers.
+	noExtensions := testServerHello(VersionTLS10, TLS_RSA_WITH_AES_128_CBC_SHA)
+	noExtensions = noExtensions[:len(noExtensions)-2]
+	noExtensions[3] -= 2
+	if ja3s, err := ja3sString(noExtensions); err != nil || ja3s != "769,47," {
+		t.Errorf("JA3S string without extensions = %q, %v, want %q", ja3s, err, "769,47,")
+	}
+	if _, err := ja3sString(noExtensions[:20]); err == nil {
+		t.Error("truncated ServerHello was accepted")
+	}
+}
+
+func TestJA3SHandshake(t *testing.T) {
+	for _, hrr := range []bool{false, true} {
+		c, s := localPipe(t)
+		serverConfig := testConfig.Clone()
+		serverConfig.CurvePreferences = []CurveID{X25519}
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- Server(s, serverConfig).Handshake()
+		}()
+
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+		keyShare := X25519
+		if hrr {
+			// Only offer a P-256 share, so that the server asks for X25519.
+			keyShare = CurveP256
+		}
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{X25519, CurveP256}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+				}},
+				&KeyShareExtension{[]KeyShare{{Group: keyShare}}},
+				&SupportedVersionsExtension{[]uint16{VersionTLS13, VersionTLS12}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got := client.JA3S(); got != "" {
+			t.Errorf("HRR %v: JA3S before the handshake = %q, want none", hrr, got)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("HRR %v: %v", hrr, err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("HRR %v: server: %v", hrr, err)
+		}
+		c.Close()
+
+		if shares := client.HandshakeState.Hello.KeyShares; hrr && (len(shares) != 1 || shares[0].Group != X25519) {
+			t.Errorf("HRR %v: second ClientHello key shares %v, want one for X25519", hrr, shares)
+		}
+		serverHello := client.HandshakeState.ServerHello
+		if bytes.Equal(serverHello.Random, helloRetryRequestRandom) {
+			t.Errorf("HRR %v: ServerHello is a HelloRetryRequest", hrr)
+		}
+		if serverHello.ServerShare.group != X25519 {
+			t.Errorf("HRR %v: server share for %v, want X25519", hrr, serverHello.ServerShare.group)
+		}
+		// crypto/tls sends supported_versions before key_share.
+		if got, want := client.JA3S(), "f4febc55ea12b31ae17cfb7e614afda8"; got != want {
+			t.Errorf("HRR %v: JA3S %s, want %s (771,4865,43-51)", hrr, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"io"
+
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
+)
+
+// This file implements X25519Kyber768Draft00, the hybrid of X25519 and
+// Kyber768 as specified for round 3 of the NIST post-quantum competition
+// (version 3.02), see draft-tls-westerbaan-xyber768d00. Kyber768 itself is
+// the one of circl.
+
+const (
+	x25519Kyber768ClientShareSize = 32 + kyber768.PublicKeySize
+	x25519Kyber768ServerShareSize = 32 + kyber768.CiphertextSize
+)
+
+// kyber768PrivateKey is a Kyber768 decapsulation key.
+type kyber768PrivateKey struct {
+	pk []byte // the encapsulation key
+	sk *kyber768.PrivateKey
+}
+
+// newKyber768Key derives a Kyber768 key pair from a 64-byte seed, the IND-CPA
+// key seed followed by the implicit rejection value z.
+func newKyber768Key(seed []byte) *kyber768PrivateKey {
+	pk, sk := kyber768.NewKeyFromSeed(seed)
+	k := &kyber768PrivateKey{pk: make([]byte, kyber768.PublicKeySize), sk: sk}
+	pk.Pack(k.pk)
+	return k
+}
+
+// kyber768Encapsulate returns a ciphertext and shared secret for the
+// encapsulation key pk, derived from the 32-byte random seed. pk must be
+// kyber768.PublicKeySize bytes long.
+func kyber768Encapsulate(pk, seed []byte) (ct, sharedKey []byte) {
+	var key kyber768.PublicKey
+	key.Unpack(pk)
+	ct = make([]byte, kyber768.CiphertextSize)
+	sharedKey = make([]byte, kyber768.SharedKeySize)
+	key.EncapsulateTo(ct, sharedKey, seed)
+	return ct, sharedKey
+}
+
+// decapsulate returns the shared secret encapsulated in ct, or a
+// pseudorandom value if ct was not generated for k. ct must be
+// kyber768.CiphertextSize bytes long.
+func (k *kyber768PrivateKey) decapsulate(ct []byte) []byte {
+	sharedKey := make([]byte, kyber768.SharedKeySize)
+	k.sk.DecapsulateTo(sharedKey, ct)
+	return sharedKey
+}
+
+// x25519Kyber768Parameters is the client side of X25519Kyber768Draft00. Its
+// key share is the X25519 public key followed by the Kyber768 encapsulation
+// key, and the server answers with its X25519 public key followed by a
+// Kyber768 ciphertext.
+type x25519Kyber768Parameters struct {
+	x25519 *x25519Parameters
+	kyber  *kyber768PrivateKey
+}
+
+func generateX25519Kyber768Parameters(rand io.Reader) (ecdheParameters, error) {
+	x25519, err := generateECDHEParameters(rand, X25519)
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]byte, 64)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	return &x25519Kyber768Parameters{
+		x25519: x25519.(*x25519Parameters),
+		kyber:  newKyber768Key(seed),
+	}, nil
+}
+
+func (p *x25519Kyber768Parameters) CurveID() CurveID {
+	return X25519Kyber768Draft00
+}
+
+func (p *x25519Kyber768Parameters) PublicKey() []byte {
+	return append(append([]byte{}, p.x25519.PublicKey()...), p.kyber.pk...)
+}
+
+func (p *x25519Kyber768Parameters) SharedKey(serverShare []byte) []byte {
+	if len(serverShare) != x25519Kyber768ServerShareSize {
+		return nil
+	}
+	sharedKey := p.x25519.SharedKey(serverShare[:32])
+	return append(sharedKey, p.kyber.decapsulate(serverShare[32:])...)
+}
+
+// x25519Kyber768Encapsulate is the server side of X25519Kyber768Draft00. It
+// returns the key share answering clientShare and the shared secret, or nil
+// ones if clientShare is malformed.
+func x25519Kyber768Encapsulate(rand io.Reader, clientShare []byte) (serverShare, sharedKey []byte, err error) {
+	if len(clientShare) != x25519Kyber768ClientShareSize {
+		return nil, nil, nil
+	}
+	x25519, err := generateECDHEParameters(rand, X25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed := make([]byte, 32)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, nil, err
+	}
+	ct, kyberKey := kyber768Encapsulate(clientShare[32:], seed)
+	serverShare = append(append([]byte{}, x25519.PublicKey()...), ct...)
+	sharedKey = append(x25519.SharedKey(clientShare[:32]), kyberKey...)
+	return serverShare, sharedKey, nil
+}
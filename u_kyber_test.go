@@ -0,0 +1,118 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestKyber768Vector(t *testing.T) {
+	// Generated with github.com/cloudflare/circl/kem/kyber/kyber768 from the
+	// key seed 0x00..0x3f and the encapsulation seed 0x40..0x5f.
+	const (
+		pkHash   = "32992ebf18a03bc8efb6dc12782f0ec788dda3599580f5ffc8a52f761c7fbe5a"
+		ctHash   = "ef1885c43a88337bfcbd0d2d33ae8bf4f96eb54012b61c0debe322f2eb4dabc5"
+		ss       = "7973130dd759b854824a18a0e046afd26cdd02ec874734200bc98d387965de7c"
+		rejected = "1f6f5151d7478ec9fe1fec0145f8df5e084f0497d82ef45aed4c280449e51a44"
+	)
+
+	seed := make([]byte, 96)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	key := newKyber768Key(seed[:64])
+	if h := sha256.Sum256(key.pk); hex.EncodeToString(h[:]) != pkHash {
+		t.Errorf("public key hash %x, want %s", h, pkHash)
+	}
+	ct, sharedKey := kyber768Encapsulate(key.pk, seed[64:])
+	if h := sha256.Sum256(ct); hex.EncodeToString(h[:]) != ctHash {
+		t.Errorf("ciphertext hash %x, want %s", h, ctHash)
+	}
+	if got := hex.EncodeToString(sharedKey); got != ss {
+		t.Errorf("encapsulated key %s, want %s", got, ss)
+	}
+	if got := hex.EncodeToString(key.decapsulate(ct)); got != ss {
+		t.Errorf("decapsulated key %s, want %s", got, ss)
+	}
+	ct[0] ^= 1
+	if got := hex.EncodeToString(key.decapsulate(ct)); got != rejected {
+		t.Errorf("implicitly rejected key %s, want %s", got, rejected)
+	}
+}
+
+// testX25519Kyber768Handshake performs a TLS 1.3 handshake between a uTLS
+// client offering X25519Kyber768Draft00 and X25519 key shares and a server
+// with the given curve preferences.
+func testX25519Kyber768Handshake(t *testing.T, serverCurves []CurveID) (client *UConn, server *Conn) {
+	c, s := localPipe(t)
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = serverCurves
+	server = Server(s, serverConfig)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- server.Handshake()
+	}()
+
+	client = UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+	if err := client.ApplyPreset(&ClientHelloSpec{
+		CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{[]CurveID{X25519Kyber768Draft00, X25519}},
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+				ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+			}},
+			&KeyShareExtension{[]KeyShare{{Group: X25519Kyber768Draft00}, {Group: X25519}}},
+			&SupportedVersionsExtension{[]uint16{VersionTLS13, VersionTLS12}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	c.Close()
+	return client, server
+}
+
+func TestX25519Kyber768Handshake(t *testing.T) {
+	client, server := testX25519Kyber768Handshake(t, []CurveID{X25519Kyber768Draft00, X25519})
+
+	share := client.HandshakeState.ServerHello.ServerShare
+	if share.group != X25519Kyber768Draft00 {
+		t.Fatalf("server selected group %v, want X25519Kyber768Draft00", share.group)
+	}
+	if len(share.data) != x25519Kyber768ServerShareSize {
+		t.Errorf("server key share is %d bytes, want %d", len(share.data), x25519Kyber768ServerShareSize)
+	}
+
+	clientState, serverState := client.ConnectionState(), server.ConnectionState()
+	clientKey, err := clientState.ExportKeyingMaterial("test", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := serverState.ExportKeyingMaterial("test", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientKey, serverKey) {
+		t.Errorf("client and server derived different secrets: %x and %x", clientKey, serverKey)
+	}
+}
+
+func TestX25519Kyber768NotPreferred(t *testing.T) {
+	// The hybrid group is only used if the server lists it.
+	client, _ := testX25519Kyber768Handshake(t, nil)
+	if group := client.HandshakeState.ServerHello.ServerShare.group; group != X25519 {
+		t.Errorf("server selected group %v, want X25519", group)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"io"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+)
+
+// This file implements the TLS 1.3 groups built on ML-KEM-768, as specified in
+// FIPS 203: MLKEM768 on its own and its hybrid with X25519, X25519MLKEM768,
+// see draft-kwiatkowski-tls-ecdhe-mlkem and
+// draft-connolly-tls-mlkem-key-agreement. ML-KEM-768 itself is the one of
+// circl.
+
+const (
+	mlkem768CiphertextSize        = mlkem768.CiphertextSize
+	x25519MLKEM768ClientShareSize = mlkem768.PublicKeySize + 32
+	x25519MLKEM768ServerShareSize = mlkem768.CiphertextSize + 32
+)
+
+// mlkem768PrivateKey is an ML-KEM-768 decapsulation key.
+type mlkem768PrivateKey struct {
+	pk []byte // the encapsulation key
+	sk *mlkem768.PrivateKey
+}
+
+// newMLKEM768Key derives an ML-KEM-768 key pair from a 64-byte seed, d
+// followed by z (FIPS 203, Algorithm 16).
+func newMLKEM768Key(seed []byte) *mlkem768PrivateKey {
+	pk, sk := mlkem768.NewKeyFromSeed(seed)
+	k := &mlkem768PrivateKey{pk: make([]byte, mlkem768.PublicKeySize), sk: sk}
+	pk.Pack(k.pk)
+	return k
+}
+
+// mlkem768Encapsulate returns a ciphertext and shared secret for the
+// encapsulation key pk, derived from the 32-byte random message m (FIPS 203,
+// Algorithm 17). It returns nil ones if pk is malformed or fails the modulus
+// check.
+func mlkem768Encapsulate(pk, m []byte) (ct, sharedKey []byte) {
+	var key mlkem768.PublicKey
+	if err := key.Unpack(pk); err != nil {
+		return nil, nil
+	}
+	ct = make([]byte, mlkem768.CiphertextSize)
+	sharedKey = make([]byte, mlkem768.SharedKeySize)
+	key.EncapsulateTo(ct, sharedKey, m)
+	return ct, sharedKey
+}
+
+// decapsulate returns the shared secret encapsulated in ct, or a
+// pseudorandom value if ct was not generated for k (FIPS 203, Algorithm 18).
+// ct must be mlkem768.CiphertextSize bytes long.
+func (k *mlkem768PrivateKey) decapsulate(ct []byte) []byte {
+	sharedKey := make([]byte, mlkem768.SharedKeySize)
+	k.sk.DecapsulateTo(sharedKey, ct)
+	return sharedKey
+}
+
+// mlkem768Parameters is the client side of MLKEM768 and, with x25519 set,
+// X25519MLKEM768. The hybrid key share is the ML-KEM-768 encapsulation key
+// followed by the X25519 public key, and the server answers with an
+// ML-KEM-768 ciphertext followed by its X25519 public key.
+type mlkem768Parameters struct {
+	mlkem  *mlkem768PrivateKey
+	x25519 *x25519Parameters
+}
+
+func generateMLKEM768Parameters(rand io.Reader, hybrid bool) (ecdheParameters, error) {
+	p := &mlkem768Parameters{}
+	if hybrid {
+		x25519, err := generateECDHEParameters(rand, X25519)
+		if err != nil {
+			return nil, err
+		}
+		p.x25519 = x25519.(*x25519Parameters)
+	}
+	seed := make([]byte, 64)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	p.mlkem = newMLKEM768Key(seed)
+	return p, nil
+}
+
+func (p *mlkem768Parameters) CurveID() CurveID {
+	if p.x25519 != nil {
+		return X25519MLKEM768
+	}
+	return MLKEM768
+}
+
+func (p *mlkem768Parameters) PublicKey() []byte {
+	pk := append([]byte{}, p.mlkem.pk...)
+	if p.x25519 != nil {
+		pk = append(pk, p.x25519.PublicKey()...)
+	}
+	return pk
+}
+
+func (p *mlkem768Parameters) SharedKey(serverShare []byte) []byte {
+	if p.x25519 == nil {
+		if len(serverShare) != mlkem768CiphertextSize {
+			return nil
+		}
+		return p.mlkem.decapsulate(serverShare)
+	}
+	if len(serverShare) != x25519MLKEM768ServerShareSize {
+		return nil
+	}
+	x25519Key := p.x25519.SharedKey(serverShare[mlkem768CiphertextSize:])
+	if x25519Key == nil {
+		return nil
+	}
+	return append(p.mlkem.decapsulate(serverShare[:mlkem768CiphertextSize]), x25519Key...)
+}
+
+// mlkem768ServerShare is the server side of MLKEM768 and, if hybrid is set,
+// X25519MLKEM768. It returns the key share answering clientShare and the
+// shared secret, or nil ones if clientShare is malformed.
+func mlkem768ServerShare(rand io.Reader, hybrid bool, clientShare []byte) (serverShare, sharedKey []byte, err error) {
+	pk := clientShare
+	if hybrid {
+		if len(clientShare) != x25519MLKEM768ClientShareSize {
+			return nil, nil, nil
+		}
+		pk = clientShare[:mlkem768.PublicKeySize]
+	}
+	m := make([]byte, 32)
+	if _, err := io.ReadFull(rand, m); err != nil {
+		return nil, nil, err
+	}
+	ct, sharedKey := mlkem768Encapsulate(pk, m)
+	if ct == nil || !hybrid {
+		return ct, sharedKey, nil
+	}
+
+	x25519, err := generateECDHEParameters(rand, X25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	x25519Key := x25519.SharedKey(clientShare[mlkem768.PublicKeySize:])
+	if x25519Key == nil {
+		return nil, nil, nil
+	}
+	serverShare = append(ct, x25519.PublicKey()...)
+	return serverShare, append(sharedKey, x25519Key...), nil
+}
+
+// isKEMGroup reports whether id is a post-quantum group, for which the server
+// share encapsulates a secret to the client share. These groups are only
+// used with TLS 1.3.
+func isKEMGroup(id CurveID) bool {
+	switch id {
+	case X25519Kyber768Draft00, X25519MLKEM768, MLKEM768:
+		return true
+	}
+	return false
+}
+
+// kemServerShare returns the server key share and shared secret of the KEM
+// group id for clientShare, or nil ones if clientShare is malformed.
+func kemServerShare(rand io.Reader, id CurveID, clientShare []byte) (serverShare, sharedKey []byte, err error) {
+	switch id {
+	case X25519Kyber768Draft00:
+		return x25519Kyber768Encapsulate(rand, clientShare)
+	case X25519MLKEM768:
+		return mlkem768ServerShare(rand, true, clientShare)
+	default:
+		return mlkem768ServerShare(rand, false, clientShare)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMLKEM768Vector(t *testing.T) {
+	// Generated with crypto/mlkem from the seed 0x00..0x3f and the
+	// encapsulation randomness 0x40..0x5f.
+	const (
+		pkHash   = "0b7934c83125c788995e2ba6bd761e33046b3e40571be53e023309a29f398cc9"
+		ctHash   = "dbf4e9aa48b078ad46ec1c9c47bda8c2d2fec9d0e7a21bd48d2238a2abedb856"
+		ss       = "9cddd089ffe70e3996e76f7c8d06746df34d07e8657bc0fcf2bb0e1c3084aea1"
+		rejected = "dcfc80c6db46ff7028e3a4398651c063ae7a42c107a6dc8cb07141861698ab92"
+	)
+
+	seed := make([]byte, 96)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	key := newMLKEM768Key(seed[:64])
+	if h := sha256.Sum256(key.pk); hex.EncodeToString(h[:]) != pkHash {
+		t.Errorf("public key hash %x, want %s", h, pkHash)
+	}
+	ct, sharedKey := mlkem768Encapsulate(key.pk, seed[64:])
+	if h := sha256.Sum256(ct); hex.EncodeToString(h[:]) != ctHash {
+		t.Errorf("ciphertext hash %x, want %s", h, ctHash)
+	}
+	if got := hex.EncodeToString(sharedKey); got != ss {
+		t.Errorf("encapsulated key %s, want %s", got, ss)
+	}
+	if got := hex.EncodeToString(key.decapsulate(ct)); got != ss {
+		t.Errorf("decapsulated key %s, want %s", got, ss)
+	}
+	ct[0] ^= 1
+	if got := hex.EncodeToString(key.decapsulate(ct)); got != rejected {
+		t.Errorf("implicitly rejected key %s, want %s", got, rejected)
+	}
+
+	// Coefficients of the encapsulation key must be reduced modulo q.
+	pk := append([]byte{}, key.pk...)
+	pk[0], pk[1] = 0xff, 0xff
+	if ct, _ := mlkem768Encapsulate(pk, seed[64:]); ct != nil {
+		t.Error("encapsulated to a key failing the modulus check")
+	}
+}
+
+// testPQOnlyHandshake performs a TLS 1.3 handshake between a uTLS client
+// sending key shares only for the post-quantum group pq, while advertising
+// groups, and a server with the given curve preferences.
+func testPQOnlyHandshake(t *testing.T, pq CurveID, groups, serverCurves []CurveID) (client *UConn, server *Conn, err error) {
+	c, s := localPipe(t)
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = serverCurves
+	server = Server(s, serverConfig)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- server.Handshake()
+	}()
+
+	client = UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+	if err := client.ApplyPreset(&ClientHelloSpec{
+		CipherSuites: []uint16{TLS_AES_128_GCM_SHA256},
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{groups},
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+				ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+			}},
+			&KeyShareExtension{[]KeyShare{{Group: pq}}},
+			&SupportedVersionsExtension{[]uint16{VersionTLS13, VersionTLS12}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err = client.Handshake()
+	c.Close()
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	return client, server, err
+}
+
+func TestPQOnlyKeyShare(t *testing.T) {
+	for _, test := range []struct {
+		group     CurveID
+		shareSize int
+	}{
+		{X25519MLKEM768, x25519MLKEM768ServerShareSize},
+		{MLKEM768, mlkem768CiphertextSize},
+	} {
+		client, server, err := testPQOnlyHandshake(t, test.group, []CurveID{test.group}, []CurveID{test.group, X25519})
+		if err != nil {
+			t.Fatalf("group %v: %v", test.group, err)
+		}
+		share := client.HandshakeState.ServerHello.ServerShare
+		if share.group != test.group {
+			t.Errorf("server selected group %v, want %v", share.group, test.group)
+		}
+		if len(share.data) != test.shareSize {
+			t.Errorf("group %v: server key share is %d bytes, want %d", test.group, len(share.data), test.shareSize)
+		}
+
+		clientState, serverState := client.ConnectionState(), server.ConnectionState()
+		clientKey, err := clientState.ExportKeyingMaterial("test", nil, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverKey, err := serverState.ExportKeyingMaterial("test", nil, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(clientKey, serverKey) {
+			t.Errorf("group %v: client and server derived different secrets: %x and %x", test.group, clientKey, serverKey)
+		}
+	}
+}
+
+func TestPQOnlyKeyShareClassicalServer(t *testing.T) {
+	// A server without post-quantum groups asks for the advertised X25519
+	// share with a HelloRetryRequest.
+	client, _, err := testPQOnlyHandshake(t, X25519MLKEM768, []CurveID{X25519MLKEM768, X25519}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group := client.HandshakeState.ServerHello.ServerShare.group; group != X25519 {
+		t.Errorf("server selected group %v, want X25519", group)
+	}
+
+	// Without a classical group to fall back to, the handshake fails.
+	if _, _, err := testPQOnlyHandshake(t, X25519MLKEM768, []CurveID{X25519MLKEM768}, nil); err == nil {
+		t.Error("handshake without a common group succeeded")
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// An OCSPPolicy makes a client check the OCSP response the server staples for
+// its certificate, see Config.OCSPPolicy.
+//
+// A response which is not signed by the issuer of the certificate, or by a
+// responder it delegated to, or which reports the certificate as revoked,
+// aborts the handshake. The other failures are soft: the server stapled no
+// response, the response is expired or reports an unknown status, or the
+// issuer is not known because the chain has a single certificate.
+// RejectExpired and EnforceMustStaple turn some of them into hard failures,
+// as does Config.VerifyStapledOCSP.
+type OCSPPolicy struct {
+	// OnSoftFail, if not nil, is called with the reason of a soft failure.
+	// If it returns a non-nil error, the handshake is aborted and that
+	// error results. If OnSoftFail is nil, soft failures are ignored.
+	OnSoftFail func(cs ConnectionState, reason error) error
+
+	// RejectExpired makes a response which is expired, or not valid yet,
+	// abort the handshake rather than be a soft failure.
+	RejectExpired bool
+
+	// EnforceMustStaple makes the handshake abort if the server stapled no
+	// response although its certificate requires one, with the TLS Feature
+	// extension listing status_request (OCSP Must-Staple, RFC 7633).
+	EnforceMustStaple bool
+}
+
+// ocspPolicy returns the OCSPPolicy a client enforces, or nil. The policy of
+// VerifyStapledOCSP is enforced even if VerifyConnection is set.
+func (c *Config) ocspPolicy() *OCSPPolicy {
+	if c.VerifyStapledOCSP {
+		var p OCSPPolicy
+		if c.OCSPPolicy != nil {
+			p = *c.OCSPPolicy
+		}
+		p.RejectExpired = true
+		p.EnforceMustStaple = true
+		return &p
+	}
+	if c.VerifyConnection != nil {
+		return nil
+	}
+	return c.OCSPPolicy
+}
+
+// OCSPStatus is the status of a server certificate in the stapled OCSP
+// response, see ConnectionState.OCSPStatus.
+type OCSPStatus uint8
+
+const (
+	// OCSPStatusUnchecked means no response was checked: there is no
+	// OCSPPolicy, the server stapled no response, or its issuer is not known.
+	OCSPStatusUnchecked OCSPStatus = iota
+	OCSPStatusGood
+	OCSPStatusRevoked
+	OCSPStatusUnknown
+)
+
+// check checks the stapled OCSP response of c, once the server certificate
+// is verified.
+func (p *OCSPPolicy) check(c *Conn) error {
+	reason, err := p.verify(c)
+	if err != nil {
+		if errors.Is(err, errOCSPRevoked) {
+			c.sendAlert(alertCertificateRevoked)
+		} else {
+			c.sendAlert(alertBadCertificate)
+		}
+		return err
+	}
+	if reason != nil && p.OnSoftFail != nil {
+		if err := p.OnSoftFail(c.connectionStateLocked(), reason); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+	return nil
+}
+
+var errOCSPRevoked = errors.New("tls: the stapled OCSP response reports the server certificate as revoked")
+
+// verify returns the reason of a soft failure, or the error aborting the
+// handshake.
+func (p *OCSPPolicy) verify(c *Conn) (softFail, err error) {
+	leaf := c.peerCertificates[0]
+	if len(c.ocspResponse) == 0 {
+		if p.EnforceMustStaple && mustStaple(leaf) {
+			return nil, errors.New("tls: the server certificate requires a stapled OCSP response, but none was stapled")
+		}
+		return errors.New("tls: the server stapled no OCSP response"), nil
+	}
+
+	var issuer *x509.Certificate
+	if len(c.verifiedChains) > 0 && len(c.verifiedChains[0]) > 1 {
+		issuer = c.verifiedChains[0][1]
+	} else if len(c.peerCertificates) > 1 {
+		issuer = c.peerCertificates[1]
+	} else {
+		return errors.New("tls: the issuer of the server certificate is not known, its OCSP response cannot be checked"), nil
+	}
+
+	resp, err := ocsp.ParseResponseForCert(c.ocspResponse, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("tls: invalid stapled OCSP response: %v", err)
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		c.ocspStatus = OCSPStatusGood
+	case ocsp.Revoked:
+		c.ocspStatus = OCSPStatusRevoked
+	default:
+		c.ocspStatus = OCSPStatusUnknown
+	}
+	now := c.config.time()
+	switch {
+	case resp.Status == ocsp.Revoked:
+		return nil, errOCSPRevoked
+	case resp.Status != ocsp.Good:
+		return errors.New("tls: the stapled OCSP response reports an unknown status"), nil
+	case now.Before(resp.ThisUpdate) || !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate):
+		err := fmt.Errorf("tls: the stapled OCSP response is only valid from %v to %v", resp.ThisUpdate, resp.NextUpdate)
+		if p.RejectExpired {
+			return nil, err
+		}
+		return err, nil
+	}
+	return nil, nil
+}
+
+// oidExtensionTLSFeature is the TLS Feature certificate extension, see RFC
+// 7633, Section 6.
+var oidExtensionTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// mustStaple reports whether cert has the TLS Feature extension listing
+// status_request, that is requires a stapled OCSP response.
+func mustStaple(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionTLSFeature) {
+			continue
+		}
+		var features []int
+		if rest, err := asn1.Unmarshal(ext.Value, &features); err != nil || len(rest) != 0 {
+			return false
+		}
+		for _, feature := range features {
+			if feature == int(extensionStatusRequest) {
+				return true
+			}
+		}
+	}
+	return false
+}
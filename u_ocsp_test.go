@@ -0,0 +1,195 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPPolicy(t *testing.T) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	newCert := func(template, parent *x509.Certificate, key crypto.PublicKey, parentKey crypto.Signer) *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	rootKey, leafKey := newKey(), newKey()
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OCSP Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	root := newCert(rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	leaf := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ocsp.example.com"},
+		DNSNames:     []string{"ocsp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, root, leafKey.Public(), rootKey)
+	// mustStapleLeaf requires a stapled response, see RFC 7633.
+	tlsFeature, err := asn1.Marshal([]int{int(extensionStatusRequest)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStapleLeaf := newCert(&x509.Certificate{
+		SerialNumber:    big.NewInt(3),
+		Subject:         pkix.Name{CommonName: "ocsp.example.com"},
+		DNSNames:        []string{"ocsp.example.com"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{{Id: oidExtensionTLSFeature, Value: tlsFeature}},
+	}, root, leafKey.Public(), rootKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	stapleUntil := func(status int, signer crypto.Signer, nextUpdate time.Time) []byte {
+		resp, err := ocsp.CreateResponse(root, root, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   time.Now().Add(-2 * time.Hour),
+			NextUpdate:   nextUpdate,
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	staple := func(status int, signer crypto.Signer) []byte {
+		return stapleUntil(status, signer, time.Now().Add(time.Hour))
+	}
+	expired := stapleUntil(ocsp.Good, rootKey, time.Now().Add(-time.Hour))
+	errSoftFail := errors.New("soft failure rejected")
+
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		for _, test := range []struct {
+			name       string
+			staple     []byte
+			strict     bool
+			verify     bool
+			policy     OCSPPolicy
+			mustStaple bool
+			wantErr    string
+			wantStatus OCSPStatus
+		}{
+			{name: "good", staple: staple(ocsp.Good, rootKey), strict: true, wantStatus: OCSPStatusGood},
+			{name: "revoked", staple: staple(ocsp.Revoked, rootKey), wantErr: "revoked"},
+			{name: "forged", staple: staple(ocsp.Good, leafKey), wantErr: "invalid stapled OCSP response"},
+			{name: "unknown", staple: staple(ocsp.Unknown, rootKey), wantStatus: OCSPStatusUnknown},
+			{name: "unknown strict", staple: staple(ocsp.Unknown, rootKey), strict: true, wantErr: "soft failure", wantStatus: OCSPStatusUnknown},
+			{name: "expired", staple: expired, wantStatus: OCSPStatusGood},
+			{name: "expired rejected", staple: expired, policy: OCSPPolicy{RejectExpired: true}, wantErr: "only valid"},
+			{name: "missing"},
+			{name: "missing strict", strict: true, wantErr: "soft failure"},
+			{name: "must-staple", mustStaple: true},
+			{name: "must-staple enforced", mustStaple: true, policy: OCSPPolicy{EnforceMustStaple: true}, wantErr: "requires a stapled OCSP response"},
+			{name: "enforced without must-staple", policy: OCSPPolicy{EnforceMustStaple: true}},
+			{name: "VerifyStapledOCSP good", staple: staple(ocsp.Good, rootKey), verify: true, wantStatus: OCSPStatusGood},
+			{name: "VerifyStapledOCSP revoked", staple: staple(ocsp.Revoked, rootKey), verify: true, wantErr: "revoked"},
+			{name: "VerifyStapledOCSP expired", staple: expired, verify: true, wantErr: "only valid"},
+			{name: "VerifyStapledOCSP missing", verify: true},
+			{name: "VerifyStapledOCSP must-staple", mustStaple: true, verify: true, wantErr: "requires a stapled OCSP response"},
+		} {
+			chain := [][]byte{leaf.Raw, root.Raw}
+			if test.mustStaple {
+				chain[0] = mustStapleLeaf.Raw
+			}
+			c, s := localPipe(t)
+			go func() {
+				defer s.Close()
+				Server(s, &Config{
+					Certificates: []Certificate{{
+						Certificate: chain,
+						PrivateKey:  leafKey,
+						OCSPStaple:  test.staple,
+					}},
+					MaxVersion: version,
+				}).Handshake()
+			}()
+
+			var softFail error
+			policy := test.policy
+			policy.OnSoftFail = func(cs ConnectionState, reason error) error {
+				softFail = reason
+				if cs.OCSPStatus != test.wantStatus {
+					t.Errorf("%x, %s: OCSPStatus in OnSoftFail = %d, want %d", version, test.name, cs.OCSPStatus, test.wantStatus)
+				}
+				if test.strict {
+					return errSoftFail
+				}
+				return nil
+			}
+			config := &Config{
+				ServerName: "ocsp.example.com",
+				RootCAs:    roots,
+				MaxVersion: version,
+				OCSPPolicy: &policy,
+			}
+			if test.verify {
+				// VerifyStapledOCSP needs no OCSPPolicy, and is enforced
+				// even if VerifyConnection is set.
+				config.OCSPPolicy = nil
+				config.VerifyStapledOCSP = true
+				config.VerifyConnection = func(cs ConnectionState) error {
+					if cs.OCSPStatus != test.wantStatus {
+						t.Errorf("%x, %s: OCSPStatus in VerifyConnection = %d, want %d", version, test.name, cs.OCSPStatus, test.wantStatus)
+					}
+					return nil
+				}
+			}
+			client := Client(c, config)
+			err := client.Handshake()
+			if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("%x, %s: got error %v, want %q", version, test.name, err, test.wantErr)
+			}
+			if err == nil && !bytes.Equal(client.ConnectionState().OCSPResponse, test.staple) {
+				t.Errorf("%x, %s: ConnectionState.OCSPResponse is not the stapled response", version, test.name)
+			}
+			if err == nil && client.ConnectionState().OCSPStatus != test.wantStatus {
+				t.Errorf("%x, %s: OCSPStatus = %d, want %d", version, test.name, client.ConnectionState().OCSPStatus, test.wantStatus)
+			}
+			if test.name == "good" && softFail != nil {
+				t.Errorf("%x, %s: unexpected soft failure %v", version, test.name, softFail)
+			}
+			c.Close()
+		}
+	}
+}
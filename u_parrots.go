@@ -12,10 +12,37 @@ import (
 	"io"
 	"sort"
 	"strconv"
+	"time"
 )
 
+// helloAutoIDs maps each browser to the parrot its *_Auto ClientHelloID
+// stands for in this version of uTLS. A ClientHelloID with the version
+// helloAutoVers resolves the same way.
+var helloAutoIDs = map[string]ClientHelloID{
+	helloChrome:  HelloChrome_Auto,
+	helloEdge:    HelloEdge_Auto,
+	helloFirefox: HelloFirefox_Auto,
+	helloOpera:   HelloOpera_Auto,
+	helloIOS:     HelloIOS_Auto,
+	helloSafari:  HelloSafari_Auto,
+}
+
+// resolveClientHelloID returns the concrete parrot id stands for.
+func resolveClientHelloID(id ClientHelloID) ClientHelloID {
+	if id.Client == HelloChrome_Shuffle.Client && id.Version == HelloChrome_Shuffle.Version {
+		// The seed of HelloChrome_Shuffle only draws the extension order.
+		return HelloChrome_Shuffle
+	}
+	if id.Version == helloAutoVers {
+		if resolved, ok := helloAutoIDs[id.Client]; ok {
+			return resolved
+		}
+	}
+	return id
+}
+
 func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
-	switch id {
+	switch resolveClientHelloID(id) {
 	case HelloChrome_58, HelloChrome_62:
 		return ClientHelloSpec{
 			TLSVersMax: VersionTLS12,
@@ -352,7 +379,7 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 				&CompressCertificateExtension{[]CertCompressionAlgo{
 					CertCompressionBrotli,
 				}},
-				&GenericExtension{Id: 0x4469}, // // extensionApplicationSettings WARNING: UNKNOWN EXTENSION, USE AT YOUR OWN RISK
+				&ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
 				&UtlsGREASEExtension{},
 				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
 			},
@@ -423,7 +450,7 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 				&CompressCertificateExtension{[]CertCompressionAlgo{
 					CertCompressionBrotli,
 				}},
-				&GenericExtension{Id: 0x4469}, // // extensionApplicationSettings WARNING: UNKNOWN EXTENSION, USE AT YOUR OWN RISK
+				&ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
 				&UtlsGREASEExtension{},
 				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
 			},
@@ -494,11 +521,237 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 				&CompressCertificateExtension{[]CertCompressionAlgo{
 					CertCompressionBrotli,
 				}},
-				&GenericExtension{Id: 0x4469}, // // extensionApplicationSettings WARNING: UNKNOWN EXTENSION, USE AT YOUR OWN RISK
+				&ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
+				&UtlsGREASEExtension{},
+				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
+			},
+		}, nil
+	case HelloChrome_120:
+		// Chrome 120 adds a GREASE encrypted_client_hello to the extensions
+		// of Chrome 113, before the trailing GREASE extension.
+		spec, err := utlsIdToSpec(HelloChrome_113)
+		if err != nil {
+			return ClientHelloSpec{}, err
+		}
+		n := len(spec.Extensions)
+		spec.Extensions = append(spec.Extensions[:n-2:n-2],
+			&GREASEEncryptedClientHelloExtension{}, spec.Extensions[n-2], spec.Extensions[n-1])
+		return spec, nil
+	case HelloChrome_124:
+		// Chrome 124 adds the X25519Kyber768Draft00 key share to the
+		// extensions of Chrome 120, in the same order.
+		return ClientHelloSpec{
+			CipherSuites: []uint16{
+				GREASE_PLACEHOLDER,
+				TLS_AES_128_GCM_SHA256,
+				TLS_AES_256_GCM_SHA384,
+				TLS_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+				TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+				TLS_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_RSA_WITH_AES_128_CBC_SHA,
+				TLS_RSA_WITH_AES_256_CBC_SHA,
+			},
+			CompressionMethods: []uint8{
+				0x00,
+			},
+			Extensions: []TLSExtension{
+				&UtlsGREASEExtension{},
+				&SNIExtension{},
+				&UtlsExtendedMasterSecretExtension{},
+				&RenegotiationInfoExtension{Renegotiation: RenegotiateOnceAsClient},
+				&SupportedCurvesExtension{[]CurveID{
+					CurveID(GREASE_PLACEHOLDER),
+					X25519Kyber768Draft00,
+					X25519,
+					CurveP256,
+					CurveP384,
+				}},
+				&SupportedPointsExtension{SupportedPoints: []byte{
+					0x00, // pointFormatUncompressed
+				}},
+				&SessionTicketExtension{},
+				&ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+				&StatusRequestExtension{},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256,
+					PSSWithSHA256,
+					PKCS1WithSHA256,
+					ECDSAWithP384AndSHA384,
+					PSSWithSHA384,
+					PKCS1WithSHA384,
+					PSSWithSHA512,
+					PKCS1WithSHA512,
+				}},
+				&SCTExtension{},
+				&KeyShareExtension{[]KeyShare{
+					{Group: CurveID(GREASE_PLACEHOLDER), Data: []byte{0}},
+					{Group: X25519Kyber768Draft00},
+					{Group: X25519},
+				}},
+				&PSKKeyExchangeModesExtension{[]uint8{
+					PskModeDHE,
+				}},
+				&SupportedVersionsExtension{[]uint16{
+					GREASE_PLACEHOLDER,
+					VersionTLS13,
+					VersionTLS12,
+				}},
+				&CompressCertificateExtension{[]CertCompressionAlgo{
+					CertCompressionBrotli,
+				}},
+				&ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
+				&GREASEEncryptedClientHelloExtension{},
+				&UtlsGREASEExtension{},
+				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
+			},
+		}, nil
+	case HelloChrome_H3:
+		return ClientHelloSpec{
+			CipherSuites: []uint16{
+				TLS_AES_128_GCM_SHA256,
+				TLS_AES_256_GCM_SHA384,
+				TLS_CHACHA20_POLY1305_SHA256,
+			},
+			CompressionMethods: []uint8{
+				0x00,
+			},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&SupportedCurvesExtension{[]CurveID{
+					X25519,
+					CurveP256,
+					CurveP384,
+				}},
+				&ALPNExtension{AlpnProtocols: []string{"h3"}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256,
+					PSSWithSHA256,
+					PKCS1WithSHA256,
+					ECDSAWithP384AndSHA384,
+					PSSWithSHA384,
+					PKCS1WithSHA384,
+					PSSWithSHA512,
+					PKCS1WithSHA512,
+				}},
+				&KeyShareExtension{[]KeyShare{
+					{Group: X25519},
+				}},
+				&PSKKeyExchangeModesExtension{[]uint8{
+					PskModeDHE,
+				}},
+				&SupportedVersionsExtension{[]uint16{
+					VersionTLS13,
+				}},
+				&CompressCertificateExtension{[]CertCompressionAlgo{
+					CertCompressionBrotli,
+				}},
+				&ApplicationSettingsExtension{SupportedProtocols: []string{"h3"}},
+				&QUICTransportParametersExtension{Parameters: []QUICTransportParameter{
+					QUICVarintParameter(QUICInitialMaxStreamDataBidiRemote, 6291456),
+					QUICVarintParameter(QUICMaxIdleTimeout, 30000),
+					QUICVarintParameter(QUICInitialMaxStreamsUni, 103),
+					QUICVarintParameter(QUICInitialMaxStreamDataUni, 6291456),
+					QUICVarintParameter(QUICMaxUDPPayloadSize, 1472),
+					QUICVarintParameter(QUICMaxDatagramFrameSize, 65536),
+					{ID: QUICInitialSourceConnectionID, Value: []byte{}},
+					QUICVarintParameter(QUICInitialMaxStreamDataBidiLocal, 6291456),
+					QUICVarintParameter(QUICInitialMaxData, 15728640),
+					QUICVarintParameter(QUICInitialMaxStreamsBidi, 100),
+					{ID: QUICGoogleVersion, Value: []byte{0x00, 0x00, 0x00, 0x01}},
+					{ID: QUICVersionInformation, Value: []byte{
+						0x00, 0x00, 0x00, 0x01, // chosen version
+						0x0a, 0x0a, 0x0a, 0x0a, // GREASE version
+						0x00, 0x00, 0x00, 0x01,
+					}},
+				}},
+			},
+		}, nil
+	case HelloEdge_122:
+		// Edge 122 sends the ClientHello of Chromium 122, with its extensions
+		// permuted on every connection, see permuteChromiumExtensions. It is
+		// spelled out rather than derived from a Chrome parrot, so that a
+		// change to those does not alter Edge.
+		return ClientHelloSpec{
+			CipherSuites: []uint16{
+				GREASE_PLACEHOLDER,
+				TLS_AES_128_GCM_SHA256,
+				TLS_AES_256_GCM_SHA384,
+				TLS_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+				TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+				TLS_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_RSA_WITH_AES_128_CBC_SHA,
+				TLS_RSA_WITH_AES_256_CBC_SHA,
+			},
+			CompressionMethods: []uint8{
+				0x00,
+			},
+			Extensions: []TLSExtension{
+				&UtlsGREASEExtension{},
+				&SNIExtension{},
+				&UtlsExtendedMasterSecretExtension{},
+				&RenegotiationInfoExtension{Renegotiation: RenegotiateOnceAsClient},
+				&SupportedCurvesExtension{[]CurveID{
+					CurveID(GREASE_PLACEHOLDER),
+					X25519,
+					CurveP256,
+					CurveP384,
+				}},
+				&SupportedPointsExtension{SupportedPoints: []byte{
+					0x00, // pointFormatUncompressed
+				}},
+				&SessionTicketExtension{},
+				&ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+				&StatusRequestExtension{},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256,
+					PSSWithSHA256,
+					PKCS1WithSHA256,
+					ECDSAWithP384AndSHA384,
+					PSSWithSHA384,
+					PKCS1WithSHA384,
+					PSSWithSHA512,
+					PKCS1WithSHA512,
+				}},
+				&SCTExtension{},
+				&KeyShareExtension{[]KeyShare{
+					{Group: CurveID(GREASE_PLACEHOLDER), Data: []byte{0}},
+					{Group: X25519},
+				}},
+				&PSKKeyExchangeModesExtension{[]uint8{
+					PskModeDHE,
+				}},
+				&SupportedVersionsExtension{[]uint16{
+					GREASE_PLACEHOLDER,
+					VersionTLS13,
+					VersionTLS12,
+				}},
+				&CompressCertificateExtension{[]CertCompressionAlgo{
+					CertCompressionBrotli,
+				}},
+				&ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
+				&GREASEEncryptedClientHelloExtension{},
 				&UtlsGREASEExtension{},
 				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
 			},
 		}, nil
+	case HelloChrome_Shuffle:
+		return utlsIdToSpec(LatestChromeVersion())
 	case HelloFirefox_55, HelloFirefox_56:
 		return ClientHelloSpec{
 			TLSVersMax: VersionTLS12,
@@ -615,7 +868,7 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 					PKCS1WithSHA1,
 				}},
 				&PSKKeyExchangeModesExtension{[]uint8{pskModeDHE}},
-				&FakeRecordSizeLimitExtension{0x4001},
+				&RecordSizeLimitExtension{0x4001},
 				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
 			}}, nil
 	case HelloFirefox_102:
@@ -662,7 +915,12 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 				&SessionTicketExtension{},
 				&ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
 				&StatusRequestExtension{},
-				&GenericExtension{Id: 0x0022}, // delegated_credentials
+				&DelegatedCredentialsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256,
+					ECDSAWithP384AndSHA384,
+					ECDSAWithP521AndSHA512,
+					ECDSAWithSHA1,
+				}},
 				&KeyShareExtension{[]KeyShare{
 					{Group: X25519},
 					{Group: CurveP256},
@@ -686,9 +944,119 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 					PKCS1WithSHA1,
 				}},
 				&PSKKeyExchangeModesExtension{[]uint8{pskModeDHE}},
-				&FakeRecordSizeLimitExtension{0x4001},
+				&RecordSizeLimitExtension{0x4001},
 				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
 			}}, nil
+	case HelloFirefox_128:
+		return ClientHelloSpec{
+			TLSVersMin: VersionTLS12,
+			TLSVersMax: VersionTLS13,
+			CipherSuites: []uint16{
+				TLS_AES_128_GCM_SHA256,
+				TLS_CHACHA20_POLY1305_SHA256,
+				TLS_AES_256_GCM_SHA384,
+				TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+				TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+				TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+				TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+				TLS_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_RSA_WITH_AES_128_CBC_SHA,
+				TLS_RSA_WITH_AES_256_CBC_SHA,
+			},
+			CompressionMethods: []byte{
+				compressionNone,
+			},
+			Extensions: []TLSExtension{
+				&SNIExtension{},
+				&UtlsExtendedMasterSecretExtension{},
+				&RenegotiationInfoExtension{Renegotiation: RenegotiateOnceAsClient},
+				&SupportedCurvesExtension{[]CurveID{
+					X25519MLKEM768,
+					X25519,
+					CurveP256,
+					CurveP384,
+					CurveP521,
+					CurveID(FakeFFDHE2048),
+					CurveID(FakeFFDHE3072),
+				}},
+				&SupportedPointsExtension{SupportedPoints: []byte{
+					pointFormatUncompressed,
+				}},
+				&SessionTicketExtension{},
+				&ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+				&StatusRequestExtension{},
+				&DelegatedCredentialsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256,
+					ECDSAWithP384AndSHA384,
+					ECDSAWithP521AndSHA512,
+					ECDSAWithSHA1,
+				}},
+				&KeyShareExtension{[]KeyShare{
+					{Group: X25519MLKEM768},
+					{Group: X25519},
+					{Group: CurveP256},
+				}},
+				&SupportedVersionsExtension{[]uint16{
+					VersionTLS13,
+					VersionTLS12}},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256,
+					ECDSAWithP384AndSHA384,
+					ECDSAWithP521AndSHA512,
+					PSSWithSHA256,
+					PSSWithSHA384,
+					PSSWithSHA512,
+					PKCS1WithSHA256,
+					PKCS1WithSHA384,
+					PKCS1WithSHA512,
+					ECDSAWithSHA1,
+					PKCS1WithSHA1,
+				}},
+				&PSKKeyExchangeModesExtension{[]uint8{pskModeDHE}},
+				&RecordSizeLimitExtension{0x4001},
+				&CompressCertificateExtension{[]CertCompressionAlgo{
+					CertCompressionZlib,
+					CertCompressionBrotli,
+					CertCompressionZstd,
+				}},
+				&GREASEEncryptedClientHelloExtension{},
+			}}, nil
+	case HelloFirefox_128_Kyber:
+		spec, err := utlsIdToSpec(HelloFirefox_128)
+		if err != nil {
+			return ClientHelloSpec{}, err
+		}
+		for _, ext := range spec.Extensions {
+			switch ext := ext.(type) {
+			case *SupportedCurvesExtension:
+				ext.Curves[0] = X25519Kyber768Draft00
+			case *KeyShareExtension:
+				ext.KeyShares[0].Group = X25519Kyber768Draft00
+			}
+		}
+		return spec, nil
+	case HelloFirefox_Tor:
+		spec, err := utlsIdToSpec(HelloFirefox_128)
+		if err != nil {
+			return ClientHelloSpec{}, err
+		}
+		extensions := spec.Extensions[:0]
+		for _, ext := range spec.Extensions {
+			switch ext.(type) {
+			case *SessionTicketExtension, *GREASEEncryptedClientHelloExtension:
+				continue
+			}
+			extensions = append(extensions, ext)
+		}
+		spec.Extensions = extensions
+		return spec, nil
 	case HelloOpera_89:
 		return ClientHelloSpec{
 			TLSVersMin: VersionTLS10,
@@ -757,7 +1125,7 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 				&CompressCertificateExtension{[]CertCompressionAlgo{
 					CertCompressionBrotli,
 				}},
-				&GenericExtension{Id: 0x4469}, // extensionApplicationSettings
+				&ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}},
 				&UtlsGREASEExtension{},
 				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
 			}}, nil
@@ -962,6 +1330,87 @@ func utlsIdToSpec(id ClientHelloID) (ClientHelloSpec, error) {
 			},
 		}, nil
 
+	case HelloSafari_iOS_17_0:
+		return ClientHelloSpec{
+			CipherSuites: []uint16{
+				GREASE_PLACEHOLDER,
+				TLS_AES_128_GCM_SHA256,
+				TLS_AES_256_GCM_SHA384,
+				TLS_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+				TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+				TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+				TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+				TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+				TLS_RSA_WITH_AES_256_GCM_SHA384,
+				TLS_RSA_WITH_AES_128_GCM_SHA256,
+				TLS_RSA_WITH_AES_256_CBC_SHA,
+				TLS_RSA_WITH_AES_128_CBC_SHA,
+				TLS_ECDHE_ECDSA_WITH_3DES_EDE_CBC_SHA,
+				TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+				TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+			},
+			CompressionMethods: []byte{
+				compressionNone,
+			},
+			// Unlike desktop Safari, iOS 17 does not send compress_certificate.
+			Extensions: []TLSExtension{
+				&UtlsGREASEExtension{},
+				&SNIExtension{},
+				&UtlsExtendedMasterSecretExtension{},
+				&RenegotiationInfoExtension{Renegotiation: RenegotiateOnceAsClient},
+				&SupportedCurvesExtension{[]CurveID{
+					CurveID(GREASE_PLACEHOLDER),
+					X25519,
+					CurveP256,
+					CurveP384,
+					CurveP521,
+				}},
+				&SupportedPointsExtension{SupportedPoints: []byte{
+					pointFormatUncompressed,
+				}},
+				&ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+				&StatusRequestExtension{},
+				&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+					ECDSAWithP256AndSHA256,
+					PSSWithSHA256,
+					PKCS1WithSHA256,
+					ECDSAWithP384AndSHA384,
+					ECDSAWithSHA1,
+					PSSWithSHA384,
+					PSSWithSHA384,
+					PKCS1WithSHA384,
+					PSSWithSHA512,
+					PKCS1WithSHA512,
+					PKCS1WithSHA1,
+				}},
+				&SCTExtension{},
+				&KeyShareExtension{[]KeyShare{
+					{Group: CurveID(GREASE_PLACEHOLDER), Data: []byte{0}},
+					{Group: X25519},
+				}},
+				&PSKKeyExchangeModesExtension{[]uint8{
+					PskModeDHE,
+				}},
+				&SupportedVersionsExtension{[]uint16{
+					GREASE_PLACEHOLDER,
+					VersionTLS13,
+					VersionTLS12,
+					VersionTLS11,
+					VersionTLS10,
+				}},
+				&UtlsGREASEExtension{},
+				// The hello is padded to 512 bytes only when it falls
+				// between 256 and 511 bytes, as BoringSSL does.
+				&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
+			},
+		}, nil
+
 	case HelloSafari_15_3:
 		return ClientHelloSpec{
 			CipherSuites: []uint16{
@@ -1133,7 +1582,7 @@ func (uconn *UConn) applyPresetByID(id ClientHelloID) (err error) {
 	uconn.ClientHelloID = id
 	// choose/generate the spec
 	switch id.Client {
-	case helloRandomized, helloRandomizedNoALPN, helloRandomizedALPN:
+	case helloRandomized, helloRandomizedNoALPN, helloRandomizedALPN, helloRandomizedTLS13, helloRandomizedTLS12:
 		spec, err = uconn.generateRandomizedSpec()
 		if err != nil {
 			return err
@@ -1146,17 +1595,48 @@ func (uconn *UConn) applyPresetByID(id ClientHelloID) (err error) {
 		if err != nil {
 			return err
 		}
+		if resolved := resolveClientHelloID(id); resolved == HelloEdge_122 || resolved == HelloChrome_Shuffle {
+			if err := uconn.permuteChromiumExtensions(&spec); err != nil {
+				return err
+			}
+		}
 	}
 
 	return uconn.ApplyPreset(&spec)
 }
 
+// permuteChromiumExtensions shuffles the extensions of spec as Chromium does
+// on every connection since version 110, see ClientHelloSpec.PermuteExtensions.
+// The order is drawn from the seed of the ClientHelloID, if any, or from
+// Config.Rand.
+func (uconn *UConn) permuteChromiumExtensions(spec *ClientHelloSpec) error {
+	seed := uconn.ClientHelloID.Seed
+	if seed == nil {
+		seed = new(PRNGSeed)
+		if _, err := io.ReadFull(uconn.config.rand(), seed[:]); err != nil {
+			return errors.New("tls: short read from Rand: " + err.Error())
+		}
+	}
+	r, err := newPRNGWithSeed(seed)
+	if err != nil {
+		return err
+	}
+	spec.permuteExtensions(r)
+	return nil
+}
+
 // ApplyPreset should only be used in conjunction with HelloCustom to apply custom specs.
 // Fields of TLSExtensions that are slices/pointers are shared across different connections with
 // same ClientHelloSpec. It is advised to use different specs and avoid any shared state.
+// Once applied, p can no longer be changed with InsertExtension, RemoveExtensionByType
+// or SwapExtensions, the extensions of the UConn are changed with SetExtensions instead.
 func (uconn *UConn) ApplyPreset(p *ClientHelloSpec) error {
 	var err error
+	uconn.helloTime = time.Time{}
 
+	if err := checkQUICExtensions(p.Extensions); err != nil {
+		return err
+	}
 	err = uconn.SetTLSVers(p.TLSVersMin, p.TLSVersMax, p.Extensions)
 	if err != nil {
 		return err
@@ -1169,7 +1649,6 @@ func (uconn *UConn) ApplyPreset(p *ClientHelloSpec) error {
 	uconn.HandshakeState.Hello = privateHello.getPublicPtr()
 	uconn.HandshakeState.State13.EcdheParams = ecdheParamMapToPublic(ecdheParams)
 	hello := uconn.HandshakeState.Hello
-	session := uconn.HandshakeState.Session
 
 	switch len(hello.Random) {
 	case 0:
@@ -1194,19 +1673,36 @@ func (uconn *UConn) ApplyPreset(p *ClientHelloSpec) error {
 	// Currently, GREASE is assumed to come from BoringSSL
 	grease_bytes := make([]byte, 2*ssl_grease_last_index)
 	grease_extensions_seen := 0
-	_, err = io.ReadFull(uconn.config.rand(), grease_bytes)
+	greaseRand := uconn.config.rand()
+	uconn.greaseRand = nil
+	if uconn.greasePRNGSeed != nil {
+		if greaseRand, err = newPRNGWithSeed(uconn.greasePRNGSeed); err != nil {
+			return err
+		}
+		// The GREASE ECH extension keeps drawing from it in ApplyConfig.
+		uconn.greaseRand = greaseRand
+	}
+	_, err = io.ReadFull(greaseRand, grease_bytes)
 	if err != nil {
 		return errors.New("tls: short read from Rand: " + err.Error())
 	}
 	for i := range uconn.greaseSeed {
 		uconn.greaseSeed[i] = binary.LittleEndian.Uint16(grease_bytes[2*i : 2*i+2])
 	}
-	if uconn.greaseSeed[ssl_grease_extension1] == uconn.greaseSeed[ssl_grease_extension2] {
+	// The two GREASE extensions must differ, which depends only on the bits
+	// of the seeds GetBoringGREASEValue keeps.
+	if GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_extension1) ==
+		GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_extension2) {
 		uconn.greaseSeed[ssl_grease_extension2] ^= 0x1010
 	}
 
 	hello.CipherSuites = make([]uint16, len(p.CipherSuites))
 	copy(hello.CipherSuites, p.CipherSuites)
+	if len(p.CompressionMethods) > 0 {
+		// Advertised verbatim: servers selecting anything but null
+		// compression are still refused.
+		hello.CompressionMethods = append([]uint8{}, p.CompressionMethods...)
+	}
 	for i := range hello.CipherSuites {
 		if hello.CipherSuites[i] == GREASE_PLACEHOLDER {
 			hello.CipherSuites[i] = GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_cipher)
@@ -1215,102 +1711,160 @@ func (uconn *UConn) ApplyPreset(p *ClientHelloSpec) error {
 	uconn.GetSessionID = p.GetSessionID
 	uconn.Extensions = make([]TLSExtension, len(p.Extensions))
 	copy(uconn.Extensions, p.Extensions)
+	p.applied = true
 
 	// reGrease, and point things to each other
-	for _, e := range uconn.Extensions {
-		switch ext := e.(type) {
-		case *SNIExtension:
-			if ext.ServerName == "" {
-				ext.ServerName = uconn.config.ServerName
-			}
-		case *UtlsGREASEExtension:
-			switch grease_extensions_seen {
-			case 0:
-				ext.Value = GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_extension1)
-			case 1:
-				ext.Value = GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_extension2)
+	for i, e := range uconn.Extensions {
+		if isPreSharedKeyExtension(e) && i != len(uconn.Extensions)-1 {
+			return errors.New("tls: PreSharedKeyExtension must be the last extension")
+		}
+		if err := uconn.prepareExtension(e, &grease_extensions_seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareExtension fills in the fields of e that depend on the connection:
+// GREASE values, key shares, the server name, and the session to resume.
+// greaseSeen counts the GREASE extensions already prepared, as the first and
+// second ones get different values.
+func (uconn *UConn) prepareExtension(e TLSExtension, greaseSeen *int) error {
+	switch ext := e.(type) {
+	case *SNIExtension:
+		if ext.ServerName == "" {
+			ext.ServerName = uconn.config.ServerName
+		}
+	case *UtlsGREASEExtension:
+		switch *greaseSeen {
+		case 0:
+			ext.Value = GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_extension1)
+		case 1:
+			ext.Value = GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_extension2)
+			if ext.Body == nil {
 				ext.Body = []byte{0}
-			default:
-				return errors.New("at most 2 grease extensions are supported")
 			}
-			grease_extensions_seen += 1
-		case *SessionTicketExtension:
-			if session == nil && uconn.config.ClientSessionCache != nil {
-				cacheKey := clientSessionCacheKey(uconn.RemoteAddr(), uconn.config)
-				session, _ = uconn.config.ClientSessionCache.Get(cacheKey)
-				// TODO: use uconn.loadSession(hello.getPrivateObj()) to support TLS 1.3 PSK-style resumption
+		default:
+			return errors.New("at most 2 grease extensions are supported")
+		}
+		*greaseSeen += 1
+	case *SessionTicketExtension:
+		session := uconn.HandshakeState.Session
+		if session == nil && uconn.config.ClientSessionCache != nil {
+			cacheKey := clientSessionCacheKey(uconn.RemoteAddr(), uconn.config)
+			session, _ = uconn.config.ClientSessionCache.Get(cacheKey)
+			if session != nil && session.vers == VersionTLS13 && uconn.config.time().After(session.useBy) {
+				// The ticket lifetime has passed, see RFC 8446, Section 4.6.1.
+				uconn.config.ClientSessionCache.Put(cacheKey, nil)
+				session = nil
+			}
+			if session != nil && session.vers == VersionTLS13 {
+				// TLS 1.3 sessions are offered in the pre_shared_key
+				// extension, the session_ticket one stays empty.
+				session = nil
 			}
-			err := uconn.SetSessionState(session)
-			if err != nil {
-				return err
+		}
+		err := uconn.SetSessionState(session)
+		if err != nil {
+			return err
+		}
+	case *SupportedCurvesExtension:
+		for i := range ext.Curves {
+			if ext.Curves[i] == GREASE_PLACEHOLDER {
+				ext.Curves[i] = CurveID(GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_group))
 			}
-		case *SupportedCurvesExtension:
-			for i := range ext.Curves {
-				if ext.Curves[i] == GREASE_PLACEHOLDER {
-					ext.Curves[i] = CurveID(GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_group))
+		}
+	case *KeyShareExtension:
+		for i := range ext.KeyShares {
+			curveID := ext.KeyShares[i].Group
+			if curveID == GREASE_PLACEHOLDER {
+				ext.KeyShares[i].Group = CurveID(GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_group))
+				if len(ext.KeyShares[i].Data) == 0 {
+					// key_exchange cannot be empty, BoringSSL sends a zero byte.
+					ext.KeyShares[i].Data = []byte{0}
 				}
+				continue
 			}
-		case *KeyShareExtension:
-			for i := range ext.KeyShares {
-				curveID := ext.KeyShares[i].Group
-				if curveID == GREASE_PLACEHOLDER {
-					ext.KeyShares[i].Group = CurveID(GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_group))
-					continue
+			if len(ext.KeyShares[i].Data) > 1 {
+				continue
+			}
+
+			var params ecdheParameters
+			switch utlsSupportedGroups[curveID] {
+			case true:
+				var ok bool
+				params, ok = uconn.HandshakeState.State13.EcdheParams[curveID]
+				if !ok {
+					// Should never happen.
+					return fmt.Errorf("BUG: unsupported Curve in KeyShareExtension: %v.", curveID)
 				}
-				if len(ext.KeyShares[i].Data) > 1 {
-					continue
+			case false:
+				var err error
+				params, err = generateECDHEParameters(uconn.config.rand(), curveID)
+				if err != nil {
+					return fmt.Errorf("unsupported Curve in KeyShareExtension: %v."+
+						"To mimic it, fill the Data(key) field manually.", curveID)
 				}
-
-				var params ecdheParameters
-				switch utlsSupportedGroups[curveID] {
-				case true:
-					var ok bool
-					params, ok = uconn.HandshakeState.State13.EcdheParams[curveID]
-					if !ok {
-						// Should never happen.
-						return fmt.Errorf("BUG: unsupported Curve in KeyShareExtension: %v.", curveID)
-					}
-				case false:
-					var err error
-					params, err = generateECDHEParameters(uconn.config.rand(), curveID)
-					if err != nil {
-						return fmt.Errorf("unsupported Curve in KeyShareExtension: %v."+
-							"To mimic it, fill the Data(key) field manually.", curveID)
-					}
+				if isKEMGroup(curveID) {
+					// Keep the KEM key to decapsulate the server share.
+					uconn.HandshakeState.State13.EcdheParams[curveID] = params
 				}
-
-				ext.KeyShares[i].Data = params.PublicKey()
 			}
-		case *SupportedVersionsExtension:
-			for i := range ext.Versions {
-				if ext.Versions[i] == GREASE_PLACEHOLDER {
-					ext.Versions[i] = GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_version)
-				}
+
+			ext.KeyShares[i].Data = params.PublicKey()
+		}
+	case *SupportedVersionsExtension:
+		for i := range ext.Versions {
+			if ext.Versions[i] == GREASE_PLACEHOLDER {
+				ext.Versions[i] = GetBoringGREASEValue(uconn.greaseSeed, ssl_grease_version)
 			}
-		case *CompressCertificateExtension:
-			uconn.HandshakeState.State13.CertCompAlgs = ext.Algorithms
+		}
+	case *CompressCertificateExtension:
+		uconn.HandshakeState.State13.CertCompAlgs = ext.Algorithms
+	case *ECHExtension:
+		if err := uconn.SetECHConfigs(ext.Configs); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// generateRandomizedSpec generates the spec of a randomized ClientHelloID,
+// seeding it first if needed. The seed is kept in uconn.ClientHelloID, so
+// that the spec can be generated again.
 func (uconn *UConn) generateRandomizedSpec() (ClientHelloSpec, error) {
-	p := ClientHelloSpec{}
-
 	if uconn.ClientHelloID.Seed == nil {
-		seed, err := NewPRNGSeed()
-		if err != nil {
-			return p, err
+		// Drawn from Config.Rand, so that a RandomnessRecorder records it.
+		seed := new(PRNGSeed)
+		if _, err := io.ReadFull(uconn.config.rand(), seed[:]); err != nil {
+			return ClientHelloSpec{}, errors.New("tls: short read from Rand: " + err.Error())
 		}
 		uconn.ClientHelloID.Seed = seed
 	}
+	return randomizedSpec(uconn.ClientHelloID, uconn.config.NextProtos)
+}
 
-	r, err := newPRNGWithSeed(uconn.ClientHelloID.Seed)
+// UTLSRandomizedSpec returns the ClientHelloSpec HelloRandomized generates
+// when seeded with seed, see ClientHelloID.WithSeed. The cipher suites, curves
+// and extensions are drawn with the odds observed in real-world ClientHellos,
+// and are always consistent, so that the spec may be applied with ApplyPreset.
+func UTLSRandomizedSpec(seed int64) (*ClientHelloSpec, error) {
+	spec, err := randomizedSpec(HelloRandomized.WithSeed(seed), nil)
 	if err != nil {
-		return p, err
+		return nil, err
 	}
+	return &spec, nil
+}
 
-	id := uconn.ClientHelloID
+// randomizedSpec generates the spec of the seeded randomized id. The ALPN
+// extension, if any, offers nextProtos, or h2 and http/1.1 if it is empty.
+func randomizedSpec(id ClientHelloID, nextProtos []string) (ClientHelloSpec, error) {
+	p := ClientHelloSpec{}
+
+	r, err := newPRNGWithSeed(id.Seed)
+	if err != nil {
+		return p, err
+	}
 
 	var WithALPN bool
 	switch id.Client {
@@ -1318,7 +1872,7 @@ func (uconn *UConn) generateRandomizedSpec() (ClientHelloSpec, error) {
 		WithALPN = true
 	case helloRandomizedNoALPN:
 		WithALPN = false
-	case helloRandomized:
+	case helloRandomized, helloRandomizedTLS13, helloRandomizedTLS12:
 		if r.FlipWeightedCoin(0.7) {
 			WithALPN = true
 		} else {
@@ -1335,28 +1889,34 @@ func (uconn *UConn) generateRandomizedSpec() (ClientHelloSpec, error) {
 		return p, err
 	}
 
-	if r.FlipWeightedCoin(0.4) {
+	tls13Only := id.Client == helloRandomizedTLS13
+	switch {
+	case tls13Only:
+		p.TLSVersMin = VersionTLS13
+		p.TLSVersMax = VersionTLS13
+		shuffledSuites = shuffledCiphersTLS13(r)
+	case id.Client == helloRandomizedTLS12:
+		p.TLSVersMin = VersionTLS12
+		p.TLSVersMax = VersionTLS12
+		shuffledSuites = removeRC4Ciphers(shuffledSuites)
+	case r.FlipWeightedCoin(0.4):
 		p.TLSVersMin = VersionTLS10
 		p.TLSVersMax = VersionTLS13
-		tls13ciphers := make([]uint16, len(defaultCipherSuitesTLS13()))
-		copy(tls13ciphers, defaultCipherSuitesTLS13())
-		r.rand.Shuffle(len(tls13ciphers), func(i, j int) {
-			tls13ciphers[i], tls13ciphers[j] = tls13ciphers[j], tls13ciphers[i]
-		})
 		// appending TLS 1.3 ciphers before TLS 1.2, since that's what popular implementations do
-		shuffledSuites = append(tls13ciphers, shuffledSuites...)
+		shuffledSuites = append(shuffledCiphersTLS13(r), shuffledSuites...)
 
 		// TLS 1.3 forbids RC4 in any configurations
 		shuffledSuites = removeRC4Ciphers(shuffledSuites)
-	} else {
+	default:
 		p.TLSVersMin = VersionTLS10
 		p.TLSVersMax = VersionTLS12
 	}
 
 	p.CipherSuites = removeRandomCiphers(r, shuffledSuites, 0.4)
 
-	sni := SNIExtension{uconn.config.ServerName}
-	sessionTicket := SessionTicketExtension{Session: uconn.HandshakeState.Session}
+	// ApplyPreset fills in the server name and the session.
+	sni := SNIExtension{}
+	sessionTicket := SessionTicketExtension{}
 
 	sigAndHashAlgos := []SignatureScheme{
 		ECDSAWithP256AndSHA256,
@@ -1383,6 +1943,11 @@ func (uconn *UConn) generateRandomizedSpec() (ClientHelloSpec, error) {
 		}
 	}
 
+	if tls13Only {
+		// TLS 1.3 forbids SHA-1 signatures
+		sigAndHashAlgos = removeSHA1SignatureSchemes(sigAndHashAlgos)
+	}
+
 	r.rand.Shuffle(len(sigAndHashAlgos), func(i, j int) {
 		sigAndHashAlgos[i], sigAndHashAlgos[j] = sigAndHashAlgos[j], sigAndHashAlgos[i]
 	})
@@ -1414,13 +1979,21 @@ func (uconn *UConn) generateRandomizedSpec() (ClientHelloSpec, error) {
 		&points,
 		&curves,
 	}
+	if tls13Only {
+		// session tickets and point formats are superseded in TLS 1.3
+		p.Extensions = []TLSExtension{
+			&sni,
+			&sigAndHash,
+			&curves,
+		}
+	}
 
 	if WithALPN {
-		if len(uconn.config.NextProtos) == 0 {
+		if len(nextProtos) == 0 {
 			// if user didn't specify alpn yet, choose something popular
-			uconn.config.NextProtos = []string{"h2", "http/1.1"}
+			nextProtos = []string{"h2", "http/1.1"}
 		}
-		alpn := ALPNExtension{AlpnProtocols: uconn.config.NextProtos}
+		alpn := ALPNExtension{AlpnProtocols: nextProtos}
 		p.Extensions = append(p.Extensions, &alpn)
 	}
 
@@ -1435,10 +2008,11 @@ func (uconn *UConn) generateRandomizedSpec() (ClientHelloSpec, error) {
 	if r.FlipWeightedCoin(0.46) {
 		p.Extensions = append(p.Extensions, &sct)
 	}
-	if r.FlipWeightedCoin(0.75) {
+	// renegotiation_info and extended_master_secret only apply to TLS 1.2
+	if r.FlipWeightedCoin(0.75) && !tls13Only {
 		p.Extensions = append(p.Extensions, &reneg)
 	}
-	if r.FlipWeightedCoin(0.77) {
+	if r.FlipWeightedCoin(0.77) && !tls13Only {
 		p.Extensions = append(p.Extensions, &ems)
 	}
 	if p.TLSVersMax == VersionTLS13 {
@@ -1494,6 +2068,27 @@ func shuffledCiphers(r *prng) ([]uint16, error) {
 	return ciphers.GetCiphers(), nil
 }
 
+// shuffledCiphersTLS13 returns the default TLS 1.3 cipher suites in random
+// order.
+func shuffledCiphersTLS13(r *prng) []uint16 {
+	ciphers := make([]uint16, len(defaultCipherSuitesTLS13()))
+	copy(ciphers, defaultCipherSuitesTLS13())
+	r.rand.Shuffle(len(ciphers), func(i, j int) {
+		ciphers[i], ciphers[j] = ciphers[j], ciphers[i]
+	})
+	return ciphers
+}
+
+func removeSHA1SignatureSchemes(s []SignatureScheme) []SignatureScheme {
+	var schemes []SignatureScheme
+	for _, scheme := range s {
+		if scheme != PKCS1WithSHA1 && scheme != ECDSAWithSHA1 {
+			schemes = append(schemes, scheme)
+		}
+	}
+	return schemes
+}
+
 type sortableCipher struct {
 	isObsolete bool
 	randomTag  int
@@ -0,0 +1,258 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"errors"
+	"io"
+)
+
+// QUIC transport parameters, see RFC 9000, Section 18.2.
+const (
+	QUICOriginalDestinationConnectionID uint64 = 0x00
+	QUICMaxIdleTimeout                  uint64 = 0x01
+	QUICStatelessResetToken             uint64 = 0x02
+	QUICMaxUDPPayloadSize               uint64 = 0x03
+	QUICInitialMaxData                  uint64 = 0x04
+	QUICInitialMaxStreamDataBidiLocal   uint64 = 0x05
+	QUICInitialMaxStreamDataBidiRemote  uint64 = 0x06
+	QUICInitialMaxStreamDataUni         uint64 = 0x07
+	QUICInitialMaxStreamsBidi           uint64 = 0x08
+	QUICInitialMaxStreamsUni            uint64 = 0x09
+	QUICAckDelayExponent                uint64 = 0x0a
+	QUICMaxAckDelay                     uint64 = 0x0b
+	QUICDisableActiveMigration          uint64 = 0x0c
+	QUICPreferredAddress                uint64 = 0x0d
+	QUICActiveConnectionIDLimit         uint64 = 0x0e
+	QUICInitialSourceConnectionID       uint64 = 0x0f
+	QUICRetrySourceConnectionID         uint64 = 0x10
+
+	QUICVersionInformation   uint64 = 0x11   // RFC 9368, Section 3
+	QUICMaxDatagramFrameSize uint64 = 0x20   // RFC 9221, Section 3
+	QUICGoogleVersion        uint64 = 0x4752 // sent by Chrome
+)
+
+// quicMaxVarint is the largest QUIC variable-length integer.
+const quicMaxVarint = 1<<62 - 1
+
+// A QUICTransportParameter is a QUIC transport parameter, with its value as
+// sent on the wire.
+type QUICTransportParameter struct {
+	ID    uint64
+	Value []byte
+}
+
+// QUICVarintParameter returns the transport parameter id with an integer
+// value, encoded as a variable-length integer, see RFC 9000, Section 16.
+func QUICVarintParameter(id, value uint64) QUICTransportParameter {
+	return QUICTransportParameter{ID: id, Value: appendQUICVarint(nil, value)}
+}
+
+// QUICTransportParametersExtension is the quic_transport_parameters extension
+// of a QUIC ClientHello, see RFC 9001, Section 8.2. Parameters are sent in
+// order, which, as it is specific to each QUIC implementation, is part of the
+// fingerprint. See UConn.QUICClientHello.
+type QUICTransportParametersExtension struct {
+	Parameters []QUICTransportParameter
+}
+
+func (e *QUICTransportParametersExtension) writeToUConn(uc *UConn) error {
+	for _, p := range e.Parameters {
+		if p.ID > quicMaxVarint {
+			return errors.New("tls: invalid QUIC transport parameter ID")
+		}
+	}
+	if e.Len() > 0xffff+4 {
+		return errors.New("tls: QUIC transport parameters are too long")
+	}
+	return nil
+}
+
+func (e *QUICTransportParametersExtension) Len() int {
+	n := 4
+	for _, p := range e.Parameters {
+		n += quicVarintLen(p.ID) + quicVarintLen(uint64(len(p.Value))) + len(p.Value)
+	}
+	return n
+}
+
+func (e *QUICTransportParametersExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	data := make([]byte, 0, e.Len()-4)
+	for _, p := range e.Parameters {
+		data = appendQUICVarint(data, p.ID)
+		data = appendQUICVarint(data, uint64(len(p.Value)))
+		data = append(data, p.Value...)
+	}
+	b[0] = byte(utlsExtensionQUICTransportParams >> 8)
+	b[1] = byte(utlsExtensionQUICTransportParams)
+	b[2] = byte(len(data) >> 8)
+	b[3] = byte(len(data))
+	copy(b[4:], data)
+	return e.Len(), io.EOF
+}
+
+// parseQUICTransportParameters parses the body of a quic_transport_parameters
+// extension.
+func parseQUICTransportParameters(data []byte) ([]QUICTransportParameter, error) {
+	var params []QUICTransportParameter
+	for len(data) > 0 {
+		id, n := readQUICVarint(data)
+		if n == 0 {
+			return nil, errors.New("malformed QUIC transport parameter ID")
+		}
+		data = data[n:]
+		length, n := readQUICVarint(data)
+		if n == 0 || uint64(len(data)-n) < length {
+			return nil, errors.New("malformed QUIC transport parameter value")
+		}
+		data = data[n:]
+		params = append(params, QUICTransportParameter{ID: id, Value: append([]byte{}, data[:length]...)})
+		data = data[length:]
+	}
+	return params, nil
+}
+
+// quicVarintLen returns the length of v encoded as a QUIC variable-length
+// integer.
+func quicVarintLen(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// appendQUICVarint appends v, which must be at most 2^62-1, to b as a QUIC
+// variable-length integer, see RFC 9000, Section 16.
+func appendQUICVarint(b []byte, v uint64) []byte {
+	n := quicVarintLen(v)
+	switch n {
+	case 2:
+		v |= 0x4000
+	case 4:
+		v |= 0x80000000
+	case 8:
+		v |= 0xc000000000000000
+	}
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+// readQUICVarint reads a QUIC variable-length integer from the start of b,
+// and returns it and its length, or a zero length if b is too short.
+func readQUICVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+// QUICClientHello returns the ClientHello handshake message, without a record
+// header, to send in the CRYPTO frames of a QUIC Initial packet, see RFC 9001,
+// Section 4. The ClientHelloSpec must offer TLS 1.3 only, ALPN and a
+// QUICTransportParametersExtension. The legacy_session_id is left empty, as
+// QUIC does not use the middlebox compatibility mode, and early_data is only
+// offered along with a PSK, as in TLS.
+//
+// The rest of the handshake is carried by QUIC, so the UConn must not be used
+// to run it.
+func (uconn *UConn) QUICClientHello() ([]byte, error) {
+	if uconn.ClientHelloID == HelloGolang {
+		return nil, errors.New("tls: QUIC ClientHellos are not supported with HelloGolang")
+	}
+	if uconn.clientHelloSent() {
+		return nil, errClientHelloSent
+	}
+	uconn.legacySessionID = []byte{}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+
+	hasVersions, hasParams, hasALPN := false, false, false
+	for _, ext := range uconn.Extensions {
+		switch ext := ext.(type) {
+		case *SupportedVersionsExtension:
+			hasVersions = true
+		case *QUICTransportParametersExtension:
+			hasParams = true
+		case *ALPNExtension:
+			hasALPN = len(ext.AlpnProtocols) > 0
+		}
+	}
+	switch {
+	case !hasVersions || uconn.config.MinVersion != VersionTLS13:
+		return nil, errors.New("tls: QUIC requires TLS 1.3 only in supported_versions")
+	case !hasParams:
+		return nil, errors.New("tls: QUIC requires a QUICTransportParametersExtension")
+	case !hasALPN:
+		return nil, errors.New("tls: QUIC requires ALPN")
+	}
+	return append([]byte{}, uconn.HandshakeState.Hello.Raw...), nil
+}
+
+// QUICTransportParameters returns the QUICTransportParametersExtension of the
+// ClientHelloSpec, or nil if it has none, so that a QUIC implementation can
+// run with the transport parameters it advertises, as with HelloChrome_H3. It
+// may update the parameters, such as initial_source_connection_id, before
+// calling QUICClientHello. The handshake state is built first, if it was not
+// already.
+func (uconn *UConn) QUICTransportParameters() (*QUICTransportParametersExtension, error) {
+	if !uconn.ClientHelloBuilt {
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+	}
+	for _, ext := range uconn.Extensions {
+		if ext, ok := ext.(*QUICTransportParametersExtension); ok {
+			return ext, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkQUICExtensions returns an error if a ClientHelloSpec with a
+// QUICTransportParametersExtension has extensions QUIC does not allow: QUIC
+// only runs TLS 1.3, which resumes sessions with pre_shared_key rather than
+// session_ticket, and does not renegotiate, see RFC 9001, Section 4.2.
+func checkQUICExtensions(extensions []TLSExtension) error {
+	isQUIC := false
+	for _, ext := range extensions {
+		if _, ok := ext.(*QUICTransportParametersExtension); ok {
+			isQUIC = true
+		}
+	}
+	if !isQUIC {
+		return nil
+	}
+	for _, ext := range extensions {
+		switch ext.(type) {
+		case *SessionTicketExtension:
+			return errors.New("tls: QUIC does not allow the session_ticket extension")
+		case *RenegotiationInfoExtension:
+			return errors.New("tls: QUIC does not allow the renegotiation_info extension")
+		case *NPNExtension:
+			return errors.New("tls: QUIC does not allow the next_protocol_negotiation extension")
+		}
+	}
+	return nil
+}
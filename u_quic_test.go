@@ -0,0 +1,206 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestQUICVarint(t *testing.T) {
+	// Examples from RFC 9000, Appendix A.1.
+	for _, test := range []struct {
+		v       uint64
+		encoded []byte
+	}{
+		{151288809941952652, []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}},
+		{494878333, []byte{0x9d, 0x7f, 0x3e, 0x7d}},
+		{15293, []byte{0x7b, 0xbd}},
+		{37, []byte{0x25}},
+	} {
+		if got := appendQUICVarint(nil, test.v); !bytes.Equal(got, test.encoded) {
+			t.Errorf("%d encoded as %x, want %x", test.v, got, test.encoded)
+		}
+		if v, n := readQUICVarint(test.encoded); v != test.v || n != len(test.encoded) {
+			t.Errorf("%x decoded as %d (%d bytes), want %d", test.encoded, v, n, test.v)
+		}
+	}
+	if _, n := readQUICVarint([]byte{0x9d, 0x7f}); n != 0 {
+		t.Error("decoded a truncated varint")
+	}
+}
+
+func quicSpec(versions []uint16, params *QUICTransportParametersExtension) *ClientHelloSpec {
+	extensions := []TLSExtension{
+		&SNIExtension{},
+		&ALPNExtension{AlpnProtocols: []string{"h3"}},
+		&SupportedCurvesExtension{[]CurveID{X25519, CurveP256}},
+		&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256, PSSWithSHA256, PKCS1WithSHA256,
+		}},
+		&KeyShareExtension{[]KeyShare{{Group: X25519}}},
+		&PSKKeyExchangeModesExtension{[]uint8{PskModeDHE}},
+		&SupportedVersionsExtension{versions},
+	}
+	if params != nil {
+		extensions = append(extensions, params)
+	}
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384, TLS_CHACHA20_POLY1305_SHA256},
+		Extensions:   extensions,
+	}
+}
+
+func TestQUICClientHello(t *testing.T) {
+	params := &QUICTransportParametersExtension{Parameters: []QUICTransportParameter{
+		QUICVarintParameter(QUICMaxIdleTimeout, 30000),
+		QUICVarintParameter(QUICInitialMaxData, 15728640),
+		{ID: QUICInitialSourceConnectionID, Value: []byte{1, 2, 3, 4}},
+		{ID: 0x4752, Value: nil},
+	}}
+	wantParams := []byte{
+		0x01, 0x04, 0x80, 0x00, 0x75, 0x30,
+		0x04, 0x04, 0x80, 0xf0, 0x00, 0x00,
+		0x0f, 0x04, 1, 2, 3, 4,
+		0x80, 0x00, 0x47, 0x52, 0x00,
+	}
+
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+	if err := uconn.ApplyPreset(quicSpec([]uint16{VersionTLS13}, params)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := uconn.QUICClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m clientHelloMsg
+	if !m.unmarshal(raw) {
+		t.Fatal("failed to unmarshal the QUIC ClientHello")
+	}
+	if len(m.sessionId) != 0 {
+		t.Errorf("legacy_session_id is %x, want it empty", m.sessionId)
+	}
+	if !reflect.DeepEqual(m.supportedVersions, []uint16{VersionTLS13}) {
+		t.Errorf("supported_versions is %x, want TLS 1.3 only", m.supportedVersions)
+	}
+	wantExt := append([]byte{0x00, 0x39, 0x00, byte(len(wantParams))}, wantParams...)
+	if !bytes.Contains(raw, wantExt) {
+		t.Errorf("ClientHello does not contain the transport parameters %x", wantExt)
+	}
+
+	spec, err := (&Fingerprinter{}).FingerprintClientHelloBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed *QUICTransportParametersExtension
+	for _, ext := range spec.Extensions {
+		if ext, ok := ext.(*QUICTransportParametersExtension); ok {
+			parsed = ext
+		}
+	}
+	if parsed == nil {
+		t.Fatal("Fingerprinter did not parse the transport parameters")
+	}
+	b := make([]byte, parsed.Len())
+	parsed.Read(b)
+	if !bytes.Equal(b, wantExt) {
+		t.Errorf("fingerprinted transport parameters marshal to %x, want %x", b, wantExt)
+	}
+
+	for name, spec := range map[string]*ClientHelloSpec{
+		"TLS 1.2":               quicSpec([]uint16{VersionTLS13, VersionTLS12}, params),
+		"no transport params":   quicSpec([]uint16{VersionTLS13}, nil),
+		"no supported_versions": {Extensions: []TLSExtension{params, &ALPNExtension{AlpnProtocols: []string{"h3"}}}},
+	} {
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(spec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := uconn.QUICClientHello(); err == nil {
+			t.Errorf("%s: QUICClientHello succeeded", name)
+		}
+	}
+}
+
+func TestUTLSTLS13Only(t *testing.T) {
+	c, s := localPipe(t)
+	done := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		done <- Server(s, testConfig).Handshake()
+	}()
+	spec := quicSpec([]uint16{VersionTLS13}, nil)
+	spec.Extensions[1] = &ALPNExtension{AlpnProtocols: []string{"h2"}}
+	client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+	if err := client.ApplyPreset(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	c.Close()
+	if v := client.ConnectionState().Version; v != VersionTLS13 {
+		t.Errorf("negotiated version %x, want TLS 1.3", v)
+	}
+}
+
+func TestHelloChromeH3(t *testing.T) {
+	uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloChrome_H3)
+	params, err := uconn.QUICTransportParameters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params == nil {
+		t.Fatal("HelloChrome_H3 has no transport parameters")
+	}
+	// Set a source connection ID, as a QUIC implementation would.
+	for i := range params.Parameters {
+		if params.Parameters[i].ID == QUICInitialSourceConnectionID {
+			params.Parameters[i].Value = []byte{5, 6, 7, 8}
+		}
+	}
+	raw, err := uconn.QUICClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m clientHelloMsg
+	if !m.unmarshal(raw) {
+		t.Fatal("failed to unmarshal the QUIC ClientHello")
+	}
+	if !reflect.DeepEqual(m.alpnProtocols, []string{"h3"}) {
+		t.Errorf("ALPN is %q, want h3 only", m.alpnProtocols)
+	}
+	if m.ticketSupported {
+		t.Error("the QUIC ClientHello has a session_ticket extension")
+	}
+	if !bytes.Contains(raw, []byte{0x0f, 0x04, 5, 6, 7, 8}) {
+		t.Error("the ClientHello does not carry the updated initial_source_connection_id")
+	}
+
+	uconn = UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloChrome_113)
+	if params, err := uconn.QUICTransportParameters(); err != nil || params != nil {
+		t.Errorf("HelloChrome_113: QUICTransportParameters = %v, %v, want none", params, err)
+	}
+
+	params = &QUICTransportParametersExtension{Parameters: []QUICTransportParameter{
+		QUICVarintParameter(QUICMaxIdleTimeout, 30000),
+	}}
+	for name, ext := range map[string]TLSExtension{
+		"session_ticket":     &SessionTicketExtension{},
+		"renegotiation_info": &RenegotiationInfoExtension{},
+	} {
+		spec := quicSpec([]uint16{VersionTLS13}, params)
+		spec.Extensions = append(spec.Extensions, ext)
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(spec); err == nil {
+			t.Errorf("ApplyPreset accepted a QUIC spec with %s", name)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+)
+
+// A RandomnessRecorder is a source of randomness, to be set as Config.Rand,
+// which records every byte read from it, so that a handshake can be replayed
+// with NewRandomnessReplayer. The client draws all its randomness from
+// Config.Rand: the ClientHello random and session ID, the key shares, and,
+// unless UConn.SetGREASESeed is used, the GREASE values, so replaying the
+// recording reproduces the exact same ClientHello.
+//
+// A RandomnessRecorder is safe for concurrent use, but the recording of
+// concurrent handshakes interleaves, so use one per connection.
+type RandomnessRecorder struct {
+	mu        sync.Mutex
+	source    io.Reader
+	replay    []byte
+	recording []byte
+}
+
+// NewRandomnessRecorder returns a RandomnessRecorder reading from source, or
+// from crypto/rand if source is nil.
+func NewRandomnessRecorder(source io.Reader) *RandomnessRecorder {
+	if source == nil {
+		source = rand.Reader
+	}
+	return &RandomnessRecorder{source: source}
+}
+
+// NewRandomnessReplayer returns a RandomnessRecorder returning the bytes of
+// recording, as returned by RandomnessRecorder.Recording, in order. Reads past
+// its end fail, as the replayed handshake diverged from the recorded one.
+func NewRandomnessReplayer(recording []byte) *RandomnessRecorder {
+	return &RandomnessRecorder{replay: append([]byte{}, recording...)}
+}
+
+var errRandomnessExhausted = errors.New("tls: replayed randomness exhausted")
+
+func (r *RandomnessRecorder) Read(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	var err error
+	if r.source == nil {
+		n = copy(b, r.replay)
+		r.replay = r.replay[n:]
+		if n < len(b) {
+			err = errRandomnessExhausted
+		}
+	} else {
+		n, err = r.source.Read(b)
+	}
+	r.recording = append(r.recording, b[:n]...)
+	return n, err
+}
+
+// Recording returns a copy of the bytes read so far.
+func (r *RandomnessRecorder) Recording() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte{}, r.recording...)
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRandomnessRecorder(t *testing.T) {
+	for _, helloID := range []ClientHelloID{HelloChrome_Auto, HelloFirefox_128, HelloRandomized} {
+		recorder := NewRandomnessRecorder(nil)
+		c, s := localPipe(t)
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			done <- Server(s, testConfig).Handshake()
+		}()
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true, Rand: recorder}, helloID)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%s: %v", helloID.Str(), err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%s: server: %v", helloID.Str(), err)
+		}
+		c.Close()
+		recorded := client.HandshakeState.Hello.Raw
+
+		// The replayed handshake stops after the ClientHello, as the server
+		// side is not replayed.
+		replayer := NewRandomnessReplayer(recorder.Recording())
+		replay := UClient(nil, &Config{ServerName: "example.golang", InsecureSkipVerify: true, Rand: replayer}, helloID)
+		if err := replay.BuildHandshakeState(); err != nil {
+			t.Fatalf("%s: %v", helloID.Str(), err)
+		}
+		if !bytes.Equal(replay.HandshakeState.Hello.Raw, recorded) {
+			t.Errorf("%s: replayed ClientHello differs from the recorded one", helloID.Str())
+		}
+		if !bytes.HasPrefix(recorder.Recording(), replayer.Recording()) {
+			t.Errorf("%s: replayed randomness is not a prefix of the recording", helloID.Str())
+		}
+	}
+
+	replayer := NewRandomnessReplayer([]byte{1, 2})
+	if n, err := replayer.Read(make([]byte, 3)); n != 2 || err == nil {
+		t.Errorf("Read past the recording = %d, %v, want 2 and an error", n, err)
+	}
+}
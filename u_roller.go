@@ -1,8 +1,12 @@
 package tls
 
 import (
+	"errors"
+	"io"
 	"net"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -46,57 +50,189 @@ func NewRoller() (*Roller, error) {
 
 // Dial attempts to establish connection to given address using different HelloIDs.
 // If a working HelloID is found, it is used again for subsequent Dials.
-// If tcp connection fails or all HelloIDs are tried, returns with last error.
+// If tcp connection fails, the handshake fails for a reason another HelloID
+// cannot fix, or all HelloIDs are tried, returns with last error.
+// The HelloIDs are tried by a FingerprintRoller, in a random order.
 //
 // Usage examples:
 //    Dial("tcp4", "google.com:443", "google.com")
 //    Dial("tcp", "10.23.144.22:443", "mywebserver.org")
 func (c *Roller) Dial(network, addr, serverName string) (*UConn, error) {
-	helloIDs := make([]ClientHelloID, len(c.HelloIDs))
-	copy(helloIDs, c.HelloIDs)
-	c.r.rand.Shuffle(len(c.HelloIDs), func(i, j int) {
-		helloIDs[i], helloIDs[j] = helloIDs[j], helloIDs[i]
-	})
-
 	c.HelloIDMu.Lock()
 	workingHelloId := c.WorkingHelloID // keep using same helloID, if it works
 	c.HelloIDMu.Unlock()
-	if workingHelloId != nil {
-		helloIDFound := false
-		for i, ID := range helloIDs {
-			if ID == *workingHelloId {
-				helloIDs[i] = helloIDs[0]
-				helloIDs[0] = *workingHelloId // push working hello ID first
-				helloIDFound = true
-				break
-			}
+
+	roller := &FingerprintRoller{
+		HelloIDs:         c.HelloIDs,
+		Dialer:           &net.Dialer{Timeout: c.TcpDialTimeout},
+		Config:           &Config{ServerName: serverName},
+		HandshakeTimeout: c.TlsHandshakeTimeout,
+		shuffle:          c.r,
+	}
+	client, err := roller.dial(network, addr, workingHelloId)
+	if err != nil {
+		return nil, err
+	}
+
+	c.HelloIDMu.Lock()
+	c.WorkingHelloID = &client.ClientHelloID
+	c.HelloIDMu.Unlock()
+	return client, nil
+}
+
+// FingerprintRoller dials TLS connections with an ordered list of
+// ClientHelloIDs. If the handshake with one of them fails with an alert or a
+// reset connection, as happens when a fingerprint is blocked, the next one is
+// tried on a new connection to the same address. The HelloID that last
+// succeeded for an address is tried first on the next Dial to it.
+//
+// A FingerprintRoller is safe for concurrent use. Its exported fields must not
+// be modified after the first call to Dial.
+type FingerprintRoller struct {
+	// HelloIDs are the fingerprints to try, in order.
+	HelloIDs []ClientHelloID
+	// Dialer is used to establish the underlying connections. If nil, the
+	// zero net.Dialer is used.
+	Dialer *net.Dialer
+	// Config is the configuration of each connection. If its ServerName is
+	// empty, it is inferred from the dialed address. Config may be nil.
+	Config *Config
+	// HandshakeTimeout bounds each handshake attempt. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	shuffle *prng // if not nil, shuffles HelloIDs on each Dial, see Roller
+
+	mu      sync.Mutex
+	working map[string]ClientHelloID // by addr
+}
+
+// NewFingerprintRoller returns a FingerprintRoller that tries helloIDs in the
+// given order, or Chrome, Firefox, iOS and Safari if none are given.
+func NewFingerprintRoller(dialer *net.Dialer, helloIDs ...ClientHelloID) *FingerprintRoller {
+	if len(helloIDs) == 0 {
+		helloIDs = []ClientHelloID{
+			HelloChrome_Auto,
+			HelloFirefox_Auto,
+			HelloIOS_Auto,
+			HelloSafari_Auto,
 		}
-		if !helloIDFound {
-			helloIDs = append([]ClientHelloID{*workingHelloId}, helloIDs...)
+	}
+	return &FingerprintRoller{
+		HelloIDs:         helloIDs,
+		Dialer:           dialer,
+		HandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// Dial connects to addr and performs a TLS handshake, trying the HelloIDs in
+// order until one succeeds. Errors from the underlying dialer and handshake
+// errors that another fingerprint cannot fix, such as certificate
+// verification failures, are returned right away. Otherwise the error of the
+// last attempt is returned.
+func (r *FingerprintRoller) Dial(network, addr string) (*UConn, error) {
+	r.mu.Lock()
+	working, ok := r.working[addr]
+	r.mu.Unlock()
+	var first *ClientHelloID
+	if ok {
+		first = &working
+	}
+
+	client, err := r.dial(network, addr, first)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	if r.working == nil {
+		r.working = make(map[string]ClientHelloID)
+	}
+	r.working[addr] = client.ClientHelloID
+	r.mu.Unlock()
+	return client, nil
+}
+
+// dial is Dial, trying first, if not nil, before the HelloIDs.
+func (r *FingerprintRoller) dial(network, addr string, first *ClientHelloID) (*UConn, error) {
+	if len(r.HelloIDs) == 0 {
+		return nil, errors.New("tls: FingerprintRoller has no HelloIDs")
+	}
+	dialer := r.Dialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+
+	config := r.Config
+	if config == nil {
+		config = defaultConfig()
+	}
+	if config.ServerName == "" {
+		colonPos := strings.LastIndex(addr, ":")
+		if colonPos == -1 {
+			colonPos = len(addr)
 		}
+		config = config.Clone()
+		config.ServerName = addr[:colonPos]
 	}
 
-	var tcpConn net.Conn
 	var err error
-	for _, helloID := range helloIDs {
-		tcpConn, err = net.DialTimeout(network, addr, c.TcpDialTimeout)
+	for _, helloID := range r.helloIDs(first) {
+		var rawConn net.Conn
+		rawConn, err = dialer.Dial(network, addr)
 		if err != nil {
-			return nil, err // on tcp Dial failure return with error right away
+			return nil, err
 		}
 
-		client := UClient(tcpConn, nil, helloID)
-		client.SetSNI(serverName)
-		client.SetDeadline(time.Now().Add(c.TlsHandshakeTimeout))
+		client := UClient(rawConn, config.Clone(), helloID)
+		if r.HandshakeTimeout != 0 {
+			rawConn.SetDeadline(time.Now().Add(r.HandshakeTimeout))
+		}
 		err = client.Handshake()
-		client.SetDeadline(time.Time{}) // unset timeout
-		if err != nil {
-			continue // on tls Dial error keep trying HelloIDs
+		if err == nil {
+			rawConn.SetDeadline(time.Time{})
+			return client, nil
+		}
+		rawConn.Close()
+		if !isFingerprintRejection(err) {
+			return nil, err
 		}
-
-		c.HelloIDMu.Lock()
-		c.WorkingHelloID = &client.ClientHelloID
-		c.HelloIDMu.Unlock()
-		return client, err
 	}
 	return nil, err
 }
+
+// helloIDs returns the order in which HelloIDs are tried, first, if not nil,
+// coming before the others.
+func (r *FingerprintRoller) helloIDs(first *ClientHelloID) []ClientHelloID {
+	others := make([]ClientHelloID, len(r.HelloIDs))
+	copy(others, r.HelloIDs)
+	if r.shuffle != nil {
+		r.shuffle.rand.Shuffle(len(others), func(i, j int) {
+			others[i], others[j] = others[j], others[i]
+		})
+	}
+
+	helloIDs := make([]ClientHelloID, 0, len(others)+1)
+	if first != nil {
+		helloIDs = append(helloIDs, *first)
+	}
+	for _, helloID := range others {
+		if first == nil || helloID != *first {
+			helloIDs = append(helloIDs, helloID)
+		}
+	}
+	return helloIDs
+}
+
+// isFingerprintRejection reports whether a handshake error might be caused
+// by the server or a middlebox rejecting the ClientHello.
+func isFingerprintRejection(err error) bool {
+	var a alert
+	if errors.As(err, &a) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFingerprintRoller(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	// The first connection is rejected with a handshake_failure alert, as a
+	// server blocking the first fingerprint would do.
+	var conns int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&conns, 1) == 1 {
+				c.Read(make([]byte, 1024))
+				c.Write([]byte{byte(recordTypeAlert), 3, 3, 0, 2, alertLevelError, byte(alertHandshakeFailure)})
+				c.Close()
+				continue
+			}
+			go func() {
+				defer c.Close()
+				Server(c, testConfig).Handshake()
+			}()
+		}
+	}()
+
+	roller := NewFingerprintRoller(nil, HelloChrome_Auto, HelloFirefox_Auto)
+	roller.Config = &Config{InsecureSkipVerify: true}
+	addr := ln.Addr().String()
+
+	client, err := roller.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if client.ClientHelloID != HelloFirefox_Auto {
+		t.Errorf("connected with %v, expected the second HelloID", client.ClientHelloID)
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("got %d connections, expected 2", n)
+	}
+
+	client, err = roller.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if client.ClientHelloID != HelloFirefox_Auto {
+		t.Errorf("connected with %v, expected the HelloID that worked before", client.ClientHelloID)
+	}
+	if n := atomic.LoadInt32(&conns); n != 3 {
+		t.Errorf("got %d connections, expected the working HelloID to be tried first", n)
+	}
+}
+
+func TestFingerprintRollerVerifyError(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	var conns int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer c.Close()
+				Server(c, testConfig).Handshake()
+			}()
+		}
+	}()
+
+	// The test certificate is not trusted, which no fingerprint can fix.
+	roller := NewFingerprintRoller(&net.Dialer{}, HelloChrome_Auto, HelloFirefox_Auto)
+	if _, err := roller.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("expected a verification error")
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("got %d connections, expected no retry", n)
+	}
+}
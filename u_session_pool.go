@@ -0,0 +1,169 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A ClientSessionPool caches the TLS 1.3 sessions of the connections it
+// creates, per server name and ClientHelloID, and resumes them in later
+// handshakes with the same ClientHelloID. A session is never offered by a
+// connection with another ClientHelloID, as resuming it would link the two
+// fingerprints.
+//
+// The connections offer a cached session in the pre_shared_key extension,
+// which is appended to their ClientHelloSpec if it has none, as browsers only
+// send it when they resume a session. Connections using HelloCustom share one
+// profile, so a ClientSessionPool must only be used with one custom
+// ClientHelloSpec. Randomized ClientHelloIDs without a seed never resume, as
+// each of their connections has its own fingerprint.
+//
+// A ClientSessionPool is safe for concurrent use.
+type ClientSessionPool struct {
+	// Dialer is used by Dial to establish the underlying connections. If
+	// nil, the zero net.Dialer is used.
+	Dialer *net.Dialer
+
+	cache ClientSessionCache
+
+	mu    sync.Mutex
+	stats ClientSessionPoolStats
+}
+
+// ClientSessionPoolStats counts the handshakes of the connections created by
+// a ClientSessionPool.
+type ClientSessionPoolStats struct {
+	// Hits is the number of handshakes which found a session to offer.
+	Hits uint64
+	// Misses is the number of handshakes which found none.
+	Misses uint64
+}
+
+// NewClientSessionPool returns a ClientSessionPool holding up to capacity
+// sessions, across all server names and ClientHelloIDs, evicting the least
+// recently used ones. If capacity is < 1, a default capacity is used.
+func NewClientSessionPool(capacity int) *ClientSessionPool {
+	return &ClientSessionPool{cache: NewLRUClientSessionCache(capacity)}
+}
+
+// UClient returns a new uTLS client like UClient, which resumes the sessions
+// of the pool. The Config.ClientSessionCache of config is ignored.
+func (p *ClientSessionPool) UClient(conn net.Conn, config *Config, helloID ClientHelloID) *UConn {
+	uconn := UClient(conn, config, helloID)
+	uconn.config.ClientSessionCache = &pooledSessionCache{pool: p, uconn: uconn}
+	uconn.offerPooledSession = true
+	return uconn
+}
+
+// Dial connects to addr and performs a TLS handshake with helloID, resuming
+// the session of a previous connection to the same server with the same
+// helloID, if any. If config.ServerName is empty, it is inferred from addr.
+// config may be nil.
+func (p *ClientSessionPool) Dial(network, addr string, config *Config, helloID ClientHelloID) (*UConn, error) {
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+	if config == nil {
+		config = defaultConfig()
+	}
+	if config.ServerName == "" {
+		colonPos := strings.LastIndex(addr, ":")
+		if colonPos == -1 {
+			colonPos = len(addr)
+		}
+		config = config.Clone()
+		config.ServerName = addr[:colonPos]
+	}
+
+	rawConn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if dialer.Timeout != 0 {
+		rawConn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+	client := p.UClient(rawConn, config, helloID)
+	if err := client.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	rawConn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// Stats returns the hit and miss counts of the pool so far.
+func (p *ClientSessionPool) Stats() ClientSessionPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// pooledSessionCache is the ClientSessionCache of a connection created by a
+// ClientSessionPool. It keys the sessions of the pool by the ClientHelloID
+// of the connection, once a randomized one has drawn its seed.
+type pooledSessionCache struct {
+	pool    *ClientSessionPool
+	uconn   *UConn
+	counted bool // whether the handshake was counted in the pool stats
+}
+
+func (c *pooledSessionCache) key(sessionKey string) string {
+	id := c.uconn.ClientHelloID
+	key := id.Str()
+	if id.Seed != nil {
+		key += "-" + hex.EncodeToString(id.Seed[:])
+	}
+	return key + "|" + sessionKey
+}
+
+func (c *pooledSessionCache) Get(sessionKey string) (*ClientSessionState, bool) {
+	session, ok := c.pool.cache.Get(c.key(sessionKey))
+	if !c.counted {
+		c.counted = true
+		c.pool.mu.Lock()
+		if ok {
+			c.pool.stats.Hits++
+		} else {
+			c.pool.stats.Misses++
+		}
+		c.pool.mu.Unlock()
+	}
+	return session, ok
+}
+
+func (c *pooledSessionCache) Put(sessionKey string, cs *ClientSessionState) {
+	if cs != nil && cs.vers != VersionTLS13 {
+		return
+	}
+	c.pool.cache.Put(c.key(sessionKey), cs)
+}
+
+// addPooledPSKExtension appends a PreSharedKeyExtension to the ClientHelloSpec
+// of a connection created by a ClientSessionPool, if it offers TLS 1.3 with
+// psk_key_exchange_modes and has none. The extension is left out if there is
+// no session to resume.
+func (uconn *UConn) addPooledPSKExtension() {
+	if !uconn.offerPooledSession {
+		return
+	}
+	hasModes := false
+	for _, ext := range uconn.Extensions {
+		switch ext.(type) {
+		case *PreSharedKeyExtension:
+			return
+		case *PSKKeyExchangeModesExtension:
+			hasModes = true
+		}
+	}
+	if hasModes {
+		uconn.Extensions = append(uconn.Extensions, &PreSharedKeyExtension{})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"net"
+	"testing"
+)
+
+// servePooled runs one server handshake on l and makes the client read the
+// NewSessionTicket message.
+func servePooled(l net.Listener) error {
+	s, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	server := Server(s, testConfig)
+	if err := server.Handshake(); err != nil {
+		return err
+	}
+	_, err = server.Write([]byte{1})
+	return err
+}
+
+func TestClientSessionPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	pool := NewClientSessionPool(0)
+	config := &Config{ServerName: "example.golang", InsecureSkipVerify: true}
+	handshake := func(helloID ClientHelloID) (didResume bool) {
+		done := make(chan error, 1)
+		go func() { done <- servePooled(l) }()
+		client, err := pool.Dial("tcp", l.Addr().String(), config, helloID)
+		if err != nil {
+			t.Fatalf("%s: %v", helloID.Str(), err)
+		}
+		defer client.Close()
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("%s: %v", helloID.Str(), err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("%s: server: %v", helloID.Str(), err)
+		}
+		for _, id := range clientHelloExtensionIDs(t, client.HandshakeState.Hello.Raw) {
+			if id == extensionPreSharedKey && !client.ConnectionState().DidResume {
+				t.Errorf("%s: pre_shared_key sent without resuming", helloID.Str())
+			}
+		}
+		return client.ConnectionState().DidResume
+	}
+
+	if handshake(HelloChrome_113) {
+		t.Fatal("first handshake resumed")
+	}
+	if !handshake(HelloChrome_113) {
+		t.Error("second handshake with the same fingerprint did not resume")
+	}
+	if handshake(HelloFirefox_Auto) {
+		t.Error("session resumed with another fingerprint")
+	}
+	// Randomized fingerprints are told apart by their seed. These ones
+	// negotiate TLS 1.3 with the test server.
+	if handshake(HelloRandomized.WithSeed(1)) {
+		t.Error("session resumed with another randomized fingerprint")
+	}
+	if !handshake(HelloRandomized.WithSeed(1)) {
+		t.Error("second handshake with the same seed did not resume")
+	}
+	if handshake(HelloRandomized.WithSeed(7)) {
+		t.Error("session resumed with another seed")
+	}
+
+	want := ClientSessionPoolStats{Hits: 2, Misses: 4}
+	if got := pool.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SetSessionTicket makes the next handshake resume the session of a ticket
+// obtained out of band, for instance by another client, instead of one from
+// Config.ClientSessionCache.
+//
+// For TLS 1.2 and earlier, masterSecret is the 48-byte master secret of the
+// session, and the ticket is sent in the session_ticket extension, which the
+// ClientHelloSpec must have. For TLS 1.3, masterSecret is the PSK of the
+// ticket, that is the resumption_master_secret already expanded with the
+// ticket_nonce, see RFC 8446, Section 4.6.1, and the ticket is offered in the
+// pre_shared_key extension. A PreSharedKeyExtension is appended to the
+// ClientHelloSpec if it has none, and the ClientHelloSpec must have a
+// PSKKeyExchangeModesExtension.
+//
+// In both cases the ClientHelloSpec must offer version and cipherSuite. Like
+// SetClientRandom, it takes effect the next time the handshake state is
+// built. It is not supported with HelloGolang or Encrypted Client Hello.
+func (uconn *UConn) SetSessionTicket(ticket []byte, masterSecret []byte, version uint16, cipherSuite uint16) error {
+	if uconn.clientHelloSent() {
+		return errClientHelloSent
+	}
+	if len(ticket) == 0 || len(ticket) > 0xffff {
+		return errors.New("tls: invalid session ticket length")
+	}
+	switch version {
+	case VersionTLS13:
+		suite := cipherSuiteTLS13ByID(cipherSuite)
+		if suite == nil {
+			return fmt.Errorf("tls: cipher suite %#04x is not a TLS 1.3 cipher suite", cipherSuite)
+		}
+		if len(masterSecret) != suite.hash.Size() {
+			return fmt.Errorf("tls: TLS 1.3 session PSK is %d bytes long, expected %d", len(masterSecret), suite.hash.Size())
+		}
+	case VersionTLS10, VersionTLS11, VersionTLS12:
+		suite := cipherSuiteByID(cipherSuite)
+		if suite == nil {
+			return fmt.Errorf("tls: cipher suite %#04x is not a TLS 1.2 cipher suite", cipherSuite)
+		}
+		if version < VersionTLS12 && suite.flags&suiteTLS12 != 0 {
+			return fmt.Errorf("tls: cipher suite %#04x requires TLS 1.2", cipherSuite)
+		}
+		if len(masterSecret) != masterSecretLength {
+			return fmt.Errorf("tls: master secret is %d bytes long, expected %d", len(masterSecret), masterSecretLength)
+		}
+	default:
+		return fmt.Errorf("tls: unsupported session version %#04x", version)
+	}
+
+	now := uconn.config.time()
+	uconn.ticketSession = &ClientSessionState{
+		sessionTicket: append([]byte{}, ticket...),
+		vers:          version,
+		cipherSuite:   cipherSuite,
+		masterSecret:  append([]byte{}, masterSecret...),
+		receivedAt:    now,
+		useBy:         now.Add(maxSessionTicketLifetime),
+	}
+	if uconn.ClientHelloBuilt {
+		if err := uconn.checkTicketSession(); err != nil {
+			uconn.ticketSession = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTicketSession prepares the ClientHelloSpec to offer the session set
+// with SetSessionTicket, if any.
+func (uconn *UConn) applyTicketSession() error {
+	session := uconn.ticketSession
+	if session == nil {
+		return nil
+	}
+	if uconn.ech != nil {
+		return errors.New("tls: session tickets set with SetSessionTicket are not supported with Encrypted Client Hello")
+	}
+	if err := uconn.checkTicketSession(); err != nil {
+		return err
+	}
+
+	if session.vers != VersionTLS13 {
+		if uconn.HandshakeState.Session == session {
+			return nil
+		}
+		return uconn.SetSessionState(session)
+	}
+	hasPSK := false
+	for _, ext := range uconn.Extensions {
+		if isPreSharedKeyExtension(ext) {
+			hasPSK = true
+		}
+	}
+	if !hasPSK {
+		uconn.Extensions = append(uconn.Extensions, &PreSharedKeyExtension{})
+	}
+	return nil
+}
+
+// checkTicketSession checks that the ClientHelloSpec can offer the session
+// set with SetSessionTicket.
+func (uconn *UConn) checkTicketSession() error {
+	session := uconn.ticketSession
+	hello := uconn.HandshakeState.Hello
+
+	versOk := false
+	for _, v := range hello.SupportedVersions {
+		versOk = versOk || v == session.vers
+	}
+	if len(hello.SupportedVersions) == 0 {
+		versOk = session.vers <= hello.Vers
+	}
+	if !versOk {
+		return fmt.Errorf("tls: the ClientHelloSpec does not offer the version %#04x of the session ticket", session.vers)
+	}
+	suiteOk := false
+	for _, id := range hello.CipherSuites {
+		suiteOk = suiteOk || id == session.cipherSuite
+	}
+	if !suiteOk {
+		return fmt.Errorf("tls: the ClientHelloSpec does not offer the cipher suite %#04x of the session ticket", session.cipherSuite)
+	}
+
+	hasTicket, hasModes := false, false
+	for _, ext := range uconn.Extensions {
+		switch ext.(type) {
+		case *SessionTicketExtension:
+			hasTicket = true
+		case *PSKKeyExchangeModesExtension:
+			hasModes = true
+		}
+	}
+	if session.vers == VersionTLS13 && !hasModes {
+		return errors.New("tls: the ClientHelloSpec has no psk_key_exchange_modes extension to resume a TLS 1.3 session ticket")
+	}
+	if session.vers != VersionTLS13 && !hasTicket {
+		return errors.New("tls: the ClientHelloSpec has no session_ticket extension to resume a session ticket")
+	}
+	return nil
+}
+
+// ticketSessionSecrets returns the pre_shared_key identity of the TLS 1.3
+// session set with SetSessionTicket, along with its early secret and binder
+// key.
+func (uconn *UConn) ticketSessionSecrets() (identity pskIdentity, earlySecret, binderKey []byte) {
+	session := uconn.ticketSession
+	suite := cipherSuiteTLS13ByID(session.cipherSuite)
+	identity = pskIdentity{label: session.sessionTicket, obfuscatedTicketAge: uconn.obfuscatedTicketAge(session)}
+	earlySecret = suite.extract(session.masterSecret, nil)
+	binderKey = suite.deriveSecret(earlySecret, resumptionBinderLabel, nil)
+	return identity, earlySecret, binderKey
+}
+
+// obfuscatedTicketAge returns the obfuscated_ticket_age of session in the
+// ClientHello, computed when it was first built, so that building it again
+// gives the same bytes, see RFC 8446, Section 4.2.11.
+func (uconn *UConn) obfuscatedTicketAge(session *ClientSessionState) uint32 {
+	now := uconn.helloTime
+	if now.IsZero() {
+		now = uconn.config.time()
+	}
+	return uint32(now.Sub(session.receivedAt)/time.Millisecond) + session.ageAdd
+}
@@ -0,0 +1,362 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ClientHelloSpecFromJSON returns a ClientHelloSpec reproducing the
+// ClientHello described by the JSON document read from r, in the format of
+// https://tls.peet.ws: either the whole /api/all response or its "tls"
+// object.
+//
+// Unlike a JA3 fingerprint, the document carries the contents of the
+// extensions, which are parsed into the same typed extensions as
+// Fingerprinter.FingerprintClientHello returns for a captured ClientHello:
+// the ones uTLS does not implement become GenericExtensions with the "data"
+// of the document, if any, and the pre_shared_key and early_data extensions
+// are dropped.
+func ClientHelloSpecFromJSON(r io.Reader) (*ClientHelloSpec, error) {
+	var doc struct {
+		jsonClientHello
+		TLS *jsonClientHello `json:"tls"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("tls: invalid fingerprint JSON: %v", err)
+	}
+	hello := &doc.jsonClientHello
+	if doc.TLS != nil {
+		hello = doc.TLS
+	}
+	if len(hello.Ciphers) == 0 {
+		return nil, errors.New("tls: fingerprint JSON has no cipher suites")
+	}
+
+	spec := &ClientHelloSpec{}
+	for _, name := range hello.Ciphers {
+		suite, err := jsonCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		spec.CipherSuites = append(spec.CipherSuites, suite)
+	}
+
+	f := &Fingerprinter{}
+	hasSupportedVersions := false
+	for _, fields := range hello.Extensions {
+		var name string
+		if err := json.Unmarshal(fields["name"], &name); err != nil {
+			return nil, errors.New("tls: fingerprint JSON has an extension without a name")
+		}
+		id, ok := jsonCodepoint(name)
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown extension %q in fingerprint JSON", name)
+		}
+		switch id {
+		case extensionPreSharedKey, extensionEarlyData:
+			continue
+		case extensionSupportedVersions:
+			hasSupportedVersions = true
+		}
+
+		body, err := jsonExtensionBody(id, fields)
+		if err != nil {
+			return nil, fmt.Errorf("tls: extension %q in fingerprint JSON: %v", name, err)
+		}
+		if body == nil {
+			body = jsonDefaultBody(id)
+		}
+		ext, err := f.parseExtension(id, body)
+		if err != nil {
+			return nil, fmt.Errorf("tls: extension %q in fingerprint JSON: %v", name, err)
+		}
+		if ext == nil && id == utlsExtensionEncryptedClientHello {
+			// GREASE ECH, described without its payload.
+			ext = &GREASEEncryptedClientHelloExtension{}
+		}
+		if ext == nil {
+			ext = &GenericExtension{Id: id, Data: body}
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+
+	if !hasSupportedVersions {
+		vers, err := strconv.ParseUint(hello.RecordVersion, 10, 16)
+		if err != nil {
+			vers = VersionTLS12
+		}
+		spec.TLSVersMin = VersionTLS10
+		spec.TLSVersMax = uint16(vers)
+	}
+	return spec, nil
+}
+
+// jsonClientHello is the part of a tls.peet.ws document describing the
+// ClientHello. The fields of the extensions depend on their type.
+type jsonClientHello struct {
+	Ciphers       []string                     `json:"ciphers"`
+	Extensions    []map[string]json.RawMessage `json:"extensions"`
+	RecordVersion string                       `json:"tls_version_record"`
+}
+
+// jsonCodepoint parses the codepoint at the end of name, such as
+// "X25519 (29)" or "TLS_GREASE (0x4a4a)". GREASE values are replaced with
+// GREASE_PLACEHOLDER.
+func jsonCodepoint(name string) (uint16, bool) {
+	i := strings.LastIndexByte(name, '(')
+	if i < 0 || !strings.HasSuffix(name, ")") {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(name[i+1:len(name)-1], 0, 16)
+	if err != nil {
+		return 0, false
+	}
+	if isGREASEValue(uint16(v)) {
+		return GREASE_PLACEHOLDER, true
+	}
+	return uint16(v), true
+}
+
+// jsonDefaultBody returns the body of an extension of type id which the JSON
+// does not describe: the only one uTLS sends for renegotiation_info and
+// status_request, or else an empty one.
+func jsonDefaultBody(id uint16) []byte {
+	switch id {
+	case extensionRenegotiationInfo:
+		return []byte{0}
+	case extensionStatusRequest:
+		return []byte{statusTypeOCSP, 0, 0, 0, 0}
+	}
+	return []byte{}
+}
+
+func jsonCipherSuite(name string) (uint16, error) {
+	if v, ok := jsonCodepoint(name); ok {
+		return v, nil
+	}
+	if v, err := strconv.ParseUint(name, 0, 16); err == nil {
+		return uint16(v), nil
+	}
+	for v, constant := range cipherSuiteNames {
+		constant = strings.TrimPrefix(strings.TrimPrefix(constant, "FAKE_"), "DISABLED_")
+		if constant == name && !isGREASEValue(uint16(v)) {
+			return uint16(v), nil
+		}
+	}
+	switch name {
+	case "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256":
+		return TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, nil
+	case "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":
+		return TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, nil
+	}
+	return 0, fmt.Errorf("tls: unknown cipher suite %q in fingerprint JSON", name)
+}
+
+// jsonSignatureSchemes maps the names of RFC 8446, Section 4.2.3, to the
+// signature schemes.
+var jsonSignatureSchemes = map[string]SignatureScheme{
+	"rsa_pkcs1_sha256":       PKCS1WithSHA256,
+	"rsa_pkcs1_sha384":       PKCS1WithSHA384,
+	"rsa_pkcs1_sha512":       PKCS1WithSHA512,
+	"ecdsa_secp256r1_sha256": ECDSAWithP256AndSHA256,
+	"ecdsa_secp384r1_sha384": ECDSAWithP384AndSHA384,
+	"ecdsa_secp521r1_sha512": ECDSAWithP521AndSHA512,
+	"rsa_pss_rsae_sha256":    PSSWithSHA256,
+	"rsa_pss_rsae_sha384":    PSSWithSHA384,
+	"rsa_pss_rsae_sha512":    PSSWithSHA512,
+	"ed25519":                0x0807,
+	"ed448":                  0x0808,
+	"rsa_pss_pss_sha256":     0x0809,
+	"rsa_pss_pss_sha384":     0x080a,
+	"rsa_pss_pss_sha512":     0x080b,
+	"rsa_pkcs1_sha1":         PKCS1WithSHA1,
+	"ecdsa_sha1":             ECDSAWithSHA1,
+	"rsa_pkcs1_sha224":       FakePKCS1WithSHA224,
+	"ecdsa_sha224":           FakeECDSAWithSHA224,
+}
+
+var jsonVersions = map[string]uint16{
+	"TLS 1.3": VersionTLS13,
+	"TLS 1.2": VersionTLS12,
+	"TLS 1.1": VersionTLS11,
+	"TLS 1.0": VersionTLS10,
+}
+
+// jsonExtensionBody returns the body of the extension of type id described
+// by fields, or nil if fields do not describe it.
+func jsonExtensionBody(id uint16, fields map[string]json.RawMessage) ([]byte, error) {
+	list := func(keys ...string) ([]string, bool, error) {
+		for _, key := range keys {
+			if raw, ok := fields[key]; ok {
+				var values []string
+				if err := json.Unmarshal(raw, &values); err != nil {
+					// A single value, such as the PSK mode.
+					var value string
+					if err := json.Unmarshal(raw, &value); err != nil {
+						return nil, false, fmt.Errorf("invalid %q", key)
+					}
+					values = []string{value}
+				}
+				return values, true, nil
+			}
+		}
+		return nil, false, nil
+	}
+	codepoints := func(values []string, names map[string]uint16) ([]uint16, error) {
+		var vs []uint16
+		for _, value := range values {
+			v, ok := names[value]
+			if !ok {
+				v, ok = jsonCodepoint(value)
+			}
+			if !ok {
+				w, err := strconv.ParseUint(value, 0, 16)
+				if err != nil {
+					return nil, fmt.Errorf("unknown value %q", value)
+				}
+				v = uint16(w)
+			}
+			vs = append(vs, v)
+		}
+		return vs, nil
+	}
+
+	var b cryptobyte.Builder
+	switch id {
+	case extensionSupportedCurves, extensionSignatureAlgorithms, extensionSignatureAlgorithmsCert,
+		utlsExtensionDelegatedCredentials, extensionSupportedVersions, extensionCompressCertificate:
+		var values []string
+		var found bool
+		var err error
+		names := map[string]uint16{}
+		switch id {
+		case extensionSupportedCurves:
+			values, found, err = list("supported_groups")
+		case extensionSupportedVersions:
+			values, found, err = list("versions")
+			names = jsonVersions
+		case extensionCompressCertificate:
+			values, found, err = list("algorithms")
+		default:
+			values, found, err = list("signature_algorithms", "signature_hash_algorithms", "algorithms")
+			for name, scheme := range jsonSignatureSchemes {
+				names[name] = uint16(scheme)
+			}
+		}
+		if err != nil || !found {
+			return jsonData(fields, err)
+		}
+		vs, err := codepoints(values, names)
+		if err != nil {
+			return nil, err
+		}
+		addList := func(b *cryptobyte.Builder) {
+			for _, v := range vs {
+				b.AddUint16(v)
+			}
+		}
+		if id == extensionSupportedVersions || id == extensionCompressCertificate {
+			b.AddUint8LengthPrefixed(addList)
+		} else {
+			b.AddUint16LengthPrefixed(addList)
+		}
+
+	case extensionSupportedPoints, extensionPSKModes:
+		key := "elliptic_curves_point_formats"
+		if id == extensionPSKModes {
+			key = "PSK_Key_Exchange_Mode"
+		}
+		values, found, err := list(key, key+"s")
+		if err != nil || !found {
+			return jsonData(fields, err)
+		}
+		vs, err := codepoints(values, nil)
+		if err != nil {
+			return nil, err
+		}
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, v := range vs {
+				b.AddUint8(uint8(v))
+			}
+		})
+
+	case extensionALPN, utlsExtensionApplicationSettings, utlsExtensionApplicationSettingsNew:
+		protocols, found, err := list("protocols")
+		if err != nil || !found {
+			return jsonData(fields, err)
+		}
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, p := range protocols {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte(p))
+				})
+			}
+		})
+
+	case extensionKeyShare:
+		raw, ok := fields["shared_keys"]
+		if !ok {
+			return jsonData(fields, nil)
+		}
+		var shares []map[string]string
+		if err := json.Unmarshal(raw, &shares); err != nil {
+			return nil, errors.New(`invalid "shared_keys"`)
+		}
+		var err error
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, share := range shares {
+				for group, data := range share {
+					v, ok := jsonCodepoint(group)
+					keyExchange, hexErr := hex.DecodeString(data)
+					if !ok || hexErr != nil {
+						err = fmt.Errorf("invalid key share %q", group)
+						return
+					}
+					b.AddUint16(v)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(keyExchange)
+					})
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return jsonData(fields, nil)
+	}
+	return b.Bytes()
+}
+
+// jsonData returns the hex-encoded "data" of fields, if any, unless err is
+// not nil.
+func jsonData(fields map[string]json.RawMessage, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := fields["data"]
+	if !ok {
+		return nil, nil
+	}
+	var data string
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, errors.New(`invalid "data"`)
+	}
+	body, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, errors.New(`invalid "data"`)
+	}
+	return body, nil
+}
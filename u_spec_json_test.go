@@ -0,0 +1,252 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chromeJSON is the "tls" object of the tls.peet.ws fingerprint of Chrome 120.
+const chromeJSON = `{
+  "ciphers": [
+    "TLS_GREASE (0x2A2A)",
+    "TLS_AES_128_GCM_SHA256",
+    "TLS_AES_256_GCM_SHA384",
+    "TLS_CHACHA20_POLY1305_SHA256",
+    "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+    "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+    "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+    "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+    "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+    "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+    "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+    "TLS_RSA_WITH_AES_128_GCM_SHA256",
+    "TLS_RSA_WITH_AES_256_GCM_SHA384",
+    "TLS_RSA_WITH_AES_128_CBC_SHA",
+    "TLS_RSA_WITH_AES_256_CBC_SHA"
+  ],
+  "extensions": [
+    {"name": "TLS_GREASE (0x3a3a)"},
+    {"name": "application_layer_protocol_negotiation (16)", "protocols": ["h2", "http/1.1"]},
+    {"name": "session_ticket (35)", "data": ""},
+    {"name": "signed_certificate_timestamp (18)"},
+    {"name": "supported_groups (10)", "supported_groups": ["TLS_GREASE (0x3a3a)", "X25519 (29)", "P-256 (23)", "P-384 (24)"]},
+    {"name": "extended_master_secret (23)", "master_secret_data": "", "extended_master_secret_data": ""},
+    {"name": "ec_point_formats (11)", "elliptic_curves_point_formats": ["0x00"]},
+    {"name": "server_name (0)", "server_name": "tls.peet.ws"},
+    {"name": "application_settings (17513)", "protocols": ["h2"]},
+    {"name": "key_share (51)", "shared_keys": [
+      {"TLS_GREASE (0x3a3a)": "00"},
+      {"X25519 (29)": "6cb6ff5f51ab0a1d1a0e47fa5c24ba3d8b2b5bdb03df9ac2cbcbf6c8f94c6b7b"}
+    ]},
+    {"name": "psk_key_exchange_modes (45)", "PSK_Key_Exchange_Mode": "PSK with (EC)DHE key establishment (psk_dhe_ke) (1)"},
+    {"name": "supported_versions (43)", "versions": ["TLS_GREASE (0x4a4a)", "TLS 1.3", "TLS 1.2"]},
+    {"name": "status_request (5)", "status_request": {"certificate_status_type": "OSCP (1)", "responder_id_list_length": 0, "request_extensions_length": 0}},
+    {"name": "extensionRenegotiationInfo (boringssl) (65281)", "data": "00"},
+    {"name": "compress_certificate (27)", "algorithms": ["brotli (2)"]},
+    {"name": "signature_algorithms (13)", "signature_algorithms": [
+      "ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256", "rsa_pkcs1_sha256", "ecdsa_secp384r1_sha384",
+      "rsa_pss_rsae_sha384", "rsa_pkcs1_sha384", "rsa_pss_rsae_sha512", "rsa_pkcs1_sha512"
+    ]},
+    {"name": "TLS_GREASE (0x0a0a)"},
+    {"name": "pre_shared_key (41)", "data": "00"},
+    {"name": "padding (21)", "padding_data_length": 0}
+  ],
+  "tls_version_record": "771",
+  "tls_version_negotiated": "772"
+}`
+
+// firefoxJSON is the tls.peet.ws /api/all response for Firefox 120.
+const firefoxJSON = `{
+  "ip": "192.0.2.1:52321",
+  "http_version": "h2",
+  "tls": {
+    "ciphers": [
+      "TLS_AES_128_GCM_SHA256",
+      "TLS_CHACHA20_POLY1305_SHA256",
+      "TLS_AES_256_GCM_SHA384",
+      "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+      "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+      "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+      "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+      "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+      "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+      "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+      "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+      "TLS_RSA_WITH_AES_128_GCM_SHA256",
+      "TLS_RSA_WITH_AES_256_GCM_SHA384",
+      "TLS_RSA_WITH_AES_128_CBC_SHA",
+      "TLS_RSA_WITH_AES_256_CBC_SHA"
+    ],
+    "extensions": [
+      {"name": "server_name (0)", "server_name": "tls.peet.ws"},
+      {"name": "extended_master_secret (23)", "master_secret_data": "", "extended_master_secret_data": ""},
+      {"name": "extensionRenegotiationInfo (boringssl) (65281)", "data": "00"},
+      {"name": "supported_groups (10)", "supported_groups": ["X25519 (29)", "P-256 (23)", "P-384 (24)", "P-521 (25)", "ffdhe2048 (256)", "ffdhe3072 (257)"]},
+      {"name": "ec_point_formats (11)", "elliptic_curves_point_formats": ["0x00"]},
+      {"name": "session_ticket (35)", "data": ""},
+      {"name": "application_layer_protocol_negotiation (16)", "protocols": ["h2", "http/1.1"]},
+      {"name": "status_request (5)", "status_request": {"certificate_status_type": "OSCP (1)", "responder_id_list_length": 0, "request_extensions_length": 0}},
+      {"name": "delegated_credentials (34)", "signature_hash_algorithms": ["ecdsa_secp256r1_sha256", "ecdsa_secp384r1_sha384", "ecdsa_secp521r1_sha512", "ecdsa_sha1"]},
+      {"name": "key_share (51)", "shared_keys": [
+        {"X25519 (29)": "2a0d8e3d4cf1b8b4e6f7c3b9a7d25f1e8c1f06b9e2f6b5a4c3d2e1f0a9b8c7d6"},
+        {"P-256 (23)": "04a1b2c3"}
+      ]},
+      {"name": "supported_versions (43)", "versions": ["TLS 1.3", "TLS 1.2"]},
+      {"name": "signature_algorithms (13)", "signature_algorithms": [
+        "ecdsa_secp256r1_sha256", "ecdsa_secp384r1_sha384", "ecdsa_secp521r1_sha512", "rsa_pss_rsae_sha256",
+        "rsa_pss_rsae_sha384", "rsa_pss_rsae_sha512", "rsa_pkcs1_sha256", "rsa_pkcs1_sha384",
+        "rsa_pkcs1_sha512", "ecdsa_sha1", "rsa_pkcs1_sha1"
+      ]},
+      {"name": "psk_key_exchange_modes (45)", "PSK_Key_Exchange_Mode": "PSK with (EC)DHE key establishment (psk_dhe_ke) (1)"},
+      {"name": "record_size_limit (28)", "data": "4001"},
+      {"name": "encrypted_client_hello (65037)"}
+    ],
+    "tls_version_record": "771",
+    "tls_version_negotiated": "772"
+  }
+}`
+
+func TestClientHelloSpecFromJSON(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		json    string
+		wantIDs []uint16
+		check   func(spec *ClientHelloSpec) bool
+	}{
+		{
+			name: "Chrome",
+			json: chromeJSON,
+			wantIDs: []uint16{
+				GREASE_PLACEHOLDER, extensionALPN, extensionSessionTicket, extensionSCT,
+				extensionSupportedCurves, utlsExtensionExtendedMasterSecret, extensionSupportedPoints,
+				extensionServerName, utlsExtensionApplicationSettings, extensionKeyShare, extensionPSKModes,
+				extensionSupportedVersions, extensionStatusRequest, extensionRenegotiationInfo,
+				extensionCompressCertificate, extensionSignatureAlgorithms, GREASE_PLACEHOLDER, utlsExtensionPadding,
+			},
+			check: func(spec *ClientHelloSpec) bool {
+				return spec.CipherSuites[0] == GREASE_PLACEHOLDER &&
+					spec.CipherSuites[8] == TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305 &&
+					reflect.DeepEqual(spec.Extensions[1], &ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}}) &&
+					reflect.DeepEqual(spec.Extensions[4], &SupportedCurvesExtension{Curves: []CurveID{GREASE_PLACEHOLDER, X25519, CurveP256, CurveP384}}) &&
+					reflect.DeepEqual(spec.Extensions[8], &ApplicationSettingsExtension{SupportedProtocols: []string{"h2"}}) &&
+					reflect.DeepEqual(spec.Extensions[9], &KeyShareExtension{KeyShares: []KeyShare{{Group: GREASE_PLACEHOLDER, Data: []byte{0}}, {Group: X25519}}}) &&
+					reflect.DeepEqual(spec.Extensions[10], &PSKKeyExchangeModesExtension{Modes: []uint8{pskModeDHE}}) &&
+					reflect.DeepEqual(spec.Extensions[11], &SupportedVersionsExtension{Versions: []uint16{GREASE_PLACEHOLDER, VersionTLS13, VersionTLS12}}) &&
+					reflect.DeepEqual(spec.Extensions[14], &CompressCertificateExtension{Algorithms: []CertCompressionAlgo{CertCompressionBrotli}}) &&
+					len(spec.Extensions[15].(*SignatureAlgorithmsExtension).SupportedSignatureAlgorithms) == 8
+			},
+		},
+		{
+			name: "Firefox",
+			json: firefoxJSON,
+			wantIDs: []uint16{
+				extensionServerName, utlsExtensionExtendedMasterSecret, extensionRenegotiationInfo,
+				extensionSupportedCurves, extensionSupportedPoints, extensionSessionTicket, extensionALPN,
+				extensionStatusRequest, utlsExtensionDelegatedCredentials, extensionKeyShare,
+				extensionSupportedVersions, extensionSignatureAlgorithms, extensionPSKModes,
+				utlsExtensionRecordSizeLimit, utlsExtensionEncryptedClientHello,
+			},
+			check: func(spec *ClientHelloSpec) bool {
+				return len(spec.CipherSuites) == 17 &&
+					reflect.DeepEqual(spec.Extensions[3].(*SupportedCurvesExtension).Curves[4:], []CurveID{0x0100, 0x0101}) &&
+					reflect.DeepEqual(spec.Extensions[8], &DelegatedCredentialsExtension{SupportedSignatureAlgorithms: []SignatureScheme{
+						ECDSAWithP256AndSHA256, ECDSAWithP384AndSHA384, ECDSAWithP521AndSHA512, ECDSAWithSHA1}}) &&
+					reflect.DeepEqual(spec.Extensions[9], &KeyShareExtension{KeyShares: []KeyShare{{Group: X25519}, {Group: CurveP256}}}) &&
+					reflect.DeepEqual(spec.Extensions[13], &RecordSizeLimitExtension{Limit: 0x4001})
+			},
+		},
+	} {
+		spec, err := ClientHelloSpecFromJSON(strings.NewReader(test.json))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var ids []uint16
+		for _, ext := range spec.Extensions {
+			if _, ok := ext.(*GenericExtension); ok {
+				t.Errorf("%s: unexpected GenericExtension %#v", test.name, ext)
+			}
+			switch ext.(type) {
+			case *UtlsGREASEExtension:
+				ids = append(ids, GREASE_PLACEHOLDER)
+			case *UtlsPaddingExtension:
+				// Empty until the spec is applied.
+				ids = append(ids, utlsExtensionPadding)
+			default:
+				b := make([]byte, ext.Len())
+				ext.Read(b)
+				ids = append(ids, uint16(b[0])<<8|uint16(b[1]))
+			}
+		}
+		if !reflect.DeepEqual(ids, test.wantIDs) {
+			t.Errorf("%s: extensions %v, want %v", test.name, ids, test.wantIDs)
+		}
+		if !test.check(spec) {
+			t.Errorf("%s: unexpected spec %s", test.name, spec)
+		}
+
+		c, s := localPipe(t)
+		go func() {
+			defer s.Close()
+			Server(s, testConfig.Clone()).Handshake()
+		}()
+		client := UClient(c, &Config{ServerName: "example.golang", InsecureSkipVerify: true}, HelloCustom)
+		if err := client.ApplyPreset(spec); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if v := client.ConnectionState().Version; v != VersionTLS13 {
+			t.Errorf("%s: negotiated version %x", test.name, v)
+		}
+		c.Close()
+	}
+}
+
+func TestClientHelloSpecFromJSONGeneric(t *testing.T) {
+	spec, err := ClientHelloSpecFromJSON(strings.NewReader(`{"tls": {
+		"ciphers": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "0xc02f", "TLS_EMPTY_RENEGOTIATION_INFO_SCSV"],
+		"extensions": [
+			{"name": "server_name (0)"},
+			{"name": "token_binding (24)", "data": "000a0102"},
+			{"name": "unknown (65000)"}
+		],
+		"tls_version_record": "771"
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ClientHelloSpec{
+		CipherSuites: []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, FAKE_TLS_EMPTY_RENEGOTIATION_INFO_SCSV},
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&GenericExtension{Id: 24, Data: []byte{0x00, 0x0a, 0x01, 0x02}},
+			&GenericExtension{Id: 65000, Data: []byte{}},
+		},
+		TLSVersMin: VersionTLS10,
+		TLSVersMax: VersionTLS12,
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("got %s, want %s", spec, want)
+	}
+
+	for _, invalid := range []string{
+		`not json`,
+		`{"tls": {"ciphers": []}}`,
+		`{"ciphers": ["TLS_UNKNOWN_CIPHER"]}`,
+		`{"ciphers": ["0x1301"], "extensions": [{"name": "no codepoint"}]}`,
+		`{"ciphers": ["0x1301"], "extensions": [{"name": "supported_groups (10)", "supported_groups": ["unknown"]}]}`,
+		`{"ciphers": ["0x1301"], "extensions": [{"name": "key_share (51)"}]}`,
+	} {
+		if _, err := ClientHelloSpecFromJSON(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
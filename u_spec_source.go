@@ -0,0 +1,418 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go/format"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// String returns spec as a Go composite literal, to commit the spec of a
+// fingerprinted ClientHello as code, see UConn.ClientHelloSpecSource. The
+// literal refers to this package as tls.
+//
+// Cipher suites, versions, groups, signature schemes and the other values
+// this package has a constant for are written with its name, unknown ones as
+// hex literals. Unexported fields, such as the state ApplyPreset generates,
+// are left out, and functions other than BoringPaddingStyle and
+// sha256.Sum256, and pointers other than the extensions, which cannot be
+// written, are left as comments.
+func (spec *ClientHelloSpec) String() string {
+	var w specSourceWriter
+	w.value(reflect.ValueOf(spec).Elem(), "")
+	src := w.String()
+	if formatted, err := format.Source([]byte(src)); err == nil {
+		return string(formatted)
+	}
+	return src
+}
+
+// ClientHelloSpecSource returns the spec of the ClientHello uconn sends, or
+// sent, as Go source, see ClientHelloSpec.String. The spec is fingerprinted
+// from the marshaled ClientHello, see Fingerprinter, so GREASE values, the
+// server name and the key shares uTLS generates are left to ApplyPreset, and
+// the pre_shared_key and early_data extensions are left out.
+func (uconn *UConn) ClientHelloSpecSource() (string, error) {
+	raw := uconn.HandshakeState.Hello.Raw
+	if !uconn.clientHelloSent() {
+		var err error
+		if raw, err = uconn.MarshalClientHello(); err != nil {
+			return "", err
+		}
+	}
+	if len(raw) == 0 {
+		return "", errors.New("tls: the ClientHello is not available")
+	}
+	spec, err := (&Fingerprinter{}).FingerprintClientHelloBytes(raw)
+	if err != nil {
+		return "", err
+	}
+	return spec.String(), nil
+}
+
+// specSourceWriter writes values as Go source, see ClientHelloSpec.String.
+type specSourceWriter struct {
+	strings.Builder
+}
+
+// value writes v. field is the name of the struct field holding v, or the
+// slice v is an element of, which tells the constants of plain integers.
+func (w *specSourceWriter) value(v reflect.Value, field string) {
+	if name, ok := specConstantName(v, field); ok {
+		w.WriteString("tls." + name)
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		w.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint8:
+		fmt.Fprintf(w, "0x%02x", v.Uint())
+	case reflect.Uint16:
+		fmt.Fprintf(w, "0x%04x", v.Uint())
+	case reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fmt.Fprintf(w, "%#x", v.Uint())
+	case reflect.String:
+		w.WriteString(strconv.Quote(v.String()))
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			w.WriteString("nil")
+			return
+		}
+		w.WriteString(specSourceType(v.Type()) + "{")
+		// Bytes and strings fit on a line, constants are listed one
+		// per line.
+		elem := v.Type().Elem().Kind()
+		multiline := elem != reflect.Uint8 && elem != reflect.String && v.Len() > 0
+		for i := 0; i < v.Len(); i++ {
+			if multiline {
+				w.WriteString("\n")
+			} else if i > 0 {
+				w.WriteString(" ")
+			}
+			w.element(v.Index(i), field)
+			if multiline || i < v.Len()-1 {
+				w.WriteString(",")
+			}
+		}
+		if multiline {
+			w.WriteString("\n")
+		}
+		w.WriteString("}")
+	case reflect.Map:
+		if v.IsNil() {
+			w.WriteString("nil")
+			return
+		}
+		w.WriteString(specSourceType(v.Type()) + "{\n")
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, k := range keys {
+			w.value(k, field)
+			w.WriteString(": ")
+			w.element(v.MapIndex(k), field)
+			w.WriteString(",\n")
+		}
+		w.WriteString("}")
+	case reflect.Struct:
+		w.WriteString(specSourceType(v.Type()))
+		w.fields(v)
+	case reflect.Ptr:
+		if v.IsNil() {
+			w.WriteString("nil")
+		} else if v.Elem().Kind() == reflect.Struct {
+			w.WriteString("&")
+			w.value(v.Elem(), field)
+		} else {
+			w.WriteString("nil /* " + specSourceType(v.Type()) + " */")
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			w.WriteString("nil")
+			return
+		}
+		w.value(v.Elem(), field)
+	case reflect.Func:
+		if name, ok := specFuncName(v); ok {
+			w.WriteString(name)
+		} else {
+			w.WriteString("nil")
+		}
+	default:
+		w.WriteString("nil /* " + specSourceType(v.Type()) + " */")
+	}
+}
+
+// element writes v, an element of a slice or a map, whose struct type may be
+// elided.
+func (w *specSourceWriter) element(v reflect.Value, field string) {
+	if v.Kind() == reflect.Struct {
+		w.fields(v)
+		return
+	}
+	w.value(v, field)
+}
+
+// fields writes the exported fields of the struct v which are set, between
+// braces. Those which cannot be written are left as comments.
+func (w *specSourceWriter) fields(v reflect.Value) {
+	t := v.Type()
+	var set []int
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() && !v.Field(i).IsZero() {
+			set = append(set, i)
+		}
+	}
+	multiline := len(set) > 1 || t == reflect.TypeOf(ClientHelloSpec{})
+	w.WriteString("{")
+	for _, i := range set {
+		f, name := v.Field(i), t.Field(i).Name
+		if multiline {
+			w.WriteString("\n")
+		}
+		if !specSourceWritable(f) {
+			fmt.Fprintf(w, "// %s: %s cannot be written.\n", name, specSourceType(f.Type()))
+			continue
+		}
+		w.WriteString(name + ": ")
+		w.value(f, name)
+		if multiline {
+			w.WriteString(",")
+		}
+	}
+	if multiline {
+		w.WriteString("\n")
+	}
+	w.WriteString("}")
+}
+
+// specSourceWritable reports whether value can write v, a struct field.
+func specSourceWritable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Func:
+		_, ok := specFuncName(v)
+		return ok
+	case reflect.Ptr:
+		// Such as the session of a SessionTicketExtension.
+		return false
+	case reflect.Chan, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return false
+	}
+	return true
+}
+
+// specFuncName returns the name of the function v, if it is a known one.
+func specFuncName(v reflect.Value) (string, bool) {
+	if v.IsNil() {
+		return "nil", true
+	}
+	switch v.Pointer() {
+	case reflect.ValueOf(BoringPaddingStyle).Pointer():
+		return "tls.BoringPaddingStyle", true
+	case reflect.ValueOf(sha256.Sum256).Pointer():
+		return "sha256.Sum256", true
+	}
+	return "", false
+}
+
+// specSourceType returns the Go source of t.
+func specSourceType(t reflect.Type) string {
+	if t.Name() != "" {
+		switch t.PkgPath() {
+		case "":
+			return t.Name()
+		case reflect.TypeOf(ClientHelloSpec{}).PkgPath():
+			return "tls." + t.Name()
+		}
+		return t.String()
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		return "[]" + specSourceType(t.Elem())
+	case reflect.Array:
+		return "[" + strconv.Itoa(t.Len()) + "]" + specSourceType(t.Elem())
+	case reflect.Map:
+		return "map[" + specSourceType(t.Key()) + "]" + specSourceType(t.Elem())
+	case reflect.Ptr:
+		return "*" + specSourceType(t.Elem())
+	}
+	return t.String()
+}
+
+// specConstantName returns the name of the constant of this package equal to
+// v, held by the struct field or slice named field.
+func specConstantName(v reflect.Value, field string) (string, bool) {
+	var names map[uint64]string
+	switch v.Type() {
+	case reflect.TypeOf(CurveID(0)):
+		names = curveIDNames
+	case reflect.TypeOf(SignatureScheme(0)):
+		names = signatureSchemeNames
+	case reflect.TypeOf(CertCompressionAlgo(0)):
+		names = certCompressionAlgoNames
+	case reflect.TypeOf(RenegotiationSupport(0)):
+		names = renegotiationSupportNames
+	case reflect.TypeOf(CachedInformationType(0)):
+		names = cachedInformationTypeNames
+	case reflect.TypeOf(uint16(0)):
+		switch field {
+		case "CipherSuites":
+			names = cipherSuiteNames
+		case "Versions", "TLSVersMin", "TLSVersMax":
+			names = versionNames
+		case "Value":
+			names = map[uint64]string{GREASE_PLACEHOLDER: "GREASE_PLACEHOLDER"}
+		case "KDFID":
+			names = hpkeKDFNames
+		case "AEADID":
+			names = hpkeAEADNames
+		}
+	case reflect.TypeOf(uint8(0)):
+		if field == "Modes" {
+			names = pskModeNames
+		}
+	}
+	if names == nil {
+		return "", false
+	}
+	var n uint64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = uint64(v.Int())
+	default:
+		n = v.Uint()
+	}
+	name, ok := names[n]
+	return name, ok
+}
+
+var (
+	cipherSuiteNames = map[uint64]string{
+		GREASE_PLACEHOLDER:                                         "GREASE_PLACEHOLDER",
+		uint64(TLS_RSA_WITH_RC4_128_SHA):                           "TLS_RSA_WITH_RC4_128_SHA",
+		uint64(TLS_RSA_WITH_3DES_EDE_CBC_SHA):                      "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+		uint64(TLS_RSA_WITH_AES_128_CBC_SHA):                       "TLS_RSA_WITH_AES_128_CBC_SHA",
+		uint64(TLS_RSA_WITH_AES_256_CBC_SHA):                       "TLS_RSA_WITH_AES_256_CBC_SHA",
+		uint64(TLS_RSA_WITH_AES_128_CBC_SHA256):                    "TLS_RSA_WITH_AES_128_CBC_SHA256",
+		uint64(TLS_RSA_WITH_AES_128_GCM_SHA256):                    "TLS_RSA_WITH_AES_128_GCM_SHA256",
+		uint64(TLS_RSA_WITH_AES_256_GCM_SHA384):                    "TLS_RSA_WITH_AES_256_GCM_SHA384",
+		uint64(TLS_ECDHE_ECDSA_WITH_RC4_128_SHA):                   "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+		uint64(TLS_ECDHE_ECDSA_WITH_3DES_EDE_CBC_SHA):              "TLS_ECDHE_ECDSA_WITH_3DES_EDE_CBC_SHA",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA):               "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA):               "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+		uint64(TLS_ECDHE_RSA_WITH_RC4_128_SHA):                     "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+		uint64(TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA):                "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+		uint64(TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA):                 "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+		uint64(TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA):                 "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256):            "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+		uint64(TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256):              "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+		uint64(TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256):              "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256):            "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		uint64(TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384):              "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384):            "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		uint64(TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305):               "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+		uint64(TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305):             "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_128_CCM):                   "TLS_ECDHE_ECDSA_WITH_AES_128_CCM",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_256_CCM):                   "TLS_ECDHE_ECDSA_WITH_AES_256_CCM",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8):                 "TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8",
+		uint64(TLS_ECDHE_ECDSA_WITH_AES_256_CCM_8):                 "TLS_ECDHE_ECDSA_WITH_AES_256_CCM_8",
+		uint64(TLS_AES_128_GCM_SHA256):                             "TLS_AES_128_GCM_SHA256",
+		uint64(TLS_AES_256_GCM_SHA384):                             "TLS_AES_256_GCM_SHA384",
+		uint64(TLS_CHACHA20_POLY1305_SHA256):                       "TLS_CHACHA20_POLY1305_SHA256",
+		uint64(TLS_AES_128_CCM_SHA256):                             "TLS_AES_128_CCM_SHA256",
+		uint64(TLS_AES_128_CCM_8_SHA256):                           "TLS_AES_128_CCM_8_SHA256",
+		uint64(TLS_FALLBACK_SCSV):                                  "TLS_FALLBACK_SCSV",
+		uint64(OLD_TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256):    "OLD_TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		uint64(OLD_TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256):  "OLD_TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+		uint64(DISABLED_TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384):   "DISABLED_TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384",
+		uint64(DISABLED_TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384):     "DISABLED_TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384",
+		uint64(DISABLED_TLS_RSA_WITH_AES_256_CBC_SHA256):           "DISABLED_TLS_RSA_WITH_AES_256_CBC_SHA256",
+		uint64(FAKE_OLD_TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256): "FAKE_OLD_TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		uint64(FAKE_TLS_DHE_RSA_WITH_AES_128_GCM_SHA256):           "FAKE_TLS_DHE_RSA_WITH_AES_128_GCM_SHA256",
+		uint64(FAKE_TLS_DHE_RSA_WITH_AES_128_CBC_SHA):              "FAKE_TLS_DHE_RSA_WITH_AES_128_CBC_SHA",
+		uint64(FAKE_TLS_DHE_RSA_WITH_AES_256_CBC_SHA):              "FAKE_TLS_DHE_RSA_WITH_AES_256_CBC_SHA",
+		uint64(FAKE_TLS_RSA_WITH_RC4_128_MD5):                      "FAKE_TLS_RSA_WITH_RC4_128_MD5",
+		uint64(FAKE_TLS_EMPTY_RENEGOTIATION_INFO_SCSV):             "FAKE_TLS_EMPTY_RENEGOTIATION_INFO_SCSV",
+	}
+
+	versionNames = map[uint64]string{
+		GREASE_PLACEHOLDER: "GREASE_PLACEHOLDER",
+		VersionSSL30:       "VersionSSL30",
+		VersionTLS10:       "VersionTLS10",
+		VersionTLS11:       "VersionTLS11",
+		VersionTLS12:       "VersionTLS12",
+		VersionTLS13:       "VersionTLS13",
+		VersionDTLS12:      "VersionDTLS12",
+	}
+
+	curveIDNames = map[uint64]string{
+		GREASE_PLACEHOLDER:            "GREASE_PLACEHOLDER",
+		uint64(CurveP256):             "CurveP256",
+		uint64(CurveP384):             "CurveP384",
+		uint64(CurveP521):             "CurveP521",
+		uint64(X25519):                "X25519",
+		uint64(X25519Kyber768Draft00): "X25519Kyber768Draft00",
+		uint64(X25519MLKEM768):        "X25519MLKEM768",
+		uint64(MLKEM768):              "MLKEM768",
+	}
+
+	signatureSchemeNames = map[uint64]string{
+		uint64(PKCS1WithSHA256):        "PKCS1WithSHA256",
+		uint64(PKCS1WithSHA384):        "PKCS1WithSHA384",
+		uint64(PKCS1WithSHA512):        "PKCS1WithSHA512",
+		uint64(PSSWithSHA256):          "PSSWithSHA256",
+		uint64(PSSWithSHA384):          "PSSWithSHA384",
+		uint64(PSSWithSHA512):          "PSSWithSHA512",
+		uint64(ECDSAWithP256AndSHA256): "ECDSAWithP256AndSHA256",
+		uint64(ECDSAWithP384AndSHA384): "ECDSAWithP384AndSHA384",
+		uint64(ECDSAWithP521AndSHA512): "ECDSAWithP521AndSHA512",
+		uint64(PKCS1WithSHA1):          "PKCS1WithSHA1",
+		uint64(ECDSAWithSHA1):          "ECDSAWithSHA1",
+	}
+
+	certCompressionAlgoNames = map[uint64]string{
+		uint64(CertCompressionZlib):   "CertCompressionZlib",
+		uint64(CertCompressionBrotli): "CertCompressionBrotli",
+		uint64(CertCompressionZstd):   "CertCompressionZstd",
+	}
+
+	renegotiationSupportNames = map[uint64]string{
+		uint64(RenegotiateNever):          "RenegotiateNever",
+		uint64(RenegotiateOnceAsClient):   "RenegotiateOnceAsClient",
+		uint64(RenegotiateFreelyAsClient): "RenegotiateFreelyAsClient",
+	}
+
+	cachedInformationTypeNames = map[uint64]string{
+		uint64(CachedInformationCert):    "CachedInformationCert",
+		uint64(CachedInformationCertReq): "CachedInformationCertReq",
+	}
+
+	pskModeNames = map[uint64]string{
+		uint64(PskModePlain): "PskModePlain",
+		uint64(PskModeDHE):   "PskModeDHE",
+	}
+
+	hpkeKDFNames = map[uint64]string{
+		uint64(HPKE_KDF_HKDF_SHA256): "HPKE_KDF_HKDF_SHA256",
+		uint64(HPKE_KDF_HKDF_SHA384): "HPKE_KDF_HKDF_SHA384",
+		uint64(HPKE_KDF_HKDF_SHA512): "HPKE_KDF_HKDF_SHA512",
+	}
+
+	hpkeAEADNames = map[uint64]string{
+		uint64(HPKE_AEAD_AES_128_GCM):       "HPKE_AEAD_AES_128_GCM",
+		uint64(HPKE_AEAD_AES_256_GCM):       "HPKE_AEAD_AES_256_GCM",
+		uint64(HPKE_AEAD_CHACHA20_POLY1305): "HPKE_AEAD_CHACHA20_POLY1305",
+	}
+)
@@ -0,0 +1,81 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"go/parser"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClientHelloSpecString(t *testing.T) {
+	spec := &ClientHelloSpec{
+		CipherSuites:       []uint16{GREASE_PLACEHOLDER, TLS_AES_128_GCM_SHA256, 0x1337},
+		CompressionMethods: []uint8{0x00},
+		Extensions: []TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{X25519, 0x0100}},
+			&ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+			&KeyShareExtension{KeyShares: []KeyShare{
+				{Group: GREASE_PLACEHOLDER, Data: []byte{0}},
+				{Group: X25519},
+			}},
+			&PSKKeyExchangeModesExtension{Modes: []uint8{PskModeDHE}},
+			&GenericExtension{Id: 0x4469, Data: []byte{0x01, 0x02}},
+			&UtlsPaddingExtension{GetPaddingLen: BoringPaddingStyle},
+		},
+		TLSVersMax: VersionTLS13,
+	}
+	want := `tls.ClientHelloSpec{
+	CipherSuites: []uint16{
+		tls.GREASE_PLACEHOLDER,
+		tls.TLS_AES_128_GCM_SHA256,
+		0x1337,
+	},
+	CompressionMethods: []uint8{0x00},
+	Extensions: []tls.TLSExtension{
+		&tls.SNIExtension{},
+		&tls.SupportedCurvesExtension{Curves: []tls.CurveID{
+			tls.X25519,
+			0x0100,
+		}},
+		&tls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+		&tls.KeyShareExtension{KeyShares: []tls.KeyShare{
+			{
+				Group: tls.GREASE_PLACEHOLDER,
+				Data:  []uint8{0x00},
+			},
+			{Group: tls.X25519},
+		}},
+		&tls.PSKKeyExchangeModesExtension{Modes: []uint8{tls.PskModeDHE}},
+		&tls.GenericExtension{
+			Id:   0x4469,
+			Data: []uint8{0x01, 0x02},
+		},
+		&tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle},
+	},
+	TLSVersMax: tls.VersionTLS13,
+}`
+	if got := spec.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestClientHelloSpecSource(t *testing.T) {
+	for _, id := range []ClientHelloID{HelloChrome_124, HelloFirefox_Auto, HelloIOS_Auto} {
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, id)
+		src, err := uconn.ClientHelloSpecSource()
+		if err != nil {
+			t.Fatalf("%s: %v", id.Str(), err)
+		}
+		if _, err := parser.ParseExpr(src); err != nil {
+			t.Errorf("%s: the source does not parse: %v\n%s", id.Str(), err, src)
+		}
+		if !strings.Contains(src, "tls.TLS_AES_128_GCM_SHA256,") {
+			t.Errorf("%s: the cipher suites are not written by name:\n%s", id.Str(), src)
+		}
+	}
+}
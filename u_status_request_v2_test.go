@@ -0,0 +1,152 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestStatusRequestV2Extension(t *testing.T) {
+	for _, test := range []struct {
+		ext  *StatusRequestV2Extension
+		want []byte
+	}{
+		{&StatusRequestV2Extension{}, []byte{0, 17, 0, 9, 0, 7, 2, 0, 4, 0, 0, 0, 0}},
+		{&StatusRequestV2Extension{StatusTypes: []uint8{statusTypeOCSPMulti, statusTypeOCSP}},
+			[]byte{0, 17, 0, 16, 0, 14, 2, 0, 4, 0, 0, 0, 0, 1, 0, 4, 0, 0, 0, 0}},
+	} {
+		b := make([]byte, test.ext.Len())
+		if n, err := test.ext.Read(b); n != len(test.want) || err != io.EOF || !bytes.Equal(b, test.want) {
+			t.Errorf("%v: Read = %x, %v, want %x", test.ext.StatusTypes, b[:n], err, test.want)
+		}
+
+		uconn := UClient(&net.TCPConn{}, &Config{ServerName: "example.com"}, HelloCustom)
+		if err := uconn.ApplyPreset(&ClientHelloSpec{
+			CipherSuites: []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			Extensions:   []TLSExtension{&SNIExtension{}, &StatusRequestExtension{}, test.ext},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := clientHelloExtension(t, uconn.HandshakeState.Hello.Raw, utlsExtensionStatusRequestV2); !bytes.Equal(got, test.want[4:]) {
+			t.Errorf("%v: ClientHello carries %x", test.ext.StatusTypes, got)
+		}
+		spec, raw := fingerprintAndRebuild(t, &Fingerprinter{}, uconn.HandshakeState.Hello.Raw)
+		if !bytes.Equal(raw, uconn.HandshakeState.Hello.Raw) {
+			t.Errorf("%v: re-marshaled ClientHello differs", test.ext.StatusTypes)
+		}
+		if ext, ok := spec.Extensions[2].(*StatusRequestV2Extension); !ok {
+			t.Errorf("%v: fingerprinted %T", test.ext.StatusTypes, spec.Extensions[2])
+		} else if len(test.ext.StatusTypes) > 0 && !reflect.DeepEqual(ext.StatusTypes, test.ext.StatusTypes) {
+			t.Errorf("fingerprinted status types %v, want %v", ext.StatusTypes, test.ext.StatusTypes)
+		}
+	}
+
+	spec, err := ClientHelloSpecFromJA3("771,49195,0-5-17,,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spec.Extensions[2].(*StatusRequestV2Extension); !ok {
+		t.Errorf("JA3 extension 17 is a %T", spec.Extensions[2])
+	}
+}
+
+func TestStatusRequestV2Handshake(t *testing.T) {
+	cert, roots := policyTestChain(t, x509.SHA256WithRSA, 2048)
+	cert.OCSPStaple = []byte("leaf OCSP response")
+
+	for _, test := range []struct {
+		name       string
+		version    uint16
+		extensions []TLSExtension
+		want       [][]byte
+	}{
+		{"TLS 1.2 status_request_v2", VersionTLS12,
+			[]TLSExtension{&StatusRequestExtension{}, &StatusRequestV2Extension{}},
+			[][]byte{cert.OCSPStaple, nil}},
+		{"TLS 1.2 status_request", VersionTLS12,
+			[]TLSExtension{&StatusRequestExtension{}},
+			[][]byte{cert.OCSPStaple}},
+		{"TLS 1.2 without OCSP", VersionTLS12, nil, nil},
+		{"TLS 1.3", VersionTLS13,
+			[]TLSExtension{&StatusRequestExtension{}, &StatusRequestV2Extension{}},
+			[][]byte{cert.OCSPStaple, nil}},
+	} {
+		c, s := localPipe(t)
+		go func() {
+			defer s.Close()
+			server := Server(s, &Config{Certificates: []Certificate{cert}, MaxVersion: test.version})
+			io.Copy(server, server)
+		}()
+
+		extensions := append([]TLSExtension{
+			&SNIExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{X25519}},
+			&SupportedPointsExtension{SupportedPoints: []byte{pointFormatUncompressed}},
+			&SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []SignatureScheme{PSSWithSHA256, PKCS1WithSHA256}},
+		}, test.extensions...)
+		if test.version == VersionTLS13 {
+			extensions = append(extensions,
+				&KeyShareExtension{KeyShares: []KeyShare{{Group: X25519}}},
+				&SupportedVersionsExtension{Versions: []uint16{VersionTLS13}})
+		}
+		client := UClient(c, &Config{ServerName: "policy.example.com", RootCAs: roots}, HelloCustom)
+		if err := client.ApplyPreset(&ClientHelloSpec{
+			TLSVersMax:         test.version,
+			TLSVersMin:         VersionTLS12,
+			CipherSuites:       []uint16{TLS_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			CompressionMethods: []byte{compressionNone},
+			Extensions:         extensions,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		state := client.ConnectionState()
+		if !reflect.DeepEqual(state.OCSPResponses, test.want) {
+			t.Errorf("%s: OCSPResponses = %q, want %q", test.name, state.OCSPResponses, test.want)
+		}
+		if test.want != nil && !bytes.Equal(state.OCSPResponse, cert.OCSPStaple) {
+			t.Errorf("%s: OCSPResponse = %q", test.name, state.OCSPResponse)
+		}
+		client.Close()
+	}
+}
+
+func TestStatusRequestV2Preset(t *testing.T) {
+	cert, roots := policyTestChain(t, x509.SHA256WithRSA, 2048)
+	cert.OCSPStaple = []byte("leaf OCSP response")
+
+	c, s := localPipe(t)
+	go func() {
+		defer s.Close()
+		server := Server(s, &Config{Certificates: []Certificate{cert}, MaxVersion: VersionTLS12})
+		io.Copy(server, server)
+	}()
+	defer c.Close()
+
+	client := UClient(c, &Config{ServerName: "policy.example.com", RootCAs: roots}, HelloChrome_124)
+	if err := client.InsertExtensionBefore(extensionStatusRequest, &StatusRequestV2Extension{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	state := client.ConnectionState()
+	if want := [][]byte{cert.OCSPStaple, nil}; !reflect.DeepEqual(state.OCSPResponses, want) {
+		t.Errorf("OCSPResponses = %q, want %q", state.OCSPResponses, want)
+	}
+	if !bytes.Equal(state.OCSPResponse, cert.OCSPStaple) {
+		t.Errorf("OCSPResponse = %q", state.OCSPResponse)
+	}
+}
@@ -7,6 +7,8 @@ package tls
 import (
 	"errors"
 	"io"
+
+	"golang.org/x/crypto/cryptobyte"
 )
 
 type TLSExtension interface {
@@ -101,6 +103,58 @@ func (e *StatusRequestExtension) Read(b []byte) (int, error) {
 	return e.Len(), io.EOF
 }
 
+// StatusRequestV2Extension is the status_request_v2 extension, which asks
+// for the OCSP responses of the whole certificate chain, see RFC 6961. It
+// requests each of StatusTypes, or ocsp_multi alone if it is empty, with no
+// responder IDs nor request extensions. ConnectionState().OCSPResponses
+// holds the responses the server staples. TLS 1.3 servers ignore it, and
+// staple responses in the Certificate message when the ClientHello has a
+// StatusRequestExtension.
+//
+// No browser sends it, so no preset includes it: add it to a preset with
+// UConn.InsertExtensionBefore, for servers which only staple the responses of
+// the intermediates through status_request_v2.
+type StatusRequestV2Extension struct {
+	StatusTypes []uint8
+}
+
+func (e *StatusRequestV2Extension) statusTypes() []uint8 {
+	if len(e.StatusTypes) == 0 {
+		return []uint8{statusTypeOCSPMulti}
+	}
+	return e.StatusTypes
+}
+
+func (e *StatusRequestV2Extension) writeToUConn(uc *UConn) error {
+	uc.statusRequestV2 = true
+	return nil
+}
+
+func (e *StatusRequestV2Extension) Len() int {
+	return 6 + 7*len(e.statusTypes())
+}
+
+func (e *StatusRequestV2Extension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	// RFC 6961, Section 2.2
+	b[0] = byte(utlsExtensionStatusRequestV2 >> 8)
+	b[1] = byte(utlsExtensionStatusRequestV2)
+	b[2] = byte((e.Len() - 4) >> 8)
+	b[3] = byte(e.Len() - 4)
+	b[4] = byte((e.Len() - 6) >> 8)
+	b[5] = byte(e.Len() - 6)
+	for i, statusType := range e.statusTypes() {
+		item := b[6+7*i : 6+7*i+7]
+		item[0] = statusType
+		item[1], item[2] = 0, 4 // request_length
+		// Two zero valued uint16s for the two lengths.
+		item[3], item[4], item[5], item[6] = 0, 0, 0, 0
+	}
+	return e.Len(), io.EOF
+}
+
 type SupportedCurvesExtension struct {
 	Curves []CurveID
 }
@@ -193,6 +247,80 @@ func (e *SignatureAlgorithmsExtension) Read(b []byte) (int, error) {
 	return e.Len(), io.EOF
 }
 
+// SignatureAlgorithmsCertExtension is the signature_algorithms_cert extension
+// of RFC 8446, Section 4.2.3, listing the signature schemes accepted in
+// certificates, as opposed to SignatureAlgorithmsExtension which lists those
+// accepted in handshake signatures. The server's certificate chain is
+// rejected if a certificate, other than a self-signed one or the root of a
+// verified chain, is signed with a scheme not in
+// SupportedSignatureAlgorithms.
+type SignatureAlgorithmsCertExtension struct {
+	SupportedSignatureAlgorithms []SignatureScheme
+}
+
+func (e *SignatureAlgorithmsCertExtension) writeToUConn(uc *UConn) error {
+	uc.HandshakeState.Hello.SupportedSignatureAlgorithmsCert = e.SupportedSignatureAlgorithms
+	uc.certSignatureSchemes = e.SupportedSignatureAlgorithms
+	return nil
+}
+
+func (e *SignatureAlgorithmsCertExtension) Len() int {
+	return 6 + 2*len(e.SupportedSignatureAlgorithms)
+}
+
+func (e *SignatureAlgorithmsCertExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	b[0] = byte(extensionSignatureAlgorithmsCert >> 8)
+	b[1] = byte(extensionSignatureAlgorithmsCert)
+	b[2] = byte((2 + 2*len(e.SupportedSignatureAlgorithms)) >> 8)
+	b[3] = byte((2 + 2*len(e.SupportedSignatureAlgorithms)))
+	b[4] = byte((2 * len(e.SupportedSignatureAlgorithms)) >> 8)
+	b[5] = byte((2 * len(e.SupportedSignatureAlgorithms)))
+	for i, sigAndHash := range e.SupportedSignatureAlgorithms {
+		b[6+2*i] = byte(sigAndHash >> 8)
+		b[7+2*i] = byte(sigAndHash)
+	}
+	return e.Len(), io.EOF
+}
+
+// DelegatedCredentialsExtension advertises the signature schemes accepted in
+// delegated credentials, see RFC 9345. A delegated credential sent by the
+// server is only accepted if its dc_cert_verify_algorithm is one of
+// SupportedSignatureAlgorithms; it is then verified against the server's
+// certificate and reported in ConnectionState.DelegatedCredential.
+type DelegatedCredentialsExtension struct {
+	SupportedSignatureAlgorithms []SignatureScheme
+}
+
+func (e *DelegatedCredentialsExtension) writeToUConn(uc *UConn) error {
+	uc.delegatedCredentialSchemes = e.SupportedSignatureAlgorithms
+	return nil
+}
+
+func (e *DelegatedCredentialsExtension) Len() int {
+	return 6 + 2*len(e.SupportedSignatureAlgorithms)
+}
+
+func (e *DelegatedCredentialsExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	// https://tools.ietf.org/html/rfc9345#section-4.1.1
+	b[0] = byte(utlsExtensionDelegatedCredentials >> 8)
+	b[1] = byte(utlsExtensionDelegatedCredentials)
+	b[2] = byte((2 + 2*len(e.SupportedSignatureAlgorithms)) >> 8)
+	b[3] = byte((2 + 2*len(e.SupportedSignatureAlgorithms)))
+	b[4] = byte((2 * len(e.SupportedSignatureAlgorithms)) >> 8)
+	b[5] = byte((2 * len(e.SupportedSignatureAlgorithms)))
+	for i, sigAndHash := range e.SupportedSignatureAlgorithms {
+		b[6+2*i] = byte(sigAndHash >> 8)
+		b[7+2*i] = byte(sigAndHash)
+	}
+	return e.Len(), io.EOF
+}
+
 type RenegotiationInfoExtension struct {
 	// Renegotiation field limits how many times client will perform renegotiation: no limit, once, or never.
 	// The extension still will be sent, even if Renegotiation is set to RenegotiateNever.
@@ -341,12 +469,26 @@ func (e *SessionTicketExtension) Read(b []byte) (int, error) {
 }
 
 // GenericExtension allows to include in ClientHello arbitrary unsupported extensions.
+// It is marshaled verbatim as Id, the length of Data and Data, wherever it is
+// placed in ClientHelloSpec.Extensions, and has no effect on the handshake.
+// Like any other extension, its Id is part of the JA3 and JA4 fingerprints.
+// Fingerprinter produces GenericExtensions for the extensions it cannot
+// reproduce otherwise.
 type GenericExtension struct {
 	Id   uint16
 	Data []byte
 }
 
+// NewGenericExtension returns a GenericExtension with the given id and a copy
+// of data.
+func NewGenericExtension(id uint16, data []byte) *GenericExtension {
+	return &GenericExtension{Id: id, Data: append([]byte{}, data...)}
+}
+
 func (e *GenericExtension) writeToUConn(uc *UConn) error {
+	if len(e.Data) > 0xffff {
+		return errors.New("tls: GenericExtension data is too long")
+	}
 	return nil
 }
 
@@ -421,6 +563,7 @@ const (
 type UtlsGREASEExtension struct {
 	Value uint16
 	Body  []byte // in Chrome first grease has empty body, second grease has a single zero byte
+	// ApplyPreset gives the second grease a single zero byte body if Body is nil
 }
 
 func (e *UtlsGREASEExtension) writeToUConn(uc *UConn) error {
@@ -645,7 +788,7 @@ func (e *CookieExtension) writeToUConn(uc *UConn) error {
 }
 
 func (e *CookieExtension) Len() int {
-	return 4 + len(e.Cookie)
+	return 6 + len(e.Cookie)
 }
 
 func (e *CookieExtension) Read(b []byte) (int, error) {
@@ -653,66 +796,375 @@ func (e *CookieExtension) Read(b []byte) (int, error) {
 		return 0, io.ErrShortBuffer
 	}
 
+	// https://tools.ietf.org/html/rfc8446#section-4.2.2
 	b[0] = byte(extensionCookie >> 8)
 	b[1] = byte(extensionCookie)
-	b[2] = byte(len(e.Cookie) >> 8)
-	b[3] = byte(len(e.Cookie))
-	if len(e.Cookie) > 0 {
-		copy(b[4:], e.Cookie)
+	b[2] = byte((len(e.Cookie) + 2) >> 8)
+	b[3] = byte(len(e.Cookie) + 2)
+	b[4] = byte(len(e.Cookie) >> 8)
+	b[5] = byte(len(e.Cookie))
+	copy(b[6:], e.Cookie)
+	return e.Len(), io.EOF
+}
+
+// setCookieExtension sets the cookie of the CookieExtension of extensions,
+// adding one if there is none. Like Chrome, it goes right after the
+// supported_versions extension, or else after key_share, so that the other
+// extensions keep their order.
+func setCookieExtension(extensions []TLSExtension, cookie []byte) []TLSExtension {
+	for _, ext := range extensions {
+		if ext, ok := ext.(*CookieExtension); ok {
+			ext.Cookie = cookie
+			return extensions
+		}
+	}
+
+	i := -1
+	for j, ext := range extensions {
+		switch ext.(type) {
+		case *SupportedVersionsExtension:
+			i = j
+		case *KeyShareExtension:
+			if i == -1 {
+				i = j
+			}
+		}
+	}
+	i++
+	extensions = append(extensions, nil)
+	copy(extensions[i+1:], extensions[i:])
+	extensions[i] = &CookieExtension{Cookie: cookie}
+	return extensions
+}
+
+// RecordSizeLimitExtension advertises the largest record the client is
+// willing to receive, see RFC 8449. If the server answers with its own limit,
+// records sent to it are capped accordingly.
+type RecordSizeLimitExtension struct {
+	Limit uint16
+}
+
+func (e *RecordSizeLimitExtension) writeToUConn(uc *UConn) error {
+	uc.recordSizeLimit = e.Limit
+	return nil
+}
+
+func (e *RecordSizeLimitExtension) Len() int {
+	return 6
+}
+
+func (e *RecordSizeLimitExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
 	}
+	// https://tools.ietf.org/html/rfc8449#section-4
+	b[0] = byte(utlsExtensionRecordSizeLimit >> 8)
+	b[1] = byte(utlsExtensionRecordSizeLimit & 0xff)
+
+	b[2] = byte(0)
+	b[3] = byte(2)
+
+	b[4] = byte(e.Limit >> 8)
+	b[5] = byte(e.Limit & 0xff)
 	return e.Len(), io.EOF
 }
 
-/*
-FAKE EXTENSIONS
-*/
+// CertificateAuthoritiesExtension lists the DER-encoded distinguished names
+// of the certificate authorities the client accepts, see RFC 8446, Section
+// 4.2.4. The list is also used to pick a client certificate from
+// Config.Certificates when the server requests one without listing any
+// certificate authorities itself.
+type CertificateAuthoritiesExtension struct {
+	CertificateAuthorities [][]byte
+}
 
-type FakeChannelIDExtension struct {
+func (e *CertificateAuthoritiesExtension) writeToUConn(uc *UConn) error {
+	if len(e.CertificateAuthorities) == 0 {
+		return errors.New("tls: CertificateAuthoritiesExtension without certificate authorities")
+	}
+	for _, ca := range e.CertificateAuthorities {
+		if len(ca) == 0 || len(ca) > 0xffff {
+			return errors.New("tls: invalid certificate authority length")
+		}
+	}
+	if e.Len() > 0xffff+4 {
+		return errors.New("tls: certificate authorities list is too long")
+	}
+	uc.certificateAuthorities = e.CertificateAuthorities
+	return nil
 }
 
-func (e *FakeChannelIDExtension) writeToUConn(uc *UConn) error {
+func (e *CertificateAuthoritiesExtension) Len() int {
+	n := 6
+	for _, ca := range e.CertificateAuthorities {
+		n += 2 + len(ca)
+	}
+	return n
+}
+
+func (e *CertificateAuthoritiesExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	// https://tools.ietf.org/html/rfc8446#section-4.2.4
+	listLen := e.Len() - 6
+	b[0] = byte(extensionCertificateAuthorities >> 8)
+	b[1] = byte(extensionCertificateAuthorities)
+	b[2] = byte((listLen + 2) >> 8)
+	b[3] = byte(listLen + 2)
+	b[4] = byte(listLen >> 8)
+	b[5] = byte(listLen)
+	i := 6
+	for _, ca := range e.CertificateAuthorities {
+		b[i] = byte(len(ca) >> 8)
+		b[i+1] = byte(len(ca))
+		i += 2 + copy(b[i+2:], ca)
+	}
+	return e.Len(), io.EOF
+}
+
+// ApplicationSettingsExtension is the application_settings (ALPS) extension
+// of draft-vvv-tls-alps, as sent by Chrome. In a ClientHello it only lists the
+// ALPN protocols the client has application settings for, the settings
+// themselves are exchanged later in the handshake.
+//
+// If the server negotiates one of SupportedProtocols and returns its settings
+// in EncryptedExtensions, they are available from UConn.PeerApplicationSettings
+// and the client replies with Settings for that protocol, empty if there is no
+// entry.
+type ApplicationSettingsExtension struct {
+	SupportedProtocols []string
+	Settings           map[string][]byte
+
+	// NewCodepoint selects the codepoint 17613 used by newer Chrome versions
+	// instead of 17513.
+	NewCodepoint bool
+}
+
+func (e *ApplicationSettingsExtension) writeToUConn(uc *UConn) error {
+	uc.applicationSettings = e
 	return nil
 }
 
-func (e *FakeChannelIDExtension) Len() int {
+func (e *ApplicationSettingsExtension) codepoint() uint16 {
+	if e.NewCodepoint {
+		return utlsExtensionApplicationSettingsNew
+	}
+	return utlsExtensionApplicationSettings
+}
+
+func (e *ApplicationSettingsExtension) supportsProtocol(proto string) bool {
+	for _, p := range e.SupportedProtocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ApplicationSettingsExtension) Len() int {
+	bLen := 2 + 2 + 2 // Type + Length + ALPS Extension length
+	for _, s := range e.SupportedProtocols {
+		bLen += 1 + len(s) // Supported ALPN Length + actual length of protocol
+	}
+	return bLen
+}
+
+func (e *ApplicationSettingsExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+
+	// https://datatracker.ietf.org/doc/html/draft-vvv-tls-alps-01#section-3
+	b[0] = byte(e.codepoint() >> 8)
+	b[1] = byte(e.codepoint() & 0xff)
+	lengths := b[2:]
+	b = b[6:]
+
+	stringsLength := 0
+	for _, s := range e.SupportedProtocols {
+		l := len(s)
+		b[0] = byte(l)
+		copy(b[1:], s)
+		b = b[1+l:]
+		stringsLength += 1 + l
+	}
+
+	lengths[2] = byte(stringsLength >> 8)
+	lengths[3] = byte(stringsLength)
+	stringsLength += 2
+	lengths[0] = byte(stringsLength >> 8)
+	lengths[1] = byte(stringsLength)
+
+	return e.Len(), io.EOF
+}
+
+// EarlyDataExtension is the early_data extension a browser sends when it
+// resumes a session that allows 0-RTT data, see RFC 8446, Section 4.2.10.
+// uTLS only mimics the extension, it never sends early data.
+//
+// A client may only indicate early data along with a pre_shared_key, so the
+// extension is left out of the ClientHello unless a PreSharedKeyExtension
+// following it offers a session.
+type EarlyDataExtension struct{}
+
+func (e *EarlyDataExtension) writeToUConn(uc *UConn) error {
+	uc.HandshakeState.Hello.EarlyData = true
+	return nil
+}
+
+func (e *EarlyDataExtension) Len() int {
 	return 4
 }
 
-func (e *FakeChannelIDExtension) Read(b []byte) (int, error) {
+func (e *EarlyDataExtension) Read(b []byte) (int, error) {
 	if len(b) < e.Len() {
 		return 0, io.ErrShortBuffer
 	}
-	// https://tools.ietf.org/html/draft-balfanz-tls-channelid-00
-	b[0] = byte(fakeExtensionChannelID >> 8)
-	b[1] = byte(fakeExtensionChannelID & 0xff)
+	b[0] = byte(extensionEarlyData >> 8)
+	b[1] = byte(extensionEarlyData)
 	// The length is 0
 	return e.Len(), io.EOF
 }
 
-type FakeRecordSizeLimitExtension struct {
-	Limit uint16
-}
+// PreSharedKeyExtension offers the TLS 1.3 session cached in
+// Config.ClientSessionCache, or set with UConn.SetSessionTicket, for
+// resumption, and the external PSKs added with UConn.AddExternalPSK, see RFC 8446, Section 4.2.11. It must be the last
+// extension of the ClientHello, and it is left out if there is no PSK to
+// offer.
+//
+// Its binders are computed once the whole ClientHello is marshaled, each
+// time the handshake state is built, so they cover every extension before
+// it, including the early_data one. They are computed again for the
+// ClientHello answering a HelloRetryRequest.
+type PreSharedKeyExtension struct {
+	identities []pskIdentity
+	binders    [][]byte
+}
+
+func (e *PreSharedKeyExtension) writeToUConn(uc *UConn) error {
+	hello := uc.HandshakeState.Hello
+	e.identities, e.binders = nil, nil
+	hello.PskIdentities, hello.PskBinders = nil, nil
+	// ECH connections do not resume sessions.
+	if uc.ech != nil || len(hello.SupportedVersions) == 0 {
+		return nil
+	}
 
-func (e *FakeRecordSizeLimitExtension) writeToUConn(uc *UConn) error {
+	if session := uc.ticketSession; session != nil && session.vers == VersionTLS13 {
+		// The session set with UConn.SetSessionTicket replaces the cached one.
+		identity, earlySecret, binderKey := uc.ticketSessionSecrets()
+		e.identities = []pskIdentity{identity}
+		e.binders = [][]byte{make([]byte, len(binderKey))}
+		uc.HandshakeState.Session = session
+		uc.HandshakeState.State13.EarlySecret = earlySecret
+		uc.HandshakeState.State13.BinderKey = binderKey
+		e.appendExternalPSKs(uc)
+		return nil
+	}
+
+	// loadSession works on a copy, as it computes binders over a ClientHello
+	// marshaled by crypto/tls. The actual ones are set by UConn.marshalHello.
+	private := hello.getPrivatePtr()
+	private.raw = nil
+	_, session, earlySecret, binderKey := uc.loadSession(private)
+	if session != nil && session.vers == VersionTLS13 && len(private.pskIdentities) > 0 {
+		e.identities = private.pskIdentities
+		e.identities[0].obfuscatedTicketAge = uc.obfuscatedTicketAge(session)
+		e.binders = [][]byte{make([]byte, len(private.pskBinders[0]))}
+		uc.HandshakeState.Session = session
+		uc.HandshakeState.State13.EarlySecret = earlySecret
+		uc.HandshakeState.State13.BinderKey = binderKey
+	}
+	e.appendExternalPSKs(uc)
 	return nil
 }
 
-func (e *FakeRecordSizeLimitExtension) Len() int {
-	return 6
+// appendExternalPSKs offers the external PSKs after the session, if any, see
+// UConn.AddExternalPSK.
+func (e *PreSharedKeyExtension) appendExternalPSKs(uc *UConn) {
+	for _, psk := range uc.externalPSKs {
+		e.identities = append(e.identities, pskIdentity{label: psk.identity})
+		e.binders = append(e.binders, make([]byte, psk.hash.Size()))
+	}
+	uc.HandshakeState.Hello.PskIdentities = e.identities
+	uc.HandshakeState.Hello.PskBinders = e.binders
+}
+
+func (e *PreSharedKeyExtension) Len() int {
+	if len(e.identities) == 0 {
+		return 0
+	}
+	l := 4 + 2 + 2
+	for _, identity := range e.identities {
+		l += 2 + len(identity.label) + 4
+	}
+	for _, binder := range e.binders {
+		l += 1 + len(binder)
+	}
+	return l
 }
 
-func (e *FakeRecordSizeLimitExtension) Read(b []byte) (int, error) {
+func (e *PreSharedKeyExtension) Read(b []byte) (int, error) {
+	if len(e.identities) == 0 {
+		return 0, io.EOF
+	}
 	if len(b) < e.Len() {
 		return 0, io.ErrShortBuffer
 	}
-	// https://tools.ietf.org/html/draft-balfanz-tls-channelid-00
-	b[0] = byte(fakeRecordSizeLimit >> 8)
-	b[1] = byte(fakeRecordSizeLimit & 0xff)
 
-	b[2] = byte(0)
-	b[3] = byte(2)
+	bb := cryptobyte.NewFixedBuilder(b[:0])
+	bb.AddUint16(extensionPreSharedKey)
+	bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+		bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+			for _, identity := range e.identities {
+				bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+					bb.AddBytes(identity.label)
+				})
+				bb.AddUint32(identity.obfuscatedTicketAge)
+			}
+		})
+		bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+			for _, binder := range e.binders {
+				bb.AddUint8LengthPrefixed(func(bb *cryptobyte.Builder) {
+					bb.AddBytes(binder)
+				})
+			}
+		})
+	})
+	if _, err := bb.Bytes(); err != nil {
+		return 0, err
+	}
+	return e.Len(), io.EOF
+}
 
-	b[4] = byte(e.Limit >> 8)
-	b[5] = byte(e.Limit & 0xff)
+/*
+FAKE EXTENSIONS
+*/
+
+type FakeChannelIDExtension struct {
+}
+
+func (e *FakeChannelIDExtension) writeToUConn(uc *UConn) error {
+	return nil
+}
+
+func (e *FakeChannelIDExtension) Len() int {
+	return 4
+}
+
+func (e *FakeChannelIDExtension) Read(b []byte) (int, error) {
+	if len(b) < e.Len() {
+		return 0, io.ErrShortBuffer
+	}
+	// https://tools.ietf.org/html/draft-balfanz-tls-channelid-00
+	b[0] = byte(fakeExtensionChannelID >> 8)
+	b[1] = byte(fakeExtensionChannelID & 0xff)
+	// The length is 0
 	return e.Len(), io.EOF
 }
+
+// FakeRecordSizeLimitExtension is the former name of RecordSizeLimitExtension.
+//
+// Deprecated: use RecordSizeLimitExtension.
+type FakeRecordSizeLimitExtension = RecordSizeLimitExtension
@@ -0,0 +1,403 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// UTransport is an http.RoundTripper making HTTPS requests over UConns, with
+// the ClientHelloID HelloIDForAddr chooses for each server. The protocol is
+// negotiated with ALPN: servers selecting h2 are spoken to over HTTP/2, the
+// others over HTTP/1.1. Connections are pooled per server, ClientHelloID and
+// proxy, so a connection is only reused by requests which would have made
+// the same ClientHello.
+//
+// Requests with the http scheme are made over plain TCP, through the same
+// proxy. A UTransport is safe for concurrent use. Its exported fields must
+// not be modified after the first request.
+type UTransport struct {
+	// HelloIDForAddr returns the ClientHelloID to connect to addr, a
+	// "host:port" address, with. If nil, HelloChrome_Auto is used.
+	HelloIDForAddr func(addr string) ClientHelloID
+
+	// Config is the configuration of each connection. If its ServerName is
+	// empty, it is the host of the request. If its NextProtos is empty, h2
+	// and http/1.1 are offered by ClientHelloIDs that do not set ALPN, such
+	// as HelloGolang. Config may be nil.
+	Config *Config
+
+	// Dialer is used to establish the underlying connections, to the
+	// server or to the proxy. If nil, the zero net.Dialer is used.
+	Dialer *net.Dialer
+
+	// Proxy returns the proxy to use for a request, as
+	// http.Transport.Proxy does, for instance http.ProxyFromEnvironment.
+	// HTTP proxies are sent a CONNECT request, and socks5 ones are
+	// supported too. If nil or if it returns a nil URL, no proxy is used.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	mu     sync.Mutex
+	pools  map[uTransportKey]*uTransportPool
+	plain  *http.Transport
+	closed bool
+}
+
+// uTransportKey identifies the connections a request may reuse.
+type uTransportKey struct {
+	addr    string
+	helloID ClientHelloID
+	proxy   string
+}
+
+// uTransportPool holds the connections of a uTransportKey. A server that
+// selected HTTP/1.1 is assumed to keep doing so, and its connections are
+// pooled by an http.Transport.
+type uTransportPool struct {
+	h2      []*http2.ClientConn
+	h1      *http.Transport
+	pending []net.Conn // dialed HTTP/1.1 connections, taken by h1
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *UTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("tls: UTransport: nil Request.URL")
+	}
+	var proxyURL *url.URL
+	if t.Proxy != nil {
+		var err error
+		if proxyURL, err = t.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+	switch req.URL.Scheme {
+	case "https":
+	case "http":
+		return t.plainTransport().RoundTrip(req)
+	default:
+		return nil, fmt.Errorf("tls: UTransport: unsupported protocol scheme %q", req.URL.Scheme)
+	}
+
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+	helloID := HelloChrome_Auto
+	if t.HelloIDForAddr != nil {
+		helloID = t.HelloIDForAddr(addr)
+	}
+	key := uTransportKey{addr: addr, helloID: helloID}
+	if proxyURL != nil {
+		key.proxy = proxyURL.String()
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, errors.New("tls: UTransport is closed")
+	}
+	if t.pools == nil {
+		t.pools = make(map[uTransportKey]*uTransportPool)
+	}
+	pool := t.pools[key]
+	if pool == nil {
+		pool = new(uTransportPool)
+		t.pools[key] = pool
+	}
+	if pool.h1 != nil {
+		t.mu.Unlock()
+		return pool.h1.RoundTrip(req)
+	}
+	if cc := pool.idleH2(); cc != nil {
+		t.mu.Unlock()
+		return cc.RoundTrip(req)
+	}
+	t.mu.Unlock()
+
+	conn, err := t.dialTLS(req.Context(), key, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		cc, err := (&http2.Transport{}).NewClientConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		t.mu.Lock()
+		pool.h2 = append(pool.h2, cc)
+		t.mu.Unlock()
+		return cc.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	pool.pending = append(pool.pending, conn)
+	if pool.h1 == nil {
+		pool.h1 = &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				t.mu.Lock()
+				if n := len(pool.pending); n > 0 {
+					conn := pool.pending[n-1]
+					pool.pending = pool.pending[:n-1]
+					t.mu.Unlock()
+					return conn, nil
+				}
+				t.mu.Unlock()
+				conn, err := t.dialTLS(ctx, key, proxyURL)
+				if err != nil {
+					return nil, err
+				}
+				if p := conn.ConnectionState().NegotiatedProtocol; p == http2.NextProtoTLS {
+					conn.Close()
+					return nil, errors.New("tls: UTransport: server switched from HTTP/1.1 to HTTP/2")
+				}
+				return conn, nil
+			},
+		}
+	}
+	h1 := pool.h1
+	t.mu.Unlock()
+	return h1.RoundTrip(req)
+}
+
+// idleH2 returns an HTTP/2 connection of the pool which can take a new
+// request, dropping the ones which cannot anymore.
+func (pool *uTransportPool) idleH2() *http2.ClientConn {
+	usable := pool.h2[:0]
+	var idle *http2.ClientConn
+	for _, cc := range pool.h2 {
+		if !cc.CanTakeNewRequest() {
+			if cc.State().Closed {
+				continue
+			}
+		} else if idle == nil {
+			idle = cc
+		}
+		usable = append(usable, cc)
+	}
+	pool.h2 = usable
+	return idle
+}
+
+// CloseIdleConnections closes the connections which are not carrying a
+// request.
+func (t *UTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	conns, transports := t.takeIdleLocked()
+	t.mu.Unlock()
+	closeIdle(conns, transports)
+}
+
+// Close closes the idle connections, and makes any later request fail.
+func (t *UTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	conns, transports := t.takeIdleLocked()
+	t.mu.Unlock()
+	closeIdle(conns, transports)
+	return nil
+}
+
+// takeIdleLocked removes the idle connections from the pools, and returns
+// them with the http.Transports whose idle connections must be closed. The
+// HTTP/2 connections carrying a request stay in their pool.
+func (t *UTransport) takeIdleLocked() (conns []io.Closer, transports []*http.Transport) {
+	for key, pool := range t.pools {
+		busy := pool.h2[:0]
+		for _, cc := range pool.h2 {
+			if cc.State().StreamsActive == 0 {
+				conns = append(conns, cc)
+			} else {
+				busy = append(busy, cc)
+			}
+		}
+		pool.h2 = busy
+		for _, conn := range pool.pending {
+			conns = append(conns, conn)
+		}
+		pool.pending = nil
+		if pool.h1 != nil {
+			transports = append(transports, pool.h1)
+		}
+		if len(pool.h2) == 0 {
+			delete(t.pools, key)
+		}
+	}
+	if t.plain != nil {
+		transports = append(transports, t.plain)
+	}
+	return conns, transports
+}
+
+// closeIdle closes what takeIdleLocked returned, without holding t.mu.
+func closeIdle(conns []io.Closer, transports []*http.Transport) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for _, transport := range transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (t *UTransport) plainTransport() *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.plain == nil {
+		t.plain = &http.Transport{
+			Proxy: t.Proxy,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return t.dialer().DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return t.plain
+}
+
+func (t *UTransport) dialer() *net.Dialer {
+	if t.Dialer == nil {
+		return new(net.Dialer)
+	}
+	return t.Dialer
+}
+
+// dialTLS connects to key.addr, through proxyURL if not nil, and performs a
+// TLS handshake with key.helloID. The dial and the handshake are aborted if
+// ctx is done first.
+func (t *UTransport) dialTLS(ctx context.Context, key uTransportKey, proxyURL *url.URL) (*UConn, error) {
+	rawConn, err := t.dialProxy(ctx, key.addr, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	config := t.Config
+	if config == nil {
+		config = defaultConfig()
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(key.addr)
+		if err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	client := UClient(rawConn, config, key.helloID)
+	if err := runWithContext(ctx, rawConn, client.Handshake); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// runWithContext runs f, which reads from or writes to conn, until it returns
+// or ctx is done. In the latter case, the I/O of f is interrupted and the
+// error of ctx is returned.
+func runWithContext(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	err := f()
+	close(done)
+	// Wait for the goroutine to exit, so that it cannot set the deadline of
+	// conn once it is returned to the caller, nor after the deferred reset.
+	if <-interrupted {
+		return ctx.Err()
+	}
+	return err
+}
+
+// dialProxy connects to addr, through proxyURL if not nil.
+func (t *UTransport) dialProxy(ctx context.Context, addr string, proxyURL *url.URL) (net.Conn, error) {
+	dialer := t.dialer()
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http", "":
+	default:
+		return nil, fmt.Errorf("tls: UTransport: unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	err = runWithContext(ctx, conn, func() error {
+		if err := connect.Write(conn); err != nil {
+			return err
+		}
+		// The body of a successful response is the tunnel itself, so it is
+		// neither read nor closed.
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, connect)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("tls: UTransport: proxy refused CONNECT: %s", resp.Status)
+		}
+		if br.Buffered() > 0 {
+			return errors.New("tls: UTransport: unexpected data from the proxy after its CONNECT response")
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2023 Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUTransport(t *testing.T) {
+	for _, h2 := range []bool{true, false} {
+		var conns int32
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}))
+		server.EnableHTTP2 = h2
+		server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		}
+		server.StartTLS()
+
+		var mu sync.Mutex
+		var addrs []string
+		transport := &UTransport{
+			HelloIDForAddr: func(addr string) ClientHelloID {
+				mu.Lock()
+				defer mu.Unlock()
+				addrs = append(addrs, addr)
+				return HelloChrome_Auto
+			},
+			Config: &Config{InsecureSkipVerify: true},
+		}
+		client := &http.Client{Transport: transport}
+		want := "HTTP/1.1"
+		if h2 {
+			want = "HTTP/2.0"
+		}
+		for i := 0; i < 3; i++ {
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != want {
+				t.Errorf("request %d was made over %s, want %s", i, body, want)
+			}
+		}
+		if n := atomic.LoadInt32(&conns); n != 1 {
+			t.Errorf("h2 %v: %d connections for sequential requests, want 1", h2, n)
+		}
+		if u, _ := url.Parse(server.URL); len(addrs) == 0 || addrs[0] != u.Host {
+			t.Errorf("HelloIDForAddr called with %q, want %q", addrs, u.Host)
+		}
+		transport.Close()
+		server.Close()
+	}
+}
+
+func TestUTransportCloseIdleConnections(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "hello")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	transport := &UTransport{Config: &Config{InsecureSkipVerify: true}}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(server.URL + "/slow")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	<-started
+
+	// The connection carrying the request is neither waited for nor closed.
+	done := make(chan struct{})
+	go func() {
+		transport.CloseIdleConnections()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CloseIdleConnections blocked on a busy connection")
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Errorf("request interrupted by CloseIdleConnections: %v", err)
+	}
+
+	transport.CloseIdleConnections()
+	transport.mu.Lock()
+	pools := len(transport.pools)
+	transport.mu.Unlock()
+	if pools != 0 {
+		t.Errorf("%d pools left after closing the idle connections", pools)
+	}
+}
+
+func TestUTransportProxy(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	var connects int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&connects, 1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	transport := &UTransport{
+		Config: &Config{InsecureSkipVerify: true},
+		Proxy:  http.ProxyURL(proxyURL),
+	}
+	defer transport.Close()
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" || resp.ProtoMajor != 2 {
+		t.Errorf("got %q over %s", body, resp.Proto)
+	}
+	if atomic.LoadInt32(&connects) != 1 {
+		t.Error("the request did not go through the proxy")
+	}
+}
+
+func TestUTransportHandshakeCancel(t *testing.T) {
+	// The server accepts connections but never answers the ClientHello.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	transport := &UTransport{Config: &Config{InsecureSkipVerify: true}}
+	defer transport.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+ln.Addr().String(), nil)
+	start := time.Now()
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RoundTrip error = %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("RoundTrip returned after %v", d)
+	}
+}
+
+// deadlineConn records the deadlines set on it.
+type deadlineConn struct {
+	net.Conn
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *deadlineConn) calls() []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Time(nil), c.deadlines...)
+}
+
+func TestRunWithContextWaitsForInterrupt(t *testing.T) {
+	// f succeeds while ctx is being canceled. Whichever wins, the deadline
+	// must not be touched once runWithContext returns, and must not be left
+	// in the past if f's result is returned.
+	for i := 0; i < 1000; i++ {
+		conn := &deadlineConn{}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		err := runWithContext(ctx, conn, func() error {
+			cancel()
+			return nil
+		})
+		calls := conn.calls()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatalf("runWithContext error = %v", err)
+		}
+		if last := calls[len(calls)-1]; !last.IsZero() {
+			t.Fatalf("deadline left at %v, want it reset", last)
+		}
+		if err == nil && len(calls) != 2 {
+			t.Fatalf("f succeeded but the deadline was set to %v", calls)
+		}
+		runtime.Gosched()
+		if n := len(conn.calls()); n != len(calls) {
+			t.Fatalf("deadline set %d times after runWithContext returned", n-len(calls))
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"io"
 
 	"github.com/dsnet/compress/brotli"
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/crypto/cryptobyte"
 )
 
@@ -32,6 +33,14 @@ const (
 	extensionCompressCertificate uint16 = 27
 )
 
+// maxDecompressedCertificateLength bounds the uncompressed_length a peer may
+// claim, so that a small compressed message can't make us allocate or inflate
+// more than an uncompressed Certificate message could carry.
+const maxDecompressedCertificateLength = maxHandshake
+
+// CompressCertificateExtension is the compress_certificate extension (RFC
+// 8879). A server Certificate compressed with any of Algorithms is
+// decompressed before verification; zlib, brotli and zstd are supported.
 type CompressCertificateExtension struct {
 	Algorithms []CertCompressionAlgo
 }
@@ -69,6 +78,9 @@ func (e *CompressCertificateExtension) Read(b []byte) (int, error) {
 	return e.Len(), io.EOF
 }
 
+// UtlsCompressCertExtension is an alias of CompressCertificateExtension.
+type UtlsCompressCertExtension = CompressCertificateExtension
+
 type compressedCertificateMsg struct {
 	raw []byte
 
@@ -82,7 +94,18 @@ func (m *compressedCertificateMsg) marshal() []byte {
 		return m.raw
 	}
 
-	panic("utls: compressedCertificateMsg.marshal() not actually implemented")
+	var b cryptobyte.Builder
+	b.AddUint8(typeCompressedCertificate)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(uint16(m.algorithm))
+		b.AddUint24(m.uncompressedLength)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.compressedCertificateMessage)
+		})
+	})
+
+	m.raw = b.BytesOrPanic()
+	return m.raw
 }
 
 func (m *compressedCertificateMsg) unmarshal(data []byte) bool {
@@ -97,7 +120,7 @@ func (m *compressedCertificateMsg) unmarshal(data []byte) bool {
 	if !s.ReadUint24(&m.uncompressedLength) {
 		return false
 	}
-	if !readUint24LengthPrefixed(&s, &m.compressedCertificateMessage) {
+	if !readUint24LengthPrefixed(&s, &m.compressedCertificateMessage) || !s.Empty() {
 		return false
 	}
 	m.algorithm = CertCompressionAlgo(algID)
@@ -112,8 +135,8 @@ func (m *compressedCertificateMsg) toCertificateMsg() (*certificateMsgTLS13, err
 		err          error
 	)
 
-	if m.uncompressedLength > 1<<24 {
-		return nil, fmt.Errorf("utls: oversized decompressed certificate length")
+	if m.uncompressedLength > maxDecompressedCertificateLength {
+		return nil, fmt.Errorf("utls: oversized decompressed certificate length: %v", m.uncompressedLength)
 	}
 
 	compressed := bytes.NewBuffer(m.compressedCertificateMessage)
@@ -122,6 +145,13 @@ func (m *compressedCertificateMsg) toCertificateMsg() (*certificateMsgTLS13, err
 		rd, err = zlib.NewReader(compressed)
 	case CertCompressionBrotli:
 		rd, err = brotli.NewReader(compressed, nil)
+	case CertCompressionZstd:
+		var zrd *zstd.Decoder
+		zrd, err = zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxDecompressedCertificateLength))
+		if err == nil {
+			rd = zrd.IOReadCloser()
+		}
 	default:
 		return nil, fmt.Errorf("utls: unknown certificate compression algorithm: %v", m.algorithm)
 	}
@@ -134,6 +164,10 @@ func (m *compressedCertificateMsg) toCertificateMsg() (*certificateMsgTLS13, err
 	if _, err = io.ReadFull(rd, decompressed); err != nil {
 		return nil, err
 	}
+	// The stream must end exactly at uncompressed_length.
+	if n, _ := rd.Read(make([]byte, 1)); n != 0 {
+		return nil, fmt.Errorf("utls: decompressed certificate exceeds the advertised length")
+	}
 
 	// Enforce the length just to be sure.
 	length := len(decompressed)